@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"kaelo/models"
+)
+
+// columnKind is the type of an exported column
+type columnKind int
+
+const (
+	kindString columnKind = iota
+	kindInt64
+	kindFloat
+	kindBool
+	kindTimestamp
+)
+
+// column is one field of an exported row. All formats are written from this table,
+// so CSV, JSONL and Parquet files always have the same columns in the same order.
+type column struct {
+	name  string
+	kind  columnKind
+	value func(data *models.SensorData) interface{}
+}
+
+// columns lists the exported fields with acceleration and gyroscope flattened per axis.
+// Float columns are the sensor values and may be nil.
+var columns = []column{
+	{"device_id", kindString, func(d *models.SensorData) interface{} { return d.DeviceID }},
+	{"timestamp", kindTimestamp, func(d *models.SensorData) interface{} { return d.Timestamp }},
+	{"message_id", kindString, func(d *models.SensorData) interface{} { return d.MessageID }},
+	{"seq", kindInt64, func(d *models.SensorData) interface{} { return int64(d.Seq) }},
+	{"temperature_dht", kindFloat, func(d *models.SensorData) interface{} { return sensorValue(d, "temperature_dht", d.TemperatureDHT) }},
+	{"temperature_mpu", kindFloat, func(d *models.SensorData) interface{} { return sensorValue(d, "temperature_mpu", d.TemperatureMPU) }},
+	{"humidity", kindFloat, func(d *models.SensorData) interface{} { return sensorValue(d, "humidity", d.Humidity) }},
+	{"gas_quality", kindString, func(d *models.SensorData) interface{} { return d.GasQuality }},
+	{"flame_detected", kindBool, func(d *models.SensorData) interface{} { return d.FlameDetected }},
+	{"accel_x", kindFloat, func(d *models.SensorData) interface{} { return sensorValue(d, "acceleration", d.Acceleration.X) }},
+	{"accel_y", kindFloat, func(d *models.SensorData) interface{} { return sensorValue(d, "acceleration", d.Acceleration.Y) }},
+	{"accel_z", kindFloat, func(d *models.SensorData) interface{} { return sensorValue(d, "acceleration", d.Acceleration.Z) }},
+	{"gyro_x", kindFloat, func(d *models.SensorData) interface{} { return sensorValue(d, "gyroscope", d.Gyroscope.X) }},
+	{"gyro_y", kindFloat, func(d *models.SensorData) interface{} { return sensorValue(d, "gyroscope", d.Gyroscope.Y) }},
+	{"gyro_z", kindFloat, func(d *models.SensorData) interface{} { return sensorValue(d, "gyroscope", d.Gyroscope.Z) }},
+}
+
+// sensorValue returns a sensor value, nil when the reading doesn't carry it (see
+// models.SensorData.Has). CSV leaves such values empty, JSONL writes null and Parquet a null.
+func sensorValue(d *models.SensorData, field string, value float64) interface{} {
+	if !d.Has(field) {
+		return nil
+	}
+	return value
+}
+
+// recordWriter writes exported readings in one file format
+type recordWriter interface {
+	Write(data *models.SensorData) error
+	// Close flushes buffered rows and writes the file footer, if the format has one
+	Close() error
+}
+
+// csvWriter writes a header row followed by one row per reading
+type csvWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func newCSVWriter(w io.Writer) *csvWriter {
+	return &csvWriter{w: csv.NewWriter(w)}
+}
+
+func (cw *csvWriter) Write(data *models.SensorData) error {
+	if !cw.header {
+		names := make([]string, len(columns))
+		for i, col := range columns {
+			names[i] = col.name
+		}
+		if err := cw.w.Write(names); err != nil {
+			return err
+		}
+		cw.header = true
+	}
+
+	row := make([]string, len(columns))
+	for i, col := range columns {
+		switch v := col.value(data).(type) {
+		case string:
+			row[i] = v
+		case int64:
+			row[i] = strconv.FormatInt(v, 10)
+		case float64:
+			row[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			row[i] = strconv.FormatBool(v)
+		case time.Time:
+			row[i] = v.In(time.Local).Format(time.RFC3339Nano)
+		}
+	}
+	return cw.w.Write(row)
+}
+
+func (cw *csvWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// jsonlWriter writes one flat JSON object per line, keys in column order
+type jsonlWriter struct {
+	w *bufio.Writer
+}
+
+func newJSONLWriter(w io.Writer) *jsonlWriter {
+	return &jsonlWriter{w: bufio.NewWriter(w)}
+}
+
+func (jw *jsonlWriter) Write(data *models.SensorData) error {
+	jw.w.WriteByte('{')
+	for i, col := range columns {
+		if i > 0 {
+			jw.w.WriteByte(',')
+		}
+
+		value := col.value(data)
+		if t, ok := value.(time.Time); ok {
+			value = t.In(time.Local).Format(time.RFC3339Nano)
+		}
+
+		name, _ := json.Marshal(col.name)
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		jw.w.Write(name)
+		jw.w.WriteByte(':')
+		jw.w.Write(encoded)
+	}
+	jw.w.WriteByte('}')
+	return jw.w.WriteByte('\n')
+}
+
+func (jw *jsonlWriter) Close() error {
+	return jw.w.Flush()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"kaelo/config"
+	"kaelo/log"
+	"kaelo/services"
+
+	"go.uber.org/zap"
+)
+
+var (
+	format   = flag.String("format", "", "Output format: csv, jsonl or parquet (default: from the -o extension, else csv)")
+	output   = flag.String("o", "", "Output file (default sensor-data.<format>)")
+	deviceID = flag.String("device", "", "Only export this device")
+	from     = flag.String("from", "", "Start of the time range, RFC3339 or YYYY-MM-DD (default: first reading)")
+	to       = flag.String("to", "", "End of the time range, RFC3339 or YYYY-MM-DD, inclusive (default: last reading)")
+	pageSize = flag.Int("page", 1000, "Readings fetched per request (max 1000)")
+	timezone = flag.String("tz", "", "Timezone of dates in -from/-to and of exported timestamps (default: TZ, else the system timezone)")
+)
+
+func main() {
+	flag.Parse()
+
+	logger := log.GetInstance()
+	defer logger.Sync()
+
+	// Stored timestamps are UTC, the timezone only affects how dates and output are read
+	if *timezone != "" {
+		loc, err := time.LoadLocation(*timezone)
+		if err != nil {
+			logger.Fatal("Invalid -tz", zap.Error(err))
+		}
+		time.Local = loc
+	}
+
+	exportFormat, outputPath, err := resolveOutput(*format, *output)
+	if err != nil {
+		logger.Fatal("Invalid output", zap.Error(err))
+	}
+
+	query := services.TimeRangeQuery{DeviceID: *deviceID, Limit: *pageSize, Order: services.SortAscending}
+	if query.From, err = services.ParseRangeTime(*from, false); err != nil {
+		logger.Fatal("Invalid -from", zap.Error(err))
+	}
+	if query.To, err = services.ParseRangeTime(*to, true); err != nil {
+		logger.Fatal("Invalid -to", zap.Error(err))
+	}
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		logger.Fatal("Failed to load config", zap.Error(err))
+	}
+	// Read the primary store only; the bolt mirror is locked by a running service
+	cfg.BoltMirror = false
+
+	store, err := services.NewSensorStore(cfg, logger)
+	if err != nil {
+		logger.Fatal("Failed to initialize sensor store",
+			zap.String("backend", cfg.StorageBackend),
+			zap.Error(err))
+	}
+	defer store.Close()
+
+	file, err := os.Create(outputPath)
+	if err != nil {
+		logger.Fatal("Failed to create output file", zap.Error(err))
+	}
+	defer file.Close()
+
+	var writer recordWriter
+	switch exportFormat {
+	case "csv":
+		writer = newCSVWriter(file)
+	case "jsonl":
+		writer = newJSONLWriter(file)
+	case "parquet":
+		writer = newParquetWriter(file)
+	}
+
+	// Ctrl+C stops after the current page; the file is still closed properly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logger.Info("Exporting readings",
+		zap.String("backend", cfg.StorageBackend),
+		zap.String("format", exportFormat),
+		zap.String("output", outputPath),
+		zap.String("device_id", query.DeviceID),
+		zap.Time("from", query.From),
+		zap.Time("to", query.To))
+
+	exported, err := export(ctx, store, query, writer, logger)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		logger.Fatal("Export failed", zap.Int("exported", exported), zap.Error(err))
+	}
+
+	logger.Info("Export complete", zap.Int("exported", exported), zap.String("output", outputPath))
+}
+
+// export streams readings page by page into the writer and returns how many were written
+func export(ctx context.Context, store services.SensorStore, query services.TimeRangeQuery, writer recordWriter, logger *zap.Logger) (int, error) {
+	exported := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return exported, fmt.Errorf("interrupted: %w", err)
+		}
+
+		pageCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
+		page, err := store.QueryReadings(pageCtx, query)
+		cancel()
+		if err != nil {
+			return exported, err
+		}
+
+		for _, data := range page.Items {
+			if err := writer.Write(data); err != nil {
+				return exported, fmt.Errorf("failed to write reading: %w", err)
+			}
+			exported++
+		}
+
+		logger.Debug("Exported page", zap.Int("readings", len(page.Items)), zap.Int("exported", exported))
+
+		if page.NextCursor == "" {
+			return exported, nil
+		}
+		query.Cursor = page.NextCursor
+	}
+}
+
+// resolveOutput picks the format from the flag or the output extension, and a default file name
+func resolveOutput(format, output string) (string, string, error) {
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(output), ".")
+		if format == "" {
+			format = "csv"
+		}
+	}
+
+	switch format {
+	case "csv", "jsonl", "parquet":
+	default:
+		return "", "", fmt.Errorf("unsupported format %q (expected csv, jsonl or parquet)", format)
+	}
+
+	if output == "" {
+		output = "sensor-data." + format
+	}
+	return format, output, nil
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+
+	"kaelo/models"
+)
+
+// A minimal Parquet writer: columns are PLAIN encoded without compression, with one data page
+// per column per row group. Sensor values (float columns) are OPTIONAL, with bit-packed
+// definition levels marking the nulls; the other columns are REQUIRED. That is enough for pandas, polars, DuckDB and
+// Spark to read the file without pulling a Parquet library (and its thrift/arrow dependencies)
+// into the module. Format reference: https://parquet.apache.org/docs/file-format/
+
+// parquetRowGroupSize is the number of rows buffered in memory before a row group is written
+const parquetRowGroupSize = 10000
+
+var parquetMagic = []byte("PAR1")
+
+// Parquet physical types, converted types and other enums used by the writer
+const (
+	parquetBoolean   = 0
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetConvertedUTF8            = 0
+	parquetConvertedTimestampMillis = 9
+
+	parquetRequired      = 0
+	parquetOptional      = 1
+	parquetEncodingPlain = 0
+	parquetEncodingRLE   = 3
+	parquetUncompressed  = 0
+	parquetDataPage      = 0
+)
+
+// parquetType returns the physical type and converted type (-1 for none) of a column kind
+func parquetType(kind columnKind) (physical, converted int32) {
+	switch kind {
+	case kindString:
+		return parquetByteArray, parquetConvertedUTF8
+	case kindInt64:
+		return parquetInt64, -1
+	case kindFloat:
+		return parquetDouble, -1
+	case kindBool:
+		return parquetBoolean, -1
+	default:
+		return parquetInt64, parquetConvertedTimestampMillis
+	}
+}
+
+// parquetOptionalColumn reports whether a column of this kind can be null
+func parquetOptionalColumn(kind columnKind) bool {
+	return kind == kindFloat
+}
+
+// parquetColumnChunk records where a column chunk of a row group was written
+type parquetColumnChunk struct {
+	offset int64
+	size   int64
+}
+
+// parquetRowGroup records a written row group for the footer
+type parquetRowGroup struct {
+	rows    int64
+	columns []parquetColumnChunk
+}
+
+// parquetWriter buffers rows column by column and writes a row group every parquetRowGroupSize rows
+type parquetWriter struct {
+	w         *bufio.Writer
+	offset    int64
+	values    []bytes.Buffer // PLAIN encoded values of the current row group per column
+	bits      []byte         // pending bit-packed booleans per column
+	levels    []bytes.Buffer // bit-packed definition levels of optional columns
+	levelBits []byte         // pending definition levels per column
+	rows      int
+	totalRows int64
+	groups    []parquetRowGroup
+}
+
+func newParquetWriter(w io.Writer) *parquetWriter {
+	return &parquetWriter{
+		w:         bufio.NewWriter(w),
+		values:    make([]bytes.Buffer, len(columns)),
+		bits:      make([]byte, len(columns)),
+		levels:    make([]bytes.Buffer, len(columns)),
+		levelBits: make([]byte, len(columns)),
+	}
+}
+
+// write writes bytes to the file, tracking the offset
+func (pw *parquetWriter) write(b []byte) error {
+	n, err := pw.w.Write(b)
+	pw.offset += int64(n)
+	return err
+}
+
+func (pw *parquetWriter) Write(data *models.SensorData) error {
+	if pw.offset == 0 {
+		if err := pw.write(parquetMagic); err != nil {
+			return err
+		}
+	}
+
+	var scratch [8]byte
+	for i, col := range columns {
+		buf := &pw.values[i]
+		value := col.value(data)
+		if parquetOptionalColumn(col.kind) {
+			// Definition level 1 for a value, 0 for a null that has no value in the page
+			pw.packBit(&pw.levels[i], &pw.levelBits[i], value != nil)
+		}
+		switch v := value.(type) {
+		case string:
+			binary.LittleEndian.PutUint32(scratch[:4], uint32(len(v)))
+			buf.Write(scratch[:4])
+			buf.WriteString(v)
+		case int64:
+			binary.LittleEndian.PutUint64(scratch[:], uint64(v))
+			buf.Write(scratch[:])
+		case float64:
+			binary.LittleEndian.PutUint64(scratch[:], math.Float64bits(v))
+			buf.Write(scratch[:])
+		case time.Time:
+			binary.LittleEndian.PutUint64(scratch[:], uint64(v.UnixMilli()))
+			buf.Write(scratch[:])
+		case bool:
+			pw.packBit(buf, &pw.bits[i], v)
+		}
+	}
+
+	pw.rows++
+	if pw.rows == parquetRowGroupSize {
+		return pw.flushRowGroup()
+	}
+	return nil
+}
+
+// packBit adds the current row's bit to a bit-packed buffer, least significant bit first
+func (pw *parquetWriter) packBit(buf *bytes.Buffer, pending *byte, set bool) {
+	if set {
+		*pending |= 1 << (pw.rows % 8)
+	}
+	if pw.rows%8 == 7 {
+		buf.WriteByte(*pending)
+		*pending = 0
+	}
+}
+
+// definitionLevels returns the definition levels of an optional column's page: a bit-packed
+// run of the RLE/bit-packed hybrid encoding, prefixed with its length
+func (pw *parquetWriter) definitionLevels(i int) []byte {
+	if pw.rows%8 != 0 {
+		pw.levels[i].WriteByte(pw.levelBits[i])
+		pw.levelBits[i] = 0
+	}
+
+	var run bytes.Buffer
+	var header [binary.MaxVarintLen64]byte
+	groups := (pw.rows + 7) / 8
+	run.Write(header[:binary.PutUvarint(header[:], uint64(groups)<<1|1)])
+	run.Write(pw.levels[i].Bytes())
+	pw.levels[i].Reset()
+
+	levels := binary.LittleEndian.AppendUint32(nil, uint32(run.Len()))
+	return append(levels, run.Bytes()...)
+}
+
+// flushRowGroup writes the buffered rows as a row group with one data page per column
+func (pw *parquetWriter) flushRowGroup() error {
+	if pw.rows == 0 {
+		return nil
+	}
+
+	group := parquetRowGroup{rows: int64(pw.rows), columns: make([]parquetColumnChunk, len(columns))}
+	for i, col := range columns {
+		if col.kind == kindBool && pw.rows%8 != 0 {
+			pw.values[i].WriteByte(pw.bits[i])
+			pw.bits[i] = 0
+		}
+		page := pw.values[i].Bytes()
+		if parquetOptionalColumn(col.kind) {
+			page = append(pw.definitionLevels(i), page...)
+		}
+
+		var header thriftWriter
+		header.i32(1, parquetDataPage)
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(len(page)))
+		header.beginStruct(5)
+		header.i32(1, int32(pw.rows))
+		header.i32(2, parquetEncodingPlain)
+		header.i32(3, parquetEncodingRLE)
+		header.i32(4, parquetEncodingRLE)
+		header.endStruct()
+		header.stop()
+
+		group.columns[i] = parquetColumnChunk{offset: pw.offset, size: int64(header.buf.Len() + len(page))}
+		if err := pw.write(header.buf.Bytes()); err != nil {
+			return err
+		}
+		if err := pw.write(page); err != nil {
+			return err
+		}
+		pw.values[i].Reset()
+	}
+
+	pw.groups = append(pw.groups, group)
+	pw.totalRows += int64(pw.rows)
+	pw.rows = 0
+	return nil
+}
+
+// Close writes the remaining rows and the file footer
+func (pw *parquetWriter) Close() error {
+	if pw.offset == 0 {
+		if err := pw.write(parquetMagic); err != nil {
+			return err
+		}
+	}
+	if err := pw.flushRowGroup(); err != nil {
+		return err
+	}
+
+	var meta thriftWriter
+	meta.i32(1, 1) // version
+
+	meta.listBegin(2, thriftStruct, len(columns)+1)
+	meta.listStruct()
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(columns)))
+	meta.listStructEnd()
+	for _, col := range columns {
+		physical, converted := parquetType(col.kind)
+		meta.listStruct()
+		meta.i32(1, physical)
+		if parquetOptionalColumn(col.kind) {
+			meta.i32(3, parquetOptional)
+		} else {
+			meta.i32(3, parquetRequired)
+		}
+		meta.binary(4, col.name)
+		if converted >= 0 {
+			meta.i32(6, converted)
+		}
+		meta.listStructEnd()
+	}
+
+	meta.i64(3, pw.totalRows)
+
+	meta.listBegin(4, thriftStruct, len(pw.groups))
+	for _, group := range pw.groups {
+		meta.listStruct()
+		var groupSize int64
+		meta.listBegin(1, thriftStruct, len(group.columns))
+		for i, chunk := range group.columns {
+			physical, _ := parquetType(columns[i].kind)
+			groupSize += chunk.size
+
+			meta.listStruct()
+			meta.i64(2, chunk.offset)
+			meta.beginStruct(3)
+			meta.i32(1, physical)
+			meta.listBegin(2, thriftI32, 2)
+			meta.listI32(parquetEncodingPlain)
+			meta.listI32(parquetEncodingRLE)
+			meta.listBegin(3, thriftBinary, 1)
+			meta.listBinary(columns[i].name)
+			meta.i32(4, parquetUncompressed)
+			meta.i64(5, group.rows)
+			meta.i64(6, chunk.size)
+			meta.i64(7, chunk.size)
+			meta.i64(9, chunk.offset)
+			meta.endStruct()
+			meta.listStructEnd()
+		}
+		meta.i64(2, groupSize)
+		meta.i64(3, group.rows)
+		meta.listStructEnd()
+	}
+
+	meta.binary(6, "kaelo export")
+	meta.stop()
+
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(meta.buf.Len()))
+	for _, b := range [][]byte{meta.buf.Bytes(), length[:], parquetMagic} {
+		if err := pw.write(b); err != nil {
+			return err
+		}
+	}
+	return pw.w.Flush()
+}
+
+// Thrift compact protocol types used by the Parquet metadata
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes Parquet metadata with the thrift compact protocol
+type thriftWriter struct {
+	buf     bytes.Buffer
+	lastID  int16
+	idStack []int16
+}
+
+func (t *thriftWriter) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (t *thriftWriter) zigzag(v int64) {
+	t.uvarint(uint64((v << 1) ^ (v >> 63)))
+}
+
+// field writes a field header, using the short delta form when possible
+func (t *thriftWriter) field(id int16, fieldType byte) {
+	if delta := id - t.lastID; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | fieldType)
+	} else {
+		t.buf.WriteByte(fieldType)
+		t.zigzag(int64(id))
+	}
+	t.lastID = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.zigzag(v)
+}
+
+func (t *thriftWriter) binary(id int16, v string) {
+	t.field(id, thriftBinary)
+	t.listBinary(v)
+}
+
+// beginStruct starts a struct field; its fields are numbered from scratch
+func (t *thriftWriter) beginStruct(id int16) {
+	t.field(id, thriftStruct)
+	t.listStruct()
+}
+
+func (t *thriftWriter) endStruct() {
+	t.listStructEnd()
+}
+
+// stop ends the top-level struct
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+}
+
+func (t *thriftWriter) listBegin(id int16, elemType byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		t.buf.WriteByte(0xf0 | elemType)
+		t.uvarint(uint64(size))
+	}
+}
+
+// listStruct starts a struct element of a list
+func (t *thriftWriter) listStruct() {
+	t.idStack = append(t.idStack, t.lastID)
+	t.lastID = 0
+}
+
+// listStructEnd ends a struct started with listStruct or beginStruct
+func (t *thriftWriter) listStructEnd() {
+	t.buf.WriteByte(0)
+	t.lastID = t.idStack[len(t.idStack)-1]
+	t.idStack = t.idStack[:len(t.idStack)-1]
+}
+
+func (t *thriftWriter) listI32(v int32) {
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) listBinary(v string) {
+	t.uvarint(uint64(len(v)))
+	t.buf.WriteString(v)
+}
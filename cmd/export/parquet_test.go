@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"kaelo/models"
+)
+
+// thriftReader decodes the thrift compact protocol into generic values: structs become
+// map[int16]interface{}, lists []interface{}, integers int64 and binaries string
+type thriftReader struct {
+	buf *bytes.Reader
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, err := binary.ReadUvarint(r.buf)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func (r *thriftReader) zigzag() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) byte() byte {
+	b, err := r.buf.ReadByte()
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func (r *thriftReader) value(fieldType byte) interface{} {
+	switch fieldType {
+	case 1, 2: // booleans are stored in the field type
+		return fieldType == 1
+	case 3:
+		return int64(int8(r.byte()))
+	case 4, thriftI32, thriftI64:
+		return r.zigzag()
+	case thriftBinary:
+		b := make([]byte, r.uvarint())
+		if _, err := r.buf.Read(b); err != nil && len(b) > 0 {
+			panic(err)
+		}
+		return string(b)
+	case thriftList:
+		header := r.byte()
+		size, elemType := int(header>>4), header&0x0f
+		if size == 15 {
+			size = int(r.uvarint())
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			list[i] = r.value(elemType)
+		}
+		return list
+	case thriftStruct:
+		return r.structure()
+	default:
+		panic(fmt.Sprintf("unsupported thrift type %d", fieldType))
+	}
+}
+
+func (r *thriftReader) structure() map[int16]interface{} {
+	fields := make(map[int16]interface{})
+	var lastID int16
+	for {
+		header := r.byte()
+		if header == 0 {
+			return fields
+		}
+		id := lastID + int16(header>>4)
+		if header>>4 == 0 {
+			id = int16(r.zigzag())
+		}
+		fields[id] = r.value(header & 0x0f)
+		lastID = id
+	}
+}
+
+// readThrift decodes a struct at offset and returns it with the offset after it
+func readThrift(t *testing.T, file []byte, offset int64) (s map[int16]interface{}, end int64) {
+	t.Helper()
+	defer func() {
+		if err := recover(); err != nil {
+			t.Fatalf("invalid thrift struct at offset %d: %v", offset, err)
+		}
+	}()
+
+	r := &thriftReader{buf: bytes.NewReader(file[offset:])}
+	s = r.structure()
+	return s, int64(len(file)) - int64(r.buf.Len())
+}
+
+// readParquet parses a file written by parquetWriter and returns its rows as column values
+func readParquet(t *testing.T, file []byte) (names []string, rows [][]interface{}) {
+	t.Helper()
+
+	if len(file) < 12 || !bytes.Equal(file[:4], parquetMagic) || !bytes.Equal(file[len(file)-4:], parquetMagic) {
+		t.Fatal("missing PAR1 magic")
+	}
+	footerLength := int64(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	footerStart := int64(len(file)) - 8 - footerLength
+	meta, end := readThrift(t, file, footerStart)
+	if end != footerStart+footerLength {
+		t.Fatalf("footer is %d bytes, length says %d", end-footerStart, footerLength)
+	}
+
+	schema := meta[2].([]interface{})
+	root := schema[0].(map[int16]interface{})
+	if root[5].(int64) != int64(len(schema)-1) {
+		t.Fatalf("schema root has %d children, schema has %d columns", root[5], len(schema)-1)
+	}
+	kinds := make([]int64, len(schema)-1)
+	optional := make([]bool, len(schema)-1)
+	for i, element := range schema[1:] {
+		element := element.(map[int16]interface{})
+		names = append(names, element[4].(string))
+		kinds[i] = element[1].(int64)
+		optional[i] = element[3].(int64) == parquetOptional
+	}
+
+	for _, group := range meta[4].([]interface{}) {
+		group := group.(map[int16]interface{})
+		groupRows := int(group[3].(int64))
+		groupValues := make([][]interface{}, groupRows)
+		for i := range groupValues {
+			groupValues[i] = make([]interface{}, len(names))
+		}
+
+		for col, chunk := range group[1].([]interface{}) {
+			chunkMeta := chunk.(map[int16]interface{})[3].(map[int16]interface{})
+			if path := chunkMeta[3].([]interface{}); path[0] != names[col] {
+				t.Fatalf("column chunk %d is for %v, want %s", col, path, names[col])
+			}
+			if chunkMeta[5].(int64) != int64(groupRows) {
+				t.Fatalf("column %s has %d values, row group has %d rows", names[col], chunkMeta[5], groupRows)
+			}
+
+			offset := chunkMeta[9].(int64)
+			header, pageStart := readThrift(t, file, offset)
+			if pageStart-offset+header[3].(int64) != chunkMeta[7].(int64) {
+				t.Fatalf("column %s chunk size %d doesn't match its page", names[col], chunkMeta[7])
+			}
+			pageBytes := file[pageStart : pageStart+header[3].(int64)]
+			defined := make([]bool, groupRows)
+			for row := range defined {
+				defined[row] = true
+			}
+			if optional[col] {
+				var levels []byte
+				levels, pageBytes = readDefinitionLevels(t, pageBytes, groupRows)
+				for row := range defined {
+					defined[row] = levels[row] == 1
+				}
+			}
+			page := bytes.NewReader(pageBytes)
+			if kinds[col] == parquetBoolean {
+				// Bit-packed, least significant bit first
+				if want := (groupRows + 7) / 8; len(pageBytes) != want {
+					t.Fatalf("column %s page has %d bytes, want %d", names[col], len(pageBytes), want)
+				}
+				for row := 0; row < groupRows; row++ {
+					groupValues[row][col] = pageBytes[row/8]&(1<<(row%8)) != 0
+				}
+				continue
+			}
+
+			for row := 0; row < groupRows; row++ {
+				var value interface{}
+				if !defined[row] {
+					groupValues[row][col] = nil
+					continue
+				}
+				switch kinds[col] {
+				case parquetByteArray:
+					var length uint32
+					binary.Read(page, binary.LittleEndian, &length)
+					b := make([]byte, length)
+					page.Read(b)
+					value = string(b)
+				case parquetInt64:
+					var v int64
+					binary.Read(page, binary.LittleEndian, &v)
+					value = v
+				case parquetDouble:
+					var v uint64
+					binary.Read(page, binary.LittleEndian, &v)
+					value = math.Float64frombits(v)
+				}
+				groupValues[row][col] = value
+			}
+			if page.Len() != 0 {
+				t.Fatalf("column %s page has %d bytes left after %d values", names[col], page.Len(), groupRows)
+			}
+		}
+		rows = append(rows, groupValues...)
+	}
+
+	if total := meta[3].(int64); total != int64(len(rows)) {
+		t.Fatalf("footer has %d rows, row groups have %d", total, len(rows))
+	}
+	return names, rows
+}
+
+// readDefinitionLevels decodes the length-prefixed RLE/bit-packed hybrid definition levels
+// (bit width 1) at the start of a page and returns them with the rest of the page
+func readDefinitionLevels(t *testing.T, page []byte, count int) (levels []byte, rest []byte) {
+	t.Helper()
+
+	if len(page) < 4 {
+		t.Fatal("page too short for definition levels")
+	}
+	length := int(binary.LittleEndian.Uint32(page))
+	if 4+length > len(page) {
+		t.Fatalf("definition levels are %d bytes, page has %d", length, len(page)-4)
+	}
+	runs := bytes.NewReader(page[4 : 4+length])
+	for runs.Len() > 0 {
+		header, err := binary.ReadUvarint(runs)
+		if err != nil {
+			t.Fatalf("invalid run header: %v", err)
+		}
+		if header&1 == 0 {
+			// RLE run: the repeated value in one byte
+			value, _ := runs.ReadByte()
+			for i := uint64(0); i < header>>1; i++ {
+				levels = append(levels, value)
+			}
+			continue
+		}
+		for i := uint64(0); i < header>>1; i++ {
+			b, err := runs.ReadByte()
+			if err != nil {
+				t.Fatalf("truncated bit-packed run: %v", err)
+			}
+			for bit := 0; bit < 8; bit++ {
+				levels = append(levels, b>>bit&1)
+			}
+		}
+	}
+	if len(levels) < count {
+		t.Fatalf("got %d definition levels, want %d", len(levels), count)
+	}
+	return levels[:count], page[4+length:]
+}
+
+func testExportReading(i int) *models.SensorData {
+	data := &models.SensorData{
+		DeviceID:       fmt.Sprintf("ESP32-%03d", i%3),
+		MessageID:      fmt.Sprintf("m-%d", i),
+		Seq:            uint64(i),
+		TemperatureDHT: 25 + float64(i)/10,
+		Humidity:       60.5,
+		GasQuality:     "good",
+		FlameDetected:  i%3 == 0,
+		Acceleration:   models.AccelerationData{Z: 9.81},
+		Gyroscope:      models.GyroscopeData{X: -float64(i)},
+		Timestamp:      time.UnixMilli(1714532755000 + int64(i)*1000),
+	}
+	// Some readings carry the MPU temperature, some had values cleared as out of range
+	if i%5 == 1 {
+		data.TemperatureMPU = 24.5
+	}
+	if i%4 == 2 {
+		data.Humidity = 0
+		data.InvalidFields = []string{"humidity", "gyroscope"}
+	}
+	return data
+}
+
+func TestParquetWriterProducesReadableFile(t *testing.T) {
+	for _, count := range []int{0, 1, 10, parquetRowGroupSize + 3} {
+		t.Run(fmt.Sprintf("%d rows", count), func(t *testing.T) {
+			var buf bytes.Buffer
+			writer := newParquetWriter(&buf)
+			for i := 0; i < count; i++ {
+				if err := writer.Write(testExportReading(i)); err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			names, rows := readParquet(t, buf.Bytes())
+			if len(names) != len(columns) {
+				t.Fatalf("got %d columns, want %d", len(names), len(columns))
+			}
+			for i, col := range columns {
+				if names[i] != col.name {
+					t.Errorf("column %d is %s, want %s", i, names[i], col.name)
+				}
+			}
+			if len(rows) != count {
+				t.Fatalf("got %d rows, want %d", len(rows), count)
+			}
+
+			for i, row := range rows {
+				data := testExportReading(i)
+				for c, col := range columns {
+					want := col.value(data)
+					if ts, ok := want.(time.Time); ok {
+						want = ts.UnixMilli()
+					}
+					if row[c] != want {
+						t.Fatalf("row %d column %s = %v, want %v", i, col.name, row[c], want)
+					}
+				}
+			}
+		})
+	}
+}
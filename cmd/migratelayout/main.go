@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"kaelo/config"
+	"kaelo/log"
+	"kaelo/services"
+
+	"go.uber.org/zap"
+)
+
+var (
+	apply     = flag.Bool("apply", false, "Move the readings (without it, only count what would be moved)")
+	chunkSize = flag.Int("chunk", 500, "Readings moved per request")
+)
+
+func main() {
+	flag.Parse()
+
+	logger := log.GetInstance()
+	defer logger.Sync()
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		logger.Fatal("Failed to load config", zap.Error(err))
+	}
+	if cfg.FirebaseDbUrl == "" || cfg.FirebaseServiceAccountJSON == "" {
+		logger.Fatal("FIREBASE_DB_URL and FIREBASE_SERVICE_ACCOUNT_JSON are required")
+	}
+	if *chunkSize <= 0 {
+		logger.Fatal("-chunk must be positive")
+	}
+
+	firebaseService, err := services.NewFirebaseService(cfg)
+	if err != nil {
+		logger.Fatal("Failed to initialize Firebase", zap.Error(err))
+	}
+
+	// Stop after the current chunk on Ctrl+C; running again continues where it stopped
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logger.Info("Migrating readings from the flat layout to the device_date layout",
+		zap.Bool("dry_run", !*apply),
+		zap.Int("chunk_size", *chunkSize))
+
+	result, err := firebaseService.MigrateReadingLayout(ctx, *chunkSize, !*apply, func(progress services.LayoutMigrationResult) {
+		logger.Info("Migration progress",
+			zap.Int("moved", progress.Moved),
+			zap.Int("skipped", progress.Skipped))
+	})
+	if err != nil {
+		logger.Fatal("Migration failed",
+			zap.Int("moved", result.Moved),
+			zap.Int("skipped", result.Skipped),
+			zap.Error(err))
+	}
+
+	if !*apply {
+		logger.Info("Dry run complete, run with -apply to move the readings",
+			zap.Int("would_move", result.Moved),
+			zap.Int("skipped", result.Skipped))
+		return
+	}
+
+	logger.Info("Migration complete, set FIREBASE_PATH_LAYOUT=device_date if not done already",
+		zap.Int("moved", result.Moved),
+		zap.Int("skipped", result.Skipped))
+}
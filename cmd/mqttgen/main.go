@@ -15,7 +15,10 @@ import (
 	"kaelo/models"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
 	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
 var (
@@ -26,6 +29,8 @@ var (
 	mqttUser   = flag.String("user", "kaelo", "MQTT username")
 	mqttPass   = flag.String("pass", "kaelo2024", "MQTT password")
 	mqttTopic  = flag.String("topic", "sensor_data_queue", "MQTT topic to publish to")
+	site       = flag.String("site", "", "Publish to the device topic kaelo/<site>/<device>/telemetry instead of -topic")
+	format     = flag.String("format", "json", "Payload format: json, cbor, msgpack or protobuf (binary formats are published to <topic>/<format>)")
 )
 
 type MockDataGenerator struct {
@@ -146,19 +151,116 @@ func (m *MockDataGenerator) GenerateSensorData() *models.SensorData {
 	}
 }
 
+// encodeSensorData encodes a reading like the firmware would in each payload format.
+// Binary formats send the timestamp as unix milliseconds.
+func encodeSensorData(format string, data *models.SensorData) ([]byte, error) {
+	switch format {
+	case "json":
+		return json.Marshal(data)
+	case "cbor", "msgpack":
+		// Same fields as JSON
+		jsonData, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(jsonData, &fields); err != nil {
+			return nil, err
+		}
+		fields["timestamp"] = data.Timestamp.UnixMilli()
+
+		if format == "cbor" {
+			return cbor.Marshal(fields)
+		}
+		return msgpack.Marshal(fields)
+	case "protobuf":
+		return encodeSensorDataProto(data), nil
+	default:
+		return nil, fmt.Errorf("unsupported format %q (expected json, cbor, msgpack or protobuf)", format)
+	}
+}
+
+// encodeSensorDataProto encodes a reading as kaelo.v1.SensorData (proto/kaelo.proto)
+func encodeSensorDataProto(data *models.SensorData) []byte {
+	var b []byte
+	appendString := func(num protowire.Number, v string) {
+		if v != "" {
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendString(b, v)
+		}
+	}
+	appendVarint := func(num protowire.Number, v uint64) {
+		if v != 0 {
+			b = protowire.AppendTag(b, num, protowire.VarintType)
+			b = protowire.AppendVarint(b, v)
+		}
+	}
+	appendFloat := func(num protowire.Number, v float64) {
+		if v != 0 {
+			b = protowire.AppendTag(b, num, protowire.Fixed32Type)
+			b = protowire.AppendFixed32(b, math.Float32bits(float32(v)))
+		}
+	}
+	appendVector := func(num protowire.Number, x, y, z float64) {
+		var v []byte
+		for i, f := range []float64{x, y, z} {
+			if f != 0 {
+				v = protowire.AppendTag(v, protowire.Number(i+1), protowire.Fixed32Type)
+				v = protowire.AppendFixed32(v, math.Float32bits(float32(f)))
+			}
+		}
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, v)
+	}
+
+	gasQuality := map[string]uint64{"good": 1, "moderate": 2, "poor": 3}[data.GasQuality]
+	flame := uint64(0)
+	if data.FlameDetected {
+		flame = 1
+	}
+
+	appendString(1, data.DeviceID)
+	appendVarint(2, uint64(data.Timestamp.UnixMilli()))
+	appendString(3, data.MessageID)
+	appendVarint(4, data.Seq)
+	appendFloat(5, data.TemperatureDHT)
+	appendFloat(6, data.Humidity)
+	appendVarint(7, gasQuality)
+	appendVarint(8, flame)
+	appendVector(9, data.Acceleration.X, data.Acceleration.Y, data.Acceleration.Z)
+	appendVector(10, data.Gyroscope.X, data.Gyroscope.Y, data.Gyroscope.Z)
+	appendFloat(11, data.TemperatureMPU)
+	return b
+}
+
 func main() {
 	flag.Parse()
 
+	// Binary formats are announced with a topic suffix, since MQTT 3.1.1 has no content type
+	topic := *mqttTopic
+	if *site != "" {
+		topic = "kaelo/" + *site + "/" + *deviceID + "/telemetry"
+	}
+	if *format != "json" {
+		topic += "/" + *format
+	}
+	if _, err := encodeSensorData(*format, &models.SensorData{}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
 	// Initialize logger
 	logger, _ := zap.NewDevelopment()
 	defer logger.Sync()
 
 	logger.Info("MQTT Mock Data Generator started",
 		zap.String("device_id", *deviceID),
+		zap.String("site", *site),
 		zap.Int("rps", *rps),
 		zap.Float64("anomaly_probability", *anomaly),
 		zap.String("mqtt_broker", *mqttBroker),
-		zap.String("mqtt_topic", *mqttTopic),
+		zap.String("mqtt_topic", topic),
+		zap.String("format", *format),
 	)
 	logger.Info("Press Ctrl+C to stop gracefully")
 
@@ -259,15 +361,15 @@ func main() {
 				anomalyCount++
 			}
 
-			// Convert to JSON (like ESP32 would do)
-			jsonData, err := json.Marshal(sensorData)
+			// Encode the payload (like ESP32 would do)
+			payload, err := encodeSensorData(*format, sensorData)
 			if err != nil {
-				logger.Error("Failed to marshal sensor data", zap.Error(err))
+				logger.Error("Failed to encode sensor data", zap.Error(err))
 				continue
 			}
 
 			// Publish to MQTT (simulating ESP32/Arduino)
-			token := mqttClient.Publish(*mqttTopic, 0, false, jsonData)
+			token := mqttClient.Publish(topic, 0, false, payload)
 			if token.Wait() && token.Error() != nil {
 				logger.Error("Failed to publish MQTT message",
 					zap.Error(token.Error()),
@@ -288,7 +390,8 @@ func main() {
 				prettyJSON, _ := json.MarshalIndent(sensorData, "", "  ")
 				logger.Debug("Published MQTT message",
 					zap.String("device_id", sensorData.DeviceID),
-					zap.String("topic", *mqttTopic),
+					zap.String("topic", topic),
+					zap.Int("payload_bytes", len(payload)),
 					zap.Bool("is_anomaly", isAnomaly),
 					zap.String("data", string(prettyJSON)))
 			}
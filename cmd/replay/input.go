@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"kaelo/models"
+	"kaelo/services"
+)
+
+// readingSource yields historical readings oldest first. Next returns io.EOF when done.
+type readingSource interface {
+	Next(ctx context.Context) (*models.SensorData, error)
+	Close() error
+}
+
+// storeSource pages through the configured sensor store
+type storeSource struct {
+	store services.SensorStore
+	query services.TimeRangeQuery
+	items []*models.SensorData
+	done  bool
+}
+
+func newStoreSource(store services.SensorStore, query services.TimeRangeQuery) *storeSource {
+	query.Order = services.SortAscending
+	return &storeSource{store: store, query: query}
+}
+
+func (s *storeSource) Next(ctx context.Context) (*models.SensorData, error) {
+	for len(s.items) == 0 {
+		if s.done {
+			return nil, io.EOF
+		}
+
+		pageCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
+		page, err := s.store.QueryReadings(pageCtx, s.query)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+
+		s.items = page.Items
+		s.query.Cursor = page.NextCursor
+		s.done = page.NextCursor == ""
+	}
+
+	data := s.items[0]
+	s.items = s.items[1:]
+	return data, nil
+}
+
+func (s *storeSource) Close() error {
+	return s.store.Close()
+}
+
+// exportRow is a reading as written by cmd/export. Sensor values the reading didn't carry are
+// empty (CSV) or null (JSONL) and decode to nil.
+type exportRow struct {
+	DeviceID       string    `json:"device_id"`
+	Timestamp      time.Time `json:"timestamp"`
+	MessageID      string    `json:"message_id"`
+	Seq            uint64    `json:"seq"`
+	TemperatureDHT *float64  `json:"temperature_dht"`
+	TemperatureMPU *float64  `json:"temperature_mpu"`
+	Humidity       *float64  `json:"humidity"`
+	GasQuality     string    `json:"gas_quality"`
+	FlameDetected  bool      `json:"flame_detected"`
+	AccelX         *float64  `json:"accel_x"`
+	AccelY         *float64  `json:"accel_y"`
+	AccelZ         *float64  `json:"accel_z"`
+	GyroX          *float64  `json:"gyro_x"`
+	GyroY          *float64  `json:"gyro_y"`
+	GyroZ          *float64  `json:"gyro_z"`
+}
+
+func (r *exportRow) sensorData() *models.SensorData {
+	data := &models.SensorData{
+		DeviceID:      r.DeviceID,
+		Timestamp:     r.Timestamp,
+		MessageID:     r.MessageID,
+		Seq:           r.Seq,
+		GasQuality:    r.GasQuality,
+		FlameDetected: r.FlameDetected,
+	}
+
+	// Missing values are listed in InvalidFields so they are skipped like at ingestion; a
+	// missing MPU temperature is just zero
+	value := func(field string, v *float64) float64 {
+		if v == nil {
+			if field != "temperature_mpu" && !slices.Contains(data.InvalidFields, field) {
+				data.InvalidFields = append(data.InvalidFields, field)
+			}
+			return 0
+		}
+		return *v
+	}
+	data.TemperatureDHT = value("temperature_dht", r.TemperatureDHT)
+	data.TemperatureMPU = value("temperature_mpu", r.TemperatureMPU)
+	data.Humidity = value("humidity", r.Humidity)
+	data.Acceleration = models.AccelerationData{
+		X: value("acceleration", r.AccelX), Y: value("acceleration", r.AccelY), Z: value("acceleration", r.AccelZ),
+	}
+	data.Gyroscope = models.GyroscopeData{
+		X: value("gyroscope", r.GyroX), Y: value("gyroscope", r.GyroY), Z: value("gyroscope", r.GyroZ),
+	}
+	return data
+}
+
+// fileSource reads a CSV or JSON Lines file written by cmd/export, keeping readings of the
+// requested device and time range
+type fileSource struct {
+	file  *os.File
+	query services.TimeRangeQuery
+	next  func() (*models.SensorData, error)
+}
+
+func newFileSource(path string, query services.TimeRangeQuery) (*fileSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &fileSource{file: file, query: query}
+	switch filepath.Ext(path) {
+	case ".csv":
+		err = s.initCSV()
+	case ".jsonl", ".json":
+		s.initJSONL()
+	default:
+		err = fmt.Errorf("unsupported input %s (expected a .csv or .jsonl export)", path)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSource) initJSONL() {
+	scanner := bufio.NewScanner(s.file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+
+	s.next = func() (*models.SensorData, error) {
+		for scanner.Scan() {
+			line++
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			var row exportRow
+			if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			return row.sensorData(), nil
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+}
+
+func (s *fileSource) initCSV() error {
+	reader := csv.NewReader(bufio.NewReader(s.file))
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	index := make(map[string]int, len(header))
+	for i, name := range header {
+		index[name] = i
+	}
+	for _, required := range []string{"device_id", "timestamp"} {
+		if _, ok := index[required]; !ok {
+			return fmt.Errorf("CSV header has no %s column", required)
+		}
+	}
+
+	s.next = func() (*models.SensorData, error) {
+		record, err := reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		var parseErr error
+		get := func(name string) string {
+			if i, ok := index[name]; ok {
+				return record[i]
+			}
+			return ""
+		}
+		float := func(name string) *float64 {
+			value := get(name)
+			if value == "" {
+				return nil
+			}
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil && parseErr == nil {
+				parseErr = fmt.Errorf("%s: %w", name, err)
+			}
+			return &f
+		}
+
+		row := exportRow{
+			DeviceID:       get("device_id"),
+			MessageID:      get("message_id"),
+			TemperatureDHT: float("temperature_dht"),
+			TemperatureMPU: float("temperature_mpu"),
+			Humidity:       float("humidity"),
+			GasQuality:     get("gas_quality"),
+			FlameDetected:  get("flame_detected") == "true",
+			AccelX:         float("accel_x"),
+			AccelY:         float("accel_y"),
+			AccelZ:         float("accel_z"),
+			GyroX:          float("gyro_x"),
+			GyroY:          float("gyro_y"),
+			GyroZ:          float("gyro_z"),
+		}
+		if seq := get("seq"); seq != "" {
+			if row.Seq, err = strconv.ParseUint(seq, 10, 64); err != nil && parseErr == nil {
+				parseErr = fmt.Errorf("seq: %w", err)
+			}
+		}
+		if row.Timestamp, err = time.Parse(time.RFC3339Nano, get("timestamp")); err != nil && parseErr == nil {
+			parseErr = fmt.Errorf("timestamp: %w", err)
+		}
+		if parseErr != nil {
+			return nil, fmt.Errorf("line %d: %w", line, parseErr)
+		}
+		return row.sensorData(), nil
+	}
+	return nil
+}
+
+func (s *fileSource) Next(ctx context.Context) (*models.SensorData, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		data, err := s.next()
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if s.query.DeviceID != "" && data.DeviceID != s.query.DeviceID {
+			continue
+		}
+		if !s.query.From.IsZero() && data.Timestamp.Before(s.query.From) {
+			continue
+		}
+		if !s.query.To.IsZero() && data.Timestamp.After(s.query.To) {
+			continue
+		}
+		return data, nil
+	}
+}
+
+func (s *fileSource) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"kaelo/config"
+	"kaelo/log"
+	"kaelo/services"
+
+	"go.uber.org/zap"
+)
+
+var (
+	candidatePath = flag.String("candidate", "", "Candidate thresholds file, same format as THRESHOLDS_PATH (required)")
+	currentPath   = flag.String("current", "", "Current thresholds file (default THRESHOLDS_PATH)")
+	input         = flag.String("input", "", "CSV or JSON Lines file written by cmd/export (default: read the sensor store)")
+	deviceID      = flag.String("device", "", "Only replay this device")
+	from          = flag.String("from", "", "Start of the time range, RFC3339 or YYYY-MM-DD (default: 7 days ago)")
+	to            = flag.String("to", "", "End of the time range, RFC3339 or YYYY-MM-DD, inclusive (default: now)")
+	pageSize      = flag.Int("page", 1000, "Readings fetched per request when reading the store (max 1000)")
+	timezone      = flag.String("tz", "", "Timezone of dates in -from/-to and of reported times (default: TZ, else the system timezone)")
+)
+
+func main() {
+	flag.Parse()
+
+	logger := log.GetInstance()
+	defer logger.Sync()
+
+	// Stored timestamps are UTC, the timezone only affects how dates are read and reported
+	if *timezone != "" {
+		loc, err := time.LoadLocation(*timezone)
+		if err != nil {
+			logger.Fatal("Invalid -tz", zap.Error(err))
+		}
+		time.Local = loc
+	}
+
+	if *candidatePath == "" {
+		logger.Fatal("-candidate is required")
+	}
+
+	query := services.TimeRangeQuery{DeviceID: *deviceID, Limit: *pageSize}
+	var err error
+	if query.From, err = services.ParseRangeTime(*from, false); err != nil {
+		logger.Fatal("Invalid -from", zap.Error(err))
+	}
+	if query.To, err = services.ParseRangeTime(*to, true); err != nil {
+		logger.Fatal("Invalid -to", zap.Error(err))
+	}
+	if *from == "" && *input == "" {
+		query.From = time.Now().AddDate(0, 0, -7)
+	}
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		logger.Fatal("Failed to load config", zap.Error(err))
+	}
+	// Read the primary store only; the bolt mirror is locked by a running service
+	cfg.BoltMirror = false
+
+	current, err := loadEvaluation(cfg, *currentPath, logger)
+	if err != nil {
+		logger.Fatal("Failed to load current thresholds", zap.Error(err))
+	}
+	candidate, err := loadEvaluation(cfg, *candidatePath, logger)
+	if err != nil {
+		logger.Fatal("Failed to load candidate thresholds", zap.Error(err))
+	}
+
+	var source readingSource
+	sourceName := *input
+	if *input != "" {
+		source, err = newFileSource(*input, query)
+		if err != nil {
+			logger.Fatal("Failed to open input", zap.Error(err))
+		}
+	} else {
+		store, err := services.NewSensorStore(cfg, logger)
+		if err != nil {
+			logger.Fatal("Failed to initialize sensor store",
+				zap.String("backend", cfg.StorageBackend),
+				zap.Error(err))
+		}
+		source = newStoreSource(store, query)
+		sourceName = cfg.StorageBackend + " store"
+	}
+	defer source.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logger.Info("Replaying readings",
+		zap.String("source", sourceName),
+		zap.String("device_id", query.DeviceID),
+		zap.Time("from", query.From),
+		zap.Time("to", query.To))
+
+	summary, err := replay(ctx, source, current, candidate)
+	if err != nil {
+		logger.Fatal("Replay failed", zap.Int("readings", summary.readings), zap.Error(err))
+	}
+	summary.source = sourceName
+
+	if err := writeReport(os.Stdout, summary, current, candidate); err != nil {
+		logger.Fatal("Failed to write report", zap.Error(err))
+	}
+}
+
+// loadEvaluation loads a thresholds file into its own manager. Nothing is written back,
+// and no notifier is involved, so replaying never changes thresholds or sends alerts.
+func loadEvaluation(cfg *config.Config, path string, logger *zap.Logger) (*evaluation, error) {
+	thresholdsCfg := *cfg
+	if path != "" {
+		// The manager silently falls back to the defaults for a missing file; a typo
+		// in an explicit path should fail instead
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+		thresholdsCfg.ThresholdsPath = path
+	}
+
+	thresholds, err := services.NewThresholdManager(&thresholdsCfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	return newEvaluation(services.NewAnomalyDetectionService(thresholds), services.NewAlertDeduplicator(cfg, logger)), nil
+}
+
+// replay feeds every reading to both evaluations
+func replay(ctx context.Context, source readingSource, current, candidate *evaluation) (replaySummary, error) {
+	var summary replaySummary
+	devices := make(map[string]bool)
+
+	for {
+		data, err := source.Next(ctx)
+		if errors.Is(err, io.EOF) {
+			summary.devices = len(devices)
+			return summary, nil
+		}
+		if err != nil {
+			return summary, err
+		}
+
+		current.add(data)
+		candidate.add(data)
+
+		if summary.readings == 0 {
+			summary.first = data.Timestamp
+		}
+		summary.last = data.Timestamp
+		summary.readings++
+		devices[data.DeviceID] = true
+	}
+}
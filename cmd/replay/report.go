@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"kaelo/models"
+	"kaelo/services"
+)
+
+// counts are the anomalies detected and the alerts that would have been sent after deduplication
+type counts struct {
+	anomalies int
+	alerts    int
+}
+
+// evaluation replays readings through one threshold configuration
+type evaluation struct {
+	detector *services.AnomalyDetectionService
+	dedup    *services.AlertDeduplicator
+	total    counts
+	byType   map[string]*counts
+	byDevice map[string]*counts
+}
+
+func newEvaluation(detector *services.AnomalyDetectionService, dedup *services.AlertDeduplicator) *evaluation {
+	return &evaluation{
+		detector: detector,
+		dedup:    dedup,
+		byType:   make(map[string]*counts),
+		byDevice: make(map[string]*counts),
+	}
+}
+
+// add runs detection on a reading. Alerts are deduplicated at the reading's own timestamp,
+// as if it had just arrived.
+func (e *evaluation) add(data *models.SensorData) {
+	anomalies := e.detector.DetectAnomalies(data)
+	for _, anomaly := range anomalies {
+		e.total.anomalies++
+		counter(e.byType, string(anomaly.Type)).anomalies++
+		counter(e.byDevice, anomaly.DeviceID).anomalies++
+	}
+
+	for _, anomaly := range e.dedup.FilterAt(anomalies, data.Timestamp) {
+		e.total.alerts++
+		counter(e.byType, string(anomaly.Type)).alerts++
+		counter(e.byDevice, anomaly.DeviceID).alerts++
+	}
+}
+
+// counter returns the counts for a key, creating them if needed
+func counter(m map[string]*counts, key string) *counts {
+	c, ok := m[key]
+	if !ok {
+		c = &counts{}
+		m[key] = c
+	}
+	return c
+}
+
+// replaySummary describes the replayed readings
+type replaySummary struct {
+	source   string
+	readings int
+	devices  int
+	first    time.Time
+	last     time.Time
+}
+
+// writeReport prints the totals, then the per-type and per-device counts of both
+// configurations with the difference
+func writeReport(w io.Writer, summary replaySummary, current, candidate *evaluation) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+
+	fmt.Fprintf(w, "\nReplayed %d readings from %d devices (%s)\n", summary.readings, summary.devices, summary.source)
+	if summary.readings > 0 {
+		fmt.Fprintf(w, "Range: %s to %s\n", summary.first.Format(time.RFC3339), summary.last.Format(time.RFC3339))
+	}
+
+	writeSection(tw, "", []string{"total"}, map[string]*counts{"total": &current.total}, map[string]*counts{"total": &candidate.total})
+	writeSection(tw, "type", sortedKeys(current.byType, candidate.byType), current.byType, candidate.byType)
+	writeSection(tw, "device", sortedKeys(current.byDevice, candidate.byDevice), current.byDevice, candidate.byDevice)
+	return tw.Flush()
+}
+
+// writeSection writes one table of the report
+func writeSection(tw *tabwriter.Writer, title string, keys []string, current, candidate map[string]*counts) {
+	fmt.Fprintf(tw, "\n%s\tanomalies now\tcandidate\tdiff\talerts now\tcandidate\tdiff\t\n", title)
+	if len(keys) == 0 {
+		fmt.Fprintf(tw, "(none)\t\t\t\t\t\t\t\n")
+	}
+	for _, key := range keys {
+		var before, after counts
+		if c, ok := current[key]; ok {
+			before = *c
+		}
+		if c, ok := candidate[key]; ok {
+			after = *c
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%d\t%d\t%s\t\n", key,
+			before.anomalies, after.anomalies, diff(before.anomalies, after.anomalies),
+			before.alerts, after.alerts, diff(before.alerts, after.alerts))
+	}
+}
+
+// diff formats the change from the current to the candidate count
+func diff(before, after int) string {
+	if before == after {
+		return "0"
+	}
+	return fmt.Sprintf("%+d", after-before)
+}
+
+// sortedKeys returns the keys present in either map, sorted
+func sortedKeys(a, b map[string]*counts) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	var keys []string
+	for _, m := range []map[string]*counts{a, b} {
+		for key := range m {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -28,10 +28,23 @@ docker run -d \
     --restart unless-stopped \
     --memory="256m" \
     --cpus="0.5" \
+    -v kaelo-data:/data \
+    -e BOLT_MIRROR=true \
     ${IMAGE_NAME}:main
 
-# Check if container is running
-if docker ps --format 'table {{.Names}}' | grep -q "^${CONTAINER_NAME}$"; then
+# Wait for the service to report ready
+echo "⏳ Waiting for service readiness..."
+READY=false
+for i in $(seq 1 30); do
+    if docker exec ${CONTAINER_NAME} wget -qO- http://localhost:8080/readyz > /dev/null 2>&1; then
+        READY=true
+        break
+    fi
+    sleep 2
+done
+
+# Check if container is running and ready
+if [ "$READY" = true ] && docker ps --format 'table {{.Names}}' | grep -q "^${CONTAINER_NAME}$"; then
     echo "✅ KAELO Service deployed successfully!"
     echo "📊 Container status:"
     docker ps --filter name=${CONTAINER_NAME} --format "table {{.Names}}\t{{.Status}}\t{{.Ports}}"
@@ -39,7 +52,8 @@ if docker ps --format 'table {{.Names}}' | grep -q "^${CONTAINER_NAME}$"; then
     echo "📝 To view logs: docker logs -f ${CONTAINER_NAME}"
     echo "🛑 To stop: docker stop ${CONTAINER_NAME}"
 else
-    echo "❌ Deployment failed!"
+    echo "❌ Deployment failed! Service did not become ready"
+    docker exec ${CONTAINER_NAME} wget -qO- http://localhost:8080/readyz 2>/dev/null || true
     echo "📝 Check logs: docker logs ${CONTAINER_NAME}"
     exit 1
 fi
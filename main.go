@@ -9,9 +9,11 @@ import (
 
 	"kaelo/config"
 	"kaelo/log"
+	"kaelo/metrics"
 	"kaelo/models"
 	"kaelo/services"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 )
 
@@ -34,52 +36,101 @@ func main() {
 	}
 
 	// Validate required configuration
-	if cfg.RabbitMQURL == "" {
+	if cfg.IngestTransport == services.IngestTransportRabbitMQ && cfg.RabbitMQURL == "" {
 		logger.Fatal("RabbitMQ configuration is required")
 	}
-	if cfg.FirebaseDbUrl == "" || cfg.FirebaseServiceAccountJSON == "" {
-		logger.Fatal("Firebase configuration is required")
+	if cfg.IngestTransport == services.IngestTransportMQTT && cfg.MQTTBrokerURL == "" {
+		logger.Fatal("MQTT configuration is required")
 	}
 	if cfg.TelegramBotToken == "" || cfg.TelegramChatID == "" {
 		logger.Fatal("Telegram configuration is required")
 	}
 
 	// Initialize services
-	firebaseService, err := services.NewFirebaseService(cfg)
+	sensorStore, err := services.NewSensorStore(cfg, logger)
 	if err != nil {
-		logger.Fatal("Failed to initialize Firebase service", zap.Error(err))
+		logger.Fatal("Failed to initialize sensor store",
+			zap.String("backend", cfg.StorageBackend),
+			zap.Error(err))
 	}
-	defer firebaseService.Close()
+	defer sensorStore.Close()
 
-	telegramService, err := services.NewTelegramService(cfg)
+	// Initialize notification outbox (every notification is persisted before delivery)
+	notificationOutbox, err := services.NewNotificationOutbox(cfg, logger)
+	if err != nil {
+		logger.Fatal("Failed to initialize notification outbox", zap.Error(err))
+	}
+
+	telegramService, err := services.NewTelegramService(cfg, notificationOutbox)
 	if err != nil {
 		logger.Fatal("Failed to initialize Telegram service", zap.Error(err))
 	}
 
-	anomalyDetector := services.NewAnomalyDetectionService(cfg)
+	// Initialize threshold manager (persisted runtime changes take precedence over env defaults)
+	thresholdManager, err := services.NewThresholdManager(cfg, logger)
+	if err != nil {
+		logger.Fatal("Failed to initialize threshold manager", zap.Error(err))
+	}
+
+	adminAuth, err := services.NewAdminAuth(cfg)
+	if err != nil {
+		logger.Fatal("Invalid admin API configuration", zap.Error(err))
+	}
+
+	anomalyDetector := services.NewAnomalyDetectionService(thresholdManager)
+
+	// Initialize alert deduplicator shared by all notifiers
+	alertDeduplicator := services.NewAlertDeduplicator(cfg, logger)
 
 	// Initialize hardware alert service
 	var hardwareAlertService *services.HardwareAlertService
 	if cfg.HardwareAlertURL != "" {
-		hardwareAlertService = services.NewHardwareAlertService(logger, cfg.HardwareAlertURL)
+		hardwareAlertService = services.NewHardwareAlertService(logger, cfg.HardwareAlertURL, notificationOutbox)
 		logger.Info("Hardware alert service initialized", zap.String("url", cfg.HardwareAlertURL))
 	}
 
-	// Initialize RabbitMQ service
-	rabbitMQService, err := services.NewRabbitMQService(cfg, logger)
+	// Initialize ingestion transport (RabbitMQ, or a plain MQTT broker)
+	ingestTransport, err := services.NewIngestTransport(cfg, services.NewMessageDeduplicator(cfg, logger), logger)
+	if err != nil {
+		logger.Fatal("Failed to initialize ingestion transport",
+			zap.String("transport", cfg.IngestTransport),
+			zap.Error(err))
+	}
+	defer ingestTransport.Close()
+
+	// Initialize spill buffer (failed batches are kept on disk and replayed)
+	spillBuffer, err := services.NewSpillBuffer(cfg, sensorStore, logger)
 	if err != nil {
-		logger.Fatal("Failed to initialize RabbitMQ service", zap.Error(err))
+		logger.Fatal("Failed to initialize spill buffer", zap.Error(err))
 	}
-	defer rabbitMQService.Close()
 
 	// Initialize batch writer service
-	batchWriterService := services.NewBatchWriterService(cfg, firebaseService, logger)
+	batchWriterService := services.NewBatchWriterService(cfg, sensorStore, spillBuffer, logger)
+
+	// Initialize InfluxDB sink (every batch is also written as line protocol for long-range queries)
+	if cfg.InfluxURL != "" {
+		influxSink, err := services.NewInfluxSink(cfg, logger)
+		if err != nil {
+			logger.Fatal("Failed to initialize InfluxDB sink", zap.Error(err))
+		}
+		batchWriterService.AddSink(influxSink)
+		logger.Info("InfluxDB sink initialized", zap.String("url", cfg.InfluxURL), zap.String("bucket", cfg.InfluxBucket))
+	}
+
+	// Initialize rollup service (per-minute and per-hour aggregates for dashboards)
+	rollupService := services.NewRollupService(cfg, sensorStore, logger)
+
+	// Initialize retention job (prunes records older than their retention policy)
+	retentionService := services.NewRetentionService(cfg, sensorStore, logger)
+
+	// Initialize event hub for live streaming to dashboards
+	eventHub := services.NewEventHub(logger)
 
 	// Initialize face recognition service
-	faceRecognitionService := services.NewFaceRecognitionService(telegramService, logger)
+	faceRecognitionService := services.NewFaceRecognitionService(telegramService, sensorStore, eventHub, logger)
 
 	// Initialize health check monitoring service
-	healthCheckService := services.NewHealthCheckService(cfg, telegramService, logger)
+	healthCheckService := services.NewHealthCheckService(cfg, telegramService, eventHub, sensorStore, logger)
 
 	// Send startup notification
 	if err := telegramService.SendStartupMessage(); err != nil {
@@ -87,19 +138,24 @@ func main() {
 	}
 
 	logger.Info("KAELO IoT Monitoring Service started",
+		zap.String("ingest_transport", cfg.IngestTransport),
 		zap.String("rabbitmq_url", cfg.RabbitMQURL),
+		zap.String("mqtt_broker_url", cfg.MQTTBrokerURL),
 		zap.String("rabbitmq_queue", cfg.RabbitMQQueue),
+		zap.String("rabbitmq_ack_mode", cfg.RabbitMQAckMode),
+		zap.String("storage_backend", cfg.StorageBackend),
+		zap.String("storage", services.DescribeStorage(cfg)),
 		zap.Int("firebase_batch_size", cfg.FirebaseBatchSize),
 		zap.Int("firebase_batch_timeout", cfg.FirebaseBatchTimeout),
-		zap.Float64("temp_min", cfg.TemperatureMin),
-		zap.Float64("temp_max", cfg.TemperatureMax),
-		zap.Float64("humidity_min", cfg.HumidityMin),
-		zap.Float64("humidity_max", cfg.HumidityMax),
+		zap.Any("thresholds", thresholdManager.Snapshot().Global),
+		zap.Int("threshold_device_overrides", len(thresholdManager.Snapshot().Devices)),
 		zap.Float64("dust_max", cfg.DustMax),
 		zap.Float64("flame_threshold", cfg.FlameThreshold),
 		zap.Float64("light_min", cfg.LightMin),
 		zap.Float64("light_max", cfg.LightMax),
 		zap.Float64("gas_max", cfg.GasMax),
+		zap.Int("alert_dedup_window", cfg.AlertDedupWindow),
+		zap.Int("alert_dedup_critical_window", cfg.AlertDedupCriticalWindow),
 	)
 
 	// Create context for graceful shutdown
@@ -136,8 +192,40 @@ func main() {
 	// Buffer size should be large enough to handle burst traffic
 	businessLogicChan := make(chan *models.SensorData, 200)
 	batchWriterChan := make(chan *models.SensorData, 200)
+	rollupChan := make(chan *models.SensorData, 200)
 	faceRecognitionChan := make(chan *models.FaceRecognitionData, 100)
 	healthCheckChan := make(chan *models.HealthCheckData, 100)
+	anomalyRecorder := services.NewAnomalyRecorder(sensorStore, 200, logger)
+
+	// Start HTTP server for liveness, readiness and status endpoints
+	httpServer := services.NewHTTPServer(cfg, logger)
+	httpServer.AddReadinessCheck(cfg.IngestTransport, ingestTransport.Ping)
+	httpServer.AddReadinessCheck(cfg.StorageBackend, sensorStore.Ping)
+	httpServer.AddReadinessCheck("telegram", telegramService.Ping)
+	httpServer.AddQueue("business_logic", func() int { return len(businessLogicChan) }, cap(businessLogicChan))
+	httpServer.AddQueue("batch_writer", func() int { return len(batchWriterChan) }, cap(batchWriterChan))
+	httpServer.AddQueue("rollup", func() int { return len(rollupChan) }, cap(rollupChan))
+	httpServer.AddQueue("face_recognition", func() int { return len(faceRecognitionChan) }, cap(faceRecognitionChan))
+	httpServer.AddQueue("health_check", func() int { return len(healthCheckChan) }, cap(healthCheckChan))
+	httpServer.AddQueue("anomaly_recorder", anomalyRecorder.QueueLength, anomalyRecorder.QueueCapacity())
+	httpServer.AddStatusSource("batch_writer_buffer_size", func() interface{} { return batchWriterService.GetBufferSize() })
+	httpServer.AddStatusSource("devices", func() interface{} { return healthCheckService.ListDevices() })
+	httpServer.AddStatusSource("outbox", func() interface{} { return notificationOutbox.Status() })
+	httpServer.AddStatusSource("spill", func() interface{} { return spillBuffer.Status() })
+	httpServer.AddStatusSource("rollups", func() interface{} { return rollupService.Status() })
+	httpServer.AddStatusSource("retention", func() interface{} { return retentionService.Status() })
+	httpServer.Handle("GET /metrics", promhttp.Handler())
+	services.NewAPIHandler(sensorStore, healthCheckService, logger).Register(httpServer)
+	httpServer.Handle("GET /api/v1/stream", eventHub)
+	if adminAuth.Enabled() {
+		services.NewThresholdAPIHandler(thresholdManager, adminAuth, logger).Register(httpServer)
+	} else {
+		logger.Warn("ADMIN_API_TOKENS not set, threshold management API disabled")
+	}
+	go httpServer.Start(ctx)
+
+	// Record detected anomalies for the API, apart from alerting
+	go anomalyRecorder.Start(ctx)
 
 	// Start Process 1: Business Logic Processing (Anomaly Detection + Alerts)
 	go func() {
@@ -153,9 +241,17 @@ func main() {
 					return
 				}
 
+				// Push reading to live stream subscribers
+				eventHub.Publish(models.StreamEventReading, sensorData.DeviceID, sensorData)
+
 				// Detect anomalies
 				anomalies := anomalyDetector.DetectAnomalies(sensorData)
 
+				for _, anomaly := range anomalies {
+					metrics.AnomaliesDetected.WithLabelValues(string(anomaly.Type), anomaly.DeviceID).Inc()
+					eventHub.Publish(models.StreamEventAnomaly, anomaly.DeviceID, *anomaly)
+				}
+
 				if len(anomalies) > 0 {
 					logger.Warn("Anomalies detected",
 						zap.String("device_id", sensorData.DeviceID),
@@ -169,28 +265,45 @@ func main() {
 						zap.Any("gyroscope", sensorData.Gyroscope),
 					)
 
-					// Send Telegram notification
+					// Record all detected anomalies for the API, before deduplication. They are
+					// written in the background so a slow store can't delay the alerts below.
+					if !anomalyRecorder.Record(anomalies) {
+						metrics.DistributorTimeouts.WithLabelValues("anomaly_recorder").Inc()
+						logger.Warn("Anomaly recorder is behind, not recording anomalies",
+							zap.String("device_id", sensorData.DeviceID),
+							zap.Int("anomaly_count", len(anomalies)))
+					}
+
+					// Drop repeats of alerts that were notified recently
+					anomalies = alertDeduplicator.Filter(anomalies)
+					if len(anomalies) == 0 {
+						logger.Debug("All anomalies suppressed by deduplication",
+							zap.String("device_id", sensorData.DeviceID))
+						continue
+					}
+
+					// Queue Telegram notification
 					if err := telegramService.SendAnomalyAlert(anomalies, sensorData); err != nil {
-						logger.Error("Failed to send Telegram alert",
+						logger.Error("Failed to queue Telegram alert",
 							zap.String("device_id", sensorData.DeviceID),
 							zap.Error(err),
 						)
 					} else {
-						logger.Info("Anomaly alert sent",
+						logger.Info("Anomaly alert queued",
 							zap.String("device_id", sensorData.DeviceID),
 							zap.Int("anomaly_count", len(anomalies)),
 						)
 					}
 
-					// Send hardware alert if service is configured
+					// Queue hardware alert if service is configured
 					if hardwareAlertService != nil {
 						if err := hardwareAlertService.SendHardwareAlert(anomalies, sensorData); err != nil {
-							logger.Error("Failed to send hardware alert",
+							logger.Error("Failed to queue hardware alert",
 								zap.String("device_id", sensorData.DeviceID),
 								zap.Error(err),
 							)
 						} else {
-							logger.Info("Hardware alert sent",
+							logger.Info("Hardware alert queued",
 								zap.String("device_id", sensorData.DeviceID),
 								zap.Int("anomaly_count", len(anomalies)),
 							)
@@ -201,8 +314,19 @@ func main() {
 		}
 	}()
 
-	// Start Process 2: Batch Writer for Firebase
+	// Start notification outbox sender (retries undelivered notifications)
+	go notificationOutbox.Start(ctx)
+
+	// Start Process 2: Batch Writer for the sensor store
 	go batchWriterService.Start(ctx, batchWriterChan)
+	go spillBuffer.Start(ctx)
+	go rollupService.Start(ctx, rollupChan)
+	go retentionService.Start(ctx)
+
+	// Answer Telegram bot commands (e.g. /latest)
+	if cfg.TelegramCommands {
+		go telegramService.StartCommands(ctx, sensorStore)
+	}
 
 	// Start Process 3: Face Recognition Processor
 	go faceRecognitionService.Start(ctx, faceRecognitionChan)
@@ -210,17 +334,18 @@ func main() {
 	// Start Process 4: Health Check Monitoring
 	go healthCheckService.Start(ctx, healthCheckChan)
 
-	// Start RabbitMQ consumers
+	// Start ingestion consumers
 	go func() {
-		logger.Info("Starting RabbitMQ sensor data consumer and message distributor")
+		logger.Info("Starting sensor data consumer and message distributor",
+			zap.String("transport", cfg.IngestTransport))
 
-		// Create a single channel for RabbitMQ sensor messages
-		rabbitMQChan := make(chan *models.SensorData, 100)
+		// Create a single channel for incoming sensor messages
+		ingestChan := make(chan *models.SensorData, 100)
 
-		// Start RabbitMQ sensor data consumer
+		// Start sensor data consumer
 		go func() {
-			if err := rabbitMQService.ConsumeSensorData(ctx, rabbitMQChan); err != nil {
-				logger.Error("RabbitMQ sensor consumer error", zap.Error(err))
+			if err := ingestTransport.ConsumeSensorData(ctx, ingestChan); err != nil {
+				logger.Error("Sensor consumer error", zap.Error(err))
 			}
 		}()
 
@@ -231,12 +356,14 @@ func main() {
 				logger.Info("Message distributor stopped")
 				close(businessLogicChan)
 				close(batchWriterChan)
+				close(rollupChan)
 				return
-			case sensorData, ok := <-rabbitMQChan:
+			case sensorData, ok := <-ingestChan:
 				if !ok {
-					logger.Info("RabbitMQ channel closed")
+					logger.Info("Ingestion channel closed")
 					close(businessLogicChan)
 					close(batchWriterChan)
+					close(rollupChan)
 					return
 				}
 
@@ -245,14 +372,36 @@ func main() {
 				select {
 				case businessLogicChan <- sensorData:
 				case <-time.After(1 * time.Second):
+					metrics.DistributorTimeouts.WithLabelValues("business_logic").Inc()
 					logger.Warn("Timeout sending to business logic channel",
 						zap.String("device_id", sensorData.DeviceID))
 				}
 
+				// Rollups
+				select {
+				case rollupChan <- sensorData:
+				case <-time.After(1 * time.Second):
+					metrics.DistributorTimeouts.WithLabelValues("rollup").Inc()
+					logger.Warn("Timeout sending to rollup channel",
+						zap.String("device_id", sensorData.DeviceID))
+				}
+
 				// Process 2: Batch Writer
+				if sensorData.Delivery != nil {
+					// Persisted ack mode: never drop a reading that still has to be acked.
+					// Waiting here applies backpressure to the consumer through the prefetch limit.
+					select {
+					case batchWriterChan <- sensorData:
+					case <-ctx.Done():
+						sensorData.Delivery.Nack(true)
+					}
+					continue
+				}
+
 				select {
 				case batchWriterChan <- sensorData:
 				case <-time.After(1 * time.Second):
+					metrics.DistributorTimeouts.WithLabelValues("batch_writer").Inc()
 					logger.Warn("Timeout sending to batch writer channel",
 						zap.String("device_id", sensorData.DeviceID))
 				}
@@ -262,23 +411,23 @@ func main() {
 
 	// Start Face Recognition Consumer
 	go func() {
-		logger.Info("Starting RabbitMQ face recognition consumer")
+		logger.Info("Starting face recognition consumer")
 
-		if err := rabbitMQService.ConsumeFaceRecognitionData(ctx, faceRecognitionChan); err != nil {
-			logger.Error("RabbitMQ face recognition consumer error", zap.Error(err))
+		if err := ingestTransport.ConsumeFaceRecognitionData(ctx, faceRecognitionChan); err != nil {
+			logger.Error("Face recognition consumer error", zap.Error(err))
 		}
 	}()
 
 	// Start Health Check Consumer
 	go func() {
-		logger.Info("Starting RabbitMQ health check consumer")
+		logger.Info("Starting health check consumer")
 
-		if err := rabbitMQService.ConsumeHealthCheck(ctx, healthCheckChan); err != nil {
-			logger.Error("RabbitMQ health check consumer error", zap.Error(err))
+		if err := ingestTransport.ConsumeHealthCheck(ctx, healthCheckChan); err != nil {
+			logger.Error("Health check consumer error", zap.Error(err))
 		}
 	}()
 
-	logger.Info("All services started, waiting for messages from RabbitMQ")
+	logger.Info("All services started, waiting for messages", zap.String("transport", cfg.IngestTransport))
 
 	// Wait for shutdown signal
 	<-ctx.Done()
@@ -294,18 +443,25 @@ func main() {
 		logger.Warn("Batch writer shutdown timeout")
 	}
 
-	// Close RabbitMQ service (will close all consumers)
-	if err := rabbitMQService.Close(); err != nil {
-		logger.Error("Error closing RabbitMQ service", zap.Error(err))
+	// Wait for rollup service to write partial buckets
+	if rollupService.WaitForShutdown(5 * time.Second) {
+		logger.Info("Rollup service shutdown completed")
+	} else {
+		logger.Warn("Rollup service shutdown timeout")
+	}
+
+	// Close ingestion transport (will close all consumers)
+	if err := ingestTransport.Close(); err != nil {
+		logger.Error("Error closing ingestion transport", zap.Error(err))
 	} else {
-		logger.Info("RabbitMQ service closed")
+		logger.Info("Ingestion transport closed")
 	}
 
-	// Close Firebase service
-	if err := firebaseService.Close(); err != nil {
-		logger.Error("Error closing Firebase service", zap.Error(err))
+	// Close sensor store
+	if err := sensorStore.Close(); err != nil {
+		logger.Error("Error closing sensor store", zap.Error(err))
 	} else {
-		logger.Info("Firebase service closed")
+		logger.Info("Sensor store closed")
 	}
 
 	// Signal cleanup completion
@@ -0,0 +1,295 @@
+package metrics
+
+import (
+	"kaelo/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "kaelo"
+
+var (
+	// Message consumption
+	MessagesConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_consumed_total",
+		Help:      "Messages received from the broker per queue.",
+	}, []string{"queue"})
+
+	MessagesAcked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_acked_total",
+		Help:      "Messages acknowledged per queue.",
+	}, []string{"queue"})
+
+	MessagesNacked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_nacked_total",
+		Help:      "Messages negatively acknowledged per queue.",
+	}, []string{"queue"})
+
+	ParseFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "message_parse_failures_total",
+		Help:      "Messages that could not be decoded or failed validation per queue.",
+	}, []string{"queue"})
+
+	DuplicateMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "duplicate_messages_total",
+		Help:      "Duplicate readings dropped at ingestion per queue.",
+	}, []string{"queue"})
+
+	MessagesByFormat = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_by_format_total",
+		Help:      "Messages received per queue and payload format (json, cbor, msgpack, protobuf).",
+	}, []string{"queue", "format"})
+
+	SchemaVersionReadings = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "schema_version_readings_total",
+		Help:      "Readings accepted per payload schema_version, before upgrading to the current one.",
+	}, []string{"version"})
+
+	SchemaValidationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "schema_validation_failures_total",
+		Help:      "Readings rejected by schema validation per schema_version.",
+	}, []string{"version"})
+
+	SensorValuesOutOfRange = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sensor_values_out_of_range_total",
+		Help:      "Sensor values cleared because they were out of the sensor's range, per field.",
+	}, []string{"field"})
+
+	InvalidSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "invalid_samples_total",
+		Help:      "Samples of batched messages dropped because they failed validation per queue.",
+	}, []string{"queue"})
+
+	// Message distribution
+	DistributorTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "distributor_timeouts_total",
+		Help:      "Readings dropped because a processing channel was full.",
+	}, []string{"channel"})
+
+	// Anomaly detection
+	AnomaliesDetected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "anomalies_detected_total",
+		Help:      "Anomalies detected per type and device.",
+	}, []string{"type", "device_id"})
+
+	// Notifications
+	NotificationsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifications_sent_total",
+		Help:      "Notifications delivered per notifier and kind.",
+	}, []string{"notifier", "kind"})
+
+	NotificationDeliveryErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notification_delivery_errors_total",
+		Help:      "Failed notification delivery attempts per notifier.",
+	}, []string{"notifier"})
+
+	NotificationsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifications_failed_total",
+		Help:      "Notifications given up on after all attempts per notifier and kind.",
+	}, []string{"notifier", "kind"})
+
+	// Firebase batch writer
+	FirebaseBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "firebase_batch_size",
+		Help:      "Number of readings per Firebase batch write.",
+		Buckets:   []float64{1, 5, 10, 25, 50, 100, 250, 500},
+	})
+
+	FirebaseFlushDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "firebase_flush_duration_seconds",
+		Help:      "Time taken to flush a batch to Firebase, including retries.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	FirebaseFlushRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "firebase_flush_retries_total",
+		Help:      "Retried Firebase batch writes.",
+	})
+
+	FirebaseFlushFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "firebase_flush_failures_total",
+		Help:      "Firebase batches that failed after all retries.",
+	})
+
+	BatchWriterBufferSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "batch_writer_buffer_size",
+		Help:      "Readings currently buffered by the batch writer.",
+	})
+
+	// Secondary sinks
+	SinkReadingsWritten = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sink_readings_written_total",
+		Help:      "Readings written to a secondary sink per sink.",
+	}, []string{"sink"})
+
+	SinkWriteFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sink_write_failures_total",
+		Help:      "Batches that could not be written to a secondary sink per sink.",
+	}, []string{"sink"})
+
+	SinkDroppedReadings = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sink_dropped_readings_total",
+		Help:      "Readings not written to a secondary sink because its queue was full, per sink.",
+	}, []string{"sink"})
+
+	// Spill buffer
+	SpillWrites = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "spill_writes_total",
+		Help:      "Failed batches written to the on-disk spill buffer.",
+	})
+
+	SpillReplayedReadings = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "spill_replayed_readings_total",
+		Help:      "Spilled readings successfully replayed to the store.",
+	})
+
+	SpillDroppedReadings = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "spill_dropped_readings_total",
+		Help:      "Readings lost because the spill buffer was full, the disk was full or a segment was unreadable.",
+	})
+
+	SpillQuarantinedReadings = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "spill_quarantined_readings_total",
+		Help:      "Spilled readings moved to quarantine because the store kept rejecting their batch.",
+	})
+
+	SpillBacklogSegments = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "spill_backlog_segments",
+		Help:      "Spilled batches waiting to be replayed.",
+	})
+
+	SpillBacklogReadings = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "spill_backlog_readings",
+		Help:      "Spilled readings waiting to be replayed.",
+	})
+
+	SpillBacklogBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "spill_backlog_bytes",
+		Help:      "Disk space used by the spill buffer.",
+	})
+
+	SpillOldestAgeSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "spill_oldest_age_seconds",
+		Help:      "Age of the oldest spilled batch (0 when the backlog is empty).",
+	})
+
+	// Rollups
+	RollupsWritten = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rollups_written_total",
+		Help:      "Rollup buckets merged into the store per resolution.",
+	}, []string{"resolution"})
+
+	RollupWriteFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rollup_write_failures_total",
+		Help:      "Failed rollup writes (the bucket is kept and retried).",
+	})
+
+	RollupLateReadings = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rollup_late_readings_total",
+		Help:      "Readings that arrived after their bucket was due per resolution.",
+	}, []string{"resolution"})
+
+	RollupDuplicateReadings = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rollup_duplicate_readings_total",
+		Help:      "Readings already counted in their bucket and skipped per resolution.",
+	}, []string{"resolution"})
+
+	RollupPendingBuckets = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "rollup_pending_buckets",
+		Help:      "Rollup buckets held in memory waiting to be written.",
+	})
+
+	// Retention
+	RetentionRecordsRemoved = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retention_records_removed_total",
+		Help:      "Records deleted by the retention job per collection.",
+	}, []string{"collection"})
+
+	RetentionErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retention_errors_total",
+		Help:      "Failed retention runs per collection.",
+	}, []string{"collection"})
+
+	RetentionLastRunTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "retention_last_run_timestamp_seconds",
+		Help:      "Unix time the retention job last finished.",
+	})
+
+	// Live stream
+	StreamSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stream_subscribers",
+		Help:      "Connected live stream subscribers.",
+	})
+
+	StreamEventsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stream_events_dropped_total",
+		Help:      "Events dropped for slow live stream subscribers.",
+	})
+
+	// Device health
+	DeviceHealth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "device_health_status",
+		Help:      "Current health status per device (1 for the active status, 0 otherwise).",
+	}, []string{"device_id", "status"})
+)
+
+// deviceHealthStatuses lists every status exported by DeviceHealth
+var deviceHealthStatuses = []models.DeviceHealthStatus{
+	models.DeviceHealthy,
+	models.DeviceTimeout,
+	models.DeviceRecovered,
+}
+
+// SetDeviceHealth marks the given status as active for a device
+func SetDeviceHealth(deviceID string, status models.DeviceHealthStatus) {
+	for _, s := range deviceHealthStatuses {
+		value := 0.0
+		if s == status {
+			value = 1
+		}
+		DeviceHealth.WithLabelValues(deviceID, string(s)).Set(value)
+	}
+}
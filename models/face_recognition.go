@@ -7,4 +7,13 @@ type FaceRecognitionData struct {
 	Base64    string    `json:"base64"`
 	UID       string    `json:"uid"`
 	Timestamp time.Time `json:"timestamp"`
+	DeviceID  string    `json:"device_id,omitempty"` // Camera that saw the face, from the device topic or payload
+	Site      string    `json:"site,omitempty"`
+}
+
+// FaceEvent represents a stored unknown person detection (without the image)
+type FaceEvent struct {
+	UID       string    `json:"uid"`
+	Timestamp time.Time `json:"timestamp"`
+	HasImage  bool      `json:"has_image"`
 }
@@ -24,6 +24,7 @@ type SensorStatus struct {
 // HealthCheckData represents health check data from ESP32 devices
 type HealthCheckData struct {
 	DeviceID      string       `json:"device_id"`
+	Site          string       `json:"site,omitempty"` // Site from the device topic or payload
 	Timestamp     time.Time    `json:"timestamp"`
 	WiFiConnected bool         `json:"wifi_connected"`
 	MQTTConnected bool         `json:"mqtt_connected"`
@@ -33,9 +34,9 @@ type HealthCheckData struct {
 
 // DeviceHealth tracks the health state of a device
 type DeviceHealth struct {
-	DeviceID        string
-	LastHealthCheck *HealthCheckData
-	LastSeen        time.Time
-	Status          DeviceHealthStatus
-	TimeoutAt       time.Time // When the device timed out (if applicable)
+	DeviceID        string             `json:"device_id"`
+	LastHealthCheck *HealthCheckData   `json:"last_health_check,omitempty"`
+	LastSeen        time.Time          `json:"last_seen"`
+	Status          DeviceHealthStatus `json:"status"`
+	TimeoutAt       time.Time          `json:"timeout_at,omitzero"` // When the device timed out (if applicable)
 }
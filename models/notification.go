@@ -0,0 +1,56 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// NotificationChannel identifies which notifier delivers a notification
+type NotificationChannel string
+
+const (
+	NotificationChannelTelegram NotificationChannel = "telegram"
+	NotificationChannelHardware NotificationChannel = "hardware"
+)
+
+// NotificationStatus represents the delivery state of an outbox notification
+type NotificationStatus string
+
+const (
+	NotificationPending NotificationStatus = "pending"
+	NotificationFailed  NotificationStatus = "failed"
+)
+
+// NotificationKind describes what a notification is about
+type NotificationKind string
+
+const (
+	NotificationAnomalyAlert    NotificationKind = "anomaly_alert"
+	NotificationUnknownPerson   NotificationKind = "unknown_person"
+	NotificationHealthTimeout   NotificationKind = "health_timeout"
+	NotificationHealthRecovery  NotificationKind = "health_recovery"
+	NotificationStatusMessage   NotificationKind = "status_message"
+	NotificationHardwareAnomaly NotificationKind = "hardware_anomaly"
+)
+
+// Notification represents a message persisted in the outbox until it is delivered
+type Notification struct {
+	ID       string              `json:"id"`
+	Channel  NotificationChannel `json:"channel"`
+	Kind     NotificationKind    `json:"kind"`
+	DeviceID string              `json:"device_id,omitempty"`
+	Critical bool                `json:"critical"` // Critical notifications are retried until delivered
+
+	// Content - Telegram uses Text/Photo, other notifiers use Payload
+	Text      string          `json:"text,omitempty"`
+	PhotoName string          `json:"photo_name,omitempty"`
+	Photo     []byte          `json:"photo,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+
+	// Delivery state
+	Status        NotificationStatus `json:"status"`
+	Attempts      int                `json:"attempts"`
+	LastError     string             `json:"last_error,omitempty"`
+	CreatedAt     time.Time          `json:"created_at"`
+	NextAttemptAt time.Time          `json:"next_attempt_at"`
+}
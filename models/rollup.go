@@ -0,0 +1,168 @@
+package models
+
+import (
+	"math"
+	"time"
+)
+
+// RollupResolution is the bucket width of a rollup
+type RollupResolution string
+
+const (
+	RollupMinute RollupResolution = "1m"
+	RollupHour   RollupResolution = "1h"
+)
+
+// RollupResolutions lists the resolutions computed for every reading
+var RollupResolutions = []RollupResolution{RollupMinute, RollupHour}
+
+// Duration returns the bucket width
+func (r RollupResolution) Duration() time.Duration {
+	switch r {
+	case RollupHour:
+		return time.Hour
+	default:
+		return time.Minute
+	}
+}
+
+// BucketStart returns the start of the bucket containing t. Buckets are aligned on UTC minutes
+// and hours (Truncate ignores the location); the result is expressed in local time.
+func (r RollupResolution) BucketStart(t time.Time) time.Time {
+	return t.In(time.Local).Truncate(r.Duration())
+}
+
+// Rollup metric names
+const (
+	RollupTemperatureDHT = "temperature_dht"
+	RollupTemperatureMPU = "temperature_mpu"
+	RollupHumidity       = "humidity"
+	RollupAcceleration   = "acceleration"
+	RollupGyroscope      = "gyroscope"
+)
+
+// RollupStat aggregates the values of one metric in a bucket
+type RollupStat struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Avg   float64 `json:"avg"`
+	Sum   float64 `json:"sum"`
+	Count int     `json:"count"`
+}
+
+// Add includes a value in the aggregate
+func (s *RollupStat) Add(value float64) {
+	if s.Count == 0 || value < s.Min {
+		s.Min = value
+	}
+	if s.Count == 0 || value > s.Max {
+		s.Max = value
+	}
+	s.Sum += value
+	s.Count++
+	s.Avg = s.Sum / float64(s.Count)
+}
+
+// Merge combines another aggregate of the same metric and bucket into this one
+func (s *RollupStat) Merge(other RollupStat) {
+	if other.Count == 0 {
+		return
+	}
+	if s.Count == 0 || other.Min < s.Min {
+		s.Min = other.Min
+	}
+	if s.Count == 0 || other.Max > s.Max {
+		s.Max = other.Max
+	}
+	s.Sum += other.Sum
+	s.Count += other.Count
+	s.Avg = s.Sum / float64(s.Count)
+}
+
+// Rollup holds the aggregates of a device's readings in one time bucket.
+// Acceleration and gyroscope are aggregated by magnitude.
+type Rollup struct {
+	DeviceID      string                `json:"device_id"`
+	Resolution    RollupResolution      `json:"resolution"`
+	BucketStart   time.Time             `json:"bucket_start"`
+	Count         int                   `json:"count"`
+	FlameCount    int                   `json:"flame_count"`
+	GasQuality    map[string]int        `json:"gas_quality,omitempty"` // readings per gas quality level
+	Metrics       map[string]RollupStat `json:"metrics"`
+	LastReadingAt time.Time             `json:"last_reading_at"`
+}
+
+// NewRollup creates an empty rollup for a device bucket
+func NewRollup(deviceID string, resolution RollupResolution, bucketStart time.Time) *Rollup {
+	return &Rollup{
+		DeviceID:    deviceID,
+		Resolution:  resolution,
+		BucketStart: bucketStart,
+		GasQuality:  make(map[string]int),
+		Metrics:     make(map[string]RollupStat),
+	}
+}
+
+// Add includes a reading in the rollup. Values the reading doesn't carry (see SensorData.Has) are
+// skipped, and optional MPU values that are zero are treated as missing.
+func (r *Rollup) Add(data *SensorData) {
+	r.Count++
+	if data.FlameDetected {
+		r.FlameCount++
+	}
+	if data.GasQuality != "" {
+		r.GasQuality[data.GasQuality]++
+	}
+	if data.Timestamp.After(r.LastReadingAt) {
+		r.LastReadingAt = data.Timestamp
+	}
+
+	if data.Has(RollupTemperatureDHT) {
+		r.addValue(RollupTemperatureDHT, data.TemperatureDHT)
+	}
+	if data.Has(RollupHumidity) {
+		r.addValue(RollupHumidity, data.Humidity)
+	}
+	if data.Has(RollupTemperatureMPU) {
+		r.addValue(RollupTemperatureMPU, data.TemperatureMPU)
+	}
+	if acc := data.Acceleration; data.Has(RollupAcceleration) && (acc.X != 0 || acc.Y != 0 || acc.Z != 0) {
+		r.addValue(RollupAcceleration, math.Sqrt(acc.X*acc.X+acc.Y*acc.Y+acc.Z*acc.Z))
+	}
+	if gyro := data.Gyroscope; data.Has(RollupGyroscope) && (gyro.X != 0 || gyro.Y != 0 || gyro.Z != 0) {
+		r.addValue(RollupGyroscope, math.Sqrt(gyro.X*gyro.X+gyro.Y*gyro.Y+gyro.Z*gyro.Z))
+	}
+}
+
+// addValue adds a value to a metric's aggregate
+func (r *Rollup) addValue(metric string, value float64) {
+	stat := r.Metrics[metric]
+	stat.Add(value)
+	r.Metrics[metric] = stat
+}
+
+// Merge combines another rollup of the same device and bucket into this one,
+// e.g. a stored bucket with late-arriving readings
+func (r *Rollup) Merge(other *Rollup) {
+	r.Count += other.Count
+	r.FlameCount += other.FlameCount
+	if other.LastReadingAt.After(r.LastReadingAt) {
+		r.LastReadingAt = other.LastReadingAt
+	}
+
+	if r.GasQuality == nil {
+		r.GasQuality = make(map[string]int)
+	}
+	for level, count := range other.GasQuality {
+		r.GasQuality[level] += count
+	}
+
+	if r.Metrics == nil {
+		r.Metrics = make(map[string]RollupStat)
+	}
+	for metric, otherStat := range other.Metrics {
+		stat := r.Metrics[metric]
+		stat.Merge(otherStat)
+		r.Metrics[metric] = stat
+	}
+}
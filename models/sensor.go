@@ -20,7 +20,11 @@ type GyroscopeData struct {
 
 // SensorData represents the data structure from ESP32 sensors
 type SensorData struct {
+	SchemaVersion  int              `json:"schema_version,omitempty"` // Payload version the device sent, see services.CurrentSensorSchemaVersion
 	DeviceID       string           `json:"device_id"`
+	Site           string           `json:"site,omitempty"`       // Site from the device topic or payload
+	MessageID      string           `json:"message_id,omitempty"` // Optional unique ID set by the device
+	Seq            uint64           `json:"seq,omitempty"`        // Optional per-device sequence number
 	TemperatureDHT float64          `json:"temperature_dht"`
 	Humidity       float64          `json:"humidity"`
 	GasQuality     string           `json:"gas_quality"` // "good", "moderate", "poor"
@@ -29,8 +33,40 @@ type SensorData struct {
 	FlameDetected  bool             `json:"flame_detected"`
 	Timestamp      time.Time        `json:"timestamp"`
 
-	// deprecated
+	// TimestampAssigned is set when the device sent no timestamp and the receive time was used.
+	// A resend of such a reading gets a different timestamp, so it is not part of its identity.
+	TimestampAssigned bool `json:"timestamp_assigned,omitempty"`
+
+	// InvalidFields lists the fields whose values were out of the sensor's range. They are
+	// cleared rather than dropping the reading, so flame and gas alerts still get through.
+	InvalidFields []string `json:"invalid_fields,omitempty"`
+
+	// deprecated, only sent by schema version 1 devices
 	TemperatureMPU float64 `json:"temperature_mpu"`
+
+	// Delivery settles the broker message this reading came from once it has been persisted.
+	// Nil for readings that don't need acknowledgement (e.g. immediate ack mode or replayed data).
+	Delivery DeliveryAck `json:"-"`
+}
+
+// Has reports whether the reading carries a value for a field: false for fields listed in
+// InvalidFields, and for the deprecated MPU temperature when it is zero (not sent)
+func (d *SensorData) Has(field string) bool {
+	for _, invalid := range d.InvalidFields {
+		if invalid == field {
+			return false
+		}
+	}
+	if field == "temperature_mpu" {
+		return d.TemperatureMPU != 0
+	}
+	return true
+}
+
+// DeliveryAck acknowledges or rejects the broker message a reading came from
+type DeliveryAck interface {
+	Ack()
+	Nack(requeue bool)
 }
 
 // AnomalyType represents different types of anomalies
@@ -49,6 +85,16 @@ const (
 	GyroscopeAbnormal       AnomalyType = "gyroscope_abnormal"
 )
 
+// AnomalySeverity represents how urgent an anomaly is
+type AnomalySeverity string
+
+const (
+	SeverityCritical AnomalySeverity = "critical"
+	SeverityHigh     AnomalySeverity = "high"
+	SeverityMedium   AnomalySeverity = "medium"
+	SeverityLow      AnomalySeverity = "low"
+)
+
 // Anomaly represents a detected anomaly
 type Anomaly struct {
 	Type        AnomalyType `json:"type"`
@@ -57,6 +103,24 @@ type Anomaly struct {
 	DeviceID    string      `json:"device_id"`
 	Timestamp   time.Time   `json:"timestamp"`
 	Description string      `json:"description"`
+
+	// Repeats of this alert suppressed by deduplication since the last notification
+	SuppressedCount int       `json:"suppressed_count,omitempty"`
+	LastNotifiedAt  time.Time `json:"last_notified_at,omitzero"`
+}
+
+// GetSeverity returns the severity level of the anomaly type
+func (a *Anomaly) GetSeverity() AnomalySeverity {
+	switch a.Type {
+	case FlameDetected, GasQualityPoor:
+		return SeverityCritical
+	case TemperatureTooHigh, GasQualityModerate, AccelerationAbnormal, GyroscopeAbnormal:
+		return SeverityHigh
+	case TemperatureTooLow, HumidityTooLow, TemperatureDifferential:
+		return SeverityMedium
+	default:
+		return SeverityLow
+	}
 }
 
 // GetAnomalyEmoji returns appropriate emoji for anomaly type
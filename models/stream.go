@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// StreamEventType identifies the kind of event pushed to live stream subscribers
+type StreamEventType string
+
+const (
+	StreamEventReading StreamEventType = "reading"
+	StreamEventAnomaly StreamEventType = "anomaly"
+	StreamEventHealth  StreamEventType = "health"
+	StreamEventFace    StreamEventType = "face"
+)
+
+// StreamEvent is a single event pushed to live stream subscribers
+type StreamEvent struct {
+	Type      StreamEventType `json:"type"`
+	DeviceID  string          `json:"device_id,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+	Data      interface{}     `json:"data"`
+}
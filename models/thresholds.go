@@ -0,0 +1,99 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// Thresholds holds the limits used for anomaly detection
+type Thresholds struct {
+	TemperatureMin  float64 `json:"temperature_min"`
+	TemperatureMax  float64 `json:"temperature_max"`
+	HumidityMin     float64 `json:"humidity_min"`
+	HumidityMax     float64 `json:"humidity_max"`
+	GyroscopeMax    float64 `json:"gyroscope_max"`    // rad/s magnitude
+	AccelerationMax float64 `json:"acceleration_max"` // m/s² magnitude
+}
+
+// Validate checks that the thresholds are consistent
+func (t Thresholds) Validate() error {
+	if t.TemperatureMin < -40 || t.TemperatureMax > 125 {
+		return fmt.Errorf("temperature thresholds must be between -40 and 125°C")
+	}
+	if t.TemperatureMin >= t.TemperatureMax {
+		return fmt.Errorf("temperature_min (%.1f) must be below temperature_max (%.1f)", t.TemperatureMin, t.TemperatureMax)
+	}
+	if t.HumidityMin < 0 || t.HumidityMax > 100 {
+		return fmt.Errorf("humidity thresholds must be between 0 and 100%%")
+	}
+	if t.HumidityMin >= t.HumidityMax {
+		return fmt.Errorf("humidity_min (%.1f) must be below humidity_max (%.1f)", t.HumidityMin, t.HumidityMax)
+	}
+	if t.GyroscopeMax <= 0 {
+		return fmt.Errorf("gyroscope_max must be positive")
+	}
+	if t.AccelerationMax <= 0 {
+		return fmt.Errorf("acceleration_max must be positive")
+	}
+	return nil
+}
+
+// ThresholdOverrides holds per-device threshold overrides. Nil fields inherit the global value.
+type ThresholdOverrides struct {
+	TemperatureMin  *float64 `json:"temperature_min,omitempty"`
+	TemperatureMax  *float64 `json:"temperature_max,omitempty"`
+	HumidityMin     *float64 `json:"humidity_min,omitempty"`
+	HumidityMax     *float64 `json:"humidity_max,omitempty"`
+	GyroscopeMax    *float64 `json:"gyroscope_max,omitempty"`
+	AccelerationMax *float64 `json:"acceleration_max,omitempty"`
+}
+
+// IsEmpty reports whether no threshold is overridden
+func (o ThresholdOverrides) IsEmpty() bool {
+	return o.TemperatureMin == nil && o.TemperatureMax == nil &&
+		o.HumidityMin == nil && o.HumidityMax == nil &&
+		o.GyroscopeMax == nil && o.AccelerationMax == nil
+}
+
+// Apply returns the base thresholds with the overrides applied
+func (o ThresholdOverrides) Apply(base Thresholds) Thresholds {
+	if o.TemperatureMin != nil {
+		base.TemperatureMin = *o.TemperatureMin
+	}
+	if o.TemperatureMax != nil {
+		base.TemperatureMax = *o.TemperatureMax
+	}
+	if o.HumidityMin != nil {
+		base.HumidityMin = *o.HumidityMin
+	}
+	if o.HumidityMax != nil {
+		base.HumidityMax = *o.HumidityMax
+	}
+	if o.GyroscopeMax != nil {
+		base.GyroscopeMax = *o.GyroscopeMax
+	}
+	if o.AccelerationMax != nil {
+		base.AccelerationMax = *o.AccelerationMax
+	}
+	return base
+}
+
+// ThresholdAuditAction describes a change made to the thresholds
+type ThresholdAuditAction string
+
+const (
+	ThresholdAuditUpdateGlobal ThresholdAuditAction = "update_global"
+	ThresholdAuditSetDevice    ThresholdAuditAction = "set_device"
+	ThresholdAuditDeleteDevice ThresholdAuditAction = "delete_device"
+)
+
+// ThresholdAuditEntry records who changed the thresholds, what changed and when
+type ThresholdAuditEntry struct {
+	Timestamp  time.Time            `json:"timestamp"`
+	Actor      string               `json:"actor"`
+	RemoteAddr string               `json:"remote_addr,omitempty"`
+	Action     ThresholdAuditAction `json:"action"`
+	DeviceID   string               `json:"device_id,omitempty"`
+	Before     interface{}          `json:"before,omitempty"`
+	After      interface{}          `json:"after,omitempty"`
+}
@@ -0,0 +1,81 @@
+package services
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"kaelo/config"
+)
+
+// AdminHandlerFunc handles an authenticated admin request. The actor is the name of the token used.
+type AdminHandlerFunc func(w http.ResponseWriter, r *http.Request, actor string)
+
+// adminToken is a named bearer token
+type adminToken struct {
+	name string
+	hash [sha256.Size]byte
+}
+
+// AdminAuth authenticates admin API requests using named bearer tokens
+type AdminAuth struct {
+	tokens []adminToken
+}
+
+// NewAdminAuth parses ADMIN_API_TOKENS ("name:token,name:token")
+func NewAdminAuth(cfg *config.Config) (*AdminAuth, error) {
+	auth := &AdminAuth{}
+
+	for i, pair := range splitList(cfg.AdminAPITokens) {
+		name, token, ok := strings.Cut(pair, ":")
+		name, token = strings.TrimSpace(name), strings.TrimSpace(token)
+		if !ok || name == "" || token == "" {
+			// Don't echo the entry, it may contain the token
+			return nil, fmt.Errorf("invalid ADMIN_API_TOKENS entry %d (expected name:token)", i+1)
+		}
+		if len(token) < 16 {
+			return nil, fmt.Errorf("admin token for %s must be at least 16 characters", name)
+		}
+
+		auth.tokens = append(auth.tokens, adminToken{name: name, hash: sha256.Sum256([]byte(token))})
+	}
+
+	return auth, nil
+}
+
+// Enabled reports whether any admin tokens are configured
+func (a *AdminAuth) Enabled() bool {
+	return len(a.tokens) > 0
+}
+
+// Require wraps a handler so it only runs for requests with a valid bearer token
+func (a *AdminAuth) Require(handler AdminHandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := a.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kaelo"`)
+			writeAPIError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+			return
+		}
+		handler(w, r, actor)
+	})
+}
+
+// authenticate returns the name of the token presented by the request
+func (a *AdminAuth) authenticate(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", false
+	}
+
+	// Compare hashes so the comparison time doesn't depend on token length
+	hash := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	for _, candidate := range a.tokens {
+		if subtle.ConstantTimeCompare(hash[:], candidate.hash[:]) == 1 {
+			return candidate.name, true
+		}
+	}
+	return "", false
+}
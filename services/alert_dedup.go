@@ -0,0 +1,131 @@
+package services
+
+import (
+	"sync"
+	"time"
+
+	"kaelo/config"
+	"kaelo/models"
+
+	"go.uber.org/zap"
+)
+
+// AlertFingerprint identifies alerts that are considered repeats of each other
+type AlertFingerprint struct {
+	DeviceID string
+	Type     models.AnomalyType
+	Severity models.AnomalySeverity
+}
+
+// alertDedupEntry tracks notification state for a single fingerprint
+type alertDedupEntry struct {
+	lastNotified time.Time
+	lastSeen     time.Time
+	suppressed   int
+}
+
+// AlertDeduplicator suppresses repeated alerts and aggregates them for all notifiers
+type AlertDeduplicator struct {
+	windows       map[models.AnomalySeverity]time.Duration
+	defaultWindow time.Duration
+	entries       map[AlertFingerprint]*alertDedupEntry
+	lastPrune     time.Time
+	logger        *zap.Logger
+	mu            sync.Mutex
+}
+
+// staleAlertEntryAge is how long an idle fingerprint is kept before being pruned
+const staleAlertEntryAge = time.Hour
+
+// NewAlertDeduplicator creates a new alert deduplicator using windows from config
+func NewAlertDeduplicator(cfg *config.Config, logger *zap.Logger) *AlertDeduplicator {
+	defaultWindow := time.Duration(cfg.AlertDedupWindow) * time.Second
+
+	return &AlertDeduplicator{
+		windows: map[models.AnomalySeverity]time.Duration{
+			models.SeverityCritical: time.Duration(cfg.AlertDedupCriticalWindow) * time.Second,
+		},
+		defaultWindow: defaultWindow,
+		entries:       make(map[AlertFingerprint]*alertDedupEntry),
+		lastPrune:     time.Now(),
+		logger:        logger,
+	}
+}
+
+// Fingerprint returns the deduplication key for an anomaly
+func (d *AlertDeduplicator) Fingerprint(anomaly *models.Anomaly) AlertFingerprint {
+	return AlertFingerprint{
+		DeviceID: anomaly.DeviceID,
+		Type:     anomaly.Type,
+		Severity: anomaly.GetSeverity(),
+	}
+}
+
+// Filter returns the anomalies that should be notified now. Repeats inside the
+// dedup window are counted and reported on the next anomaly that goes out.
+func (d *AlertDeduplicator) Filter(anomalies []*models.Anomaly) []*models.Anomaly {
+	return d.FilterAt(anomalies, time.Now())
+}
+
+// FilterAt is Filter with an explicit current time, used to replay historical readings
+func (d *AlertDeduplicator) FilterAt(anomalies []*models.Anomaly, now time.Time) []*models.Anomaly {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.pruneLocked(now)
+
+	var notify []*models.Anomaly
+	for _, anomaly := range anomalies {
+		fingerprint := d.Fingerprint(anomaly)
+
+		entry, exists := d.entries[fingerprint]
+		if !exists {
+			entry = &alertDedupEntry{}
+			d.entries[fingerprint] = entry
+		}
+		entry.lastSeen = now
+
+		if exists && now.Sub(entry.lastNotified) < d.windowFor(fingerprint.Severity) {
+			entry.suppressed++
+			d.logger.Debug("Suppressing duplicate alert",
+				zap.String("device_id", fingerprint.DeviceID),
+				zap.String("type", string(fingerprint.Type)),
+				zap.String("severity", string(fingerprint.Severity)),
+				zap.Int("suppressed_count", entry.suppressed))
+			continue
+		}
+
+		if exists {
+			anomaly.SuppressedCount = entry.suppressed
+			anomaly.LastNotifiedAt = entry.lastNotified
+		}
+
+		entry.lastNotified = now
+		entry.suppressed = 0
+		notify = append(notify, anomaly)
+	}
+
+	return notify
+}
+
+// windowFor returns the dedup window for a severity
+func (d *AlertDeduplicator) windowFor(severity models.AnomalySeverity) time.Duration {
+	if window, ok := d.windows[severity]; ok {
+		return window
+	}
+	return d.defaultWindow
+}
+
+// pruneLocked removes fingerprints that have not been seen for a long time
+func (d *AlertDeduplicator) pruneLocked(now time.Time) {
+	if now.Sub(d.lastPrune) < time.Minute {
+		return
+	}
+	d.lastPrune = now
+
+	for fingerprint, entry := range d.entries {
+		if now.Sub(entry.lastSeen) > staleAlertEntryAge {
+			delete(d.entries, fingerprint)
+		}
+	}
+}
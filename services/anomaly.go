@@ -2,47 +2,50 @@ package services
 
 import (
 	"fmt"
-	"kaelo/config"
 	"kaelo/models"
 	"math"
 	"time"
 )
 
 type AnomalyDetectionService struct {
-	config *config.Config
+	thresholds *ThresholdManager
 }
 
-func NewAnomalyDetectionService(cfg *config.Config) *AnomalyDetectionService {
+func NewAnomalyDetectionService(thresholds *ThresholdManager) *AnomalyDetectionService {
 	return &AnomalyDetectionService{
-		config: cfg,
+		thresholds: thresholds,
 	}
 }
 
-// DetectAnomalies analyzes sensor data and returns any detected anomalies
+// DetectAnomalies analyzes sensor data and returns any detected anomalies. Values cleared as
+// out of range are skipped, flame and gas are always checked.
 func (s *AnomalyDetectionService) DetectAnomalies(data *models.SensorData) []*models.Anomaly {
 	var anomalies []*models.Anomaly
+	thresholds := s.thresholds.For(data.DeviceID)
 
 	// Temperature anomalies for DHT sensor
-	if data.TemperatureDHT > s.config.TemperatureMax {
-		anomalies = append(anomalies, &models.Anomaly{
-			Type:        models.TemperatureTooHigh,
-			Value:       data.TemperatureDHT,
-			Threshold:   s.config.TemperatureMax,
-			DeviceID:    data.DeviceID,
-			Description: fmt.Sprintf("DHT Temperature %.1f°C exceeds threshold %.1f°C", data.TemperatureDHT, s.config.TemperatureMax),
-			Timestamp:   time.Now(),
-		})
-	}
+	if data.Has("temperature_dht") {
+		if data.TemperatureDHT > thresholds.TemperatureMax {
+			anomalies = append(anomalies, &models.Anomaly{
+				Type:        models.TemperatureTooHigh,
+				Value:       data.TemperatureDHT,
+				Threshold:   thresholds.TemperatureMax,
+				DeviceID:    data.DeviceID,
+				Description: fmt.Sprintf("DHT Temperature %.1f°C exceeds threshold %.1f°C", data.TemperatureDHT, thresholds.TemperatureMax),
+				Timestamp:   time.Now(),
+			})
+		}
 
-	if data.TemperatureDHT < s.config.TemperatureMin {
-		anomalies = append(anomalies, &models.Anomaly{
-			Type:        models.TemperatureTooLow,
-			Value:       data.TemperatureDHT,
-			Threshold:   s.config.TemperatureMin,
-			DeviceID:    data.DeviceID,
-			Description: fmt.Sprintf("DHT Temperature %.1f°C below threshold %.1f°C", data.TemperatureDHT, s.config.TemperatureMin),
-			Timestamp:   time.Now(),
-		})
+		if data.TemperatureDHT < thresholds.TemperatureMin {
+			anomalies = append(anomalies, &models.Anomaly{
+				Type:        models.TemperatureTooLow,
+				Value:       data.TemperatureDHT,
+				Threshold:   thresholds.TemperatureMin,
+				DeviceID:    data.DeviceID,
+				Description: fmt.Sprintf("DHT Temperature %.1f°C below threshold %.1f°C", data.TemperatureDHT, thresholds.TemperatureMin),
+				Timestamp:   time.Now(),
+			})
+		}
 	}
 
 	// TODO: remove this because TemperatureMPU is deprecated
@@ -63,26 +66,28 @@ func (s *AnomalyDetectionService) DetectAnomalies(data *models.SensorData) []*mo
 	// }
 
 	// Check humidity anomalies
-	if data.Humidity > s.config.HumidityMax {
-		anomalies = append(anomalies, &models.Anomaly{
-			Type:        models.HumidityTooHigh,
-			Value:       data.Humidity,
-			Threshold:   s.config.HumidityMax,
-			DeviceID:    data.DeviceID,
-			Timestamp:   data.Timestamp,
-			Description: fmt.Sprintf("Humidity %.1f%% exceeds maximum threshold of %.1f%%", data.Humidity, s.config.HumidityMax),
-		})
-	}
+	if data.Has("humidity") {
+		if data.Humidity > thresholds.HumidityMax {
+			anomalies = append(anomalies, &models.Anomaly{
+				Type:        models.HumidityTooHigh,
+				Value:       data.Humidity,
+				Threshold:   thresholds.HumidityMax,
+				DeviceID:    data.DeviceID,
+				Timestamp:   data.Timestamp,
+				Description: fmt.Sprintf("Humidity %.1f%% exceeds maximum threshold of %.1f%%", data.Humidity, thresholds.HumidityMax),
+			})
+		}
 
-	if data.Humidity < s.config.HumidityMin {
-		anomalies = append(anomalies, &models.Anomaly{
-			Type:        models.HumidityTooLow,
-			Value:       data.Humidity,
-			Threshold:   s.config.HumidityMin,
-			DeviceID:    data.DeviceID,
-			Timestamp:   data.Timestamp,
-			Description: fmt.Sprintf("Humidity %.1f%% is below minimum threshold of %.1f%%", data.Humidity, s.config.HumidityMin),
-		})
+		if data.Humidity < thresholds.HumidityMin {
+			anomalies = append(anomalies, &models.Anomaly{
+				Type:        models.HumidityTooLow,
+				Value:       data.Humidity,
+				Threshold:   thresholds.HumidityMin,
+				DeviceID:    data.DeviceID,
+				Timestamp:   data.Timestamp,
+				Description: fmt.Sprintf("Humidity %.1f%% is below minimum threshold of %.1f%%", data.Humidity, thresholds.HumidityMin),
+			})
+		}
 	}
 
 	// Gas quality anomalies
@@ -114,29 +119,33 @@ func (s *AnomalyDetectionService) DetectAnomalies(data *models.SensorData) []*mo
 	}
 
 	// Gyroscope anomaly detection
-	gyroMagnitude := math.Sqrt(data.Gyroscope.X*data.Gyroscope.X + data.Gyroscope.Y*data.Gyroscope.Y + data.Gyroscope.Z*data.Gyroscope.Z)
-	if gyroMagnitude > 5.0 { // Threshold for abnormal angular velocity
-		anomalies = append(anomalies, &models.Anomaly{
-			Type:        models.GyroscopeAbnormal,
-			Value:       gyroMagnitude,
-			Threshold:   5.0,
-			DeviceID:    data.DeviceID,
-			Description: fmt.Sprintf("Abnormal gyroscope reading: %.2f rad/s", gyroMagnitude),
-			Timestamp:   time.Now(),
-		})
+	if data.Has("gyroscope") {
+		gyroMagnitude := math.Sqrt(data.Gyroscope.X*data.Gyroscope.X + data.Gyroscope.Y*data.Gyroscope.Y + data.Gyroscope.Z*data.Gyroscope.Z)
+		if gyroMagnitude > thresholds.GyroscopeMax { // Threshold for abnormal angular velocity
+			anomalies = append(anomalies, &models.Anomaly{
+				Type:        models.GyroscopeAbnormal,
+				Value:       gyroMagnitude,
+				Threshold:   thresholds.GyroscopeMax,
+				DeviceID:    data.DeviceID,
+				Description: fmt.Sprintf("Abnormal gyroscope reading: %.2f rad/s", gyroMagnitude),
+				Timestamp:   time.Now(),
+			})
+		}
 	}
 
 	// Acceleration anomaly detection
-	accMagnitude := math.Sqrt(data.Acceleration.X*data.Acceleration.X + data.Acceleration.Y*data.Acceleration.Y + data.Acceleration.Z*data.Acceleration.Z)
-	if accMagnitude > 15.0 { // Threshold for abnormal acceleration
-		anomalies = append(anomalies, &models.Anomaly{
-			Type:        models.AccelerationAbnormal,
-			Value:       accMagnitude,
-			Threshold:   15.0,
-			DeviceID:    data.DeviceID,
-			Description: fmt.Sprintf("Abnormal acceleration detected: %.2f m/s²", accMagnitude),
-			Timestamp:   time.Now(),
-		})
+	if data.Has("acceleration") {
+		accMagnitude := math.Sqrt(data.Acceleration.X*data.Acceleration.X + data.Acceleration.Y*data.Acceleration.Y + data.Acceleration.Z*data.Acceleration.Z)
+		if accMagnitude > thresholds.AccelerationMax { // Threshold for abnormal acceleration
+			anomalies = append(anomalies, &models.Anomaly{
+				Type:        models.AccelerationAbnormal,
+				Value:       accMagnitude,
+				Threshold:   thresholds.AccelerationMax,
+				DeviceID:    data.DeviceID,
+				Description: fmt.Sprintf("Abnormal acceleration detected: %.2f m/s²", accMagnitude),
+				Timestamp:   time.Now(),
+			})
+		}
 	}
 
 	return anomalies
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"context"
+
+	"kaelo/models"
+
+	"go.uber.org/zap"
+)
+
+// AnomalyRecorder writes detected anomalies to the store in the background, so a slow store
+// can't delay alerting
+type AnomalyRecorder struct {
+	store  SensorStore
+	queue  chan []*models.Anomaly
+	logger *zap.Logger
+}
+
+// NewAnomalyRecorder creates a recorder that queues up to size batches of anomalies
+func NewAnomalyRecorder(store SensorStore, size int, logger *zap.Logger) *AnomalyRecorder {
+	return &AnomalyRecorder{
+		store:  store,
+		queue:  make(chan []*models.Anomaly, size),
+		logger: logger,
+	}
+}
+
+// Record queues anomalies as detected and reports false when the queue is full. The recorder
+// keeps copies: alert deduplication sets notification fields on the originals, which must not
+// be stored or be changed while they are encoded.
+func (r *AnomalyRecorder) Record(anomalies []*models.Anomaly) bool {
+	copies := make([]*models.Anomaly, len(anomalies))
+	for i, anomaly := range anomalies {
+		record := *anomaly
+		copies[i] = &record
+	}
+
+	select {
+	case r.queue <- copies:
+		return true
+	default:
+		return false
+	}
+}
+
+// QueueLength returns the number of queued batches
+func (r *AnomalyRecorder) QueueLength() int {
+	return len(r.queue)
+}
+
+// QueueCapacity returns the number of batches the queue holds
+func (r *AnomalyRecorder) QueueCapacity() int {
+	return cap(r.queue)
+}
+
+// Start writes queued anomalies until ctx is done
+func (r *AnomalyRecorder) Start(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case anomalies := <-r.queue:
+			if err := r.store.WriteAnomalies(ctx, anomalies); err != nil {
+				r.logger.Error("Failed to record anomalies",
+					zap.String("device_id", anomalies[0].DeviceID),
+					zap.Int("anomaly_count", len(anomalies)),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+}
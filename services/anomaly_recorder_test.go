@@ -0,0 +1,59 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"kaelo/config"
+	"kaelo/models"
+
+	"go.uber.org/zap"
+)
+
+// Run with -race: deduplication updates the detected anomalies while the recorder encodes them
+func TestAnomalyRecorderKeepsDetectionsApartFromDeduplication(t *testing.T) {
+	store, err := NewLocalStore(&config.Config{LocalStoreDir: t.TempDir()}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+	recorder := NewAnomalyRecorder(store, 100, zap.NewNop())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go recorder.Start(ctx)
+
+	dedup := NewAlertDeduplicator(&config.Config{AlertDedupWindow: 3600, AlertDedupCriticalWindow: 3600}, zap.NewNop())
+	start := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	const detections = 50
+	for i := 0; i < detections; i++ {
+		anomalies := []*models.Anomaly{{
+			Type:      models.FlameDetected,
+			DeviceID:  "ESP32-001",
+			Timestamp: start.Add(time.Duration(i) * time.Second),
+		}}
+		if !recorder.Record(anomalies) {
+			t.Fatal("recorder queue full")
+		}
+		// The first detection is notified, repeats are suppressed and counted on the next one
+		dedup.FilterAt(anomalies, start.Add(time.Duration(i)*time.Hour))
+	}
+
+	var page Page[*models.Anomaly]
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		page, err = store.QueryAnomalies(ctx, AnomalyQuery{TimeRangeQuery: TimeRangeQuery{Limit: 1000}})
+		if err != nil {
+			t.Fatalf("QueryAnomalies: %v", err)
+		}
+		if len(page.Items) == detections {
+			break
+		}
+	}
+	if len(page.Items) != detections {
+		t.Fatalf("recorded %d anomalies, want %d", len(page.Items), detections)
+	}
+	for _, anomaly := range page.Items {
+		if anomaly.SuppressedCount != 0 || !anomaly.LastNotifiedAt.IsZero() {
+			t.Errorf("recorded anomaly has notification state %d, %s", anomaly.SuppressedCount, anomaly.LastNotifiedAt)
+		}
+	}
+}
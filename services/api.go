@@ -0,0 +1,303 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"kaelo/models"
+
+	"go.uber.org/zap"
+)
+
+// defaultQueryWindow is the time range used when a list request has no "from" parameter
+const defaultQueryWindow = 24 * time.Hour
+
+// APIHandler serves the read-only REST API for devices, readings and events
+type APIHandler struct {
+	store       SensorStore
+	healthCheck *HealthCheckService
+	logger      *zap.Logger
+}
+
+// DeviceSummary describes a device and its current health status
+type DeviceSummary struct {
+	models.DeviceHealth
+	LatestReading *models.SensorData `json:"latest_reading,omitempty"`
+}
+
+// NewAPIHandler creates a new REST API handler
+func NewAPIHandler(store SensorStore, healthCheck *HealthCheckService, logger *zap.Logger) *APIHandler {
+	return &APIHandler{
+		store:       store,
+		healthCheck: healthCheck,
+		logger:      logger,
+	}
+}
+
+// Register registers the API routes on the HTTP server
+func (a *APIHandler) Register(server *HTTPServer) {
+	server.Handle("GET /api/v1/devices", http.HandlerFunc(a.handleListDevices))
+	server.Handle("GET /api/v1/devices/{id}", http.HandlerFunc(a.handleGetDevice))
+	server.Handle("GET /api/v1/devices/{id}/latest", http.HandlerFunc(a.handleLatestReading))
+	server.Handle("GET /api/v1/devices/{id}/readings", http.HandlerFunc(a.handleDeviceReadings))
+	server.Handle("GET /api/v1/readings", http.HandlerFunc(a.handleReadings))
+	server.Handle("GET /api/v1/anomalies", http.HandlerFunc(a.handleAnomalies))
+	server.Handle("GET /api/v1/face-events", http.HandlerFunc(a.handleFaceEvents))
+	if _, ok := a.store.(HealthEventStore); ok {
+		server.Handle("GET /api/v1/devices/{id}/health-events", http.HandlerFunc(a.handleHealthEvents))
+	}
+}
+
+// handleListDevices lists known devices with their health status.
+// Supports ?status= filtering and ?limit=&cursor= pagination by device ID.
+func (a *APIHandler) handleListDevices(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	status := models.DeviceHealthStatus(params.Get("status"))
+	cursor := params.Get("cursor")
+
+	limit, err := parseLimit(params.Get("limit"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	page := Page[models.DeviceHealth]{Items: []models.DeviceHealth{}}
+	for _, device := range a.healthCheck.ListDevices() {
+		if status != "" && device.Status != status {
+			continue
+		}
+		if cursor != "" && device.DeviceID <= cursor {
+			continue
+		}
+		if len(page.Items) == limit {
+			page.NextCursor = page.Items[len(page.Items)-1].DeviceID
+			break
+		}
+		page.Items = append(page.Items, device)
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+// handleGetDevice returns a device's health status and latest reading
+func (a *APIHandler) handleGetDevice(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+
+	device, exists := a.healthCheck.GetDeviceHealth(deviceID)
+	summary := DeviceSummary{DeviceHealth: models.DeviceHealth{DeviceID: deviceID}}
+	if exists {
+		summary.DeviceHealth = device
+	}
+
+	latest, err := a.store.LatestReading(r.Context(), deviceID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		a.writeStoreError(w, err)
+		return
+	}
+	summary.LatestReading = latest
+
+	if !exists && latest == nil {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("device %s not found", deviceID))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// handleLatestReading returns the latest reading for a device
+func (a *APIHandler) handleLatestReading(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+
+	latest, err := a.store.LatestReading(r.Context(), deviceID)
+	if errors.Is(err, ErrNotFound) {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("no readings found for device %s", deviceID))
+		return
+	}
+	if err != nil {
+		a.writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, latest)
+}
+
+// handleDeviceReadings returns readings for a single device in a time range
+func (a *APIHandler) handleDeviceReadings(w http.ResponseWriter, r *http.Request) {
+	query, err := parseTimeRangeQuery(r, SortAscending)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	query.DeviceID = r.PathValue("id")
+
+	a.writeReadings(w, r, query)
+}
+
+// handleReadings returns readings for all devices (or ?device=) in a time range
+func (a *APIHandler) handleReadings(w http.ResponseWriter, r *http.Request) {
+	query, err := parseTimeRangeQuery(r, SortAscending)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	a.writeReadings(w, r, query)
+}
+
+// writeReadings queries readings and writes the page as JSON
+func (a *APIHandler) writeReadings(w http.ResponseWriter, r *http.Request, query TimeRangeQuery) {
+	page, err := a.store.QueryReadings(r.Context(), query)
+	if err != nil {
+		a.writeStoreError(w, err)
+		return
+	}
+	if page.Items == nil {
+		page.Items = []*models.SensorData{}
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+// handleAnomalies returns recent anomalies, newest first by default.
+// Supports ?device=, ?type= and ?severity= filters.
+func (a *APIHandler) handleAnomalies(w http.ResponseWriter, r *http.Request) {
+	query, err := parseTimeRangeQuery(r, SortDescending)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	params := r.URL.Query()
+	page, err := a.store.QueryAnomalies(r.Context(), AnomalyQuery{
+		TimeRangeQuery: query,
+		Type:           models.AnomalyType(params.Get("type")),
+		Severity:       models.AnomalySeverity(params.Get("severity")),
+	})
+	if err != nil {
+		a.writeStoreError(w, err)
+		return
+	}
+	if page.Items == nil {
+		page.Items = []*models.Anomaly{}
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+// handleFaceEvents returns recent unknown person events, newest first by default
+func (a *APIHandler) handleFaceEvents(w http.ResponseWriter, r *http.Request) {
+	query, err := parseTimeRangeQuery(r, SortDescending)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	page, err := a.store.QueryFaceEvents(r.Context(), query)
+	if err != nil {
+		a.writeStoreError(w, err)
+		return
+	}
+	if page.Items == nil {
+		page.Items = []*models.FaceEvent{}
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+// handleHealthEvents returns recorded health checks of a device, newest first by default
+func (a *APIHandler) handleHealthEvents(w http.ResponseWriter, r *http.Request) {
+	query, err := parseTimeRangeQuery(r, SortDescending)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	query.DeviceID = r.PathValue("id")
+
+	page, err := a.store.(HealthEventStore).QueryHealthEvents(r.Context(), query)
+	if err != nil {
+		a.writeStoreError(w, err)
+		return
+	}
+	if page.Items == nil {
+		page.Items = []*models.HealthCheckData{}
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+// writeStoreError logs a storage error and writes a generic error response
+func (a *APIHandler) writeStoreError(w http.ResponseWriter, err error) {
+	a.logger.Error("API storage query failed", zap.Error(err))
+	writeAPIError(w, http.StatusInternalServerError, fmt.Errorf("storage query failed"))
+}
+
+// parseTimeRangeQuery builds a query from ?device=&from=&to=&limit=&cursor=&order= parameters
+func parseTimeRangeQuery(r *http.Request, defaultOrder SortOrder) (TimeRangeQuery, error) {
+	params := r.URL.Query()
+
+	query := TimeRangeQuery{
+		DeviceID: params.Get("device"),
+		Cursor:   params.Get("cursor"),
+		Order:    defaultOrder,
+	}
+
+	var err error
+	if query.Limit, err = parseLimit(params.Get("limit")); err != nil {
+		return query, err
+	}
+
+	if query.From, err = parseTimeParam(params.Get("from")); err != nil {
+		return query, fmt.Errorf("invalid from: %w", err)
+	}
+	if query.To, err = parseTimeParam(params.Get("to")); err != nil {
+		return query, fmt.Errorf("invalid to: %w", err)
+	}
+	if query.From.IsZero() {
+		query.From = time.Now().Add(-defaultQueryWindow)
+	}
+	if !query.To.IsZero() && query.To.Before(query.From) {
+		return query, fmt.Errorf("to must not be before from")
+	}
+
+	switch order := SortOrder(params.Get("order")); order {
+	case "":
+	case SortAscending, SortDescending:
+		query.Order = order
+	default:
+		return query, fmt.Errorf("invalid order %q (expected asc or desc)", order)
+	}
+
+	return query, nil
+}
+
+// parseLimit parses the ?limit= parameter
+func parseLimit(value string) (int, error) {
+	if value == "" {
+		return defaultQueryLimit, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 || limit > maxQueryLimit {
+		return 0, fmt.Errorf("invalid limit %q (expected 1-%d)", value, maxQueryLimit)
+	}
+	return limit, nil
+}
+
+// parseTimeParam parses an RFC3339 timestamp or unix seconds
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// writeAPIError writes a JSON error response
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -6,34 +6,107 @@ import (
 	"time"
 
 	"kaelo/config"
+	"kaelo/metrics"
 	"kaelo/models"
 
 	"go.uber.org/zap"
 )
 
-// BatchWriterService handles batching sensor data and writing to Firebase
+// sinkQueueSize is how many flushed batches may wait for a sink before new ones are dropped
+const sinkQueueSize = 16
+
+// sinkWorker writes the batches queued for a sink in the background
+type sinkWorker struct {
+	sink  ReadingSink
+	queue chan []*models.SensorData
+}
+
+// BatchWriterService handles batching sensor data and writing it to the sensor store
 type BatchWriterService struct {
-	config          *config.Config
-	firebaseService *FirebaseService
-	logger          *zap.Logger
-	buffer          []*models.SensorData
-	bufferMutex     sync.Mutex
-	flushTimer      *time.Timer
-	maxBatchSize    int
-	batchTimeout    time.Duration
-	shutdownChan    chan bool
+	config       *config.Config
+	store        SensorStore
+	sinks        []*sinkWorker
+	sinksDone    sync.WaitGroup
+	spill        *SpillBuffer
+	logger       *zap.Logger
+	buffer       []*models.SensorData
+	bufferMutex  sync.Mutex
+	flushTimer   *time.Timer
+	maxBatchSize int
+	batchTimeout time.Duration
+	shutdownChan chan bool
 }
 
 // NewBatchWriterService creates a new batch writer service
-func NewBatchWriterService(cfg *config.Config, firebaseService *FirebaseService, logger *zap.Logger) *BatchWriterService {
+// Batches that still fail after retries are written to the spill buffer.
+func NewBatchWriterService(cfg *config.Config, store SensorStore, spill *SpillBuffer, logger *zap.Logger) *BatchWriterService {
 	return &BatchWriterService{
-		config:          cfg,
-		firebaseService: firebaseService,
-		logger:          logger,
-		buffer:          make([]*models.SensorData, 0, cfg.FirebaseBatchSize),
-		maxBatchSize:    cfg.FirebaseBatchSize,
-		batchTimeout:    time.Duration(cfg.FirebaseBatchTimeout) * time.Second,
-		shutdownChan:    make(chan bool, 1),
+		config:       cfg,
+		store:        store,
+		spill:        spill,
+		logger:       logger,
+		buffer:       make([]*models.SensorData, 0, cfg.FirebaseBatchSize),
+		maxBatchSize: cfg.FirebaseBatchSize,
+		batchTimeout: time.Duration(cfg.FirebaseBatchTimeout) * time.Second,
+		shutdownChan: make(chan bool, 1),
+	}
+}
+
+// AddSink registers a sink that receives every flushed batch. Must be called before Start.
+func (bw *BatchWriterService) AddSink(sink ReadingSink) {
+	bw.sinks = append(bw.sinks, &sinkWorker{sink: sink, queue: make(chan []*models.SensorData, sinkQueueSize)})
+}
+
+// startSinks runs a writer per sink. Sink writes outlive ctx so batches queued before shutdown
+// can still be written by stopSinks.
+func (bw *BatchWriterService) startSinks(ctx context.Context) context.CancelFunc {
+	sinkCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	for _, worker := range bw.sinks {
+		bw.sinksDone.Add(1)
+		go func() {
+			defer bw.sinksDone.Done()
+			for batch := range worker.queue {
+				bw.writeSink(sinkCtx, worker.sink, batch)
+			}
+		}()
+	}
+	return cancel
+}
+
+// stopSinks waits up to timeout for the sinks to write their queued batches, then abandons
+// the rest
+func (bw *BatchWriterService) stopSinks(cancel context.CancelFunc, timeout time.Duration) {
+	for _, worker := range bw.sinks {
+		close(worker.queue)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		bw.sinksDone.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		bw.logger.Warn("Timed out writing queued batches to sinks")
+	}
+	cancel()
+	<-done
+}
+
+// queueForSinks hands a flushed batch to every sink without waiting for it. A sink that has
+// fallen sinkQueueSize batches behind misses the batch.
+func (bw *BatchWriterService) queueForSinks(batch []*models.SensorData) {
+	for _, worker := range bw.sinks {
+		select {
+		case worker.queue <- batch:
+		default:
+			metrics.SinkDroppedReadings.WithLabelValues(worker.sink.Name()).Add(float64(len(batch)))
+			bw.logger.Warn("Sink queue full, dropping batch for this sink",
+				zap.String("sink", worker.sink.Name()),
+				zap.Int("batch_size", len(batch)))
+		}
 	}
 }
 
@@ -46,11 +119,19 @@ func (bw *BatchWriterService) Start(ctx context.Context, sensorDataChan <-chan *
 	// Initialize flush timer
 	bw.flushTimer = time.NewTimer(bw.batchTimeout)
 
+	cancelSinks := bw.startSinks(ctx)
+
 	for {
 		select {
 		case <-ctx.Done():
 			bw.logger.Info("Batch writer received shutdown signal")
-			bw.flushBuffer(ctx)
+
+			// ctx is already cancelled, give the final flush a short deadline of its own
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 3*time.Second)
+			bw.flushBuffer(flushCtx)
+			cancel()
+			bw.stopSinks(cancelSinks, 3*time.Second)
+
 			bw.shutdownChan <- true
 			return
 
@@ -58,6 +139,7 @@ func (bw *BatchWriterService) Start(ctx context.Context, sensorDataChan <-chan *
 			if !ok {
 				bw.logger.Warn("Sensor data channel closed")
 				bw.flushBuffer(ctx)
+				bw.stopSinks(cancelSinks, 3*time.Second)
 				return
 			}
 
@@ -67,6 +149,8 @@ func (bw *BatchWriterService) Start(ctx context.Context, sensorDataChan <-chan *
 			currentSize := len(bw.buffer)
 			bw.bufferMutex.Unlock()
 
+			metrics.BatchWriterBufferSize.Set(float64(currentSize))
+
 			bw.logger.Debug("Added sensor data to buffer",
 				zap.String("device_id", sensorData.DeviceID),
 				zap.Int("buffer_size", currentSize),
@@ -74,7 +158,7 @@ func (bw *BatchWriterService) Start(ctx context.Context, sensorDataChan <-chan *
 
 			// Check if buffer is full
 			if currentSize >= bw.maxBatchSize {
-				bw.logger.Info("Buffer full, flushing to Firebase",
+				bw.logger.Info("Buffer full, flushing to store",
 					zap.Int("buffer_size", currentSize))
 
 				// Stop and reset timer
@@ -97,7 +181,7 @@ func (bw *BatchWriterService) Start(ctx context.Context, sensorDataChan <-chan *
 			bw.bufferMutex.Unlock()
 
 			if currentSize > 0 {
-				bw.logger.Info("Batch timeout reached, flushing to Firebase",
+				bw.logger.Info("Batch timeout reached, flushing to store",
 					zap.Int("buffer_size", currentSize))
 				bw.flushBuffer(ctx)
 			}
@@ -108,7 +192,7 @@ func (bw *BatchWriterService) Start(ctx context.Context, sensorDataChan <-chan *
 	}
 }
 
-// flushBuffer writes the current buffer to Firebase and clears it
+// flushBuffer writes the current buffer to the store and clears it
 func (bw *BatchWriterService) flushBuffer(ctx context.Context) {
 	bw.bufferMutex.Lock()
 
@@ -126,35 +210,114 @@ func (bw *BatchWriterService) flushBuffer(ctx context.Context) {
 
 	bw.bufferMutex.Unlock()
 
-	// Write batch to Firebase with retry
+	metrics.BatchWriterBufferSize.Set(0)
+
+	// Sinks are written in the background so a slow sink never delays the store or acknowledgement
+	bw.queueForSinks(batch)
+
+	metrics.FirebaseBatchSize.Observe(float64(len(batch)))
+
+	// While spilled batches are waiting to be replayed, queue this one behind them so the store
+	// receives readings in order
+	if bw.spill.Status().Segments > 0 {
+		spillErr := bw.spill.Append(batch)
+		if spillErr == nil {
+			bw.logger.Info("Spill backlog pending, queued batch behind it",
+				zap.Int("batch_size", len(batch)))
+			settleDeliveries(batch, true)
+			return
+		}
+		// Better out of order than lost
+		bw.logger.Warn("Failed to queue batch behind spill backlog, writing it to the store",
+			zap.Int("batch_size", len(batch)),
+			zap.Error(spillErr))
+	}
+
+	startTime := time.Now()
+	defer func() {
+		metrics.FirebaseFlushDuration.Observe(time.Since(startTime).Seconds())
+	}()
+
+	// Write batch to the store with retry
 	maxRetries := 3
 	var err error
 
 	for attempt := 1; attempt <= maxRetries; attempt++ {
-		err = bw.firebaseService.WriteBatch(ctx, batch)
+		if attempt > 1 {
+			metrics.FirebaseFlushRetries.Inc()
+		}
+
+		err = bw.store.WriteBatch(ctx, batch)
 		if err == nil {
-			bw.logger.Info("Successfully flushed batch to Firebase",
+			bw.logger.Info("Successfully flushed batch to store",
 				zap.Int("batch_size", len(batch)))
+			settleDeliveries(batch, true)
 			return
 		}
 
-		bw.logger.Error("Failed to flush batch to Firebase",
+		bw.logger.Error("Failed to flush batch to store",
 			zap.Int("attempt", attempt),
 			zap.Int("max_retries", maxRetries),
 			zap.Int("batch_size", len(batch)),
 			zap.Error(err))
 
 		// Exponential backoff
-		if attempt < maxRetries {
+		if attempt < maxRetries && ctx.Err() == nil {
 			backoff := time.Duration(attempt) * time.Second
 			time.Sleep(backoff)
 		}
 	}
 
-	// If all retries failed, log error (data will be lost)
-	bw.logger.Error("Failed to flush batch after all retries, data lost",
+	metrics.FirebaseFlushFailures.Inc()
+
+	// Keep the batch on disk so it can be replayed once the store is reachable again
+	if spillErr := bw.spill.Append(batch); spillErr != nil {
+		bw.logger.Error("Failed to flush batch after all retries and could not spill it",
+			zap.Int("batch_size", len(batch)),
+			zap.NamedError("spill_error", spillErr),
+			zap.Error(err))
+		// Readings that came from the broker are requeued; the rest are lost
+		settleDeliveries(batch, false)
+		return
+	}
+
+	bw.logger.Warn("Failed to flush batch after all retries, spilled to disk for replay",
 		zap.Int("batch_size", len(batch)),
 		zap.Error(err))
+	settleDeliveries(batch, true)
+}
+
+// writeSink writes a batch to a sink. Sinks retry on their own within the deadline; a batch
+// that still fails is dropped for that sink only.
+func (bw *BatchWriterService) writeSink(ctx context.Context, sink ReadingSink, batch []*models.SensorData) {
+	writeCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	if err := sink.WriteBatch(writeCtx, batch); err != nil {
+		metrics.SinkWriteFailures.WithLabelValues(sink.Name()).Inc()
+		bw.logger.Error("Failed to write batch to sink",
+			zap.String("sink", sink.Name()),
+			zap.Int("batch_size", len(batch)),
+			zap.Error(err))
+		return
+	}
+
+	metrics.SinkReadingsWritten.WithLabelValues(sink.Name()).Add(float64(len(batch)))
+}
+
+// settleDeliveries acks the broker messages of a persisted batch, or requeues them if it
+// could not be persisted. Readings without a delivery are skipped.
+func settleDeliveries(batch []*models.SensorData, persisted bool) {
+	for _, data := range batch {
+		if data.Delivery == nil {
+			continue
+		}
+		if persisted {
+			data.Delivery.Ack()
+		} else {
+			data.Delivery.Nack(true)
+		}
+	}
 }
 
 // WaitForShutdown waits for the batch writer to complete shutdown
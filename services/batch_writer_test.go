@@ -0,0 +1,389 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"kaelo/config"
+	"kaelo/metrics"
+	"kaelo/models"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+// fakeSensorStore records the batches written to it and fails the first failures writes as
+// unreachable. Batches from rejectDevice are always rejected.
+type fakeSensorStore struct {
+	SensorStore
+
+	mu           sync.Mutex
+	failures     int
+	rejectDevice string
+	attempts     int
+	batches      [][]*models.SensorData
+	written      chan struct{}
+}
+
+func newFakeSensorStore(failures int) *fakeSensorStore {
+	return &fakeSensorStore{failures: failures, written: make(chan struct{}, 16)}
+}
+
+func (s *fakeSensorStore) WriteBatch(_ context.Context, batch []*models.SensorData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attempts++
+	if s.attempts <= s.failures {
+		return fmt.Errorf("store unavailable: %w", syscall.ECONNREFUSED)
+	}
+	if s.rejectDevice != "" && batch[0].DeviceID == s.rejectDevice {
+		return errors.New("invalid data")
+	}
+	s.batches = append(s.batches, append([]*models.SensorData(nil), batch...))
+	s.written <- struct{}{}
+	return nil
+}
+
+func (s *fakeSensorStore) writes() ([][]*models.SensorData, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batches, s.attempts
+}
+
+// fakeDelivery records how a reading's broker message was settled
+type fakeDelivery struct {
+	mu      sync.Mutex
+	acked   bool
+	nacked  bool
+	requeue bool
+}
+
+func (d *fakeDelivery) Ack() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.acked = true
+}
+
+func (d *fakeDelivery) Nack(requeue bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nacked, d.requeue = true, requeue
+}
+
+func (d *fakeDelivery) state() (acked, nacked, requeue bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.acked, d.nacked, d.requeue
+}
+
+func newTestBatchWriter(t *testing.T, store SensorStore, batchSize, batchTimeout int) (*BatchWriterService, *SpillBuffer) {
+	t.Helper()
+
+	cfg := &config.Config{
+		FirebaseBatchSize:    batchSize,
+		FirebaseBatchTimeout: batchTimeout,
+		SpillDir:             t.TempDir(),
+		SpillMaxMB:           1,
+		SpillReplayInterval:  60,
+	}
+	spill, err := NewSpillBuffer(cfg, store, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewSpillBuffer: %v", err)
+	}
+	return NewBatchWriterService(cfg, store, spill, zap.NewNop()), spill
+}
+
+func testReading(deviceID string, seq uint64, delivery models.DeliveryAck) *models.SensorData {
+	return &models.SensorData{
+		DeviceID:  deviceID,
+		Seq:       seq,
+		Timestamp: time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC),
+		Delivery:  delivery,
+	}
+}
+
+// startBatchWriter runs the batch writer until the test ends
+func startBatchWriter(t *testing.T, bw *BatchWriterService) chan<- *models.SensorData {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sensorDataChan := make(chan *models.SensorData)
+	go bw.Start(ctx, sensorDataChan)
+	t.Cleanup(func() {
+		cancel()
+		bw.WaitForShutdown(5 * time.Second)
+	})
+	return sensorDataChan
+}
+
+func waitForWrite(t *testing.T, store *fakeSensorStore, timeout time.Duration) {
+	t.Helper()
+
+	select {
+	case <-store.written:
+	case <-time.After(timeout):
+		t.Fatalf("no batch written within %s", timeout)
+	}
+}
+
+func TestBatchWriterFlushesWhenFull(t *testing.T) {
+	store := newFakeSensorStore(0)
+	bw, _ := newTestBatchWriter(t, store, 3, 60)
+	sensorDataChan := startBatchWriter(t, bw)
+
+	for seq := uint64(1); seq <= 3; seq++ {
+		sensorDataChan <- testReading("ESP32-001", seq, nil)
+	}
+	waitForWrite(t, store, 2*time.Second)
+
+	batches, _ := store.writes()
+	if len(batches) != 1 || len(batches[0]) != 3 {
+		t.Fatalf("got batches %v, want one batch of 3", batches)
+	}
+	for i, data := range batches[0] {
+		if data.Seq != uint64(i+1) {
+			t.Errorf("reading %d has seq %d, want %d", i, data.Seq, i+1)
+		}
+	}
+}
+
+func TestBatchWriterFlushesOnTimeout(t *testing.T) {
+	store := newFakeSensorStore(0)
+	bw, _ := newTestBatchWriter(t, store, 100, 1)
+	sensorDataChan := startBatchWriter(t, bw)
+
+	sensorDataChan <- testReading("ESP32-001", 1, nil)
+	sensorDataChan <- testReading("ESP32-001", 2, nil)
+
+	if bw.GetBufferSize() == 0 {
+		t.Fatal("buffer flushed before the batch timeout")
+	}
+	waitForWrite(t, store, 3*time.Second)
+
+	batches, _ := store.writes()
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatalf("got batches %v, want one batch of 2", batches)
+	}
+	if size := bw.GetBufferSize(); size != 0 {
+		t.Errorf("buffer size after flush = %d, want 0", size)
+	}
+}
+
+func TestBatchWriterRetriesBeforeSucceeding(t *testing.T) {
+	store := newFakeSensorStore(1)
+	bw, spill := newTestBatchWriter(t, store, 1, 60)
+
+	delivery := &fakeDelivery{}
+	bw.buffer = append(bw.buffer, testReading("ESP32-001", 1, delivery))
+	bw.flushBuffer(context.Background())
+
+	batches, attempts := store.writes()
+	if attempts != 2 || len(batches) != 1 {
+		t.Fatalf("got %d attempts and %d stored batches, want 2 and 1", attempts, len(batches))
+	}
+	if status := spill.Status(); status.Segments != 0 {
+		t.Errorf("spilled %d segments, want none", status.Segments)
+	}
+	if acked, nacked, _ := delivery.state(); !acked || nacked {
+		t.Errorf("delivery acked=%v nacked=%v, want acked once stored", acked, nacked)
+	}
+}
+
+func TestBatchWriterSpillsAfterRetries(t *testing.T) {
+	store := newFakeSensorStore(3)
+	bw, spill := newTestBatchWriter(t, store, 2, 60)
+
+	deliveries := []*fakeDelivery{{}, {}}
+	for i, delivery := range deliveries {
+		bw.buffer = append(bw.buffer, testReading("ESP32-001", uint64(i+1), delivery))
+	}
+	bw.flushBuffer(context.Background())
+
+	if _, attempts := store.writes(); attempts != 3 {
+		t.Errorf("got %d store attempts, want 3", attempts)
+	}
+	status := spill.Status()
+	if status.Segments != 1 || status.Readings != 2 {
+		t.Fatalf("spill status = %+v, want one segment of 2 readings", status)
+	}
+
+	// Once spilled the readings are safe on disk, so their messages are acked
+	for i, delivery := range deliveries {
+		if acked, nacked, _ := delivery.state(); !acked || nacked {
+			t.Errorf("delivery %d acked=%v nacked=%v, want acked once spilled", i, acked, nacked)
+		}
+	}
+
+	// The store recovers and the spilled batch is replayed
+	spill.replay(context.Background())
+	batches, _ := store.writes()
+	if len(batches) != 1 || len(batches[0]) != 2 || batches[0][1].Seq != 2 {
+		t.Fatalf("replayed batches %v, want the spilled batch of 2", batches)
+	}
+	if status := spill.Status(); status.Segments != 0 {
+		t.Errorf("%d segments left after replay, want none", status.Segments)
+	}
+}
+
+func TestBatchWriterRequeuesWhenSpillFails(t *testing.T) {
+	store := newFakeSensorStore(3)
+	bw, spill := newTestBatchWriter(t, store, 1, 60)
+	spill.maxBytes = 1 // no batch fits
+
+	delivery := &fakeDelivery{}
+	bw.buffer = append(bw.buffer, testReading("ESP32-001", 1, delivery))
+	bw.flushBuffer(context.Background())
+
+	if acked, nacked, requeue := delivery.state(); acked || !nacked || !requeue {
+		t.Errorf("delivery acked=%v nacked=%v requeue=%v, want requeued", acked, nacked, requeue)
+	}
+}
+
+func TestBatchWriterQueuesBehindSpillBacklog(t *testing.T) {
+	store := newFakeSensorStore(3)
+	bw, spill := newTestBatchWriter(t, store, 1, 60)
+
+	bw.buffer = append(bw.buffer, testReading("ESP32-001", 1, nil))
+	bw.flushBuffer(context.Background())
+
+	// The store is back, but the first batch is still waiting in the spill
+	delivery := &fakeDelivery{}
+	bw.buffer = append(bw.buffer, testReading("ESP32-001", 2, delivery))
+	bw.flushBuffer(context.Background())
+
+	if batches, _ := store.writes(); len(batches) != 0 {
+		t.Fatalf("store received %v ahead of the spill backlog", batches)
+	}
+	if status := spill.Status(); status.Segments != 2 {
+		t.Fatalf("spill has %d segments, want 2", status.Segments)
+	}
+	if acked, _, _ := delivery.state(); !acked {
+		t.Error("delivery of a batch queued in the spill was not acked")
+	}
+
+	spill.replay(context.Background())
+	batches, _ := store.writes()
+	if len(batches) != 2 || batches[0][0].Seq != 1 || batches[1][0].Seq != 2 {
+		t.Fatalf("replayed batches %v, want seq 1 then seq 2", batches)
+	}
+}
+
+func TestSpillQuarantinesRejectedSegment(t *testing.T) {
+	store := newFakeSensorStore(0)
+	store.rejectDevice = "ESP32-BAD"
+	_, spill := newTestBatchWriter(t, store, 1, 60)
+
+	for _, reading := range []*models.SensorData{
+		testReading("ESP32-BAD", 1, nil),
+		testReading("ESP32-001", 2, nil),
+		testReading("ESP32-001", 3, nil),
+	} {
+		if err := spill.Append([]*models.SensorData{reading}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	for i := 1; i < spillMaxRejections; i++ {
+		spill.replay(context.Background())
+		if batches, _ := store.writes(); len(batches) != 0 {
+			t.Fatalf("replayed %v past a rejected segment before quarantining it", batches)
+		}
+	}
+
+	spill.replay(context.Background())
+	batches, _ := store.writes()
+	if len(batches) != 2 || batches[0][0].Seq != 2 || batches[1][0].Seq != 3 {
+		t.Fatalf("replayed batches %v, want seq 2 then seq 3", batches)
+	}
+	if status := spill.Status(); status.Segments != 0 {
+		t.Errorf("spill has %d segments left, want 0", status.Segments)
+	}
+	quarantined, err := os.ReadDir(filepath.Join(spill.dir, spillQuarantineDir))
+	if err != nil || len(quarantined) != 1 {
+		t.Errorf("quarantine holds %v (%v), want the rejected segment", quarantined, err)
+	}
+}
+
+func TestSpillKeepsSegmentWhileStoreUnreachable(t *testing.T) {
+	store := newFakeSensorStore(2 * spillMaxRejections)
+	_, spill := newTestBatchWriter(t, store, 1, 60)
+	if err := spill.Append([]*models.SensorData{testReading("ESP32-001", 1, nil)}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	for i := 0; i < 2*spillMaxRejections; i++ {
+		spill.replay(context.Background())
+	}
+	if status := spill.Status(); status.Segments != 1 {
+		t.Fatalf("spill has %d segments, want the segment kept for the next replay", status.Segments)
+	}
+
+	spill.replay(context.Background())
+	if batches, _ := store.writes(); len(batches) != 1 {
+		t.Errorf("replayed %d batches once the store was back, want 1", len(batches))
+	}
+}
+
+// blockingSink holds every write until released
+type blockingSink struct {
+	release chan struct{}
+	written chan int
+}
+
+func (s *blockingSink) Name() string { return "blocking" }
+
+func (s *blockingSink) WriteBatch(ctx context.Context, batch []*models.SensorData) error {
+	select {
+	case <-s.release:
+		s.written <- len(batch)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestBatchWriterDoesNotWaitForSinks(t *testing.T) {
+	store := newFakeSensorStore(0)
+	bw, _ := newTestBatchWriter(t, store, 1, 60)
+	sink := &blockingSink{release: make(chan struct{}), written: make(chan int, 2*sinkQueueSize)}
+	bw.AddSink(sink)
+	sensorDataChan := startBatchWriter(t, bw)
+	droppedBefore := testutil.ToFloat64(metrics.SinkDroppedReadings.WithLabelValues(sink.Name()))
+
+	// One batch is being written, sinkQueueSize wait in the queue and the rest overflow
+	const overflow = 3
+	for seq := uint64(1); seq <= sinkQueueSize+1+overflow; seq++ {
+		sensorDataChan <- testReading("ESP32-001", seq, nil)
+		waitForWrite(t, store, 2*time.Second)
+		for seq == 1 && len(bw.sinks[0].queue) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	dropped := func() float64 {
+		return testutil.ToFloat64(metrics.SinkDroppedReadings.WithLabelValues(sink.Name())) - droppedBefore
+	}
+	for deadline := time.Now().Add(2 * time.Second); dropped() < overflow && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := dropped(); got != overflow {
+		t.Errorf("sink dropped %g readings, want %d", got, overflow)
+	}
+
+	close(sink.release)
+	for i := 0; i < sinkQueueSize+1; i++ {
+		select {
+		case <-sink.written:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("sink wrote %d queued batches, want %d", i, sinkQueueSize+1)
+		}
+	}
+}
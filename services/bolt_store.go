@@ -0,0 +1,545 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"kaelo/config"
+	"kaelo/models"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// healthEventsPath holds device health checks. Only the embedded store records them.
+const healthEventsPath = "health-events"
+
+// healthEventKey returns the storage key of a health check
+func healthEventKey(data *models.HealthCheckData) string {
+	return fmt.Sprintf("%d-%s", data.Timestamp.UnixNano(), data.DeviceID)
+}
+
+// boltKey returns the key of a record in a collection bucket. Keys start with the stored
+// timestamp so a cursor walks the bucket in time order; the record key breaks ties.
+func boltKey(timestamp, key string) []byte {
+	return []byte(timestamp + "|" + key)
+}
+
+// splitBoltKey returns the timestamp and record key of a bucket key
+func splitBoltKey(k []byte) (timestamp, key string) {
+	timestamp, key, _ = strings.Cut(string(k), "|")
+	return timestamp, key
+}
+
+// boltCollection stores JSON records in a bucket ordered by timestamp. Collections with a
+// device function also keep a per-device index so device queries only visit that device.
+type boltCollection[T any] struct {
+	db       *bolt.DB
+	name     []byte
+	index    []byte         // bucket of per-device index buckets, nil without an index
+	deviceOf func(T) string // device of a record, nil without an index
+}
+
+// newBoltCollection creates the collection buckets
+func newBoltCollection[T any](db *bolt.DB, name string, deviceOf func(T) string) (*boltCollection[T], error) {
+	c := &boltCollection[T]{db: db, name: []byte(name), deviceOf: deviceOf}
+	if deviceOf != nil {
+		c.index = []byte(name + "#device")
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(c.name); err != nil {
+			return err
+		}
+		if c.index != nil {
+			if _, err := tx.CreateBucketIfNotExists(c.index); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bucket %s: %w", name, err)
+	}
+	return c, nil
+}
+
+// put writes a record, replacing a stored record with the same timestamp and key
+func (c *boltCollection[T]) put(tx *bolt.Tx, timestamp, key string, data T) error {
+	value, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode record %s: %w", key, err)
+	}
+
+	k := boltKey(timestamp, key)
+	if err := tx.Bucket(c.name).Put(k, value); err != nil {
+		return err
+	}
+
+	if c.index != nil {
+		devices, err := tx.Bucket(c.index).CreateBucketIfNotExists([]byte(c.deviceOf(data)))
+		if err != nil {
+			return err
+		}
+		if err := devices.Put(k, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// append writes records in one transaction
+func (c *boltCollection[T]) append(records []localRecord[T]) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		for _, record := range records {
+			if err := c.put(tx, record.Timestamp, record.Key, record.Data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// update replaces a record with the result of fn, which receives the stored record if there is one
+func (c *boltCollection[T]) update(key, timestamp string, fn func(existing T, ok bool) T) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		var existing T
+		found := false
+		if value := tx.Bucket(c.name).Get(boltKey(timestamp, key)); value != nil {
+			if err := json.Unmarshal(value, &existing); err != nil {
+				return fmt.Errorf("failed to decode record %s: %w", key, err)
+			}
+			found = true
+		}
+		return c.put(tx, timestamp, key, fn(existing, found))
+	})
+}
+
+// query returns one page of records matching the time range and filter
+func (c *boltCollection[T]) query(q TimeRangeQuery, deviceID string, match func(T) bool) (Page[T], error) {
+	limit := q.normalizedLimit()
+	descending := q.descending()
+
+	var cursorValue, cursorKey string
+	hasCursor := q.Cursor != ""
+	if hasCursor {
+		var err error
+		if cursorValue, cursorKey, err = decodeCursor(q.Cursor); err != nil {
+			return Page[T]{}, err
+		}
+	}
+
+	start, end := "", ""
+	if !q.From.IsZero() {
+		start = storedTimestamp(q.From)
+	}
+	if !q.To.IsZero() {
+		end = storedTimestamp(q.To)
+	}
+
+	var page Page[T]
+	err := c.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(c.name)
+
+		// Walk the device index when there is one, reading records from the data bucket
+		walk := data
+		if deviceID != "" && c.index != nil {
+			walk = tx.Bucket(c.index).Bucket([]byte(deviceID))
+			if walk == nil {
+				return nil
+			}
+		}
+
+		cursor := walk.Cursor()
+		var k []byte
+		switch {
+		case descending && hasCursor:
+			k = seekBefore(cursor, boltKey(cursorValue, cursorKey))
+		case descending && end != "":
+			k = seekBefore(cursor, boltKey(end, "\xff"))
+		case descending:
+			k, _ = cursor.Last()
+		case hasCursor:
+			k, _ = cursor.Seek(boltKey(cursorValue, cursorKey))
+		default:
+			k, _ = cursor.Seek([]byte(start))
+		}
+
+		var lastValue, lastKey string
+		for ; k != nil; k = step(cursor, descending) {
+			timestamp, key := splitBoltKey(k)
+			if (descending && start != "" && timestamp < start) || (!descending && end != "" && timestamp > end) {
+				break
+			}
+			if (start != "" && timestamp < start) || (end != "" && timestamp > end) {
+				continue
+			}
+			if hasCursor && !pastCursor(timestamp, key, cursorValue, cursorKey, descending) {
+				continue
+			}
+
+			var record T
+			if err := json.Unmarshal(data.Get(k), &record); err != nil {
+				continue
+			}
+			if !match(record) {
+				continue
+			}
+
+			if len(page.Items) == limit {
+				page.NextCursor = encodeCursor(lastValue, lastKey)
+				return nil
+			}
+			page.Items = append(page.Items, record)
+			lastValue, lastKey = timestamp, key
+		}
+		return nil
+	})
+	if err != nil {
+		return Page[T]{}, fmt.Errorf("failed to query %s: %w", c.name, err)
+	}
+
+	return page, nil
+}
+
+// seekBefore positions the cursor on the last key before k
+func seekBefore(cursor *bolt.Cursor, k []byte) []byte {
+	found, _ := cursor.Seek(k)
+	if found == nil {
+		found, _ = cursor.Last()
+		return found
+	}
+	for found != nil && bytes.Compare(found, k) >= 0 {
+		found, _ = cursor.Prev()
+	}
+	return found
+}
+
+// step moves the cursor in query order
+func step(cursor *bolt.Cursor, descending bool) []byte {
+	var k []byte
+	if descending {
+		k, _ = cursor.Prev()
+	} else {
+		k, _ = cursor.Next()
+	}
+	return k
+}
+
+// prune deletes records older than the cutoff, chunkSize records per transaction
+func (c *boltCollection[T]) prune(cutoff time.Time, opts PruneOptions) (int, error) {
+	end := []byte(storedTimestamp(cutoff))
+	from := []byte{}
+	removed := 0
+
+	for {
+		var keys [][]byte
+		err := c.db.View(func(tx *bolt.Tx) error {
+			// A dry run doesn't delete, so continue after the records counted by earlier chunks
+			cursor := tx.Bucket(c.name).Cursor()
+			for k, _ := cursor.Seek(from); k != nil && bytes.Compare(k, end) < 0 && len(keys) < opts.ChunkSize; k, _ = cursor.Next() {
+				keys = append(keys, bytes.Clone(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return removed, fmt.Errorf("failed to scan %s: %w", c.name, err)
+		}
+		if len(keys) == 0 {
+			return removed, nil
+		}
+
+		if !opts.DryRun {
+			if err := c.delete(keys); err != nil {
+				return removed, err
+			}
+		}
+		removed += len(keys)
+		from = append(keys[len(keys)-1], 0)
+
+		if len(keys) < opts.ChunkSize {
+			return removed, nil
+		}
+	}
+}
+
+// delete removes records and their index entries in one transaction
+func (c *boltCollection[T]) delete(keys [][]byte) error {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		data := tx.Bucket(c.name)
+		for _, k := range keys {
+			if c.index != nil {
+				var record T
+				if err := json.Unmarshal(data.Get(k), &record); err == nil {
+					if devices := tx.Bucket(c.index).Bucket([]byte(c.deviceOf(record))); devices != nil {
+						if err := devices.Delete(k); err != nil {
+							return err
+						}
+					}
+				}
+			}
+			if err := data.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete from %s: %w", c.name, err)
+	}
+	return nil
+}
+
+// BoltStore stores readings, anomalies, face events and device health checks in an embedded
+// bbolt database file. It needs no network, so edge deployments keep their history offline.
+type BoltStore struct {
+	db           *bolt.DB
+	readings     *boltCollection[*models.SensorData]
+	anomalies    *boltCollection[*models.Anomaly]
+	faceEvents   *boltCollection[*models.FaceEvent]
+	healthEvents *boltCollection[*models.HealthCheckData]
+	rollups      map[models.RollupResolution]*boltCollection[*models.Rollup]
+	latest       map[string]*models.SensorData
+	latestMu     sync.RWMutex
+	logger       *zap.Logger
+}
+
+// NewBoltStore opens (or creates) the database at BOLT_PATH
+func NewBoltStore(cfg *config.Config, logger *zap.Logger) (*BoltStore, error) {
+	if err := os.MkdirAll(filepath.Dir(cfg.BoltPath), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", filepath.Dir(cfg.BoltPath), err)
+	}
+
+	// The timeout fails fast when another process holds the file lock
+	db, err := bolt.Open(cfg.BoltPath, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", cfg.BoltPath, err)
+	}
+
+	bs := &BoltStore{
+		db:      db,
+		rollups: make(map[models.RollupResolution]*boltCollection[*models.Rollup]),
+		latest:  make(map[string]*models.SensorData),
+		logger:  logger,
+	}
+
+	if bs.readings, err = newBoltCollection(db, sensorDataPath, func(data *models.SensorData) string { return data.DeviceID }); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if bs.anomalies, err = newBoltCollection(db, anomaliesPath, func(anomaly *models.Anomaly) string { return anomaly.DeviceID }); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if bs.faceEvents, err = newBoltCollection[*models.FaceEvent](db, faceEventsPath, nil); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if bs.healthEvents, err = newBoltCollection(db, healthEventsPath, func(data *models.HealthCheckData) string { return data.DeviceID }); err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, resolution := range models.RollupResolutions {
+		collection, err := newBoltCollection[*models.Rollup](db, rollupCollection(resolution), nil)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		bs.rollups[resolution] = collection
+	}
+
+	logger.Info("Using embedded bolt store", zap.String("path", cfg.BoltPath))
+
+	return bs, nil
+}
+
+// WriteBatch stores a batch of readings in one transaction
+func (bs *BoltStore) WriteBatch(ctx context.Context, batch []*models.SensorData) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	records := make([]localRecord[*models.SensorData], len(batch))
+	for i, data := range batch {
+		records[i] = localRecord[*models.SensorData]{
+			Key:       readingKey(data),
+			Timestamp: storedTimestamp(data.Timestamp),
+			Data:      data,
+		}
+	}
+
+	if err := bs.readings.append(records); err != nil {
+		return fmt.Errorf("failed to write batch: %w", err)
+	}
+
+	bs.latestMu.Lock()
+	for _, data := range batch {
+		if current, ok := bs.latest[data.DeviceID]; !ok || data.Timestamp.After(current.Timestamp) {
+			bs.latest[data.DeviceID] = data
+		}
+	}
+	bs.latestMu.Unlock()
+
+	return nil
+}
+
+// LatestReading returns the newest stored reading for a device
+func (bs *BoltStore) LatestReading(ctx context.Context, deviceID string) (*models.SensorData, error) {
+	bs.latestMu.RLock()
+	latest, ok := bs.latest[deviceID]
+	bs.latestMu.RUnlock()
+	if ok {
+		return latest, nil
+	}
+
+	// Not written since startup, the device index makes this a single seek
+	page, err := bs.QueryReadings(ctx, TimeRangeQuery{DeviceID: deviceID, Limit: 1, Order: SortDescending})
+	if err != nil {
+		return nil, err
+	}
+	if len(page.Items) == 0 {
+		return nil, ErrNotFound
+	}
+
+	bs.latestMu.Lock()
+	if current, ok := bs.latest[deviceID]; !ok || page.Items[0].Timestamp.After(current.Timestamp) {
+		bs.latest[deviceID] = page.Items[0]
+	}
+	latest = bs.latest[deviceID]
+	bs.latestMu.Unlock()
+
+	return latest, nil
+}
+
+// QueryReadings returns stored readings in a time range
+func (bs *BoltStore) QueryReadings(ctx context.Context, q TimeRangeQuery) (Page[*models.SensorData], error) {
+	return bs.readings.query(q, q.DeviceID, func(*models.SensorData) bool { return true })
+}
+
+// WriteAnomalies records detected anomalies
+func (bs *BoltStore) WriteAnomalies(ctx context.Context, anomalies []*models.Anomaly) error {
+	if len(anomalies) == 0 {
+		return nil
+	}
+
+	records := make([]localRecord[*models.Anomaly], len(anomalies))
+	for i, anomaly := range anomalies {
+		records[i] = localRecord[*models.Anomaly]{
+			Key:       anomalyKey(anomaly),
+			Timestamp: storedTimestamp(anomaly.Timestamp),
+			Data:      anomaly,
+		}
+	}
+
+	if err := bs.anomalies.append(records); err != nil {
+		return fmt.Errorf("failed to write anomalies: %w", err)
+	}
+	return nil
+}
+
+// QueryAnomalies returns recorded anomalies in a time range
+func (bs *BoltStore) QueryAnomalies(ctx context.Context, q AnomalyQuery) (Page[*models.Anomaly], error) {
+	return bs.anomalies.query(q.TimeRangeQuery, q.DeviceID, func(anomaly *models.Anomaly) bool {
+		return (q.Type == "" || anomaly.Type == q.Type) &&
+			(q.Severity == "" || anomaly.GetSeverity() == q.Severity)
+	})
+}
+
+// WriteFaceEvent records an unknown person detection
+func (bs *BoltStore) WriteFaceEvent(ctx context.Context, event *models.FaceEvent) error {
+	err := bs.faceEvents.append([]localRecord[*models.FaceEvent]{{
+		Key:       faceEventKey(event),
+		Timestamp: storedTimestamp(event.Timestamp),
+		Data:      event,
+	}})
+	if err != nil {
+		return fmt.Errorf("failed to write face event: %w", err)
+	}
+	return nil
+}
+
+// QueryFaceEvents returns recorded unknown person detections in a time range
+func (bs *BoltStore) QueryFaceEvents(ctx context.Context, q TimeRangeQuery) (Page[*models.FaceEvent], error) {
+	return bs.faceEvents.query(q, "", func(*models.FaceEvent) bool { return true })
+}
+
+// WriteHealthEvent records a device health check
+func (bs *BoltStore) WriteHealthEvent(ctx context.Context, data *models.HealthCheckData) error {
+	err := bs.healthEvents.append([]localRecord[*models.HealthCheckData]{{
+		Key:       healthEventKey(data),
+		Timestamp: storedTimestamp(data.Timestamp),
+		Data:      data,
+	}})
+	if err != nil {
+		return fmt.Errorf("failed to write health event: %w", err)
+	}
+	return nil
+}
+
+// QueryHealthEvents returns recorded health checks in a time range
+func (bs *BoltStore) QueryHealthEvents(ctx context.Context, q TimeRangeQuery) (Page[*models.HealthCheckData], error) {
+	return bs.healthEvents.query(q, q.DeviceID, func(*models.HealthCheckData) bool { return true })
+}
+
+// MergeRollup adds a rollup to the stored bucket
+func (bs *BoltStore) MergeRollup(ctx context.Context, rollup *models.Rollup) error {
+	collection, ok := bs.rollups[rollup.Resolution]
+	if !ok {
+		return fmt.Errorf("unknown rollup resolution %q", rollup.Resolution)
+	}
+
+	key := rollup.DeviceID + "|" + rollupKey(rollup)
+	err := collection.update(key, storedTimestamp(rollup.BucketStart), func(existing *models.Rollup, ok bool) *models.Rollup {
+		if !ok {
+			return rollup
+		}
+		existing.Merge(rollup)
+		return existing
+	})
+	if err != nil {
+		return fmt.Errorf("failed to merge rollup: %w", err)
+	}
+	return nil
+}
+
+// Prune deletes records older than the cutoff in chunks
+func (bs *BoltStore) Prune(ctx context.Context, collection string, cutoff time.Time, opts PruneOptions) (int, error) {
+	opts.ChunkSize = max(opts.ChunkSize, 1)
+
+	switch collection {
+	case sensorDataPath:
+		return bs.readings.prune(cutoff, opts)
+	case anomaliesPath:
+		return bs.anomalies.prune(cutoff, opts)
+	case faceEventsPath:
+		return bs.faceEvents.prune(cutoff, opts)
+	case healthEventsPath:
+		return bs.healthEvents.prune(cutoff, opts)
+	}
+
+	for resolution, rollups := range bs.rollups {
+		if collection == rollupCollection(resolution) {
+			return rollups.prune(cutoff, opts)
+		}
+	}
+
+	return 0, fmt.Errorf("unknown collection %q", collection)
+}
+
+// Ping checks that the database is open
+func (bs *BoltStore) Ping(ctx context.Context) error {
+	return bs.db.View(func(tx *bolt.Tx) error { return nil })
+}
+
+// Close closes the database file
+func (bs *BoltStore) Close() error {
+	bs.logger.Info("Closing bolt store")
+	return bs.db.Close()
+}
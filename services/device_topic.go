@@ -0,0 +1,89 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Kinds of per-device topics, the last segment of {root}/{site}/{device_id}/{kind}
+const (
+	deviceTopicTelemetry = "telemetry"
+	deviceTopicHealth    = "health"
+	deviceTopicFace      = "face"
+)
+
+// deviceTopic is the site and device a message was published under. The zero value means the
+// message didn't come from a per-device topic.
+type deviceTopic struct {
+	site     string
+	deviceID string
+}
+
+// deviceTopicBindings returns the amq.topic routing keys of one kind of device topic. RabbitMQ's
+// MQTT plugin turns kaelo/site-a/ESP32-001/telemetry into kaelo.site-a.ESP32-001.telemetry;
+// the second key matches a payload format suffix (kaelo/site-a/ESP32-001/telemetry/cbor).
+func deviceTopicBindings(root, kind string) []string {
+	return []string{
+		root + ".*.*." + kind,
+		root + ".*.*." + kind + ".*",
+	}
+}
+
+// parseDeviceTopic extracts the site and device ID from the routing key of a device topic of
+// the given kind. ok is false for any other routing key, e.g. the plain queue name.
+func parseDeviceTopic(root, routingKey, kind string) (topic deviceTopic, ok bool) {
+	if root == "" {
+		return deviceTopic{}, false
+	}
+	rest, ok := strings.CutPrefix(routingKey, root+".")
+	if !ok {
+		return deviceTopic{}, false
+	}
+
+	segments := strings.Split(rest, ".")
+	switch {
+	case len(segments) < 3 || len(segments) > 4:
+		return deviceTopic{}, false
+	case segments[2] != kind:
+		return deviceTopic{}, false
+	case len(segments) == 4 && !isPayloadFormat(segments[3]):
+		return deviceTopic{}, false
+	case segments[0] == "" || segments[1] == "":
+		return deviceTopic{}, false
+	}
+	return deviceTopic{site: segments[0], deviceID: segments[1]}, true
+}
+
+// claim fills the device_id and site of a decoded payload from the topic, and rejects payloads
+// that name a different device or site. Fields that aren't strings are left to validation.
+func (t deviceTopic) claim(doc map[string]interface{}) error {
+	if t.deviceID == "" {
+		return nil
+	}
+	for _, field := range [...]struct{ name, value string }{{"device_id", t.deviceID}, {"site", t.site}} {
+		switch own := doc[field.name].(type) {
+		case nil:
+			doc[field.name] = field.value
+		case string:
+			if own == "" {
+				doc[field.name] = field.value
+			} else if own != field.value {
+				return fmt.Errorf("%s %q does not match topic %s %q", field.name, own, field.name, field.value)
+			}
+		}
+	}
+	return nil
+}
+
+// apply is claim for payloads that were already decoded into a model
+func (t deviceTopic) apply(deviceID, site *string) error {
+	if t.deviceID == "" {
+		return nil
+	}
+	doc := map[string]interface{}{"device_id": *deviceID, "site": *site}
+	if err := t.claim(doc); err != nil {
+		return err
+	}
+	*deviceID, *site = doc["device_id"].(string), doc["site"].(string)
+	return nil
+}
@@ -0,0 +1,259 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kaelo/metrics"
+	"kaelo/models"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// streamBufferSize is the number of events buffered per subscriber before dropping
+	streamBufferSize = 256
+
+	// streamMaxDropped disconnects subscribers that fall this far behind
+	streamMaxDropped = 10 * streamBufferSize
+
+	// streamHeartbeatInterval keeps idle connections open through proxies
+	streamHeartbeatInterval = 15 * time.Second
+)
+
+// StreamFilter selects which events a subscriber receives. Empty sets match everything.
+type StreamFilter struct {
+	DeviceIDs map[string]bool
+	Types     map[models.StreamEventType]bool
+}
+
+// matches reports whether an event passes the filter
+func (f StreamFilter) matches(event *models.StreamEvent) bool {
+	if len(f.Types) > 0 && !f.Types[event.Type] {
+		return false
+	}
+	if len(f.DeviceIDs) > 0 && event.DeviceID != "" && !f.DeviceIDs[event.DeviceID] {
+		return false
+	}
+	return true
+}
+
+// Subscription is a single live stream subscriber
+type Subscription struct {
+	filter  StreamFilter
+	events  chan *models.StreamEvent
+	dropped atomic.Int64
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// close marks the subscription as closed
+func (s *Subscription) close() {
+	s.once.Do(func() { close(s.closed) })
+}
+
+// EventHub fans out readings, anomalies, health changes and face events to live subscribers
+type EventHub struct {
+	subscribers map[*Subscription]struct{}
+	logger      *zap.Logger
+	mu          sync.RWMutex
+}
+
+// NewEventHub creates a new event hub
+func NewEventHub(logger *zap.Logger) *EventHub {
+	return &EventHub{
+		subscribers: make(map[*Subscription]struct{}),
+		logger:      logger,
+	}
+}
+
+// Subscribe registers a new subscriber
+func (h *EventHub) Subscribe(filter StreamFilter) *Subscription {
+	sub := &Subscription{
+		filter: filter,
+		events: make(chan *models.StreamEvent, streamBufferSize),
+		closed: make(chan struct{}),
+	}
+
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	count := len(h.subscribers)
+	h.mu.Unlock()
+
+	metrics.StreamSubscribers.Set(float64(count))
+	return sub
+}
+
+// Unsubscribe removes a subscriber
+func (h *EventHub) Unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	delete(h.subscribers, sub)
+	count := len(h.subscribers)
+	h.mu.Unlock()
+
+	sub.close()
+	metrics.StreamSubscribers.Set(float64(count))
+}
+
+// Publish delivers an event to all matching subscribers without blocking.
+// When a subscriber's buffer is full its oldest event is dropped.
+func (h *EventHub) Publish(eventType models.StreamEventType, deviceID string, data interface{}) {
+	event := &models.StreamEvent{
+		Type:      eventType,
+		DeviceID:  deviceID,
+		Timestamp: time.Now(),
+		Data:      data,
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for sub := range h.subscribers {
+		if !sub.filter.matches(event) {
+			continue
+		}
+
+		select {
+		case sub.events <- event:
+			continue
+		default:
+		}
+
+		// Slow subscriber: drop the oldest buffered event to make room
+		select {
+		case <-sub.events:
+			sub.dropped.Add(1)
+			metrics.StreamEventsDropped.Inc()
+		default:
+		}
+
+		select {
+		case sub.events <- event:
+		default:
+			sub.dropped.Add(1)
+			metrics.StreamEventsDropped.Inc()
+		}
+
+		if sub.dropped.Load() > streamMaxDropped {
+			sub.close()
+		}
+	}
+}
+
+// ServeHTTP streams events to the client as Server-Sent Events.
+// Supports ?device=a,b and ?types=reading,anomaly,health,face filters.
+func (h *EventHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+		return
+	}
+
+	filter, err := parseStreamFilter(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	sub := h.Subscribe(filter)
+	defer h.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	h.logger.Info("Stream client connected", zap.String("remote_addr", r.RemoteAddr))
+	defer h.logger.Info("Stream client disconnected",
+		zap.String("remote_addr", r.RemoteAddr),
+		zap.Int64("dropped_events", sub.dropped.Load()))
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	var reportedDropped int64
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-sub.closed:
+			h.logger.Warn("Disconnecting slow stream client",
+				zap.String("remote_addr", r.RemoteAddr),
+				zap.Int64("dropped_events", sub.dropped.Load()))
+			return
+
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case event := <-sub.events:
+			// Tell the client how many events it missed since the last report
+			if dropped := sub.dropped.Load(); dropped > reportedDropped {
+				if err := writeSSE(w, "dropped", map[string]int64{"count": dropped - reportedDropped}); err != nil {
+					return
+				}
+				reportedDropped = dropped
+			}
+
+			if err := writeSSE(w, string(event.Type), event); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeSSE writes a single Server-Sent Event
+func writeSSE(w http.ResponseWriter, eventName string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventName, payload)
+	return err
+}
+
+// parseStreamFilter builds a filter from ?device= and ?types= parameters
+func parseStreamFilter(r *http.Request) (StreamFilter, error) {
+	filter := StreamFilter{
+		DeviceIDs: make(map[string]bool),
+		Types:     make(map[models.StreamEventType]bool),
+	}
+
+	for _, deviceID := range splitList(r.URL.Query().Get("device")) {
+		filter.DeviceIDs[deviceID] = true
+	}
+
+	for _, value := range splitList(r.URL.Query().Get("types")) {
+		eventType := models.StreamEventType(value)
+		switch eventType {
+		case models.StreamEventReading, models.StreamEventAnomaly, models.StreamEventHealth, models.StreamEventFace:
+			filter.Types[eventType] = true
+		default:
+			return filter, fmt.Errorf("invalid event type %q", value)
+		}
+	}
+
+	return filter, nil
+}
+
+// splitList splits a comma-separated query parameter, ignoring empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
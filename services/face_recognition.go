@@ -12,12 +12,16 @@ import (
 type FaceRecognitionService struct {
 	logger          *zap.Logger
 	telegramService *TelegramService
+	store           SensorStore
+	eventHub        *EventHub
 }
 
 // NewFaceRecognitionService creates a new face recognition service
-func NewFaceRecognitionService(telegramService *TelegramService, logger *zap.Logger) *FaceRecognitionService {
+func NewFaceRecognitionService(telegramService *TelegramService, store SensorStore, eventHub *EventHub, logger *zap.Logger) *FaceRecognitionService {
 	return &FaceRecognitionService{
 		telegramService: telegramService,
+		store:           store,
+		eventHub:        eventHub,
 		logger:          logger,
 	}
 }
@@ -39,29 +43,44 @@ func (f *FaceRecognitionService) Start(ctx context.Context, faceDataChan <-chan
 			}
 
 			// Process the face recognition data
-			f.processFaceData(faceData)
+			f.processFaceData(ctx, faceData)
 		}
 	}
 }
 
 // processFaceData processes face recognition data and sends alerts
-func (f *FaceRecognitionService) processFaceData(faceData *models.FaceRecognitionData) {
+func (f *FaceRecognitionService) processFaceData(ctx context.Context, faceData *models.FaceRecognitionData) {
 	f.logger.Info("Processing face recognition data",
 		zap.String("uid", faceData.UID),
+		zap.String("device_id", faceData.DeviceID),
+		zap.String("site", faceData.Site),
 		zap.Time("timestamp", faceData.Timestamp),
 		zap.Bool("has_image", faceData.Base64 != ""))
 
+	event := &models.FaceEvent{
+		UID:       faceData.UID,
+		Timestamp: faceData.Timestamp,
+		HasImage:  faceData.Base64 != "",
+	}
+	f.eventHub.Publish(models.StreamEventFace, "", event)
+
 	// Format timestamp for display
 	timestampStr := faceData.Timestamp.Format("2006-01-02 15:04:05")
 
-	// Send Telegram notification with photo
+	// Queue Telegram notification with photo first, so a slow store can't delay it
 	if err := f.telegramService.SendUnknownPersonAlert(faceData.UID, faceData.Base64, timestampStr); err != nil {
 		f.logger.Error("Failed to send unknown person alert",
 			zap.String("uid", faceData.UID),
 			zap.Error(err))
-		return
+	} else {
+		f.logger.Info("Unknown person alert queued",
+			zap.String("uid", faceData.UID))
 	}
 
-	f.logger.Info("Unknown person alert sent successfully",
-		zap.String("uid", faceData.UID))
+	// Record the event for the API (the image itself is not stored)
+	if err := f.store.WriteFaceEvent(ctx, event); err != nil {
+		f.logger.Error("Failed to record face event",
+			zap.String("uid", faceData.UID),
+			zap.Error(err))
+	}
 }
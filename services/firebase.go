@@ -2,7 +2,9 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"kaelo/config"
@@ -15,15 +17,22 @@ import (
 )
 
 type FirebaseService struct {
-	client *db.Client
-	config *config.Config
-	logger *zap.Logger
+	client   *db.Client
+	config   *config.Config
+	logger   *zap.Logger
+	latest   map[string]*models.SensorData // newest reading per device, mirrors the latest node
+	latestMu sync.RWMutex
 }
 
 func NewFirebaseService(cfg *config.Config) (*FirebaseService, error) {
 	logger, _ := zap.NewProduction()
 	ctx := context.Background()
 
+	if !validPathLayout(cfg.FirebasePathLayout) {
+		return nil, fmt.Errorf("invalid FIREBASE_PATH_LAYOUT %q (expected %s or %s)",
+			cfg.FirebasePathLayout, PathLayoutFlat, PathLayoutDeviceDate)
+	}
+
 	// Parse the service account JSON from environment variable
 	serviceAccountJSON := []byte(cfg.FirebaseServiceAccountJSON)
 
@@ -48,6 +57,7 @@ func NewFirebaseService(cfg *config.Config) (*FirebaseService, error) {
 		client: client,
 		config: cfg,
 		logger: logger,
+		latest: make(map[string]*models.SensorData),
 	}
 
 	// Test Firebase connection with retry
@@ -90,10 +100,18 @@ func (fs *FirebaseService) testConnection() error {
 	return fmt.Errorf("failed to connect to Firebase after %d attempts", maxRetries)
 }
 
+// Ping checks that the Firebase Realtime Database is reachable
+func (fs *FirebaseService) Ping(ctx context.Context) error {
+	// Read a small node instead of the root to keep the check cheap
+	var data interface{}
+	if err := fs.client.NewRef("service-health").Get(ctx, &data); err != nil {
+		return fmt.Errorf("firebase unreachable: %w", err)
+	}
+	return nil
+}
+
 // SubscribeToSensorData subscribes to sensor data updates from Firebase using optimized polling
 func (fs *FirebaseService) SubscribeToSensorData(ctx context.Context, callback func(*models.SensorData)) error {
-	ref := fs.client.NewRef("sensor-data")
-
 	// Track last read timestamp and processed records
 	lastReadTime := time.Now().Add(-1 * time.Minute)
 	processedRecords := make(map[string]bool)
@@ -113,11 +131,9 @@ func (fs *FirebaseService) SubscribeToSensorData(ctx context.Context, callback f
 				fs.logger.Info("Firebase polling received shutdown signal")
 				return
 			case <-ticker.C:
-				// Query records newer than lastReadTime using orderBy + startAt (index enabled)
-				query := ref.OrderByChild("timestamp").StartAt(lastReadTime.Format(time.RFC3339))
-
-				var data map[string]interface{}
-				if err := query.Get(ctx, &data); err != nil {
+				// Query records newer than lastReadTime using the timestamp index (works with every path layout)
+				data, err := fs.readingsSince(ctx, lastReadTime)
+				if err != nil {
 					fs.logger.Error("Error getting sensor data", zap.Error(err))
 					continue
 				}
@@ -130,38 +146,30 @@ func (fs *FirebaseService) SubscribeToSensorData(ctx context.Context, callback f
 				latestTimestamp := lastReadTime
 
 				// Process each record
-				for randomID, randomData := range data {
-					if randomMap, ok := randomData.(map[string]interface{}); ok {
-						// Skip if already processed
-						if processedRecords[randomID] {
-							continue
-						}
+				for recordID, sensorData := range data {
+					// Skip if already processed or not newer
+					if processedRecords[recordID] || !sensorData.Timestamp.After(lastReadTime) {
+						continue
+					}
 
-						sensorData := fs.parseSensorData(randomID, randomMap)
-						if sensorData != nil {
-							// Only process if timestamp is newer
-							if sensorData.Timestamp.After(lastReadTime) {
-								processedRecords[randomID] = true
-								callback(sensorData)
-								newRecordsCount++
-
-								// Update latest timestamp
-								if sensorData.Timestamp.After(latestTimestamp) {
-									latestTimestamp = sensorData.Timestamp
-								}
-
-								fs.logger.Debug("New sensor data received",
-									zap.String("record_id", randomID),
-									zap.String("device_id", sensorData.DeviceID),
-									zap.Float64("temperature_dht", sensorData.TemperatureDHT),
-									zap.Float64("temperature_mpu", sensorData.TemperatureMPU),
-									zap.Float64("humidity", sensorData.Humidity),
-									zap.String("gas_quality", sensorData.GasQuality),
-									zap.Bool("flame_detected", sensorData.FlameDetected),
-								)
-							}
-						}
+					processedRecords[recordID] = true
+					callback(sensorData)
+					newRecordsCount++
+
+					// Update latest timestamp
+					if sensorData.Timestamp.After(latestTimestamp) {
+						latestTimestamp = sensorData.Timestamp
 					}
+
+					fs.logger.Debug("New sensor data received",
+						zap.String("record_id", recordID),
+						zap.String("device_id", sensorData.DeviceID),
+						zap.Float64("temperature_dht", sensorData.TemperatureDHT),
+						zap.Float64("temperature_mpu", sensorData.TemperatureMPU),
+						zap.Float64("humidity", sensorData.Humidity),
+						zap.String("gas_quality", sensorData.GasQuality),
+						zap.Bool("flame_detected", sensorData.FlameDetected),
+					)
 				}
 
 				// Update lastReadTime
@@ -193,84 +201,45 @@ func (fs *FirebaseService) SubscribeToSensorData(ctx context.Context, callback f
 	return nil
 }
 
-// parseSensorData converts Firebase data to SensorData struct
-func (fs *FirebaseService) parseSensorData(randomID string, data map[string]interface{}) *models.SensorData {
-	// Extract device_id from the nested data
-	deviceID, deviceOk := data["device_id"].(string)
-	temperatureDHT, tempDHTOk := data["temperature_dht"].(float64)
-	temperatureMPU, tempMPUOk := data["temperature_mpu"].(float64)
-	humidity, humOk := data["humidity"].(float64)
-	gasQuality, gasOk := data["gas_quality"].(string)
-	flameDetected, flameOk := data["flame_detected"].(bool)
-	timestampStr, timeOk := data["timestamp"].(string)
-
-	if !deviceOk || !tempDHTOk || !humOk || !gasOk || !timeOk {
-		fs.logger.Warn("Invalid sensor data format", zap.String("record_id", randomID))
-		return nil
-	}
+// readingsSince returns readings stored at or after a time, keyed by storage key
+func (fs *FirebaseService) readingsSince(ctx context.Context, since time.Time) (map[string]*models.SensorData, error) {
+	readings := make(map[string]*models.SensorData)
 
-	// Set defaults for optional fields
-	if !tempMPUOk {
-		temperatureMPU = 0
-	}
-	if !flameOk {
-		flameDetected = false
+	query := TimeRangeQuery{From: since, Limit: maxQueryLimit}
+	for {
+		page, err := fs.QueryReadings(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		for _, data := range page.Items {
+			readings[readingKey(data)] = data
+		}
+		if page.NextCursor == "" {
+			return readings, nil
+		}
+		query.Cursor = page.NextCursor
 	}
+}
 
-	// Parse timestamp
-	timestamp, err := time.Parse(time.RFC3339, timestampStr)
+// parseSensorData converts a stored record to SensorData, logging records that can't be decoded
+func (fs *FirebaseService) parseSensorData(randomID string, data map[string]interface{}) *models.SensorData {
+	sensorData, err := decodeSensorData(data)
 	if err != nil {
-		fs.logger.Warn("Invalid timestamp format",
+		fs.logger.Warn("Invalid sensor data format",
 			zap.String("record_id", randomID),
 			zap.Error(err))
 		return nil
 	}
-
-	return &models.SensorData{
-		DeviceID:       deviceID,
-		TemperatureDHT: temperatureDHT,
-		TemperatureMPU: temperatureMPU,
-		Humidity:       humidity,
-		GasQuality:     gasQuality,
-		FlameDetected:  flameDetected,
-		Timestamp:      timestamp,
-	}
+	return sensorData
 }
 
 // GetLatestSensorData retrieves the latest sensor data for a device
 func (fs *FirebaseService) GetLatestSensorData(ctx context.Context, deviceID string) (*models.SensorData, error) {
-	ref := fs.client.NewRef("sensor-data")
-
-	var data map[string]interface{}
-	if err := ref.Get(ctx, &data); err != nil {
-		return nil, fmt.Errorf("error getting sensor data: %v", err)
-	}
-
-	if data == nil {
-		return nil, fmt.Errorf("no data found")
-	}
-
-	// Find the latest entry for the specified device
-	var latestData *models.SensorData
-	var latestTime time.Time
-
-	for randomID, randomData := range data {
-		if randomMap, ok := randomData.(map[string]interface{}); ok {
-			sensorData := fs.parseSensorData(randomID, randomMap)
-			if sensorData != nil && sensorData.DeviceID == deviceID {
-				if latestData == nil || sensorData.Timestamp.After(latestTime) {
-					latestData = sensorData
-					latestTime = sensorData.Timestamp
-				}
-			}
-		}
-	}
-
-	if latestData == nil {
+	data, err := fs.LatestReading(ctx, deviceID)
+	if errors.Is(err, ErrNotFound) {
 		return nil, fmt.Errorf("no data found for device %s", deviceID)
 	}
-
-	return latestData, nil
+	return data, err
 }
 
 // WriteBatch writes a batch of sensor data to Firebase
@@ -282,45 +251,13 @@ func (fs *FirebaseService) WriteBatch(ctx context.Context, batch []*models.Senso
 	fs.logger.Info("Writing batch to Firebase",
 		zap.Int("batch_size", len(batch)))
 
-	ref := fs.client.NewRef("sensor-data")
+	ref := fs.client.NewRef(sensorDataPath)
 
 	// Use multi-path update for better performance
 	updates := make(map[string]interface{})
 
 	for _, data := range batch {
-		// Generate a unique key for each record (using timestamp + device ID)
-		key := fmt.Sprintf("%d-%s", data.Timestamp.UnixNano(), data.DeviceID)
-
-		// Convert struct to map
-		dataMap := map[string]interface{}{
-			"device_id":       data.DeviceID,
-			"temperature_dht": data.TemperatureDHT,
-			"temperature_mpu": data.TemperatureMPU,
-			"humidity":        data.Humidity,
-			"gas_quality":     data.GasQuality,
-			"flame_detected":  data.FlameDetected,
-			"timestamp":       data.Timestamp.Format(time.RFC3339),
-		}
-
-		// Add acceleration data if present
-		if data.Acceleration.X != 0 || data.Acceleration.Y != 0 || data.Acceleration.Z != 0 {
-			dataMap["acceleration"] = map[string]interface{}{
-				"x": data.Acceleration.X,
-				"y": data.Acceleration.Y,
-				"z": data.Acceleration.Z,
-			}
-		}
-
-		// Add gyroscope data if present
-		if data.Gyroscope.X != 0 || data.Gyroscope.Y != 0 || data.Gyroscope.Z != 0 {
-			dataMap["gyroscope"] = map[string]interface{}{
-				"x": data.Gyroscope.X,
-				"y": data.Gyroscope.Y,
-				"z": data.Gyroscope.Z,
-			}
-		}
-
-		updates[key] = dataMap
+		updates[fs.readingPath(data)] = encodeSensorData(data)
 	}
 
 	// Perform batch update with timeout
@@ -337,6 +274,9 @@ func (fs *FirebaseService) WriteBatch(ctx context.Context, batch []*models.Senso
 	fs.logger.Info("Successfully wrote batch to Firebase",
 		zap.Int("batch_size", len(batch)))
 
+	// The readings are stored; a stale latest node is fixed by the next newer batch
+	fs.updateLatest(ctx, batch)
+
 	return nil
 }
 
@@ -0,0 +1,351 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"kaelo/models"
+)
+
+// sensorField describes how one field of a reading is stored on Firebase.
+// encodeSensorData and decodeSensorData both walk sensorDataSchema, so a field added
+// here is written and read back the same way.
+type sensorField struct {
+	name     string
+	aliases  []string // names used by older record shapes, tried when name is missing
+	required bool
+	encode   func(data *models.SensorData) interface{} // nil leaves the field out
+	decode   func(data *models.SensorData, value interface{}) error
+}
+
+// sensorDataSchema lists the stored fields of a reading.
+// Acceleration and gyroscope are always written, zero values included, so a reading at rest
+// reads back the same as it was received. Values the reading doesn't carry (see
+// models.SensorData.Has) are left out; invalid_fields records which were cleared.
+var sensorDataSchema = []sensorField{
+	{
+		name:     "device_id",
+		required: true,
+		encode:   func(data *models.SensorData) interface{} { return data.DeviceID },
+		decode: func(data *models.SensorData, value interface{}) (err error) {
+			data.DeviceID, err = decodeString(value)
+			if err == nil && data.DeviceID == "" {
+				err = fmt.Errorf("empty")
+			}
+			return err
+		},
+	},
+	{
+		// RFC3339 in UTC with nanoseconds, see storedTimestamp
+		name:     "timestamp",
+		required: true,
+		encode:   func(data *models.SensorData) interface{} { return storedTimestamp(data.Timestamp) },
+		decode: func(data *models.SensorData, value interface{}) (err error) {
+			data.Timestamp, err = decodeTimestamp(value)
+			return err
+		},
+	},
+	{
+		name: "timestamp_assigned",
+		encode: func(data *models.SensorData) interface{} {
+			if !data.TimestampAssigned {
+				return nil
+			}
+			return true
+		},
+		decode: func(data *models.SensorData, value interface{}) (err error) {
+			data.TimestampAssigned, err = decodeBool(value)
+			return err
+		},
+	},
+	{
+		name: "invalid_fields",
+		encode: func(data *models.SensorData) interface{} {
+			if len(data.InvalidFields) == 0 {
+				return nil
+			}
+			return data.InvalidFields
+		},
+		decode: func(data *models.SensorData, value interface{}) error {
+			if names, ok := value.([]string); ok {
+				data.InvalidFields = names
+				return nil
+			}
+			fields, ok := value.([]interface{})
+			if !ok {
+				return fmt.Errorf("expected a list, got %T", value)
+			}
+			for _, field := range fields {
+				name, err := decodeString(field)
+				if err != nil {
+					return err
+				}
+				data.InvalidFields = append(data.InvalidFields, name)
+			}
+			return nil
+		},
+	},
+	{
+		name: "site",
+		encode: func(data *models.SensorData) interface{} {
+			if data.Site == "" {
+				return nil
+			}
+			return data.Site
+		},
+		decode: func(data *models.SensorData, value interface{}) (err error) {
+			data.Site, err = decodeString(value)
+			return err
+		},
+	},
+	{
+		name: "message_id",
+		encode: func(data *models.SensorData) interface{} {
+			if data.MessageID == "" {
+				return nil
+			}
+			return data.MessageID
+		},
+		decode: func(data *models.SensorData, value interface{}) (err error) {
+			data.MessageID, err = decodeString(value)
+			return err
+		},
+	},
+	{
+		name: "seq",
+		encode: func(data *models.SensorData) interface{} {
+			if data.Seq == 0 {
+				return nil
+			}
+			return data.Seq
+		},
+		decode: func(data *models.SensorData, value interface{}) error {
+			seq, err := decodeFloat(value)
+			if err != nil {
+				return err
+			}
+			if seq < 0 {
+				return fmt.Errorf("negative")
+			}
+			data.Seq = uint64(seq)
+			return nil
+		},
+	},
+	{
+		name: "schema_version",
+		encode: func(data *models.SensorData) interface{} {
+			if data.SchemaVersion == 0 {
+				return nil
+			}
+			return data.SchemaVersion
+		},
+		decode: func(data *models.SensorData, value interface{}) error {
+			version, err := decodeFloat(value)
+			data.SchemaVersion = int(version)
+			return err
+		},
+	},
+	{
+		name:    "temperature_dht",
+		aliases: []string{"temperature"},
+		encode: func(data *models.SensorData) interface{} {
+			return sensorValue(data, "temperature_dht", data.TemperatureDHT)
+		},
+		decode: func(data *models.SensorData, value interface{}) (err error) {
+			data.TemperatureDHT, err = decodeFloat(value)
+			return err
+		},
+	},
+	{
+		name: "temperature_mpu",
+		encode: func(data *models.SensorData) interface{} {
+			return sensorValue(data, "temperature_mpu", data.TemperatureMPU)
+		},
+		decode: func(data *models.SensorData, value interface{}) (err error) {
+			data.TemperatureMPU, err = decodeFloat(value)
+			return err
+		},
+	},
+	{
+		name:   "humidity",
+		encode: func(data *models.SensorData) interface{} { return sensorValue(data, "humidity", data.Humidity) },
+		decode: func(data *models.SensorData, value interface{}) (err error) {
+			data.Humidity, err = decodeFloat(value)
+			return err
+		},
+	},
+	{
+		name:   "gas_quality",
+		encode: func(data *models.SensorData) interface{} { return data.GasQuality },
+		decode: func(data *models.SensorData, value interface{}) (err error) {
+			data.GasQuality, err = decodeString(value)
+			return err
+		},
+	},
+	{
+		name:   "flame_detected",
+		encode: func(data *models.SensorData) interface{} { return data.FlameDetected },
+		decode: func(data *models.SensorData, value interface{}) (err error) {
+			data.FlameDetected, err = decodeBool(value)
+			return err
+		},
+	},
+	{
+		name: "acceleration",
+		encode: func(data *models.SensorData) interface{} {
+			if !data.Has("acceleration") {
+				return nil
+			}
+			return encodeVector(data.Acceleration.X, data.Acceleration.Y, data.Acceleration.Z)
+		},
+		decode: func(data *models.SensorData, value interface{}) error {
+			return decodeVector(value, &data.Acceleration.X, &data.Acceleration.Y, &data.Acceleration.Z)
+		},
+	},
+	{
+		name: "gyroscope",
+		encode: func(data *models.SensorData) interface{} {
+			if !data.Has("gyroscope") {
+				return nil
+			}
+			return encodeVector(data.Gyroscope.X, data.Gyroscope.Y, data.Gyroscope.Z)
+		},
+		decode: func(data *models.SensorData, value interface{}) error {
+			return decodeVector(value, &data.Gyroscope.X, &data.Gyroscope.Y, &data.Gyroscope.Z)
+		},
+	},
+}
+
+// encodeSensorData converts a reading to its Firebase representation
+func encodeSensorData(data *models.SensorData) map[string]interface{} {
+	record := make(map[string]interface{}, len(sensorDataSchema))
+	for _, field := range sensorDataSchema {
+		if value := field.encode(data); value != nil {
+			record[field.name] = value
+		}
+	}
+	return record
+}
+
+// decodeSensorData converts a stored record to a reading. Only device_id and timestamp are
+// required; other missing fields, including motion data in records written before it was
+// always stored, decode to zero. Numbers and booleans stored as strings are accepted.
+func decodeSensorData(record map[string]interface{}) (*models.SensorData, error) {
+	data := &models.SensorData{}
+	for _, field := range sensorDataSchema {
+		value, ok := record[field.name]
+		for _, alias := range field.aliases {
+			if ok {
+				break
+			}
+			value, ok = record[alias]
+		}
+
+		if !ok || value == nil {
+			if field.required {
+				return nil, fmt.Errorf("missing %s", field.name)
+			}
+			continue
+		}
+		if err := field.decode(data, value); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", field.name, err)
+		}
+	}
+	return data, nil
+}
+
+// sensorValue returns a sensor value to store, nil when the reading doesn't carry it
+func sensorValue(data *models.SensorData, field string, value float64) interface{} {
+	if !data.Has(field) {
+		return nil
+	}
+	return value
+}
+
+// encodeVector stores the three axes of a motion sensor
+func encodeVector(x, y, z float64) map[string]interface{} {
+	return map[string]interface{}{"x": x, "y": y, "z": z}
+}
+
+// decodeVector reads the axes of a motion sensor, missing axes are zero
+func decodeVector(value interface{}, x, y, z *float64) error {
+	axes, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("expected an object, got %T", value)
+	}
+
+	for name, target := range map[string]*float64{"x": x, "y": y, "z": z} {
+		axis, ok := axes[name]
+		if !ok || axis == nil {
+			continue
+		}
+		v, err := decodeFloat(axis)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		*target = v
+	}
+	return nil
+}
+
+// decodeString reads a string value
+func decodeString(value interface{}) (string, error) {
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("expected a string, got %T", value)
+	}
+	return s, nil
+}
+
+// decodeFloat reads a number, also accepting numbers stored as strings
+func decodeFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case json.Number:
+		return v.Float64()
+	case string:
+		return strconv.ParseFloat(v, 64)
+	default:
+		return 0, fmt.Errorf("expected a number, got %T", value)
+	}
+}
+
+// decodeBool reads a boolean, also accepting 0/1 and booleans stored as strings
+func decodeBool(value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case float64:
+		return v != 0, nil
+	case string:
+		return strconv.ParseBool(v)
+	default:
+		return false, fmt.Errorf("expected a boolean, got %T", value)
+	}
+}
+
+// decodeTimestamp reads an RFC3339 timestamp, or unix seconds or milliseconds
+// as written by devices that stored readings directly
+func decodeTimestamp(value interface{}) (time.Time, error) {
+	if s, ok := value.(string); ok {
+		return time.Parse(time.RFC3339Nano, s)
+	}
+
+	unix, err := decodeFloat(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected RFC3339 or unix time, got %T", value)
+	}
+	if unix > 1e12 {
+		return time.UnixMilli(int64(unix)), nil
+	}
+	return time.Unix(int64(unix), 0), nil
+}
@@ -0,0 +1,216 @@
+package services
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"kaelo/models"
+)
+
+// roundTrip encodes a reading and decodes it again, directly and through JSON as Firebase
+// stores it
+func roundTrip(t *testing.T, data *models.SensorData) (direct, stored *models.SensorData) {
+	t.Helper()
+
+	record := encodeSensorData(data)
+	direct, err := decodeSensorData(record)
+	if err != nil {
+		t.Fatalf("decodeSensorData(%v): %v", record, err)
+	}
+
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	stored, err = decodeSensorData(decoded)
+	if err != nil {
+		t.Fatalf("decodeSensorData(%s): %v", encoded, err)
+	}
+	return direct, stored
+}
+
+// assertSameReading compares readings, timestamps by instant
+func assertSameReading(t *testing.T, got, want *models.SensorData) {
+	t.Helper()
+
+	if !got.Timestamp.Equal(want.Timestamp) {
+		t.Errorf("timestamp = %s, want %s", got.Timestamp, want.Timestamp)
+	}
+	gotCopy, wantCopy := *got, *want
+	gotCopy.Timestamp, wantCopy.Timestamp = time.Time{}, time.Time{}
+	if !reflect.DeepEqual(gotCopy, wantCopy) {
+		t.Errorf("decoded %+v, want %+v", gotCopy, wantCopy)
+	}
+}
+
+func TestSensorDataRoundTrip(t *testing.T) {
+	bangkok := time.FixedZone("ICT", 7*3600)
+
+	tests := []struct {
+		name string
+		data *models.SensorData
+	}{
+		{
+			name: "full reading",
+			data: &models.SensorData{
+				SchemaVersion:  2,
+				DeviceID:       "ESP32-001",
+				Site:           "site-a",
+				MessageID:      "abc",
+				Seq:            42,
+				TemperatureDHT: 27.4,
+				Humidity:       60.5,
+				GasQuality:     "moderate",
+				Acceleration:   models.AccelerationData{X: 0.01, Y: -0.02, Z: 9.81},
+				Gyroscope:      models.GyroscopeData{X: 0.5, Y: 0, Z: -0.25},
+				FlameDetected:  true,
+				Timestamp:      time.Date(2024, 5, 1, 10, 5, 30, 123456789, bangkok),
+			},
+		},
+		{
+			name: "device at rest",
+			data: &models.SensorData{
+				DeviceID:       "ESP32-002",
+				TemperatureDHT: 25,
+				Humidity:       55,
+				GasQuality:     "good",
+				Timestamp:      time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name: "server-assigned timestamp",
+			data: &models.SensorData{
+				SchemaVersion:     1,
+				DeviceID:          "ESP32-003",
+				Seq:               7,
+				TemperatureDHT:    24,
+				TemperatureMPU:    24.5,
+				GasQuality:        "good",
+				Timestamp:         time.Date(2024, 5, 1, 3, 0, 0, 1000, time.UTC),
+				TimestampAssigned: true,
+			},
+		},
+		{
+			name: "values cleared as out of range",
+			data: &models.SensorData{
+				SchemaVersion:  2,
+				DeviceID:       "ESP32-004",
+				TemperatureDHT: 26,
+				GasQuality:     "poor",
+				FlameDetected:  true,
+				Acceleration:   models.AccelerationData{Z: 9.81},
+				Timestamp:      time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC),
+				InvalidFields:  []string{"humidity", "gyroscope"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			direct, stored := roundTrip(t, tt.data)
+			assertSameReading(t, direct, tt.data)
+			assertSameReading(t, stored, tt.data)
+		})
+	}
+}
+
+func TestSensorDataStoredTimestampIsUTC(t *testing.T) {
+	data := &models.SensorData{
+		DeviceID:  "ESP32-001",
+		Timestamp: time.Date(2024, 5, 1, 10, 5, 30, 500000000, time.FixedZone("ICT", 7*3600)),
+	}
+
+	if got, want := encodeSensorData(data)["timestamp"], "2024-05-01T03:05:30.500000000Z"; got != want {
+		t.Errorf("stored timestamp = %v, want %s", got, want)
+	}
+}
+
+func TestSensorDataOmitsMissingValues(t *testing.T) {
+	record := encodeSensorData(&models.SensorData{
+		DeviceID:      "ESP32-001",
+		Timestamp:     time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC),
+		InvalidFields: []string{"humidity", "acceleration"},
+	})
+
+	for _, field := range []string{"humidity", "acceleration", "temperature_mpu"} {
+		if value, ok := record[field]; ok {
+			t.Errorf("stored %s = %v, want it left out", field, value)
+		}
+	}
+	for _, field := range []string{"temperature_dht", "gyroscope"} {
+		if _, ok := record[field]; !ok {
+			t.Errorf("%s not stored", field)
+		}
+	}
+}
+
+func TestDecodeLegacySensorData(t *testing.T) {
+	tests := []struct {
+		name   string
+		record map[string]interface{}
+		want   *models.SensorData
+	}{
+		{
+			name: "unix seconds",
+			record: map[string]interface{}{
+				"device_id": "ESP32-001", "timestamp": float64(1714532730), "temperature": 27.5,
+			},
+			want: &models.SensorData{DeviceID: "ESP32-001", TemperatureDHT: 27.5, Timestamp: time.Unix(1714532730, 0)},
+		},
+		{
+			name: "unix milliseconds",
+			record: map[string]interface{}{
+				"device_id": "ESP32-001", "timestamp": float64(1714532730250), "humidity": 61.0,
+			},
+			want: &models.SensorData{DeviceID: "ESP32-001", Humidity: 61, Timestamp: time.UnixMilli(1714532730250)},
+		},
+		{
+			name: "local offset without motion data",
+			record: map[string]interface{}{
+				"device_id": "ESP32-001", "timestamp": "2024-05-01T10:05:30+07:00",
+				"temperature_dht": "27.5", "flame_detected": "true", "gas_quality": "good",
+			},
+			want: &models.SensorData{
+				DeviceID:       "ESP32-001",
+				TemperatureDHT: 27.5,
+				FlameDetected:  true,
+				GasQuality:     "good",
+				Timestamp:      time.Date(2024, 5, 1, 3, 5, 30, 0, time.UTC),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeSensorData(tt.record)
+			if err != nil {
+				t.Fatalf("decodeSensorData: %v", err)
+			}
+			assertSameReading(t, got, tt.want)
+
+			// Rewritten in the current format, the record reads back the same
+			direct, stored := roundTrip(t, got)
+			assertSameReading(t, direct, tt.want)
+			assertSameReading(t, stored, tt.want)
+		})
+	}
+}
+
+func TestDecodeSensorDataRequiresDeviceAndTimestamp(t *testing.T) {
+	for _, record := range []map[string]interface{}{
+		{"timestamp": "2024-05-01T03:05:30Z"},
+		{"device_id": "", "timestamp": "2024-05-01T03:05:30Z"},
+		{"device_id": "ESP32-001"},
+		{"device_id": "ESP32-001", "timestamp": "yesterday"},
+	} {
+		if _, err := decodeSensorData(record); err == nil {
+			t.Errorf("decodeSensorData(%v) succeeded, want an error", record)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"kaelo/models"
+
+	"firebase.google.com/go/v4/db"
+	"go.uber.org/zap"
+)
+
+// Firebase path layouts for readings selectable via FIREBASE_PATH_LAYOUT
+const (
+	// PathLayoutFlat stores readings at sensor-data/{key}
+	PathLayoutFlat = "flat"
+	// PathLayoutDeviceDate stores readings at sensor-data/{device_id}/{YYYY-MM-DD}/{key}
+	PathLayoutDeviceDate = "device_date"
+)
+
+// validPathLayout reports whether a path layout is supported
+func validPathLayout(layout string) bool {
+	return layout == PathLayoutFlat || layout == PathLayoutDeviceDate
+}
+
+// deviceDatePath returns the path of a reading below sensor-data in the device_date layout
+func deviceDatePath(deviceID, timestamp, key string) string {
+	return sanitizeKey(deviceID) + "/" + dayOf(timestamp) + "/" + key
+}
+
+// readingPath returns the path of a reading below sensor-data in the configured layout
+func (fs *FirebaseService) readingPath(data *models.SensorData) string {
+	if fs.config.FirebasePathLayout == PathLayoutDeviceDate {
+		return deviceDatePath(data.DeviceID, storedTimestamp(data.Timestamp), readingKey(data))
+	}
+	return readingKey(data)
+}
+
+// isDay reports whether a key is a day partition
+func isDay(key string) bool {
+	_, err := time.Parse("2006-01-02", key)
+	return err == nil
+}
+
+// childKeys returns the keys of a node's children in ascending order without downloading them
+func (fs *FirebaseService) childKeys(ctx context.Context, ref *db.Ref) ([]string, error) {
+	var children map[string]interface{}
+	if err := ref.GetShallow(ctx, &children); err != nil {
+		return nil, fmt.Errorf("error listing %s: %w", ref.Path, err)
+	}
+
+	keys := make([]string, 0, len(children))
+	for key := range children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// dayKeys returns the day partitions of a device in ascending order
+func (fs *FirebaseService) dayKeys(ctx context.Context, deviceRef *db.Ref) ([]string, error) {
+	keys, err := fs.childKeys(ctx, deviceRef)
+	if err != nil {
+		return nil, err
+	}
+
+	days := keys[:0]
+	for _, key := range keys {
+		if isDay(key) {
+			days = append(days, key)
+		}
+	}
+	return days, nil
+}
+
+// keyedReading is a reading with the values it is ordered by
+type keyedReading struct {
+	data      *models.SensorData
+	sortValue string
+	key       string
+}
+
+// queryPartitionedReadings returns a page of readings stored in the device_date layout.
+// Each device is queried day by day and the results are merged in query order.
+func (fs *FirebaseService) queryPartitionedReadings(ctx context.Context, q TimeRangeQuery) (Page[*models.SensorData], error) {
+	limit := q.normalizedLimit()
+	descending := q.descending()
+	ref := fs.client.NewRef(sensorDataPath)
+
+	var devices []string
+	if q.DeviceID != "" {
+		devices = []string{sanitizeKey(q.DeviceID)}
+	} else {
+		var err error
+		if devices, err = fs.childKeys(ctx, ref); err != nil {
+			return Page[*models.SensorData]{}, err
+		}
+	}
+
+	var readings []keyedReading
+	more := false
+	for _, device := range devices {
+		deviceReadings, deviceMore, err := fs.queryDeviceReadings(ctx, ref.Child(device), q, limit)
+		if err != nil {
+			return Page[*models.SensorData]{}, err
+		}
+		readings = append(readings, deviceReadings...)
+		more = more || deviceMore
+	}
+
+	sort.Slice(readings, func(i, j int) bool {
+		a, b := readings[i], readings[j]
+		if a.sortValue != b.sortValue {
+			return (a.sortValue < b.sortValue) != descending
+		}
+		return (a.key < b.key) != descending
+	})
+	if len(readings) > limit {
+		readings = readings[:limit]
+		more = true
+	}
+
+	page := Page[*models.SensorData]{Items: make([]*models.SensorData, len(readings))}
+	for i, reading := range readings {
+		page.Items[i] = reading.data
+	}
+	if more && len(readings) > 0 {
+		last := readings[len(readings)-1]
+		page.NextCursor = encodeCursor(last.sortValue, last.key)
+	}
+
+	return page, nil
+}
+
+// queryDeviceReadings returns up to limit readings of one device in query order and whether
+// more may exist. Days outside the time range or before the cursor are skipped.
+func (fs *FirebaseService) queryDeviceReadings(ctx context.Context, deviceRef *db.Ref, q TimeRangeQuery, limit int) ([]keyedReading, bool, error) {
+	days, err := fs.dayKeys(ctx, deviceRef)
+	if err != nil {
+		return nil, false, err
+	}
+
+	descending := q.descending()
+	if descending {
+		sort.Sort(sort.Reverse(sort.StringSlice(days)))
+	}
+
+	var cursorDay string
+	if q.Cursor != "" {
+		cursorValue, _, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return nil, false, err
+		}
+		cursorDay = dayOf(cursorValue)
+	}
+
+	var readings []keyedReading
+	for i, day := range days {
+		if (!q.From.IsZero() && day < dayOf(storedTimestamp(q.From))) || (!q.To.IsZero() && day > dayOf(storedTimestamp(q.To))) {
+			continue
+		}
+		if cursorDay != "" && ((descending && day > cursorDay) || (!descending && day < cursorDay)) {
+			continue
+		}
+
+		// The cursor is a bound on (timestamp, key), so it can be applied to every day
+		dayQuery := q
+		dayQuery.Limit = limit - len(readings)
+
+		page, err := queryTimestampPage(ctx, deviceRef.Child(day), dayQuery,
+			func(key string, node db.QueryNode) (keyedReading, string, bool) {
+				var data map[string]interface{}
+				if err := node.Unmarshal(&data); err != nil {
+					return keyedReading{}, "", false
+				}
+
+				sensorData := fs.parseSensorData(key, data)
+				if sensorData == nil || (q.DeviceID != "" && sensorData.DeviceID != q.DeviceID) {
+					return keyedReading{}, "", false
+				}
+
+				sortValue, _ := data["timestamp"].(string)
+				return keyedReading{data: sensorData, sortValue: sortValue, key: key}, sortValue, true
+			})
+		if err != nil {
+			return nil, false, err
+		}
+
+		readings = append(readings, page.Items...)
+		if page.NextCursor != "" {
+			return readings, true, nil
+		}
+		if len(readings) >= limit {
+			return readings, i < len(days)-1, nil
+		}
+	}
+
+	return readings, false, nil
+}
+
+// prunePartitionedReadings deletes whole days of readings older than the cutoff for every
+// device, one day per request
+func (fs *FirebaseService) prunePartitionedReadings(ctx context.Context, cutoff time.Time, opts PruneOptions) (int, error) {
+	ref := fs.client.NewRef(sensorDataPath)
+	cutoffDay := dayOf(storedTimestamp(cutoff))
+
+	devices, err := fs.childKeys(ctx, ref)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, device := range devices {
+		deviceRef := ref.Child(device)
+		days, err := fs.dayKeys(ctx, deviceRef)
+		if err != nil {
+			return removed, err
+		}
+
+		for _, day := range days {
+			if day >= cutoffDay {
+				break
+			}
+
+			keys, err := fs.childKeys(ctx, deviceRef.Child(day))
+			if err != nil {
+				return removed, err
+			}
+			if err := fs.deleteKeys(ctx, deviceRef, []string{day}, opts.DryRun); err != nil {
+				return removed, err
+			}
+			removed += len(keys)
+		}
+	}
+
+	return removed, nil
+}
+
+// migratedReading returns the device_date path of a flat record and re-encodes its timestamp
+// like storedTimestamp, so records written with a local offset (e.g. +07:00) sort and prune
+// alongside new ones and land in their UTC day. It reports false for records without a
+// device_id or a valid timestamp.
+func migratedReading(key string, record map[string]interface{}) (string, bool) {
+	deviceID, _ := record["device_id"].(string)
+	timestamp, err := decodeTimestamp(record["timestamp"])
+	if deviceID == "" || err != nil {
+		return "", false
+	}
+
+	stored := storedTimestamp(timestamp)
+	record["timestamp"] = stored
+	return deviceDatePath(deviceID, stored, key), true
+}
+
+// LayoutMigrationResult reports the outcome of a path layout migration
+type LayoutMigrationResult struct {
+	Moved   int // Readings moved (or that would be moved in a dry run)
+	Skipped int // Records without a device_id or timestamp, left in place
+}
+
+// MigrateReadingLayout moves readings stored in the flat layout to the device_date layout.
+// Each chunk is moved with a single multi-path update, so a reading is never lost or
+// duplicated if the migration is interrupted; running it again continues where it stopped.
+// progress is called after every chunk with the running totals.
+func (fs *FirebaseService) MigrateReadingLayout(ctx context.Context, chunkSize int, dryRun bool, progress func(LayoutMigrationResult)) (LayoutMigrationResult, error) {
+	ref := fs.client.NewRef(sensorDataPath)
+	var result LayoutMigrationResult
+
+	// Flat records have a timestamp child; device nodes don't and sort before any string,
+	// so starting at "" only returns flat records
+	lastValue, lastKey := "", ""
+	fetch := chunkSize
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		nodes, err := ref.OrderByChild("timestamp").StartAt(lastValue).LimitToFirst(fetch).GetOrdered(ctx)
+		if err != nil {
+			return result, fmt.Errorf("error querying %s: %w", ref.Path, err)
+		}
+
+		updates := make(map[string]interface{})
+		progressed := false
+		for _, node := range nodes {
+			var record map[string]interface{}
+			if err := node.Unmarshal(&record); err != nil {
+				continue
+			}
+
+			timestamp, _ := record["timestamp"].(string)
+			if lastKey != "" && !pastCursor(timestamp, node.Key(), lastValue, lastKey, false) {
+				continue
+			}
+			lastValue, lastKey = timestamp, node.Key()
+			progressed = true
+
+			path, ok := migratedReading(node.Key(), record)
+			if !ok {
+				fs.logger.Warn("Skipping record without device_id or timestamp", zap.String("key", node.Key()))
+				result.Skipped++
+				continue
+			}
+
+			updates[node.Key()] = nil
+			updates[path] = record
+			result.Moved++
+		}
+
+		if len(updates) > 0 && !dryRun {
+			writeCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
+			err := ref.Update(writeCtx, updates)
+			cancel()
+			if err != nil {
+				result.Moved -= len(updates) / 2
+				return result, fmt.Errorf("failed to move readings: %w", err)
+			}
+		}
+		if progress != nil {
+			progress(result)
+		}
+
+		if len(nodes) < fetch {
+			return result, nil
+		}
+		if !progressed {
+			// A whole chunk shares the cursor timestamp, fetch more to get past it
+			fetch *= 2
+		} else {
+			fetch = chunkSize
+		}
+	}
+}
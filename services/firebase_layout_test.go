@@ -0,0 +1,36 @@
+package services
+
+import "testing"
+
+func TestMigratedReadingNormalizesTimestamp(t *testing.T) {
+	// 05:30 on 2 May in Bangkok is still 1 May in UTC
+	record := map[string]interface{}{
+		"device_id":       "ESP32-001",
+		"timestamp":       "2024-05-02T05:30:00.5+07:00",
+		"temperature_dht": 27.5,
+	}
+
+	path, ok := migratedReading("key-1", record)
+	if !ok {
+		t.Fatal("record with device_id and timestamp skipped")
+	}
+	if want := "2024-05-01T22:30:00.500000000Z"; record["timestamp"] != want {
+		t.Errorf("timestamp = %v, want %s", record["timestamp"], want)
+	}
+	if want := "ESP32-001/2024-05-01/key-1"; path != want {
+		t.Errorf("path = %s, want %s", path, want)
+	}
+	if record["temperature_dht"] != 27.5 {
+		t.Errorf("values changed: %v", record)
+	}
+
+	for _, invalid := range []map[string]interface{}{
+		{"timestamp": "2024-05-01T10:00:00Z"},
+		{"device_id": "ESP32-001", "timestamp": "yesterday"},
+		{"device_id": "ESP32-001"},
+	} {
+		if _, ok := migratedReading("key-2", invalid); ok {
+			t.Errorf("record %v not skipped", invalid)
+		}
+	}
+}
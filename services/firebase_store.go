@@ -0,0 +1,564 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"kaelo/models"
+
+	"firebase.google.com/go/v4/db"
+	"go.uber.org/zap"
+)
+
+const (
+	sensorDataPath = "sensor-data"
+	anomaliesPath  = "anomalies"
+	faceEventsPath = "face-events"
+	rollupsPath    = "rollups"
+	latestPath     = "latest"
+
+	// maxQueryFetch bounds how many records a single page may scan when filtering
+	maxQueryFetch = 10000
+)
+
+// timestampDecoder decodes a query node, returning the record, its timestamp sort value and
+// whether it matches the query filters
+type timestampDecoder[T any] func(key string, node db.QueryNode) (T, string, bool)
+
+// queryTimestampPage runs an indexed timestamp range query and returns one page of matching records.
+// Records filtered out by the decoder are skipped, fetching more records until the page is full.
+func queryTimestampPage[T any](ctx context.Context, ref *db.Ref, q TimeRangeQuery, decode timestampDecoder[T]) (Page[T], error) {
+	limit := q.normalizedLimit()
+	descending := q.descending()
+
+	var cursorValue, cursorKey string
+	hasCursor := q.Cursor != ""
+	if hasCursor {
+		var err error
+		if cursorValue, cursorKey, err = decodeCursor(q.Cursor); err != nil {
+			return Page[T]{}, err
+		}
+	}
+
+	fetch := limit + 1
+	for {
+		query := ref.OrderByChild("timestamp")
+
+		start, end := "", ""
+		if !q.From.IsZero() {
+			start = storedTimestamp(q.From)
+		}
+		if !q.To.IsZero() {
+			end = storedTimestamp(q.To)
+		}
+		if hasCursor {
+			if descending {
+				end = cursorValue
+			} else {
+				start = cursorValue
+			}
+		}
+		if start != "" {
+			query = query.StartAt(start)
+		}
+		if end != "" {
+			query = query.EndAt(end)
+		}
+		if descending {
+			query = query.LimitToLast(fetch)
+		} else {
+			query = query.LimitToFirst(fetch)
+		}
+
+		nodes, err := query.GetOrdered(ctx)
+		if err != nil {
+			return Page[T]{}, fmt.Errorf("error querying %s: %w", ref.Path, err)
+		}
+		if descending {
+			for i, j := 0, len(nodes)-1; i < j; i, j = i+1, j-1 {
+				nodes[i], nodes[j] = nodes[j], nodes[i]
+			}
+		}
+
+		var items []T
+		var lastValue, lastKey string
+		for _, node := range nodes {
+			item, sortValue, ok := decode(node.Key(), node)
+			if !ok {
+				continue
+			}
+			if hasCursor && !pastCursor(sortValue, node.Key(), cursorValue, cursorKey, descending) {
+				continue
+			}
+
+			if len(items) == limit {
+				// One more matching record exists, so there is a next page
+				return Page[T]{Items: items, NextCursor: encodeCursor(lastValue, lastKey)}, nil
+			}
+
+			items = append(items, item)
+			lastValue, lastKey = sortValue, node.Key()
+		}
+
+		exhausted := len(nodes) < fetch
+		if exhausted || fetch >= maxQueryFetch {
+			page := Page[T]{Items: items}
+			if !exhausted && len(items) > 0 {
+				page.NextCursor = encodeCursor(lastValue, lastKey)
+			}
+			return page, nil
+		}
+
+		fetch = min(fetch*4, maxQueryFetch)
+	}
+}
+
+// LatestReading returns the newest stored reading for a device from the in-process cache,
+// the latest/{device_id} node or, for devices not written since the node was introduced,
+// an indexed query
+func (fs *FirebaseService) LatestReading(ctx context.Context, deviceID string) (*models.SensorData, error) {
+	if latest, ok := fs.cachedLatest(deviceID); ok {
+		return latest, nil
+	}
+
+	var stored map[string]interface{}
+	if err := fs.client.NewRef(latestPath).Child(sanitizeKey(deviceID)).Get(ctx, &stored); err != nil {
+		return nil, fmt.Errorf("error getting latest reading: %w", err)
+	}
+	if stored != nil {
+		if latest := fs.parseSensorData(deviceID, stored); latest != nil {
+			return fs.cacheLatest(latest), nil
+		}
+	}
+
+	page, err := fs.QueryReadings(ctx, TimeRangeQuery{
+		DeviceID: deviceID,
+		Limit:    1,
+		Order:    SortDescending,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(page.Items) == 0 {
+		return nil, ErrNotFound
+	}
+	return fs.cacheLatest(page.Items[0]), nil
+}
+
+// updateLatest moves the latest/{device_id} node forward for devices whose newest reading in
+// the batch is newer than the stored one. Failures are logged, not returned.
+func (fs *FirebaseService) updateLatest(ctx context.Context, batch []*models.SensorData) {
+	newest := make(map[string]*models.SensorData)
+	for _, data := range batch {
+		if current, ok := newest[data.DeviceID]; !ok || data.Timestamp.After(current.Timestamp) {
+			newest[data.DeviceID] = data
+		}
+	}
+
+	for deviceID, data := range newest {
+		if cached, ok := fs.cachedLatest(deviceID); ok && !data.Timestamp.After(cached.Timestamp) {
+			continue
+		}
+
+		ref := fs.client.NewRef(latestPath).Child(sanitizeKey(deviceID))
+		latest := data
+
+		writeCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		err := ref.Transaction(writeCtx, func(node db.TransactionNode) (interface{}, error) {
+			var stored map[string]interface{}
+			if err := node.Unmarshal(&stored); err != nil {
+				return nil, err
+			}
+
+			// Another writer (e.g. spill replay) may have stored a newer reading
+			latest = data
+			if stored != nil {
+				if current := fs.parseSensorData(deviceID, stored); current != nil && !data.Timestamp.After(current.Timestamp) {
+					latest = current
+					return stored, nil
+				}
+			}
+			return encodeSensorData(data), nil
+		})
+		cancel()
+
+		if err != nil {
+			fs.logger.Warn("Failed to update latest reading",
+				zap.String("device_id", deviceID),
+				zap.Error(err))
+			continue
+		}
+		fs.cacheLatest(latest)
+	}
+}
+
+// cachedLatest returns the cached newest reading for a device
+func (fs *FirebaseService) cachedLatest(deviceID string) (*models.SensorData, bool) {
+	fs.latestMu.RLock()
+	defer fs.latestMu.RUnlock()
+	latest, ok := fs.latest[deviceID]
+	return latest, ok
+}
+
+// cacheLatest caches a reading unless a newer one is already cached, and returns the newest
+func (fs *FirebaseService) cacheLatest(data *models.SensorData) *models.SensorData {
+	fs.latestMu.Lock()
+	defer fs.latestMu.Unlock()
+	if current, ok := fs.latest[data.DeviceID]; ok && !data.Timestamp.After(current.Timestamp) {
+		return current
+	}
+	fs.latest[data.DeviceID] = data
+	return data
+}
+
+// QueryReadings returns stored readings in a time range
+func (fs *FirebaseService) QueryReadings(ctx context.Context, q TimeRangeQuery) (Page[*models.SensorData], error) {
+	if fs.config.FirebasePathLayout == PathLayoutDeviceDate {
+		return fs.queryPartitionedReadings(ctx, q)
+	}
+
+	return queryTimestampPage(ctx, fs.client.NewRef(sensorDataPath), q,
+		func(key string, node db.QueryNode) (*models.SensorData, string, bool) {
+			var data map[string]interface{}
+			if err := node.Unmarshal(&data); err != nil {
+				return nil, "", false
+			}
+
+			sensorData := fs.parseSensorData(key, data)
+			if sensorData == nil || (q.DeviceID != "" && sensorData.DeviceID != q.DeviceID) {
+				return nil, "", false
+			}
+
+			sortValue, _ := data["timestamp"].(string)
+			return sensorData, sortValue, true
+		})
+}
+
+// storedAnomaly is the Firebase representation of an anomaly
+type storedAnomaly struct {
+	Type        models.AnomalyType     `json:"type"`
+	Severity    models.AnomalySeverity `json:"severity"`
+	Value       float64                `json:"value"`
+	Threshold   float64                `json:"threshold"`
+	DeviceID    string                 `json:"device_id"`
+	Description string                 `json:"description"`
+	Timestamp   string                 `json:"timestamp"`
+}
+
+// WriteAnomalies records detected anomalies
+func (fs *FirebaseService) WriteAnomalies(ctx context.Context, anomalies []*models.Anomaly) error {
+	if len(anomalies) == 0 {
+		return nil
+	}
+
+	updates := make(map[string]interface{}, len(anomalies))
+	for _, anomaly := range anomalies {
+		updates[anomalyKey(anomaly)] = storedAnomaly{
+			Type:        anomaly.Type,
+			Severity:    anomaly.GetSeverity(),
+			Value:       anomaly.Value,
+			Threshold:   anomaly.Threshold,
+			DeviceID:    anomaly.DeviceID,
+			Description: anomaly.Description,
+			Timestamp:   storedTimestamp(anomaly.Timestamp),
+		}
+	}
+
+	writeCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	if err := fs.client.NewRef(anomaliesPath).Update(writeCtx, updates); err != nil {
+		fs.logger.Error("Failed to write anomalies to Firebase",
+			zap.Int("count", len(anomalies)),
+			zap.Error(err))
+		return fmt.Errorf("failed to write anomalies: %w", err)
+	}
+
+	return nil
+}
+
+// QueryAnomalies returns recorded anomalies in a time range
+func (fs *FirebaseService) QueryAnomalies(ctx context.Context, q AnomalyQuery) (Page[*models.Anomaly], error) {
+	return queryTimestampPage(ctx, fs.client.NewRef(anomaliesPath), q.TimeRangeQuery,
+		func(key string, node db.QueryNode) (*models.Anomaly, string, bool) {
+			var stored storedAnomaly
+			if err := node.Unmarshal(&stored); err != nil {
+				return nil, "", false
+			}
+
+			timestamp, err := time.Parse(time.RFC3339, stored.Timestamp)
+			if err != nil {
+				return nil, "", false
+			}
+
+			anomaly := &models.Anomaly{
+				Type:        stored.Type,
+				Value:       stored.Value,
+				Threshold:   stored.Threshold,
+				DeviceID:    stored.DeviceID,
+				Timestamp:   timestamp,
+				Description: stored.Description,
+			}
+
+			if q.DeviceID != "" && anomaly.DeviceID != q.DeviceID {
+				return nil, "", false
+			}
+			if q.Type != "" && anomaly.Type != q.Type {
+				return nil, "", false
+			}
+			if q.Severity != "" && anomaly.GetSeverity() != q.Severity {
+				return nil, "", false
+			}
+
+			return anomaly, stored.Timestamp, true
+		})
+}
+
+// storedFaceEvent is the Firebase representation of a face recognition event
+type storedFaceEvent struct {
+	UID       string `json:"uid"`
+	HasImage  bool   `json:"has_image"`
+	Timestamp string `json:"timestamp"`
+}
+
+// WriteFaceEvent records an unknown person detection
+func (fs *FirebaseService) WriteFaceEvent(ctx context.Context, event *models.FaceEvent) error {
+	writeCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	err := fs.client.NewRef(faceEventsPath).Child(faceEventKey(event)).Set(writeCtx, storedFaceEvent{
+		UID:       event.UID,
+		HasImage:  event.HasImage,
+		Timestamp: storedTimestamp(event.Timestamp),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write face event: %w", err)
+	}
+
+	return nil
+}
+
+// QueryFaceEvents returns recorded unknown person detections in a time range
+func (fs *FirebaseService) QueryFaceEvents(ctx context.Context, q TimeRangeQuery) (Page[*models.FaceEvent], error) {
+	return queryTimestampPage(ctx, fs.client.NewRef(faceEventsPath), q,
+		func(key string, node db.QueryNode) (*models.FaceEvent, string, bool) {
+			var stored storedFaceEvent
+			if err := node.Unmarshal(&stored); err != nil {
+				return nil, "", false
+			}
+
+			timestamp, err := time.Parse(time.RFC3339, stored.Timestamp)
+			if err != nil {
+				return nil, "", false
+			}
+
+			return &models.FaceEvent{
+				UID:       stored.UID,
+				Timestamp: timestamp,
+				HasImage:  stored.HasImage,
+			}, stored.Timestamp, true
+		})
+}
+
+// storedRollup is the Firebase representation of a rollup bucket
+type storedRollup struct {
+	DeviceID      string                       `json:"device_id"`
+	Resolution    models.RollupResolution      `json:"resolution"`
+	BucketStart   string                       `json:"bucket_start"`
+	Count         int                          `json:"count"`
+	FlameCount    int                          `json:"flame_count"`
+	GasQuality    map[string]int               `json:"gas_quality,omitempty"`
+	Metrics       map[string]models.RollupStat `json:"metrics"`
+	LastReadingAt string                       `json:"last_reading_at"`
+}
+
+// newStoredRollup converts a rollup to its Firebase representation
+func newStoredRollup(rollup *models.Rollup) storedRollup {
+	return storedRollup{
+		DeviceID:      rollup.DeviceID,
+		Resolution:    rollup.Resolution,
+		BucketStart:   storedTimestamp(rollup.BucketStart),
+		Count:         rollup.Count,
+		FlameCount:    rollup.FlameCount,
+		GasQuality:    rollup.GasQuality,
+		Metrics:       rollup.Metrics,
+		LastReadingAt: storedTimestamp(rollup.LastReadingAt),
+	}
+}
+
+// rollup converts the stored representation back to a rollup
+func (s storedRollup) rollup() (*models.Rollup, error) {
+	bucketStart, err := time.Parse(time.RFC3339, s.BucketStart)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bucket_start: %w", err)
+	}
+	lastReadingAt, err := time.Parse(time.RFC3339, s.LastReadingAt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid last_reading_at: %w", err)
+	}
+
+	rollup := models.NewRollup(s.DeviceID, s.Resolution, bucketStart)
+	rollup.Merge(&models.Rollup{
+		Count:         s.Count,
+		FlameCount:    s.FlameCount,
+		GasQuality:    s.GasQuality,
+		Metrics:       s.Metrics,
+		LastReadingAt: lastReadingAt,
+	})
+	return rollup, nil
+}
+
+// MergeRollup adds a rollup to the stored bucket in a transaction, so late readings and
+// buckets flushed in several parts (e.g. around a restart) are combined rather than overwritten
+func (fs *FirebaseService) MergeRollup(ctx context.Context, rollup *models.Rollup) error {
+	ref := fs.client.NewRef(rollupsPath).
+		Child(string(rollup.Resolution)).
+		Child(sanitizeKey(rollup.DeviceID)).
+		Child(rollupKey(rollup))
+
+	writeCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	err := ref.Transaction(writeCtx, func(node db.TransactionNode) (interface{}, error) {
+		var stored *storedRollup
+		if err := node.Unmarshal(&stored); err != nil {
+			return nil, err
+		}
+		if stored == nil {
+			return newStoredRollup(rollup), nil
+		}
+
+		// The update function may run several times, so merge into the stored copy
+		merged, err := stored.rollup()
+		if err != nil {
+			return nil, fmt.Errorf("stored rollup %s is corrupt: %w", ref.Path, err)
+		}
+		merged.Merge(rollup)
+		return newStoredRollup(merged), nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to merge rollup %s: %w", ref.Path, err)
+	}
+
+	return nil
+}
+
+// pruneEnd returns the last instant before the cutoff. Firebase's EndAt is inclusive, and
+// stored timestamps keep nanoseconds, so a record just before the cutoff is pruned like on the
+// local and bolt stores while one at the cutoff is kept.
+func pruneEnd(cutoff time.Time) time.Time {
+	return cutoff.Add(-time.Nanosecond)
+}
+
+// Prune deletes records older than the cutoff in chunks, using the timestamp index for
+// records and the bucket keys for rollups
+func (fs *FirebaseService) Prune(ctx context.Context, collection string, cutoff time.Time, opts PruneOptions) (int, error) {
+	ref := fs.client.NewRef(collection)
+	if strings.HasPrefix(collection, rollupsPath+"/") {
+		return fs.pruneRollups(ctx, ref, cutoff, opts)
+	}
+	if collection == sensorDataPath && fs.config.FirebasePathLayout == PathLayoutDeviceDate {
+		return fs.prunePartitionedReadings(ctx, cutoff, opts)
+	}
+
+	removed := 0
+	query := TimeRangeQuery{
+		To:    pruneEnd(cutoff),
+		Limit: opts.ChunkSize,
+	}
+	for {
+		page, err := queryTimestampPage(ctx, ref, query,
+			func(key string, node db.QueryNode) (string, string, bool) {
+				var record struct {
+					Timestamp string `json:"timestamp"`
+				}
+				if err := node.Unmarshal(&record); err != nil {
+					return "", "", false
+				}
+				return key, record.Timestamp, true
+			})
+		if err != nil {
+			return removed, err
+		}
+
+		if err := fs.deleteKeys(ctx, ref, page.Items, opts.DryRun); err != nil {
+			return removed, err
+		}
+		removed += len(page.Items)
+
+		if page.NextCursor == "" {
+			return removed, nil
+		}
+		query.Cursor = page.NextCursor
+	}
+}
+
+// pruneRollups deletes rollup buckets older than the cutoff for every device
+func (fs *FirebaseService) pruneRollups(ctx context.Context, ref *db.Ref, cutoff time.Time, opts PruneOptions) (int, error) {
+	var devices map[string]interface{}
+	if err := ref.GetShallow(ctx, &devices); err != nil {
+		return 0, fmt.Errorf("error listing %s: %w", ref.Path, err)
+	}
+
+	// Bucket keys are stored timestamps, so they sort by time
+	end := storedTimestamp(pruneEnd(cutoff))
+
+	removed := 0
+	for device := range devices {
+		deviceRef := ref.Child(device)
+
+		last := ""
+		for {
+			query := deviceRef.OrderByKey().EndAt(end)
+			if last != "" {
+				query = query.StartAt(last)
+			}
+
+			nodes, err := query.LimitToFirst(opts.ChunkSize + 1).GetOrdered(ctx)
+			if err != nil {
+				return removed, fmt.Errorf("error querying %s: %w", deviceRef.Path, err)
+			}
+
+			var keys []string
+			for _, node := range nodes {
+				// StartAt is inclusive, skip the last key of the previous chunk
+				if node.Key() != last && len(keys) < opts.ChunkSize {
+					keys = append(keys, node.Key())
+				}
+			}
+			if len(keys) == 0 {
+				break
+			}
+
+			if err := fs.deleteKeys(ctx, deviceRef, keys, opts.DryRun); err != nil {
+				return removed, err
+			}
+			removed += len(keys)
+			last = keys[len(keys)-1]
+		}
+	}
+
+	return removed, nil
+}
+
+// deleteKeys deletes children of a node in a single multi-path update
+func (fs *FirebaseService) deleteKeys(ctx context.Context, ref *db.Ref, keys []string, dryRun bool) error {
+	if len(keys) == 0 || dryRun {
+		return nil
+	}
+
+	updates := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		updates[key] = nil
+	}
+
+	deleteCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	if err := ref.Update(deleteCtx, updates); err != nil {
+		return fmt.Errorf("failed to delete %d records from %s: %w", len(keys), ref.Path, err)
+	}
+	return nil
+}
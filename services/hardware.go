@@ -2,9 +2,11 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"kaelo/models"
@@ -17,6 +19,7 @@ type HardwareAlertService struct {
 	logger     *zap.Logger
 	apiURL     string
 	httpClient *http.Client
+	outbox     *NotificationOutbox
 }
 
 // HardwareAlertPayload represents the payload sent to hardware alert API
@@ -27,17 +30,22 @@ type HardwareAlertPayload struct {
 }
 
 // NewHardwareAlertService creates a new hardware alert service
-func NewHardwareAlertService(logger *zap.Logger, apiURL string) *HardwareAlertService {
-	return &HardwareAlertService{
+func NewHardwareAlertService(logger *zap.Logger, apiURL string, outbox *NotificationOutbox) *HardwareAlertService {
+	h := &HardwareAlertService{
 		logger: logger,
 		apiURL: apiURL,
 		httpClient: &http.Client{
 			Timeout: 10 * time.Second,
 		},
+		outbox: outbox,
 	}
+
+	outbox.RegisterSender(models.NotificationChannelHardware, h)
+
+	return h
 }
 
-// SendHardwareAlert sends alert to hardware service via HTTP POST
+// SendHardwareAlert queues an alert for the hardware service
 func (h *HardwareAlertService) SendHardwareAlert(anomalies []*models.Anomaly, sensorData *models.SensorData) error {
 	if len(anomalies) == 0 {
 		return nil
@@ -62,11 +70,32 @@ func (h *HardwareAlertService) SendHardwareAlert(anomalies []*models.Anomaly, se
 		return fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
+	err = h.outbox.Enqueue(&models.Notification{
+		Channel:  models.NotificationChannelHardware,
+		Kind:     models.NotificationHardwareAnomaly,
+		DeviceID: sensorData.DeviceID,
+		Critical: severity == "critical",
+		Payload:  jsonData,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to queue hardware alert: %w", err)
+	}
+
+	h.logger.Info("Hardware alert queued",
+		zap.String("device_id", sensorData.DeviceID),
+		zap.Int("anomaly_count", len(anomalies)),
+		zap.String("severity", severity),
+	)
+	return nil
+}
+
+// DeliverNotification sends a queued hardware alert via HTTP POST
+func (h *HardwareAlertService) DeliverNotification(ctx context.Context, notification *models.Notification) error {
 	// Build endpoint
 	endpoint := fmt.Sprintf("%s/api/v1/hardware-alert", h.apiURL)
 
 	// Create HTTP request
-	req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewBuffer(notification.Payload))
 	if err != nil {
 		h.logger.Error("Failed to create HTTP request",
 			zap.Error(err),
@@ -84,7 +113,7 @@ func (h *HardwareAlertService) SendHardwareAlert(anomalies []*models.Anomaly, se
 	if err != nil {
 		h.logger.Error("Failed to send hardware alert",
 			zap.Error(err),
-			zap.String("device_id", sensorData.DeviceID),
+			zap.String("device_id", notification.DeviceID),
 			zap.String("url", endpoint),
 		)
 		return fmt.Errorf("failed to send request: %w", err)
@@ -94,19 +123,28 @@ func (h *HardwareAlertService) SendHardwareAlert(anomalies []*models.Anomaly, se
 	// Check response status
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
 		h.logger.Info("Hardware alert sent successfully",
-			zap.String("device_id", sensorData.DeviceID),
-			zap.Int("anomaly_count", len(anomalies)),
-			zap.String("severity", severity),
+			zap.String("device_id", notification.DeviceID),
 			zap.Int("status_code", resp.StatusCode),
 		)
 		return nil
 	}
 
 	h.logger.Error("Hardware alert API returned error",
-		zap.String("device_id", sensorData.DeviceID),
+		zap.String("device_id", notification.DeviceID),
 		zap.Int("status_code", resp.StatusCode),
 		zap.String("status", resp.Status),
 	)
+
+	// Honour rate limiting from the hardware API
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			return &RetryAfterError{
+				Delay: time.Duration(seconds) * time.Second,
+				Err:   fmt.Errorf("hardware alert API error: %s", resp.Status),
+			}
+		}
+	}
+
 	return fmt.Errorf("hardware alert API error: %s", resp.Status)
 }
 
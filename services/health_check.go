@@ -2,10 +2,12 @@ package services
 
 import (
 	"context"
+	"sort"
 	"sync"
 	"time"
 
 	"kaelo/config"
+	"kaelo/metrics"
 	"kaelo/models"
 
 	"go.uber.org/zap"
@@ -15,16 +17,23 @@ import (
 type HealthCheckService struct {
 	config          *config.Config
 	telegramService *TelegramService
+	eventHub        *EventHub
+	events          HealthEventStore // nil when the store doesn't record health events
 	logger          *zap.Logger
 	devices         map[string]*models.DeviceHealth
 	mu              sync.RWMutex
 }
 
-// NewHealthCheckService creates a new health check monitoring service
-func NewHealthCheckService(cfg *config.Config, telegram *TelegramService, logger *zap.Logger) *HealthCheckService {
+// NewHealthCheckService creates a new health check monitoring service.
+// Health checks are recorded when the store implements HealthEventStore.
+func NewHealthCheckService(cfg *config.Config, telegram *TelegramService, eventHub *EventHub, store SensorStore, logger *zap.Logger) *HealthCheckService {
+	events, _ := store.(HealthEventStore)
+
 	return &HealthCheckService{
 		config:          cfg,
 		telegramService: telegram,
+		eventHub:        eventHub,
+		events:          events,
 		logger:          logger,
 		devices:         make(map[string]*models.DeviceHealth),
 	}
@@ -51,6 +60,7 @@ func (h *HealthCheckService) Start(ctx context.Context, healthCheckChan <-chan *
 				return
 			}
 			h.updateHealthCheck(healthCheck)
+			h.recordHealthCheck(ctx, healthCheck)
 		}
 	}
 }
@@ -77,11 +87,18 @@ func (h *HealthCheckService) updateHealthCheck(data *models.HealthCheckData) {
 
 	// Check if device was previously in timeout state
 	wasTimeout := device.Status == models.DeviceTimeout
+	previousStatus := device.Status
 
 	// Update device health
 	device.LastHealthCheck = data
 	device.LastSeen = now
 	device.Status = models.DeviceHealthy
+	metrics.SetDeviceHealth(deviceID, device.Status)
+
+	// Publish status changes (including newly registered devices) to live subscribers
+	if !exists || previousStatus != device.Status {
+		h.eventHub.Publish(models.StreamEventHealth, deviceID, *device)
+	}
 
 	h.logger.Debug("Health check received",
 		zap.String("device_id", deviceID),
@@ -105,6 +122,23 @@ func (h *HealthCheckService) updateHealthCheck(data *models.HealthCheckData) {
 	}
 }
 
+// recordHealthCheck stores a health check for history queries. Failures are logged only,
+// monitoring doesn't depend on the history.
+func (h *HealthCheckService) recordHealthCheck(ctx context.Context, data *models.HealthCheckData) {
+	if h.events == nil {
+		return
+	}
+
+	writeCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if err := h.events.WriteHealthEvent(writeCtx, data); err != nil {
+		h.logger.Warn("Failed to record health check",
+			zap.String("device_id", data.DeviceID),
+			zap.Error(err))
+	}
+}
+
 // runTimeoutChecker periodically checks for device timeouts
 func (h *HealthCheckService) runTimeoutChecker(ctx context.Context) {
 	ticker := time.NewTicker(10 * time.Second)
@@ -148,6 +182,8 @@ func (h *HealthCheckService) checkTimeouts() {
 			// Update device status
 			device.Status = models.DeviceTimeout
 			device.TimeoutAt = now
+			metrics.SetDeviceHealth(deviceID, device.Status)
+			h.eventHub.Publish(models.StreamEventHealth, deviceID, *device)
 
 			// Send timeout alert
 			if err := h.telegramService.SendHealthCheckTimeoutAlert(
@@ -164,11 +200,31 @@ func (h *HealthCheckService) checkTimeouts() {
 	}
 }
 
-// GetDeviceHealth returns the current health status of a device (for testing/debugging)
-func (h *HealthCheckService) GetDeviceHealth(deviceID string) (*models.DeviceHealth, bool) {
+// ListDevices returns a snapshot of the health status of all known devices
+func (h *HealthCheckService) ListDevices() []models.DeviceHealth {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	devices := make([]models.DeviceHealth, 0, len(h.devices))
+	for _, device := range h.devices {
+		devices = append(devices, *device)
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].DeviceID < devices[j].DeviceID
+	})
+
+	return devices
+}
+
+// GetDeviceHealth returns a copy of the current health status of a device
+func (h *HealthCheckService) GetDeviceHealth(deviceID string) (models.DeviceHealth, bool) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
 	device, exists := h.devices[deviceID]
-	return device, exists
+	if !exists {
+		return models.DeviceHealth{}, false
+	}
+	return *device, true
 }
@@ -0,0 +1,225 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"kaelo/config"
+
+	"go.uber.org/zap"
+)
+
+// readinessCacheTTL is how long a readiness check result is reused before re-checking
+const readinessCacheTTL = 15 * time.Second
+
+// ReadinessCheck reports whether a dependency is ready to serve traffic
+type ReadinessCheck func(ctx context.Context) error
+
+// readinessProbe caches the last result of a readiness check
+type readinessProbe struct {
+	name        string
+	check       ReadinessCheck
+	lastErr     error
+	lastChecked time.Time
+	mu          sync.Mutex // guards lastErr and lastChecked
+}
+
+// result returns the cached result, re-running the check once it's older than readinessCacheTTL
+func (p *readinessProbe) result(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if time.Since(p.lastChecked) > readinessCacheTTL {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		p.lastErr = p.check(ctx)
+		p.lastChecked = time.Now()
+		cancel()
+	}
+	return p.lastErr
+}
+
+// queueProbe reports the depth of an in-process channel
+type queueProbe struct {
+	name     string
+	depth    func() int
+	capacity int
+}
+
+// statusSource contributes a section to the /status response
+type statusSource struct {
+	name  string
+	value func() interface{}
+}
+
+// QueueStatus represents the depth of an in-process queue
+type QueueStatus struct {
+	Depth    int `json:"depth"`
+	Capacity int `json:"capacity"`
+}
+
+// HTTPServer serves health, readiness and status endpoints
+type HTTPServer struct {
+	config    *config.Config
+	logger    *zap.Logger
+	mux       *http.ServeMux
+	server    *http.Server
+	startedAt time.Time
+	checks    []*readinessProbe
+	queues    []queueProbe
+	sources   []statusSource
+	mu        sync.Mutex
+}
+
+// NewHTTPServer creates a new HTTP server with the built-in health endpoints registered
+func NewHTTPServer(cfg *config.Config, logger *zap.Logger) *HTTPServer {
+	s := &HTTPServer{
+		config:    cfg,
+		logger:    logger,
+		mux:       http.NewServeMux(),
+		startedAt: time.Now(),
+	}
+
+	s.mux.HandleFunc("GET /healthz", s.handleHealthz)
+	s.mux.HandleFunc("GET /readyz", s.handleReadyz)
+	s.mux.HandleFunc("GET /status", s.handleStatus)
+
+	s.server = &http.Server{
+		Addr:              ":" + cfg.HTTPPort,
+		Handler:           s.mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return s
+}
+
+// Handle registers an additional handler on the server
+func (s *HTTPServer) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// AddReadinessCheck registers a dependency check used by /readyz
+func (s *HTTPServer) AddReadinessCheck(name string, check ReadinessCheck) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checks = append(s.checks, &readinessProbe{name: name, check: check})
+}
+
+// AddQueue registers an in-process queue whose depth is reported by /status
+func (s *HTTPServer) AddQueue(name string, depth func() int, capacity int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queues = append(s.queues, queueProbe{name: name, depth: depth, capacity: capacity})
+}
+
+// AddStatusSource registers a section reported by /status
+func (s *HTTPServer) AddStatusSource(name string, value func() interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sources = append(s.sources, statusSource{name: name, value: value})
+}
+
+// Start serves HTTP until the context is cancelled
+func (s *HTTPServer) Start(ctx context.Context) {
+	s.logger.Info("Starting HTTP server", zap.String("addr", s.server.Addr))
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := s.server.Shutdown(shutdownCtx); err != nil {
+			s.logger.Error("Error shutting down HTTP server", zap.Error(err))
+		}
+	}()
+
+	if err := s.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.logger.Error("HTTP server error", zap.Error(err))
+		return
+	}
+
+	s.logger.Info("HTTP server stopped")
+}
+
+// handleHealthz reports that the process is alive
+func (s *HTTPServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz reports whether all dependencies are reachable
+func (s *HTTPServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	// The checks go over the network, so run them concurrently and without holding s.mu
+	s.mu.Lock()
+	probes := append([]*readinessProbe(nil), s.checks...)
+	s.mu.Unlock()
+
+	results := make([]error, len(probes))
+	var wg sync.WaitGroup
+	for i, probe := range probes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = probe.result(r.Context())
+		}()
+	}
+	wg.Wait()
+
+	ready := true
+	checks := make(map[string]string, len(probes))
+	for i, probe := range probes {
+		if results[i] != nil {
+			ready = false
+			checks[probe.name] = results[i].Error()
+			continue
+		}
+		checks[probe.name] = "ok"
+	}
+
+	status := http.StatusOK
+	result := "ready"
+	if !ready {
+		status = http.StatusServiceUnavailable
+		result = "not_ready"
+		s.logger.Warn("Readiness check failed", zap.Any("checks", checks))
+	}
+
+	writeJSON(w, status, map[string]interface{}{
+		"status": result,
+		"checks": checks,
+	})
+}
+
+// handleStatus reports uptime, queue depths and registered status sources
+func (s *HTTPServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queues := make(map[string]QueueStatus, len(s.queues))
+	for _, queue := range s.queues {
+		queues[queue.name] = QueueStatus{Depth: queue.depth(), Capacity: queue.capacity}
+	}
+
+	response := map[string]interface{}{
+		"started_at":     s.startedAt,
+		"uptime_seconds": int64(time.Since(s.startedAt).Seconds()),
+		"uptime":         formatDuration(time.Since(s.startedAt)),
+		"queues":         queues,
+	}
+
+	for _, source := range s.sources {
+		response[source.name] = source.value()
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// writeJSON writes a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,241 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"kaelo/config"
+	"kaelo/models"
+
+	"go.uber.org/zap"
+)
+
+// gasQualityLevels maps gas quality to a numeric level so it can be charted and aggregated
+var gasQualityLevels = map[string]int{
+	"good":     0,
+	"moderate": 1,
+	"poor":     2,
+}
+
+// InfluxSink writes readings as InfluxDB line protocol to the /api/v2/write endpoint.
+// The endpoint is also served by InfluxDB 1.8+ (bucket "database/retention-policy") and by
+// compatible databases such as VictoriaMetrics.
+type InfluxSink struct {
+	writeURL     string
+	token        string
+	measurement  string
+	maxRetries   int
+	retryBackoff time.Duration
+	logger       *zap.Logger
+	httpClient   *http.Client
+}
+
+// influxWriteError is a failed write request. Rejected batches (4xx other than 429) are not
+// retried, they would fail the same way again.
+type influxWriteError struct {
+	status  int
+	message string
+}
+
+func (e *influxWriteError) Error() string {
+	return fmt.Sprintf("influxdb returned status %d: %s", e.status, e.message)
+}
+
+// retryable reports whether the request may succeed when sent again
+func (e *influxWriteError) retryable() bool {
+	return e.status == http.StatusTooManyRequests || e.status >= 500
+}
+
+// NewInfluxSink creates an InfluxDB sink from the INFLUX_* settings
+func NewInfluxSink(cfg *config.Config, logger *zap.Logger) (*InfluxSink, error) {
+	base, err := url.Parse(cfg.InfluxURL)
+	if err != nil || base.Scheme == "" || base.Host == "" {
+		return nil, fmt.Errorf("invalid INFLUX_URL %q", cfg.InfluxURL)
+	}
+	if cfg.InfluxBucket == "" || cfg.InfluxMeasurement == "" {
+		return nil, fmt.Errorf("INFLUX_BUCKET and INFLUX_MEASUREMENT are required")
+	}
+
+	query := url.Values{}
+	query.Set("bucket", cfg.InfluxBucket)
+	query.Set("precision", "ms")
+	if cfg.InfluxOrg != "" {
+		query.Set("org", cfg.InfluxOrg)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/api/v2/write"
+	base.RawQuery = query.Encode()
+
+	return &InfluxSink{
+		writeURL:     base.String(),
+		token:        cfg.InfluxToken,
+		measurement:  cfg.InfluxMeasurement,
+		maxRetries:   3,
+		retryBackoff: time.Second,
+		logger:       logger,
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}, nil
+}
+
+// Name identifies the sink in logs and metrics
+func (s *InfluxSink) Name() string {
+	return "influxdb"
+}
+
+// WriteBatch writes a batch of readings in one request, retrying with backoff when the
+// database is unreachable or overloaded. Readings that can't be written as line protocol
+// (no device ID) are left out, as are NaN and infinite values.
+func (s *InfluxSink) WriteBatch(ctx context.Context, batch []*models.SensorData) error {
+	body, skipped := encodeLineProtocol(s.measurement, batch)
+	if skipped > 0 {
+		s.logger.Warn("Skipped readings without a device ID for InfluxDB", zap.Int("skipped", skipped))
+	}
+	if len(body) == 0 {
+		return nil
+	}
+
+	var err error
+	for attempt := 1; attempt <= s.maxRetries; attempt++ {
+		err = s.write(ctx, body)
+		if err == nil {
+			s.logger.Debug("Wrote batch to InfluxDB", zap.Int("batch_size", len(batch)-skipped))
+			return nil
+		}
+
+		var writeErr *influxWriteError
+		if errors.As(err, &writeErr) && !writeErr.retryable() {
+			return err
+		}
+		if attempt == s.maxRetries {
+			break
+		}
+
+		s.logger.Warn("Failed to write batch to InfluxDB, retrying",
+			zap.Int("attempt", attempt),
+			zap.Int("max_retries", s.maxRetries),
+			zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt) * s.retryBackoff):
+		}
+	}
+	return err
+}
+
+// write sends line protocol in one request
+func (s *InfluxSink) write(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &influxWriteError{status: resp.StatusCode, message: strings.TrimSpace(string(message))}
+	}
+	return nil
+}
+
+// encodeLineProtocol formats readings as line protocol with millisecond timestamps,
+// one point per reading tagged with the device ID (and site, when known). Tag values can't be
+// empty, so readings without a device ID are skipped and counted. Values the reading doesn't
+// carry, like cleared out of range values or an unsent MPU temperature, are left out.
+func encodeLineProtocol(measurement string, batch []*models.SensorData) (body []byte, skipped int) {
+	var buf bytes.Buffer
+	for _, data := range batch {
+		if data.DeviceID == "" {
+			skipped++
+			continue
+		}
+
+		buf.WriteString(escapeLineProtocol(measurement, ", "))
+		buf.WriteString(",device_id=")
+		buf.WriteString(escapeLineProtocol(data.DeviceID, ",= "))
+		if data.Site != "" {
+			buf.WriteString(",site=")
+			buf.WriteString(escapeLineProtocol(data.Site, ",= "))
+		}
+		buf.WriteByte(' ')
+
+		fields := []string{"flame_detected=" + strconv.FormatBool(data.FlameDetected)}
+		for _, field := range [...]struct {
+			name, source string // source is the reading field, see SensorData.Has
+			value        float64
+		}{
+			{"temperature_dht", "temperature_dht", data.TemperatureDHT},
+			{"temperature_mpu", "temperature_mpu", data.TemperatureMPU},
+			{"humidity", "humidity", data.Humidity},
+			{"accel_x", "acceleration", data.Acceleration.X},
+			{"accel_y", "acceleration", data.Acceleration.Y},
+			{"accel_z", "acceleration", data.Acceleration.Z},
+			{"gyro_x", "gyroscope", data.Gyroscope.X},
+			{"gyro_y", "gyroscope", data.Gyroscope.Y},
+			{"gyro_z", "gyroscope", data.Gyroscope.Z},
+		} {
+			if !data.Has(field.source) {
+				continue
+			}
+			// Line protocol has no representation for NaN or infinity
+			if math.IsNaN(field.value) || math.IsInf(field.value, 0) {
+				continue
+			}
+			fields = append(fields, field.name+"="+formatLineFloat(field.value))
+		}
+		if level, ok := gasQualityLevels[data.GasQuality]; ok {
+			fields = append(fields, "gas_quality_level="+strconv.Itoa(level)+"i")
+		}
+		buf.WriteString(strings.Join(fields, ","))
+
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatInt(data.Timestamp.UnixMilli(), 10))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), skipped
+}
+
+// escapeLineProtocol backslash-escapes the given special characters. Line breaks end a point
+// and can't be escaped, they are replaced with spaces (escaped if spaces are special).
+func escapeLineProtocol(s, special string) string {
+	if !strings.ContainsAny(s, special+"\r\n") {
+		return s
+	}
+
+	var sb strings.Builder
+	for _, r := range s {
+		if r == '\r' || r == '\n' {
+			r = ' '
+		}
+		if strings.ContainsRune(special, r) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// formatLineFloat formats a float field value
+func formatLineFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,165 @@
+package services
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kaelo/config"
+	"kaelo/models"
+
+	"go.uber.org/zap"
+)
+
+// influxServer is a fake /api/v2/write endpoint answering with the given statuses in turn,
+// then 204
+type influxServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+}
+
+func newInfluxServer(t *testing.T, statuses ...int) *influxServer {
+	t.Helper()
+
+	s := &influxServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		s.mu.Lock()
+		s.requests = append(s.requests, r)
+		s.bodies = append(s.bodies, string(body))
+		status := http.StatusNoContent
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		s.mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *influxServer) received() ([]*http.Request, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests, s.bodies
+}
+
+func newTestInfluxSink(t *testing.T, url string) *InfluxSink {
+	t.Helper()
+
+	sink, err := NewInfluxSink(&config.Config{
+		InfluxURL:         url,
+		InfluxToken:       "dev-token",
+		InfluxOrg:         "kaelo",
+		InfluxBucket:      "kaelo",
+		InfluxMeasurement: "sensor_readings",
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewInfluxSink: %v", err)
+	}
+	sink.retryBackoff = time.Millisecond
+	return sink
+}
+
+func TestInfluxSinkWritesLineProtocol(t *testing.T) {
+	server := newInfluxServer(t)
+	sink := newTestInfluxSink(t, server.URL)
+
+	batch := []*models.SensorData{
+		{
+			DeviceID:       "ESP32 001",
+			Site:           "site,a",
+			TemperatureDHT: 27.5,
+			Humidity:       60.2,
+			GasQuality:     "good",
+			Acceleration:   models.AccelerationData{Z: 9.81},
+			Timestamp:      time.UnixMilli(1714532755000),
+		},
+		{
+			DeviceID:       "ESP32-002",
+			TemperatureDHT: math.NaN(),
+			TemperatureMPU: 24.5,
+			Humidity:       math.Inf(1),
+			FlameDetected:  true,
+			InvalidFields:  []string{"gyroscope"},
+			Timestamp:      time.UnixMilli(1714532756000),
+		},
+		{Timestamp: time.UnixMilli(1714532757000)},
+	}
+	if err := sink.WriteBatch(context.Background(), batch); err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+
+	requests, bodies := server.received()
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(requests))
+	}
+	req := requests[0]
+	if req.URL.Path != "/api/v2/write" || req.URL.Query().Get("bucket") != "kaelo" || req.URL.Query().Get("precision") != "ms" {
+		t.Errorf("request URL = %s", req.URL)
+	}
+	if auth := req.Header.Get("Authorization"); auth != "Token dev-token" {
+		t.Errorf("Authorization = %q", auth)
+	}
+
+	want := "sensor_readings,device_id=ESP32\\ 001,site=site\\,a flame_detected=false,temperature_dht=27.5,humidity=60.2," +
+		"accel_x=0,accel_y=0,accel_z=9.81,gyro_x=0,gyro_y=0,gyro_z=0,gas_quality_level=0i 1714532755000\n" +
+		"sensor_readings,device_id=ESP32-002 flame_detected=true,temperature_mpu=24.5," +
+		"accel_x=0,accel_y=0,accel_z=0 1714532756000\n"
+	if bodies[0] != want {
+		t.Errorf("body =\n%s\nwant\n%s", bodies[0], want)
+	}
+	for _, bad := range []string{"NaN", "Inf", "device_id= ", "device_id=,"} {
+		if strings.Contains(bodies[0], bad) {
+			t.Errorf("body contains %q", bad)
+		}
+	}
+}
+
+func TestInfluxSinkRetriesUnavailable(t *testing.T) {
+	server := newInfluxServer(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	sink := newTestInfluxSink(t, server.URL)
+
+	if err := sink.WriteBatch(context.Background(), []*models.SensorData{testReading("ESP32-001", 1, nil)}); err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+	if requests, _ := server.received(); len(requests) != 3 {
+		t.Errorf("got %d requests, want 3", len(requests))
+	}
+}
+
+func TestInfluxSinkGivesUpAfterRetries(t *testing.T) {
+	server := newInfluxServer(t, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+	sink := newTestInfluxSink(t, server.URL)
+
+	if err := sink.WriteBatch(context.Background(), []*models.SensorData{testReading("ESP32-001", 1, nil)}); err == nil {
+		t.Fatal("WriteBatch succeeded, want an error")
+	}
+	if requests, _ := server.received(); len(requests) != 3 {
+		t.Errorf("got %d requests, want 3", len(requests))
+	}
+}
+
+func TestInfluxSinkDoesNotRetryRejectedBatch(t *testing.T) {
+	server := newInfluxServer(t, http.StatusBadRequest)
+	sink := newTestInfluxSink(t, server.URL)
+
+	if err := sink.WriteBatch(context.Background(), []*models.SensorData{testReading("ESP32-001", 1, nil)}); err == nil {
+		t.Fatal("WriteBatch succeeded, want an error")
+	}
+	if requests, _ := server.received(); len(requests) != 1 {
+		t.Errorf("got %d requests, want 1", len(requests))
+	}
+}
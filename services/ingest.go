@@ -0,0 +1,343 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"kaelo/config"
+	"kaelo/metrics"
+	"kaelo/models"
+
+	"go.uber.org/zap"
+)
+
+// Ingestion transports selectable via INGEST_TRANSPORT
+const (
+	// IngestTransportRabbitMQ consumes the RabbitMQ queues (devices publish through its MQTT plugin)
+	IngestTransportRabbitMQ = "rabbitmq"
+	// IngestTransportMQTT subscribes to the device topics on a plain MQTT broker such as Mosquitto
+	IngestTransportMQTT = "mqtt"
+)
+
+// IngestTransport receives device messages and feeds them to the processing channels
+type IngestTransport interface {
+	ConsumeSensorData(ctx context.Context, sensorDataChan chan<- *models.SensorData) error
+	ConsumeFaceRecognitionData(ctx context.Context, faceDataChan chan<- *models.FaceRecognitionData) error
+	ConsumeHealthCheck(ctx context.Context, healthCheckChan chan<- *models.HealthCheckData) error
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// NewIngestTransport connects the transport selected by cfg.IngestTransport
+func NewIngestTransport(cfg *config.Config, dedup *MessageDeduplicator, logger *zap.Logger) (IngestTransport, error) {
+	switch cfg.IngestTransport {
+	case IngestTransportRabbitMQ:
+		return NewRabbitMQService(cfg, dedup, logger)
+	case IngestTransportMQTT:
+		return NewMQTTService(cfg, dedup, logger)
+	default:
+		return nil, fmt.Errorf("invalid INGEST_TRANSPORT %q (expected %s or %s)",
+			cfg.IngestTransport, IngestTransportRabbitMQ, IngestTransportMQTT)
+	}
+}
+
+// errDuplicateMessage is returned for readings that were already ingested
+var errDuplicateMessage = errors.New("duplicate message")
+
+// errInvalidPayload is returned for messages that can't be decoded or fail validation.
+// Redelivering them won't help, so they are rejected without requeueing.
+var errInvalidPayload = errors.New("invalid payload")
+
+// ingestMessage is a device message as received by either transport
+type ingestMessage struct {
+	contentType string // empty for MQTT, which selects the format by topic
+	topic       string // AMQP routing key, MQTT topics are converted to the same form
+	messageID   string
+	body        []byte
+}
+
+// messageDelivery settles a received message exactly once, through the transport's own
+// acknowledgement
+type messageDelivery struct {
+	queue  string
+	ack    func() error
+	nack   func(requeue bool) error
+	forget func()    // clears the readings from the dedup cache when the message is requeued
+	id     zap.Field // identifies the message in logs
+	logger *zap.Logger
+	once   sync.Once
+}
+
+// newMessageDelivery returns a delivery settled by the given functions
+func newMessageDelivery(queue string, ack func() error, nack func(requeue bool) error, id zap.Field, logger *zap.Logger) *messageDelivery {
+	return &messageDelivery{
+		queue:  queue,
+		ack:    ack,
+		nack:   nack,
+		forget: func() {},
+		id:     id,
+		logger: logger,
+	}
+}
+
+// Ack acknowledges the delivery
+func (d *messageDelivery) Ack() {
+	d.once.Do(func() {
+		if err := d.ack(); err != nil {
+			// The connection was closed since delivery; the broker will redeliver the message
+			d.logger.Warn("Failed to ack message, it will be redelivered", d.id, zap.Error(err))
+			return
+		}
+		metrics.MessagesAcked.WithLabelValues(d.queue).Inc()
+	})
+}
+
+// Nack rejects the delivery
+func (d *messageDelivery) Nack(requeue bool) {
+	d.once.Do(func() {
+		if requeue {
+			d.forget()
+		}
+		if err := d.nack(requeue); err != nil {
+			d.logger.Warn("Failed to nack message", d.id, zap.Error(err))
+			return
+		}
+		metrics.MessagesNacked.WithLabelValues(d.queue).Inc()
+	})
+}
+
+// messageProcessor decodes, validates and deduplicates device messages for both transports
+type messageProcessor struct {
+	config *config.Config
+	dedup  *MessageDeduplicator
+	logger *zap.Logger
+}
+
+// handleSensorMessage processes a sensor message and settles its delivery. In persisted ack
+// mode successful messages are left to the batch writer, which acks them once stored.
+func (p *messageProcessor) handleSensorMessage(msg ingestMessage, delivery *messageDelivery, sensorDataChan chan<- *models.SensorData) {
+	err := p.processSensorMessage(msg, delivery, sensorDataChan)
+	switch {
+	case errors.Is(err, errDuplicateMessage):
+		// Already ingested, acknowledge so it isn't redelivered again
+		delivery.Ack()
+	case errors.Is(err, errInvalidPayload):
+		p.logger.Warn("Rejecting invalid message",
+			zap.Error(err),
+			zap.String("message_id", msg.messageID))
+
+		// Dropped, or dead-lettered if the queue has a dead letter exchange
+		delivery.Nack(false)
+	case err != nil:
+		p.logger.Error("Failed to process message",
+			zap.Error(err),
+			zap.String("message_id", msg.messageID))
+
+		// Negative acknowledgment - requeue the message
+		delivery.Nack(true)
+	case p.config.RabbitMQAckMode == AckModeImmediate:
+		delivery.Ack()
+	}
+}
+
+// processSensorMessage parses and forwards sensor data to the channel. A message may carry a
+// single reading or a batch (see decodeSensorPayload); invalid samples of a batch are dropped
+// and the rest are forwarded with their original timestamps.
+func (p *messageProcessor) processSensorMessage(msg ingestMessage, delivery *messageDelivery, sensorDataChan chan<- *models.SensorData) error {
+	body, err := p.messageJSON(msg, p.config.RabbitMQQueue, protoSensorData)
+	if err != nil {
+		metrics.ParseFailures.WithLabelValues(p.config.RabbitMQQueue).Inc()
+		return fmt.Errorf("%w: %v", errInvalidPayload, err)
+	}
+
+	topic, _ := parseDeviceTopic(p.config.DeviceTopicRoot, msg.topic, deviceTopicTelemetry)
+	readings, invalid, err := decodeSensorPayload(body, topic)
+	if err != nil {
+		metrics.ParseFailures.WithLabelValues(p.config.RabbitMQQueue).Inc()
+		return fmt.Errorf("%w: %v", errInvalidPayload, err)
+	}
+
+	for _, sampleErr := range invalid {
+		metrics.InvalidSamples.WithLabelValues(p.config.RabbitMQQueue).Inc()
+		p.logger.Warn("Dropping invalid sample from batch",
+			zap.Error(sampleErr),
+			zap.String("message_id", msg.messageID))
+	}
+	if len(readings) == 0 {
+		metrics.ParseFailures.WithLabelValues(p.config.RabbitMQQueue).Inc()
+		return fmt.Errorf("%w: none of the %d samples are valid", errInvalidPayload, len(invalid))
+	}
+
+	// Drop readings that were already ingested, e.g. from a batch redelivered after a partial failure
+	fresh := readings[:0]
+	for _, sensorData := range readings {
+		if p.dedup.Seen(sensorData) {
+			metrics.DuplicateMessages.WithLabelValues(p.config.RabbitMQQueue).Inc()
+			continue
+		}
+		fresh = append(fresh, sensorData)
+	}
+	if len(fresh) == 0 {
+		return errDuplicateMessage
+	}
+	readings = fresh
+
+	// When the message is requeued, let the redelivery through. In immediate mode readings
+	// already handed to the pipeline are done and stay deduplicated; in persisted mode they
+	// may not be stored yet, so all of them are let through.
+	sent := 0
+	delivery.forget = func() {
+		from := sent
+		if p.config.RabbitMQAckMode == AckModePersisted {
+			from = 0
+		}
+		for _, sensorData := range readings[from:] {
+			p.dedup.Forget(sensorData)
+		}
+	}
+
+	if p.config.RabbitMQAckMode == AckModePersisted {
+		if len(readings) == 1 {
+			readings[0].Delivery = delivery
+		} else {
+			for i, ack := range newBatchDeliveryAck(delivery, len(readings)) {
+				readings[i].Delivery = ack
+			}
+		}
+	}
+
+	for i, sensorData := range readings {
+		if len(sensorData.InvalidFields) > 0 {
+			p.logger.Warn("Cleared sensor values out of range",
+				zap.String("device_id", sensorData.DeviceID),
+				zap.Strings("fields", sensorData.InvalidFields),
+				zap.String("message_id", msg.messageID))
+		}
+		p.logger.Debug("Received sensor data",
+			zap.String("device_id", sensorData.DeviceID),
+			zap.String("site", sensorData.Site),
+			zap.Float64("temperature_dht", sensorData.TemperatureDHT),
+			zap.Float64("humidity", sensorData.Humidity),
+			zap.String("gas_quality", sensorData.GasQuality),
+			zap.Bool("flame_detected", sensorData.FlameDetected),
+			zap.Time("timestamp", sensorData.Timestamp))
+
+		// Send to processing channel (non-blocking with timeout)
+		select {
+		case sensorDataChan <- sensorData:
+			sent++
+		case <-time.After(5 * time.Second):
+			return fmt.Errorf("timeout sending to processing channel (%d of %d readings sent)", i, len(readings))
+		}
+	}
+	return nil
+}
+
+// messageJSON converts a message body to JSON, picking the decoder from the message's content
+// type or the format suffix of its topic (see payloadFormat)
+func (p *messageProcessor) messageJSON(msg ingestMessage, queue string, schema protoSchema) ([]byte, error) {
+	format := payloadFormat(msg.contentType, msg.topic)
+	metrics.MessagesByFormat.WithLabelValues(queue, format).Inc()
+	return payloadJSON(format, schema, msg.body)
+}
+
+// processFaceRecognitionMessage parses and forwards face recognition data to the channel.
+// Messages that can't be decoded or validated return errInvalidPayload.
+func (p *messageProcessor) processFaceRecognitionMessage(msg ingestMessage, faceDataChan chan<- *models.FaceRecognitionData) error {
+	body, err := p.messageJSON(msg, faceRecognitionQueue, protoFaceRecognitionData)
+	if err != nil {
+		metrics.ParseFailures.WithLabelValues(faceRecognitionQueue).Inc()
+		return fmt.Errorf("%w: %v", errInvalidPayload, err)
+	}
+
+	var faceData models.FaceRecognitionData
+	if err := json.Unmarshal(body, &faceData); err != nil {
+		metrics.ParseFailures.WithLabelValues(faceRecognitionQueue).Inc()
+		return fmt.Errorf("%w: failed to unmarshal face recognition message: %v", errInvalidPayload, err)
+	}
+
+	topic, _ := parseDeviceTopic(p.config.DeviceTopicRoot, msg.topic, deviceTopicFace)
+	if err := topic.apply(&faceData.DeviceID, &faceData.Site); err != nil {
+		metrics.ParseFailures.WithLabelValues(faceRecognitionQueue).Inc()
+		return fmt.Errorf("%w: face recognition data: %v", errInvalidPayload, err)
+	}
+
+	// Validate data
+	if faceData.UID == "" {
+		metrics.ParseFailures.WithLabelValues(faceRecognitionQueue).Inc()
+		return fmt.Errorf("%w: face recognition data: missing uid", errInvalidPayload)
+	}
+
+	// Set timestamp if not provided
+	if faceData.Timestamp.IsZero() {
+		faceData.Timestamp = time.Now()
+	}
+
+	p.logger.Debug("Received face recognition data",
+		zap.String("uid", faceData.UID),
+		zap.String("device_id", faceData.DeviceID),
+		zap.String("site", faceData.Site),
+		zap.Time("timestamp", faceData.Timestamp),
+		zap.Bool("has_image", faceData.Base64 != ""))
+
+	// Send to processing channel (non-blocking with timeout)
+	select {
+	case faceDataChan <- &faceData:
+		return nil
+	case <-time.After(5 * time.Second):
+		return fmt.Errorf("timeout sending to face recognition processing channel")
+	}
+}
+
+// processHealthCheckMessage parses and forwards health check data to the channel.
+// Messages that can't be decoded or validated return errInvalidPayload.
+func (p *messageProcessor) processHealthCheckMessage(msg ingestMessage, healthCheckChan chan<- *models.HealthCheckData) error {
+	body, err := p.messageJSON(msg, p.config.HealthCheckQueue, protoHealthCheckData)
+	if err != nil {
+		metrics.ParseFailures.WithLabelValues(p.config.HealthCheckQueue).Inc()
+		return fmt.Errorf("%w: %v", errInvalidPayload, err)
+	}
+
+	var healthCheck models.HealthCheckData
+	if err := json.Unmarshal(body, &healthCheck); err != nil {
+		metrics.ParseFailures.WithLabelValues(p.config.HealthCheckQueue).Inc()
+		return fmt.Errorf("%w: failed to unmarshal health check message: %v", errInvalidPayload, err)
+	}
+
+	topic, _ := parseDeviceTopic(p.config.DeviceTopicRoot, msg.topic, deviceTopicHealth)
+	if err := topic.apply(&healthCheck.DeviceID, &healthCheck.Site); err != nil {
+		metrics.ParseFailures.WithLabelValues(p.config.HealthCheckQueue).Inc()
+		return fmt.Errorf("%w: health check data: %v", errInvalidPayload, err)
+	}
+
+	// Validate data
+	if healthCheck.DeviceID == "" {
+		metrics.ParseFailures.WithLabelValues(p.config.HealthCheckQueue).Inc()
+		return fmt.Errorf("%w: health check data: missing device_id", errInvalidPayload)
+	}
+
+	// Set timestamp if not provided
+	if healthCheck.Timestamp.IsZero() {
+		healthCheck.Timestamp = time.Now()
+	}
+
+	p.logger.Debug("Received health check data",
+		zap.String("device_id", healthCheck.DeviceID),
+		zap.String("site", healthCheck.Site),
+		zap.Time("timestamp", healthCheck.Timestamp),
+		zap.Bool("wifi_connected", healthCheck.WiFiConnected),
+		zap.Bool("mqtt_connected", healthCheck.MQTTConnected),
+		zap.Int64("uptime_ms", healthCheck.UptimeMs))
+
+	// Send to processing channel (non-blocking with timeout)
+	select {
+	case healthCheckChan <- &healthCheck:
+		return nil
+	case <-time.After(5 * time.Second):
+		return fmt.Errorf("timeout sending to health check processing channel")
+	}
+}
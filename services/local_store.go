@@ -0,0 +1,527 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"kaelo/config"
+	"kaelo/models"
+
+	"go.uber.org/zap"
+)
+
+// localRecord is a single line in a local store file
+type localRecord[T any] struct {
+	Key       string `json:"key"`
+	Timestamp string `json:"timestamp"` // storedTimestamp format, used for ordering
+	Data      T      `json:"data"`
+}
+
+// localCollection stores records as JSON lines, one file per local day
+type localCollection[T any] struct {
+	dir    string
+	logger *zap.Logger
+	mu     sync.RWMutex
+}
+
+// newLocalCollection creates the collection directory
+func newLocalCollection[T any](root, name string, logger *zap.Logger) (*localCollection[T], error) {
+	dir := filepath.Join(root, name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	return &localCollection[T]{dir: dir, logger: logger}, nil
+}
+
+// dayOf returns the day partition of a stored timestamp
+func dayOf(timestamp string) string {
+	if len(timestamp) < len("2006-01-02") {
+		return timestamp
+	}
+	return timestamp[:len("2006-01-02")]
+}
+
+// path returns the file holding records for a day
+func (c *localCollection[T]) path(day string) string {
+	return filepath.Join(c.dir, day+".jsonl")
+}
+
+// append writes records to their day files and syncs them to disk
+func (c *localCollection[T]) append(records []localRecord[T]) error {
+	byDay := make(map[string]*bytes.Buffer)
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to encode record %s: %w", record.Key, err)
+		}
+
+		day := dayOf(record.Timestamp)
+		if byDay[day] == nil {
+			byDay[day] = &bytes.Buffer{}
+		}
+		byDay[day].Write(line)
+		byDay[day].WriteByte('\n')
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.appendLocked(byDay)
+}
+
+// appendLocked writes encoded lines to their day files. Must be called with c.mu held.
+func (c *localCollection[T]) appendLocked(byDay map[string]*bytes.Buffer) error {
+	for day, buf := range byDay {
+		file, err := os.OpenFile(c.path(day), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+
+		_, err = file.Write(buf.Bytes())
+		if err == nil {
+			err = file.Sync()
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %w", c.path(day), err)
+		}
+	}
+
+	return nil
+}
+
+// update replaces a record with the result of fn, which receives the stored record if there
+// is one. The read and write happen under one lock so concurrent updates aren't lost.
+func (c *localCollection[T]) update(key, timestamp string, fn func(existing T, ok bool) T) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	day := dayOf(timestamp)
+	records, err := c.readDay(day)
+	if err != nil {
+		return err
+	}
+
+	var existing T
+	found := false
+	for _, record := range records {
+		if record.Key == key {
+			existing, found = record.Data, true
+			break
+		}
+	}
+
+	line, err := json.Marshal(localRecord[T]{Key: key, Timestamp: timestamp, Data: fn(existing, found)})
+	if err != nil {
+		return fmt.Errorf("failed to encode record %s: %w", key, err)
+	}
+
+	buf := bytes.NewBuffer(line)
+	buf.WriteByte('\n')
+	return c.appendLocked(map[string]*bytes.Buffer{day: buf})
+}
+
+// days returns the stored day partitions in ascending order
+func (c *localCollection[T]) days() ([]string, error) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var days []string
+	for _, entry := range entries {
+		if day, ok := strings.CutSuffix(entry.Name(), ".jsonl"); ok && !entry.IsDir() {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// readDay reads all records of a day, skipping lines that can't be decoded
+// (e.g. a partial line left by a crash). When a key was written more than once
+// the last write wins, so redelivered records overwrite rather than duplicate.
+func (c *localCollection[T]) readDay(day string) ([]localRecord[T], error) {
+	file, err := os.Open(c.path(day))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []localRecord[T]
+	index := make(map[string]int)
+	skipped := 0
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var record localRecord[T]
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			skipped++
+			continue
+		}
+		if i, ok := index[record.Key]; ok {
+			records[i] = record
+			continue
+		}
+		index[record.Key] = len(records)
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", c.path(day), err)
+	}
+
+	if skipped > 0 {
+		c.logger.Warn("Skipped malformed records in local store",
+			zap.String("path", c.path(day)),
+			zap.Int("skipped", skipped))
+	}
+
+	return records, nil
+}
+
+// prune deletes the day files that lie entirely before the cutoff and returns the number of
+// records they held. Records are pruned by whole days.
+func (c *localCollection[T]) prune(cutoff time.Time, dryRun bool) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	days, err := c.days()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list %s: %w", c.dir, err)
+	}
+
+	cutoffDay := dayOf(storedTimestamp(cutoff))
+	removed := 0
+	for _, day := range days {
+		if day >= cutoffDay {
+			break
+		}
+
+		records, err := c.readDay(day)
+		if err != nil {
+			return removed, err
+		}
+		if !dryRun {
+			if err := os.Remove(c.path(day)); err != nil {
+				return removed, fmt.Errorf("failed to remove %s: %w", c.path(day), err)
+			}
+		}
+		removed += len(records)
+	}
+
+	return removed, nil
+}
+
+// query returns one page of records matching the time range and filter
+func (c *localCollection[T]) query(q TimeRangeQuery, match func(T) bool) (Page[T], error) {
+	limit := q.normalizedLimit()
+	descending := q.descending()
+
+	var cursorValue, cursorKey string
+	hasCursor := q.Cursor != ""
+	if hasCursor {
+		var err error
+		if cursorValue, cursorKey, err = decodeCursor(q.Cursor); err != nil {
+			return Page[T]{}, err
+		}
+	}
+
+	start, end := "", ""
+	if !q.From.IsZero() {
+		start = storedTimestamp(q.From)
+	}
+	if !q.To.IsZero() {
+		end = storedTimestamp(q.To)
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	days, err := c.days()
+	if err != nil {
+		return Page[T]{}, fmt.Errorf("failed to list %s: %w", c.dir, err)
+	}
+	if descending {
+		sort.Sort(sort.Reverse(sort.StringSlice(days)))
+	}
+
+	var items []T
+	var lastValue, lastKey string
+	for _, day := range days {
+		if (start != "" && day < dayOf(start)) || (end != "" && day > dayOf(end)) {
+			continue
+		}
+		if hasCursor && ((descending && day > dayOf(cursorValue)) || (!descending && day < dayOf(cursorValue))) {
+			continue
+		}
+
+		records, err := c.readDay(day)
+		if err != nil {
+			return Page[T]{}, err
+		}
+
+		// Late records may be appended out of order within a day
+		sort.SliceStable(records, func(i, j int) bool {
+			a, b := records[i], records[j]
+			if a.Timestamp != b.Timestamp {
+				return (a.Timestamp < b.Timestamp) != descending
+			}
+			return (a.Key < b.Key) != descending
+		})
+
+		for _, record := range records {
+			if (start != "" && record.Timestamp < start) || (end != "" && record.Timestamp > end) {
+				continue
+			}
+			if hasCursor && !pastCursor(record.Timestamp, record.Key, cursorValue, cursorKey, descending) {
+				continue
+			}
+			if !match(record.Data) {
+				continue
+			}
+
+			if len(items) == limit {
+				return Page[T]{Items: items, NextCursor: encodeCursor(lastValue, lastKey)}, nil
+			}
+
+			items = append(items, record.Data)
+			lastValue, lastKey = record.Timestamp, record.Key
+		}
+	}
+
+	return Page[T]{Items: items}, nil
+}
+
+// LocalStore stores readings, anomalies and face events as JSON lines on local disk.
+// It lets edge deployments run without Firebase.
+type LocalStore struct {
+	dir        string
+	readings   *localCollection[*models.SensorData]
+	anomalies  *localCollection[*models.Anomaly]
+	faceEvents *localCollection[*models.FaceEvent]
+	rollups    map[models.RollupResolution]*localCollection[*models.Rollup]
+	latest     map[string]*models.SensorData
+	latestMu   sync.RWMutex
+	logger     *zap.Logger
+}
+
+// NewLocalStore creates a local store in LOCAL_STORE_DIR
+func NewLocalStore(cfg *config.Config, logger *zap.Logger) (*LocalStore, error) {
+	readings, err := newLocalCollection[*models.SensorData](cfg.LocalStoreDir, sensorDataPath, logger)
+	if err != nil {
+		return nil, err
+	}
+	anomalies, err := newLocalCollection[*models.Anomaly](cfg.LocalStoreDir, anomaliesPath, logger)
+	if err != nil {
+		return nil, err
+	}
+	faceEvents, err := newLocalCollection[*models.FaceEvent](cfg.LocalStoreDir, faceEventsPath, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	rollups := make(map[models.RollupResolution]*localCollection[*models.Rollup])
+	for _, resolution := range models.RollupResolutions {
+		collection, err := newLocalCollection[*models.Rollup](cfg.LocalStoreDir, rollupCollection(resolution), logger)
+		if err != nil {
+			return nil, err
+		}
+		rollups[resolution] = collection
+	}
+
+	logger.Info("Using local storage backend", zap.String("dir", cfg.LocalStoreDir))
+
+	return &LocalStore{
+		dir:        cfg.LocalStoreDir,
+		readings:   readings,
+		anomalies:  anomalies,
+		faceEvents: faceEvents,
+		rollups:    rollups,
+		latest:     make(map[string]*models.SensorData),
+		logger:     logger,
+	}, nil
+}
+
+// WriteBatch appends a batch of readings
+func (ls *LocalStore) WriteBatch(ctx context.Context, batch []*models.SensorData) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	records := make([]localRecord[*models.SensorData], len(batch))
+	for i, data := range batch {
+		records[i] = localRecord[*models.SensorData]{
+			Key:       readingKey(data),
+			Timestamp: storedTimestamp(data.Timestamp),
+			Data:      data,
+		}
+	}
+
+	if err := ls.readings.append(records); err != nil {
+		return fmt.Errorf("failed to write batch: %w", err)
+	}
+
+	ls.latestMu.Lock()
+	for _, data := range batch {
+		if current, ok := ls.latest[data.DeviceID]; !ok || data.Timestamp.After(current.Timestamp) {
+			ls.latest[data.DeviceID] = data
+		}
+	}
+	ls.latestMu.Unlock()
+
+	return nil
+}
+
+// LatestReading returns the newest stored reading for a device
+func (ls *LocalStore) LatestReading(ctx context.Context, deviceID string) (*models.SensorData, error) {
+	ls.latestMu.RLock()
+	latest, ok := ls.latest[deviceID]
+	ls.latestMu.RUnlock()
+	if ok {
+		return latest, nil
+	}
+
+	// Not written since startup, fall back to scanning the stored readings
+	page, err := ls.QueryReadings(ctx, TimeRangeQuery{DeviceID: deviceID, Limit: 1, Order: SortDescending})
+	if err != nil {
+		return nil, err
+	}
+	if len(page.Items) == 0 {
+		return nil, ErrNotFound
+	}
+
+	ls.latestMu.Lock()
+	if current, ok := ls.latest[deviceID]; !ok || page.Items[0].Timestamp.After(current.Timestamp) {
+		ls.latest[deviceID] = page.Items[0]
+	}
+	latest = ls.latest[deviceID]
+	ls.latestMu.Unlock()
+
+	return latest, nil
+}
+
+// QueryReadings returns stored readings in a time range
+func (ls *LocalStore) QueryReadings(ctx context.Context, q TimeRangeQuery) (Page[*models.SensorData], error) {
+	return ls.readings.query(q, func(data *models.SensorData) bool {
+		return q.DeviceID == "" || data.DeviceID == q.DeviceID
+	})
+}
+
+// WriteAnomalies records detected anomalies
+func (ls *LocalStore) WriteAnomalies(ctx context.Context, anomalies []*models.Anomaly) error {
+	if len(anomalies) == 0 {
+		return nil
+	}
+
+	records := make([]localRecord[*models.Anomaly], len(anomalies))
+	for i, anomaly := range anomalies {
+		records[i] = localRecord[*models.Anomaly]{
+			Key:       anomalyKey(anomaly),
+			Timestamp: storedTimestamp(anomaly.Timestamp),
+			Data:      anomaly,
+		}
+	}
+
+	if err := ls.anomalies.append(records); err != nil {
+		return fmt.Errorf("failed to write anomalies: %w", err)
+	}
+	return nil
+}
+
+// QueryAnomalies returns recorded anomalies in a time range
+func (ls *LocalStore) QueryAnomalies(ctx context.Context, q AnomalyQuery) (Page[*models.Anomaly], error) {
+	return ls.anomalies.query(q.TimeRangeQuery, func(anomaly *models.Anomaly) bool {
+		return (q.DeviceID == "" || anomaly.DeviceID == q.DeviceID) &&
+			(q.Type == "" || anomaly.Type == q.Type) &&
+			(q.Severity == "" || anomaly.GetSeverity() == q.Severity)
+	})
+}
+
+// WriteFaceEvent records an unknown person detection
+func (ls *LocalStore) WriteFaceEvent(ctx context.Context, event *models.FaceEvent) error {
+	err := ls.faceEvents.append([]localRecord[*models.FaceEvent]{{
+		Key:       faceEventKey(event),
+		Timestamp: storedTimestamp(event.Timestamp),
+		Data:      event,
+	}})
+	if err != nil {
+		return fmt.Errorf("failed to write face event: %w", err)
+	}
+	return nil
+}
+
+// QueryFaceEvents returns recorded unknown person detections in a time range
+func (ls *LocalStore) QueryFaceEvents(ctx context.Context, q TimeRangeQuery) (Page[*models.FaceEvent], error) {
+	return ls.faceEvents.query(q, func(*models.FaceEvent) bool { return true })
+}
+
+// MergeRollup adds a rollup to the stored bucket
+func (ls *LocalStore) MergeRollup(ctx context.Context, rollup *models.Rollup) error {
+	collection, ok := ls.rollups[rollup.Resolution]
+	if !ok {
+		return fmt.Errorf("unknown rollup resolution %q", rollup.Resolution)
+	}
+
+	key := rollup.DeviceID + "|" + rollupKey(rollup)
+	err := collection.update(key, storedTimestamp(rollup.BucketStart), func(existing *models.Rollup, ok bool) *models.Rollup {
+		if !ok {
+			return rollup
+		}
+		existing.Merge(rollup)
+		return existing
+	})
+	if err != nil {
+		return fmt.Errorf("failed to merge rollup: %w", err)
+	}
+	return nil
+}
+
+// Prune deletes whole days of records older than the cutoff
+func (ls *LocalStore) Prune(ctx context.Context, collection string, cutoff time.Time, opts PruneOptions) (int, error) {
+	switch collection {
+	case sensorDataPath:
+		return ls.readings.prune(cutoff, opts.DryRun)
+	case anomaliesPath:
+		return ls.anomalies.prune(cutoff, opts.DryRun)
+	case faceEventsPath:
+		return ls.faceEvents.prune(cutoff, opts.DryRun)
+	}
+
+	for resolution, rollups := range ls.rollups {
+		if collection == rollupCollection(resolution) {
+			return rollups.prune(cutoff, opts.DryRun)
+		}
+	}
+
+	return 0, fmt.Errorf("unknown collection %q", collection)
+}
+
+// Ping checks that the store directory is accessible
+func (ls *LocalStore) Ping(ctx context.Context) error {
+	if _, err := os.Stat(ls.dir); err != nil {
+		return fmt.Errorf("local store unavailable: %w", err)
+	}
+	return nil
+}
+
+// Close closes the local store
+func (ls *LocalStore) Close() error {
+	ls.logger.Info("Closing local store")
+	return nil
+}
@@ -0,0 +1,172 @@
+package services
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"kaelo/config"
+	"kaelo/models"
+
+	"go.uber.org/zap"
+)
+
+// readingFingerprint hashes the sequence number, device timestamp and values of a reading.
+// Two readings with the same fingerprint are the same measurement sent twice. A timestamp the
+// server assigned on receipt is left out, it differs between a reading and its resend.
+func readingFingerprint(data *models.SensorData) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%d|%s|%g|%g|%g|%s|%t|%g|%g|%g|%g|%g|%g",
+		data.DeviceID, data.Seq, deviceTimestamp(data),
+		data.TemperatureDHT, data.TemperatureMPU, data.Humidity, data.GasQuality, data.FlameDetected,
+		data.Acceleration.X, data.Acceleration.Y, data.Acceleration.Z,
+		data.Gyroscope.X, data.Gyroscope.Y, data.Gyroscope.Z)
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// deviceTimestamp formats the timestamp the device sent, or returns "" when the server
+// assigned it
+func deviceTimestamp(data *models.SensorData) string {
+	if data.TimestampAssigned {
+		return ""
+	}
+	return strconv.FormatInt(data.Timestamp.UnixNano(), 10)
+}
+
+// seqEpochBucket is how finely the receive time of a reading with a sequence number but no
+// device timestamp is kept. A device restarting its counter after a reboot reuses sequence
+// numbers, so the bucket keeps it from colliding with readings of an earlier boot; a resend
+// straddling a bucket boundary is stored twice rather than overwriting anything.
+const seqEpochBucket = 10 * time.Minute
+
+// seqEpoch returns the start of the bucket a reading with an assigned timestamp was received in
+func seqEpoch(data *models.SensorData) time.Time {
+	return data.Timestamp.Truncate(seqEpochBucket)
+}
+
+// messageIdentity identifies a reading for deduplication: the device's message ID when
+// present, then its sequence number with the device timestamp or, without one, the bucketed
+// receive time, in case the counter restarted. A reading with a device timestamp is otherwise
+// identified by its fingerprint. A reading with none of these returns "": a resend can't be
+// told apart from a reading that repeats the same values, so it isn't deduplicated.
+func messageIdentity(data *models.SensorData) string {
+	switch {
+	case data.MessageID != "":
+		return data.DeviceID + "|m|" + data.MessageID
+	case data.Seq != 0 && data.TimestampAssigned:
+		return data.DeviceID + "|s|" + strconv.FormatUint(data.Seq, 10) + "|e" + strconv.FormatInt(seqEpoch(data).Unix(), 10)
+	case data.Seq != 0:
+		return data.DeviceID + "|s|" + strconv.FormatUint(data.Seq, 10) + "|" + deviceTimestamp(data)
+	case data.TimestampAssigned:
+		return ""
+	}
+	return data.DeviceID + "|f|" + readingFingerprint(data)
+}
+
+// seenMessage is an entry in the deduplication cache
+type seenMessage struct {
+	identity string
+	seenAt   time.Time
+}
+
+// MessageDeduplicator drops readings that were already ingested recently, e.g. a device
+// re-sending after an MQTT reconnect or a RabbitMQ redelivery. The cache is bounded by
+// size and age, oldest entries are evicted first.
+type MessageDeduplicator struct {
+	window  time.Duration
+	maxSize int
+	entries map[string]*list.Element
+	order   *list.List // of *seenMessage, oldest first
+	logger  *zap.Logger
+	mu      sync.Mutex
+}
+
+// NewMessageDeduplicator creates a deduplicator from DEDUP_CACHE_SIZE and DEDUP_WINDOW
+func NewMessageDeduplicator(cfg *config.Config, logger *zap.Logger) *MessageDeduplicator {
+	return &MessageDeduplicator{
+		window:  time.Duration(cfg.DedupWindow) * time.Second,
+		maxSize: cfg.DedupCacheSize,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		logger:  logger,
+	}
+}
+
+// Enabled reports whether deduplication is turned on
+func (d *MessageDeduplicator) Enabled() bool {
+	return d.maxSize > 0 && d.window > 0
+}
+
+// Seen records a reading and reports whether it was already seen within the window
+func (d *MessageDeduplicator) Seen(data *models.SensorData) bool {
+	if !d.Enabled() {
+		return false
+	}
+
+	identity := messageIdentity(data)
+	if identity == "" {
+		return false
+	}
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.evictExpiredLocked(now)
+
+	if element, ok := d.entries[identity]; ok {
+		d.logger.Debug("Dropping duplicate reading",
+			zap.String("device_id", data.DeviceID),
+			zap.String("message_id", data.MessageID),
+			zap.Uint64("seq", data.Seq),
+			zap.Time("first_seen", element.Value.(*seenMessage).seenAt))
+		return true
+	}
+
+	d.entries[identity] = d.order.PushBack(&seenMessage{identity: identity, seenAt: now})
+	for d.order.Len() > d.maxSize {
+		d.removeLocked(d.order.Front())
+	}
+
+	return false
+}
+
+// Forget removes a reading from the cache, e.g. when its message is requeued so the
+// redelivery isn't dropped as a duplicate
+func (d *MessageDeduplicator) Forget(data *models.SensorData) {
+	if !d.Enabled() {
+		return
+	}
+
+	identity := messageIdentity(data)
+	if identity == "" {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if element, ok := d.entries[identity]; ok {
+		d.removeLocked(element)
+	}
+}
+
+// evictExpiredLocked drops entries older than the window. Must be called with d.mu held.
+func (d *MessageDeduplicator) evictExpiredLocked(now time.Time) {
+	for front := d.order.Front(); front != nil; front = d.order.Front() {
+		if now.Sub(front.Value.(*seenMessage).seenAt) < d.window {
+			return
+		}
+		d.removeLocked(front)
+	}
+}
+
+// removeLocked removes a cache entry. Must be called with d.mu held.
+func (d *MessageDeduplicator) removeLocked(element *list.Element) {
+	delete(d.entries, element.Value.(*seenMessage).identity)
+	d.order.Remove(element)
+}
@@ -0,0 +1,139 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"kaelo/config"
+	"kaelo/models"
+
+	"go.uber.org/zap"
+)
+
+func newTestDeduplicator() *MessageDeduplicator {
+	return NewMessageDeduplicator(&config.Config{DedupWindow: 600, DedupCacheSize: 100}, zap.NewNop())
+}
+
+// decodeTestReading decodes a single reading payload
+func decodeTestReading(t *testing.T, body string) *models.SensorData {
+	t.Helper()
+
+	readings, invalid, err := decodeSensorPayload([]byte(body), deviceTopic{})
+	if err != nil || len(invalid) > 0 || len(readings) != 1 {
+		t.Fatalf("decodeSensorPayload(%s) = %v, %v, %v", body, readings, invalid, err)
+	}
+	return readings[0]
+}
+
+func TestDeduplicatorResendWithoutTimestamp(t *testing.T) {
+	const body = `{"device_id": "ESP32-001", "seq": 7, "temperature_dht": 25.5, "humidity": 60, "gas_quality": "good"}`
+
+	first := decodeTestReading(t, body)
+	time.Sleep(2 * time.Millisecond)
+	resend := decodeTestReading(t, body)
+
+	if !first.TimestampAssigned || !resend.TimestampAssigned {
+		t.Fatal("reading without a timestamp not marked as assigned")
+	}
+	if first.Timestamp.Equal(resend.Timestamp) {
+		t.Fatal("resend got the same receive time, test doesn't cover assigned timestamps")
+	}
+
+	dedup := newTestDeduplicator()
+	if dedup.Seen(first) {
+		t.Fatal("first reading reported as a duplicate")
+	}
+	if !dedup.Seen(resend) {
+		t.Error("resend with the same seq not reported as a duplicate")
+	}
+	if readingKey(first) != readingKey(resend) {
+		t.Errorf("resend stored under %q, first under %q", readingKey(resend), readingKey(first))
+	}
+
+	next := decodeTestReading(t, `{"device_id": "ESP32-001", "seq": 8, "temperature_dht": 25.5, "humidity": 60, "gas_quality": "good"}`)
+	if dedup.Seen(next) {
+		t.Error("next seq reported as a duplicate")
+	}
+}
+
+func TestDeduplicatorSeqReset(t *testing.T) {
+	received := time.Date(2024, 5, 1, 3, 5, 0, 0, time.UTC)
+	reading := func(seq uint64, at time.Time) *models.SensorData {
+		return &models.SensorData{DeviceID: "ESP32-001", Seq: seq, Timestamp: at, TimestampAssigned: true, TemperatureDHT: 25.5}
+	}
+	first := reading(7, received)
+
+	dedup := newTestDeduplicator()
+	dedup.Seen(first)
+	resend := reading(7, received.Add(3*time.Second))
+	if !dedup.Seen(resend) || readingKey(resend) != readingKey(first) {
+		t.Error("resend within seconds not treated as the same reading")
+	}
+
+	// The device rebooted and counts from 1 again, reaching seq 7 within the dedup window
+	reset := reading(7, received.Add(8*time.Minute))
+	if dedup.Seen(reset) {
+		t.Error("reading after a seq reset reported as a duplicate")
+	}
+	if readingKey(reset) == readingKey(first) {
+		t.Errorf("reading after a seq reset stored under %q, overwriting the earlier reading", readingKey(reset))
+	}
+}
+
+func TestDeduplicatorRepeatedValuesWithoutIdentity(t *testing.T) {
+	const body = `{"device_id": "ESP32-001", "temperature_dht": 25.5, "humidity": 60, "gas_quality": "good"}`
+
+	first := decodeTestReading(t, body)
+	time.Sleep(2 * time.Millisecond)
+	repeated := decodeTestReading(t, body)
+
+	// Without a message ID, seq or device timestamp a resend can't be told apart from a
+	// steady sensor, so neither is dropped or overwritten
+	dedup := newTestDeduplicator()
+	dedup.Seen(first)
+	if dedup.Seen(repeated) {
+		t.Error("reading repeating the same values reported as a duplicate")
+	}
+	if readingKey(first) == readingKey(repeated) {
+		t.Error("reading repeating the same values would overwrite the stored reading")
+	}
+}
+
+func TestDeduplicatorDeviceTimestamp(t *testing.T) {
+	const body = `{"schema_version": 2, "device_id": "ESP32-001", "seq": 7, "timestamp": "2024-05-01T10:00:00+07:00",
+		"temperature_dht": 25.5, "humidity": 60, "gas_quality": "good", "flame_detected": false,
+		"acceleration": {"x": 0, "y": 0, "z": 1}, "gyroscope": {"x": 0, "y": 0, "z": 0}}`
+
+	first := decodeTestReading(t, body)
+	if first.TimestampAssigned {
+		t.Fatal("device timestamp marked as assigned")
+	}
+
+	dedup := newTestDeduplicator()
+	dedup.Seen(first)
+	if !dedup.Seen(decodeTestReading(t, body)) {
+		t.Error("redelivered reading not reported as a duplicate")
+	}
+
+	// The device restarted and its counter with it: same seq, later reading
+	restarted := decodeTestReading(t, `{"schema_version": 2, "device_id": "ESP32-001", "seq": 7, "timestamp": "2024-05-01T12:00:00+07:00",
+		"temperature_dht": 25.5, "humidity": 60, "gas_quality": "good", "flame_detected": false,
+		"acceleration": {"x": 0, "y": 0, "z": 1}, "gyroscope": {"x": 0, "y": 0, "z": 0}}`)
+	if dedup.Seen(restarted) {
+		t.Error("reading after a counter restart reported as a duplicate")
+	}
+	if readingKey(first) == readingKey(restarted) {
+		t.Error("reading after a counter restart would overwrite the stored reading")
+	}
+}
+
+func TestDeduplicatorForgetRequeued(t *testing.T) {
+	data := decodeTestReading(t, `{"device_id": "ESP32-001", "message_id": "abc", "temperature_dht": 25.5}`)
+
+	dedup := newTestDeduplicator()
+	dedup.Seen(data)
+	dedup.Forget(data)
+	if dedup.Seen(data) {
+		t.Error("redelivery of a requeued message reported as a duplicate")
+	}
+}
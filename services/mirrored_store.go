@@ -0,0 +1,164 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"kaelo/models"
+
+	"go.uber.org/zap"
+)
+
+// MirroredStore keeps a copy of everything written to a remote store in the embedded bolt
+// store. Writes go to both; the primary's result is returned and mirror failures are logged.
+// Queries are served by the primary and fall back to the mirror when it fails, so history
+// stays available while the connection is down.
+type MirroredStore struct {
+	primary SensorStore
+	mirror  *BoltStore
+	logger  *zap.Logger
+}
+
+// NewMirroredStore wraps a primary store with an embedded mirror
+func NewMirroredStore(primary SensorStore, mirror *BoltStore, logger *zap.Logger) *MirroredStore {
+	logger.Info("Mirroring the sensor store to the embedded bolt store")
+
+	return &MirroredStore{
+		primary: primary,
+		mirror:  mirror,
+		logger:  logger,
+	}
+}
+
+// mirrorFailed logs a failed mirror write
+func (ms *MirroredStore) mirrorFailed(operation string, err error) {
+	ms.logger.Warn("Failed to write to the bolt mirror",
+		zap.String("operation", operation),
+		zap.Error(err))
+}
+
+// fallback reports whether a primary query error should be retried on the mirror, logging it
+func (ms *MirroredStore) fallback(operation string, err error) bool {
+	if err == nil || errors.Is(err, ErrNotFound) {
+		return false
+	}
+	ms.logger.Warn("Primary store query failed, serving from the bolt mirror",
+		zap.String("operation", operation),
+		zap.Error(err))
+	return true
+}
+
+// WriteBatch writes readings to the mirror, then the primary. Retried batches overwrite
+// the mirrored copies since keys are deterministic.
+func (ms *MirroredStore) WriteBatch(ctx context.Context, batch []*models.SensorData) error {
+	if err := ms.mirror.WriteBatch(ctx, batch); err != nil {
+		ms.mirrorFailed("write_batch", err)
+	}
+	return ms.primary.WriteBatch(ctx, batch)
+}
+
+// LatestReading returns the newest reading from the primary, or the mirror if it fails
+func (ms *MirroredStore) LatestReading(ctx context.Context, deviceID string) (*models.SensorData, error) {
+	data, err := ms.primary.LatestReading(ctx, deviceID)
+	if ms.fallback("latest_reading", err) {
+		return ms.mirror.LatestReading(ctx, deviceID)
+	}
+	return data, err
+}
+
+// QueryReadings queries the primary, or the mirror if it fails
+func (ms *MirroredStore) QueryReadings(ctx context.Context, q TimeRangeQuery) (Page[*models.SensorData], error) {
+	page, err := ms.primary.QueryReadings(ctx, q)
+	if ms.fallback("query_readings", err) {
+		return ms.mirror.QueryReadings(ctx, q)
+	}
+	return page, err
+}
+
+// WriteAnomalies writes anomalies to the mirror, then the primary
+func (ms *MirroredStore) WriteAnomalies(ctx context.Context, anomalies []*models.Anomaly) error {
+	if err := ms.mirror.WriteAnomalies(ctx, anomalies); err != nil {
+		ms.mirrorFailed("write_anomalies", err)
+	}
+	return ms.primary.WriteAnomalies(ctx, anomalies)
+}
+
+// QueryAnomalies queries the primary, or the mirror if it fails
+func (ms *MirroredStore) QueryAnomalies(ctx context.Context, q AnomalyQuery) (Page[*models.Anomaly], error) {
+	page, err := ms.primary.QueryAnomalies(ctx, q)
+	if ms.fallback("query_anomalies", err) {
+		return ms.mirror.QueryAnomalies(ctx, q)
+	}
+	return page, err
+}
+
+// WriteFaceEvent writes a face event to the mirror, then the primary
+func (ms *MirroredStore) WriteFaceEvent(ctx context.Context, event *models.FaceEvent) error {
+	if err := ms.mirror.WriteFaceEvent(ctx, event); err != nil {
+		ms.mirrorFailed("write_face_event", err)
+	}
+	return ms.primary.WriteFaceEvent(ctx, event)
+}
+
+// QueryFaceEvents queries the primary, or the mirror if it fails
+func (ms *MirroredStore) QueryFaceEvents(ctx context.Context, q TimeRangeQuery) (Page[*models.FaceEvent], error) {
+	page, err := ms.primary.QueryFaceEvents(ctx, q)
+	if ms.fallback("query_face_events", err) {
+		return ms.mirror.QueryFaceEvents(ctx, q)
+	}
+	return page, err
+}
+
+// WriteHealthEvent records a health check in the mirror only
+func (ms *MirroredStore) WriteHealthEvent(ctx context.Context, data *models.HealthCheckData) error {
+	return ms.mirror.WriteHealthEvent(ctx, data)
+}
+
+// QueryHealthEvents returns health checks recorded in the mirror
+func (ms *MirroredStore) QueryHealthEvents(ctx context.Context, q TimeRangeQuery) (Page[*models.HealthCheckData], error) {
+	return ms.mirror.QueryHealthEvents(ctx, q)
+}
+
+// MergeRollup merges into the primary, then the mirror. Merging isn't idempotent, so the
+// mirror only sees rollups the primary accepted; failed rollups are retried by the service.
+func (ms *MirroredStore) MergeRollup(ctx context.Context, rollup *models.Rollup) error {
+	if err := ms.primary.MergeRollup(ctx, rollup); err != nil {
+		return err
+	}
+	if err := ms.mirror.MergeRollup(ctx, rollup); err != nil {
+		ms.mirrorFailed("merge_rollup", err)
+	}
+	return nil
+}
+
+// Prune applies the retention policy to both stores and reports the primary's count.
+// Health events only exist in the mirror.
+func (ms *MirroredStore) Prune(ctx context.Context, collection string, cutoff time.Time, opts PruneOptions) (int, error) {
+	mirrored, mirrorErr := ms.mirror.Prune(ctx, collection, cutoff, opts)
+	if collection == healthEventsPath {
+		return mirrored, mirrorErr
+	}
+	if mirrorErr != nil {
+		ms.logger.Warn("Failed to prune the bolt mirror",
+			zap.String("collection", collection),
+			zap.Error(mirrorErr))
+	}
+
+	return ms.primary.Prune(ctx, collection, cutoff, opts)
+}
+
+// Ping checks the primary store
+func (ms *MirroredStore) Ping(ctx context.Context) error {
+	return ms.primary.Ping(ctx)
+}
+
+// Close closes both stores
+func (ms *MirroredStore) Close() error {
+	primaryErr := ms.primary.Close()
+	if err := ms.mirror.Close(); err != nil {
+		return fmt.Errorf("failed to close bolt mirror: %w", err)
+	}
+	return primaryErr
+}
@@ -0,0 +1,401 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kaelo/config"
+	"kaelo/metrics"
+	"kaelo/models"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+)
+
+// mqttRedeliveryDelay is how long a requeued message waits before it is handed to its
+// consumer again
+var mqttRedeliveryDelay = 5 * time.Second
+
+// mqttRoute feeds the messages of one queue's topics to its consumer
+type mqttRoute struct {
+	queue    string
+	bindings []string // routing key patterns, as the queue is bound in RabbitMQ
+	messages chan mqtt.Message
+}
+
+// MQTTService subscribes to the device topics on a plain MQTT broker (e.g. Mosquitto on the
+// Pi) instead of consuming RabbitMQ queues. It subscribes to the same topics the RabbitMQ
+// queues are bound to, and messages go through the same decoding, validation and deduplication.
+type MQTTService struct {
+	config    *config.Config
+	processor *messageProcessor
+	client    mqtt.Client
+	logger    *zap.Logger
+
+	sensor    *mqttRoute
+	face      *mqttRoute
+	health    *mqttRoute
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	subscribed atomic.Bool  // the subscriptions of the current connection succeeded
+	unacked    atomic.Int64 // messages received and not settled yet
+}
+
+// NewMQTTService connects to the MQTT broker. The session is persistent (clean session off)
+// and subscriptions use QoS 1, so the broker keeps readings published while the service is
+// offline, and messages are only acknowledged once processed.
+func NewMQTTService(cfg *config.Config, dedup *MessageDeduplicator, logger *zap.Logger) (*MQTTService, error) {
+	if cfg.RabbitMQAckMode != AckModeImmediate && cfg.RabbitMQAckMode != AckModePersisted {
+		return nil, fmt.Errorf("invalid RABBITMQ_ACK_MODE %q (expected %s or %s)",
+			cfg.RabbitMQAckMode, AckModeImmediate, AckModePersisted)
+	}
+	if cfg.MQTTClientID == "" {
+		return nil, errors.New("MQTT_CLIENT_ID is required for a persistent session")
+	}
+	if cfg.MQTTMaxInflight <= 0 {
+		return nil, fmt.Errorf("invalid MQTT_MAX_INFLIGHT %d (expected a positive number)", cfg.MQTTMaxInflight)
+	}
+
+	service := newMQTTService(cfg, dedup, logger)
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.MQTTBrokerURL).
+		SetClientID(cfg.MQTTClientID).
+		SetUsername(cfg.MQTTUsername).
+		SetPassword(cfg.MQTTPassword).
+		SetCleanSession(false).   // the broker queues QoS 1 messages while we're offline
+		SetAutoAckDisabled(true). // messages are acked once processed (or stored)
+		SetOrderMatters(false).   // handlers block until a consumer takes the message
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(30 * time.Second).
+		// Messages queued in the session can arrive before the subscriptions are renewed
+		SetDefaultPublishHandler(service.handleMessage).
+		SetOnConnectHandler(service.subscribe).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			service.subscribed.Store(false)
+			logger.Warn("Lost connection to MQTT broker, reconnecting", zap.Error(err))
+		})
+	service.client = mqtt.NewClient(opts)
+
+	logger.Info("Connecting to MQTT broker",
+		zap.String("broker", cfg.MQTTBrokerURL),
+		zap.String("client_id", cfg.MQTTClientID))
+
+	// Connect to the broker with retry
+	var err error
+	maxRetries := 5
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		token := service.client.Connect()
+		if !token.WaitTimeout(30 * time.Second) {
+			err = errors.New("timeout")
+		} else {
+			err = token.Error()
+		}
+		if err == nil {
+			break
+		}
+
+		logger.Warn("Failed to connect to MQTT broker",
+			zap.Int("attempt", attempt),
+			zap.Int("max_retries", maxRetries),
+			zap.Error(err))
+
+		if attempt < maxRetries {
+			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MQTT broker after %d attempts: %w", maxRetries, err)
+	}
+
+	logger.Info("Connected to MQTT broker successfully")
+	return service, nil
+}
+
+// newMQTTService returns the service without a client
+func newMQTTService(cfg *config.Config, dedup *MessageDeduplicator, logger *zap.Logger) *MQTTService {
+	return &MQTTService{
+		config:    cfg,
+		processor: &messageProcessor{config: cfg, dedup: dedup, logger: logger},
+		logger:    logger,
+		sensor:    newMQTTRoute(cfg, cfg.RabbitMQQueue, deviceTopicTelemetry),
+		face:      newMQTTRoute(cfg, faceRecognitionQueue, deviceTopicFace),
+		health:    newMQTTRoute(cfg, cfg.HealthCheckQueue, deviceTopicHealth),
+		closed:    make(chan struct{}),
+	}
+}
+
+// newMQTTRoute returns the route of a queue: its own name (with an optional payload format
+// suffix) and its kind of device topic
+func newMQTTRoute(cfg *config.Config, queue, kind string) *mqttRoute {
+	route := &mqttRoute{
+		queue:    queue,
+		bindings: []string{queue, queue + ".*"},
+		messages: make(chan mqtt.Message),
+	}
+	if cfg.DeviceTopicRoot != "" {
+		route.bindings = append(route.bindings, deviceTopicBindings(cfg.DeviceTopicRoot, kind)...)
+	}
+	return route
+}
+
+// subscribe (re)subscribes to every topic after connecting. It runs in its own goroutine and
+// retries until the subscriptions succeed, the connection is lost (the next connection
+// subscribes again) or the service is closed.
+func (m *MQTTService) subscribe(client mqtt.Client) {
+	filters := make(map[string]byte)
+	for _, route := range []*mqttRoute{m.sensor, m.face, m.health} {
+		for _, binding := range route.bindings {
+			filters[mqttTopicFilter(binding)] = 1
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		token := client.SubscribeMultiple(filters, m.handleMessage)
+		err := errors.New("timeout")
+		if token.WaitTimeout(30 * time.Second) {
+			err = token.Error()
+		}
+		if err == nil {
+			break
+		}
+
+		m.logger.Error("Failed to subscribe to MQTT topics, retrying",
+			zap.Int("attempt", attempt),
+			zap.Error(err))
+		select {
+		case <-time.After(min(time.Duration(attempt)*2*time.Second, 30*time.Second)):
+		case <-m.closed:
+			return
+		}
+		if !client.IsConnectionOpen() {
+			return
+		}
+	}
+	m.subscribed.Store(true)
+
+	topics := make([]string, 0, len(filters))
+	for filter := range filters {
+		topics = append(topics, filter)
+	}
+	m.logger.Info("Subscribed to MQTT topics", zap.Strings("topics", topics), zap.Int("qos", 1))
+}
+
+// handleMessage hands a message to the consumer of its topic. It runs in its own goroutine
+// and waits for the consumer, so the number of unacked messages the broker allows in flight
+// limits how much is buffered.
+func (m *MQTTService) handleMessage(_ mqtt.Client, msg mqtt.Message) {
+	route := m.route(msg.Topic())
+	if route == nil {
+		m.logger.Warn("Ignoring MQTT message on unexpected topic", zap.String("topic", msg.Topic()))
+		msg.Ack()
+		return
+	}
+
+	m.unacked.Add(1)
+	m.deliver(route, msg)
+}
+
+// deliver waits for the consumer of a route to take a message
+func (m *MQTTService) deliver(route *mqttRoute, msg mqtt.Message) {
+	select {
+	case route.messages <- msg:
+	case <-m.closed:
+		// Left unacked, the broker redelivers it when the session resumes
+	}
+}
+
+// redeliver hands a requeued message to its consumer again after mqttRedeliveryDelay. The
+// broker only redelivers unacked messages when the session resumes, so waiting for it would
+// hold the message (and one of the broker's in-flight slots) until the next reconnect.
+func (m *MQTTService) redeliver(route *mqttRoute, msg mqtt.Message) {
+	select {
+	case <-time.After(mqttRedeliveryDelay):
+		m.deliver(route, msg)
+	case <-m.closed:
+	}
+}
+
+// route finds the route of an MQTT topic
+func (m *MQTTService) route(topic string) *mqttRoute {
+	key := mqttRoutingKey(topic)
+	for _, route := range []*mqttRoute{m.sensor, m.face, m.health} {
+		for _, binding := range route.bindings {
+			if matchRoutingKey(binding, key) {
+				return route
+			}
+		}
+	}
+	return nil
+}
+
+// ConsumeSensorData processes sensor data messages until ctx is done
+func (m *MQTTService) ConsumeSensorData(ctx context.Context, sensorDataChan chan<- *models.SensorData) error {
+	m.logger.Info("Started consuming messages from MQTT",
+		zap.String("queue", m.sensor.queue),
+		zap.String("ack_mode", m.config.RabbitMQAckMode))
+
+	return m.consume(ctx, m.sensor, func(msg ingestMessage, delivery *messageDelivery) {
+		m.processor.handleSensorMessage(msg, delivery, sensorDataChan)
+	})
+}
+
+// ConsumeFaceRecognitionData processes face recognition messages until ctx is done
+func (m *MQTTService) ConsumeFaceRecognitionData(ctx context.Context, faceDataChan chan<- *models.FaceRecognitionData) error {
+	return m.consume(ctx, m.face, func(msg ingestMessage, delivery *messageDelivery) {
+		err := m.processor.processFaceRecognitionMessage(msg, faceDataChan)
+		m.settle(delivery, err, "Failed to process face recognition message", msg)
+	})
+}
+
+// ConsumeHealthCheck processes health check messages until ctx is done
+func (m *MQTTService) ConsumeHealthCheck(ctx context.Context, healthCheckChan chan<- *models.HealthCheckData) error {
+	return m.consume(ctx, m.health, func(msg ingestMessage, delivery *messageDelivery) {
+		err := m.processor.processHealthCheckMessage(msg, healthCheckChan)
+		m.settle(delivery, err, "Failed to process health check message", msg)
+	})
+}
+
+// settle acks a processed face or health message. Invalid messages are dropped, other
+// failures (e.g. a full processing channel) are requeued, as with RabbitMQ.
+func (m *MQTTService) settle(delivery *messageDelivery, err error, failure string, msg ingestMessage) {
+	switch {
+	case errors.Is(err, errInvalidPayload):
+		m.logger.Warn("Rejecting invalid message", zap.Error(err), zap.String("topic", msg.topic))
+		delivery.Nack(false)
+	case err != nil:
+		m.logger.Error(failure, zap.Error(err), zap.String("topic", msg.topic))
+		delivery.Nack(true)
+	default:
+		delivery.Ack()
+	}
+}
+
+// consume passes the messages of a route to handle
+func (m *MQTTService) consume(ctx context.Context, route *mqttRoute, handle func(ingestMessage, *messageDelivery)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			m.logger.Info("Stopping MQTT consumer", zap.String("queue", route.queue))
+			return nil
+
+		case msg := <-route.messages:
+			metrics.MessagesConsumed.WithLabelValues(route.queue).Inc()
+			handle(mqttMessage(msg), m.newDelivery(route, msg))
+		}
+	}
+}
+
+// Ping reports whether the MQTT connection is open with its subscriptions in place, and
+// whether messages still flow: once MQTT_MAX_INFLIGHT messages are unacked the broker stops
+// sending, e.g. while the batch writer can't store readings in persisted ack mode
+func (m *MQTTService) Ping(ctx context.Context) error {
+	if !m.client.IsConnectionOpen() {
+		return errors.New("MQTT connection is not open")
+	}
+	if !m.subscribed.Load() {
+		return errors.New("not subscribed to the MQTT topics")
+	}
+	if unacked := m.unacked.Load(); unacked >= int64(m.config.MQTTMaxInflight) {
+		return fmt.Errorf("%d messages unacked, the broker's in-flight limit of %d is reached", unacked, m.config.MQTTMaxInflight)
+	}
+	return nil
+}
+
+// Close disconnects from the broker. Unacked messages stay in the session and are
+// redelivered on the next start.
+func (m *MQTTService) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+
+		m.logger.Info("Closing MQTT connection")
+		m.client.Disconnect(250)
+		m.logger.Info("MQTT connection closed")
+	})
+	return nil
+}
+
+// mqttMessage converts an MQTT message for the message processor. MQTT 3.1.1 has no content
+// type, so the format comes from the topic suffix.
+func mqttMessage(msg mqtt.Message) ingestMessage {
+	return ingestMessage{
+		topic:     mqttRoutingKey(msg.Topic()),
+		messageID: strconv.Itoa(int(msg.MessageID())),
+		body:      msg.Payload(),
+	}
+}
+
+// newDelivery wraps an MQTT message so it settles exactly once. MQTT has no negative
+// acknowledgement: a rejected message is acked (dropped), and a requeued one stays unacked
+// and is handed to the consumer again after mqttRedeliveryDelay (see redeliver).
+func (m *MQTTService) newDelivery(route *mqttRoute, msg mqtt.Message) *messageDelivery {
+	ack := func() error {
+		msg.Ack()
+		m.unacked.Add(-1)
+		return nil
+	}
+	return newMessageDelivery(route.queue,
+		ack,
+		func(requeue bool) error {
+			if requeue {
+				go m.redeliver(route, msg)
+				return nil
+			}
+			return ack()
+		},
+		zap.String("topic", msg.Topic()),
+		m.logger)
+}
+
+// mqttRoutingKey converts an MQTT topic to a routing key the way RabbitMQ's MQTT plugin does,
+// so both transports see the same topics (kaelo/site-a/ESP32-001/telemetry becomes
+// kaelo.site-a.ESP32-001.telemetry)
+func mqttRoutingKey(topic string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/':
+			return '.'
+		case '.':
+			return '/'
+		}
+		return r
+	}, topic)
+}
+
+// mqttTopicFilter converts a binding pattern back to an MQTT topic filter, with * becoming
+// the single-level wildcard +
+func mqttTopicFilter(pattern string) string {
+	segments := strings.Split(pattern, ".")
+	for i, segment := range segments {
+		if segment == "*" {
+			segments[i] = "+"
+		} else {
+			segments[i] = strings.ReplaceAll(segment, "/", ".")
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// matchRoutingKey matches a routing key against a binding pattern where * stands for exactly
+// one segment, as on a topic exchange
+func matchRoutingKey(pattern, key string) bool {
+	patternSegments := strings.Split(pattern, ".")
+	keySegments := strings.Split(key, ".")
+	if len(patternSegments) != len(keySegments) {
+		return false
+	}
+	for i, segment := range patternSegments {
+		if segment != "*" && segment != keySegments[i] {
+			return false
+		}
+	}
+	return true
+}
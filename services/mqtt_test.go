@@ -0,0 +1,184 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"kaelo/config"
+	"kaelo/models"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+)
+
+// fakeMQTTMessage records whether it was acked
+type fakeMQTTMessage struct {
+	mqtt.Message
+
+	topic   string
+	payload []byte
+
+	mu    sync.Mutex
+	acked int
+}
+
+func (m *fakeMQTTMessage) Topic() string     { return m.topic }
+func (m *fakeMQTTMessage) MessageID() uint16 { return 1 }
+func (m *fakeMQTTMessage) Payload() []byte   { return m.payload }
+
+func (m *fakeMQTTMessage) Ack() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.acked++
+}
+
+func (m *fakeMQTTMessage) ackCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.acked
+}
+
+// fakeMQTTToken is a completed token
+type fakeMQTTToken struct {
+	mqtt.Token
+	err error
+}
+
+func (t *fakeMQTTToken) WaitTimeout(time.Duration) bool { return true }
+func (t *fakeMQTTToken) Error() error                   { return t.err }
+
+// fakeMQTTClient is a connected client whose first subscribeFailures subscriptions fail
+type fakeMQTTClient struct {
+	mqtt.Client
+
+	mu                sync.Mutex
+	subscribeFailures int
+	subscribes        int
+}
+
+func (c *fakeMQTTClient) IsConnectionOpen() bool { return true }
+
+func (c *fakeMQTTClient) SubscribeMultiple(map[string]byte, mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscribes++
+	if c.subscribes <= c.subscribeFailures {
+		return &fakeMQTTToken{err: errors.New("not authorised")}
+	}
+	return &fakeMQTTToken{}
+}
+
+func newTestMQTTService(t *testing.T) *MQTTService {
+	t.Helper()
+
+	cfg := &config.Config{
+		RabbitMQQueue:    "sensor_data_queue",
+		HealthCheckQueue: "health_check_queue",
+		RabbitMQAckMode:  AckModeImmediate,
+		MQTTMaxInflight:  2,
+	}
+	service := newMQTTService(cfg, newTestDeduplicator(), zap.NewNop())
+	service.client = &fakeMQTTClient{}
+	t.Cleanup(func() { close(service.closed) })
+
+	delay := mqttRedeliveryDelay
+	mqttRedeliveryDelay = 10 * time.Millisecond
+	t.Cleanup(func() { mqttRedeliveryDelay = delay })
+	return service
+}
+
+// receive waits for the next message of a route
+func receive(t *testing.T, route *mqttRoute) mqtt.Message {
+	t.Helper()
+
+	select {
+	case msg := <-route.messages:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no message on %s", route.queue)
+		return nil
+	}
+}
+
+func TestMQTTRequeuedMessageIsRedelivered(t *testing.T) {
+	service := newTestMQTTService(t)
+	msg := &fakeMQTTMessage{topic: "sensor_data_queue"}
+	go service.handleMessage(nil, msg)
+
+	service.newDelivery(service.sensor, receive(t, service.sensor)).Nack(true)
+	redelivered := receive(t, service.sensor)
+	if redelivered != msg || msg.ackCount() != 0 {
+		t.Fatalf("requeued message acked %d times, want redelivered unacked", msg.ackCount())
+	}
+	if unacked := service.unacked.Load(); unacked != 1 {
+		t.Errorf("unacked = %d, want 1 while redelivered", unacked)
+	}
+
+	service.newDelivery(service.sensor, redelivered).Ack()
+	if msg.ackCount() != 1 || service.unacked.Load() != 0 {
+		t.Errorf("acked %d times with %d unacked, want acked once", msg.ackCount(), service.unacked.Load())
+	}
+}
+
+func TestMQTTFaceMessageSettlement(t *testing.T) {
+	service := newTestMQTTService(t)
+	faceDataChan := make(chan *models.FaceRecognitionData, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go service.ConsumeFaceRecognitionData(ctx, faceDataChan)
+
+	invalid := &fakeMQTTMessage{topic: faceRecognitionQueue, payload: []byte(`{"device_id": "ESP32-CAM"}`)}
+	valid := &fakeMQTTMessage{topic: faceRecognitionQueue, payload: []byte(`{"uid": "unknown-7"}`)}
+	service.handleMessage(nil, invalid)
+	service.handleMessage(nil, valid)
+
+	<-faceDataChan
+	deadline := time.Now().Add(2 * time.Second)
+	for (invalid.ackCount() == 0 || valid.ackCount() == 0) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if invalid.ackCount() != 1 || valid.ackCount() != 1 {
+		t.Fatalf("invalid acked %d times, valid %d, want both acked once", invalid.ackCount(), valid.ackCount())
+	}
+}
+
+func TestMQTTFailedFaceMessageIsRequeued(t *testing.T) {
+	service := newTestMQTTService(t)
+
+	// A temporary failure is retried rather than dropped
+	failed := &fakeMQTTMessage{topic: faceRecognitionQueue}
+	service.unacked.Add(1)
+	service.settle(service.newDelivery(service.face, failed), errors.New("timeout sending to face recognition processing channel"), "failed", ingestMessage{})
+	if receive(t, service.face) != failed || failed.ackCount() != 0 {
+		t.Errorf("failed message acked %d times, want redelivered", failed.ackCount())
+	}
+}
+
+func TestMQTTReadiness(t *testing.T) {
+	service := newTestMQTTService(t)
+	client := &fakeMQTTClient{subscribeFailures: 1}
+	service.client = client
+
+	if err := service.Ping(context.Background()); err == nil {
+		t.Error("ready before subscribing")
+	}
+
+	service.subscribe(client)
+	if client.subscribes != 2 {
+		t.Errorf("subscribed %d times, want a retry after the failure", client.subscribes)
+	}
+	if err := service.Ping(context.Background()); err != nil {
+		t.Errorf("not ready after subscribing: %v", err)
+	}
+
+	for i := 0; i < service.config.MQTTMaxInflight; i++ {
+		go service.handleMessage(nil, &fakeMQTTMessage{topic: "sensor_data_queue"})
+		receive(t, service.sensor)
+	}
+	if err := service.Ping(context.Background()); err == nil {
+		t.Error("ready with the in-flight limit reached")
+	}
+}
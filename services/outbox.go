@@ -0,0 +1,401 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"kaelo/config"
+	"kaelo/metrics"
+	"kaelo/models"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// NotificationSender delivers outbox notifications for a single channel
+type NotificationSender interface {
+	DeliverNotification(ctx context.Context, notification *models.Notification) error
+}
+
+// RetryAfterError is returned by senders when the remote API asks us to back off
+type RetryAfterError struct {
+	Delay time.Duration
+	Err   error
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("retry after %s: %v", e.Delay, e.Err)
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// OutboxItemStatus is a summary of a single outbox notification
+type OutboxItemStatus struct {
+	ID            string                     `json:"id"`
+	Channel       models.NotificationChannel `json:"channel"`
+	Kind          models.NotificationKind    `json:"kind"`
+	DeviceID      string                     `json:"device_id,omitempty"`
+	Critical      bool                       `json:"critical"`
+	Status        models.NotificationStatus  `json:"status"`
+	Attempts      int                        `json:"attempts"`
+	LastError     string                     `json:"last_error,omitempty"`
+	CreatedAt     time.Time                  `json:"created_at"`
+	NextAttemptAt time.Time                  `json:"next_attempt_at"`
+}
+
+// OutboxStatus is a snapshot of pending and failed notifications
+type OutboxStatus struct {
+	Pending int                `json:"pending"`
+	Failed  int                `json:"failed"`
+	Items   []OutboxItemStatus `json:"items"`
+}
+
+const (
+	outboxBaseBackoff = 2 * time.Second
+	outboxMaxBackoff  = 5 * time.Minute
+)
+
+// NotificationOutbox persists every notification to disk before delivery and
+// retries delivery with backoff until it succeeds
+type NotificationOutbox struct {
+	dir         string
+	maxAttempts int
+	logger      *zap.Logger
+	senders     map[models.NotificationChannel]NotificationSender
+	items       map[string]*models.Notification
+	pausedUntil map[models.NotificationChannel]time.Time
+	wake        chan struct{}
+	mu          sync.Mutex
+}
+
+// NewNotificationOutbox creates the outbox and loads notifications left over from a previous run
+func NewNotificationOutbox(cfg *config.Config, logger *zap.Logger) (*NotificationOutbox, error) {
+	if err := os.MkdirAll(cfg.OutboxDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create outbox directory: %w", err)
+	}
+
+	o := &NotificationOutbox{
+		dir:         cfg.OutboxDir,
+		maxAttempts: cfg.OutboxMaxAttempts,
+		logger:      logger,
+		senders:     make(map[models.NotificationChannel]NotificationSender),
+		items:       make(map[string]*models.Notification),
+		pausedUntil: make(map[models.NotificationChannel]time.Time),
+		wake:        make(chan struct{}, 1),
+	}
+
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// load reads persisted notifications from the outbox directory
+func (o *NotificationOutbox) load() error {
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read outbox directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		path := filepath.Join(o.dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			o.logger.Error("Failed to read outbox notification", zap.String("path", path), zap.Error(err))
+			continue
+		}
+
+		var notification models.Notification
+		if err := json.Unmarshal(data, &notification); err != nil {
+			o.logger.Error("Failed to parse outbox notification", zap.String("path", path), zap.Error(err))
+			continue
+		}
+
+		o.items[notification.ID] = &notification
+	}
+
+	if len(o.items) > 0 {
+		o.logger.Info("Loaded notifications from outbox",
+			zap.String("dir", o.dir),
+			zap.Int("count", len(o.items)))
+	}
+
+	return nil
+}
+
+// RegisterSender registers the sender responsible for a notification channel
+func (o *NotificationOutbox) RegisterSender(channel models.NotificationChannel, sender NotificationSender) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.senders[channel] = sender
+}
+
+// Enqueue persists a notification and schedules it for immediate delivery
+func (o *NotificationOutbox) Enqueue(notification *models.Notification) error {
+	now := time.Now()
+	notification.ID = uuid.New().String()
+	notification.Status = models.NotificationPending
+	notification.CreatedAt = now
+	notification.NextAttemptAt = now
+
+	if err := o.persist(notification); err != nil {
+		return fmt.Errorf("failed to persist notification: %w", err)
+	}
+
+	o.mu.Lock()
+	o.items[notification.ID] = notification
+	o.mu.Unlock()
+
+	o.logger.Debug("Notification queued",
+		zap.String("id", notification.ID),
+		zap.String("channel", string(notification.Channel)),
+		zap.String("kind", string(notification.Kind)),
+		zap.Bool("critical", notification.Critical))
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Start runs the delivery loop until the context is cancelled
+func (o *NotificationOutbox) Start(ctx context.Context) {
+	o.logger.Info("Starting notification outbox sender",
+		zap.String("dir", o.dir),
+		zap.Int("max_attempts", o.maxAttempts))
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	statusTicker := time.NewTicker(time.Minute)
+	defer statusTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			o.logger.Info("Notification outbox sender stopped")
+			return
+		case <-o.wake:
+			o.deliverDue(ctx)
+		case <-ticker.C:
+			o.deliverDue(ctx)
+		case <-statusTicker.C:
+			if status := o.Status(); status.Pending > 0 || status.Failed > 0 {
+				o.logger.Warn("Notification outbox backlog",
+					zap.Int("pending", status.Pending),
+					zap.Int("failed", status.Failed))
+			}
+		}
+	}
+}
+
+// deliverDue attempts delivery of all pending notifications whose retry time has passed, oldest first
+func (o *NotificationOutbox) deliverDue(ctx context.Context) {
+	for _, notification := range o.dueNotifications() {
+		if ctx.Err() != nil {
+			return
+		}
+
+		o.mu.Lock()
+		sender, ok := o.senders[notification.Channel]
+		paused := time.Now().Before(o.pausedUntil[notification.Channel])
+		o.mu.Unlock()
+
+		if paused {
+			continue
+		}
+		if !ok {
+			o.scheduleRetry(notification, fmt.Errorf("no sender registered for channel %s", notification.Channel))
+			continue
+		}
+
+		err := sender.DeliverNotification(ctx, notification)
+		if err == nil {
+			o.complete(notification)
+			continue
+		}
+
+		o.scheduleRetry(notification, err)
+	}
+}
+
+// dueNotifications returns pending notifications ready for delivery, ordered by creation time
+func (o *NotificationOutbox) dueNotifications() []*models.Notification {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	var due []*models.Notification
+	for _, notification := range o.items {
+		if notification.Status == models.NotificationPending && !notification.NextAttemptAt.After(now) {
+			due = append(due, notification)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].CreatedAt.Before(due[j].CreatedAt)
+	})
+
+	return due
+}
+
+// complete removes a delivered notification from the outbox
+func (o *NotificationOutbox) complete(notification *models.Notification) {
+	o.mu.Lock()
+	delete(o.items, notification.ID)
+	o.mu.Unlock()
+
+	if err := os.Remove(o.path(notification.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		o.logger.Error("Failed to remove delivered notification from outbox",
+			zap.String("id", notification.ID),
+			zap.Error(err))
+	}
+
+	metrics.NotificationsSent.WithLabelValues(string(notification.Channel), string(notification.Kind)).Inc()
+
+	o.logger.Info("Notification delivered",
+		zap.String("id", notification.ID),
+		zap.String("channel", string(notification.Channel)),
+		zap.String("kind", string(notification.Kind)),
+		zap.Int("attempts", notification.Attempts+1))
+}
+
+// scheduleRetry records a failed attempt and computes the next attempt time
+func (o *NotificationOutbox) scheduleRetry(notification *models.Notification, deliveryErr error) {
+	o.mu.Lock()
+
+	notification.Attempts++
+	notification.LastError = deliveryErr.Error()
+
+	delay := outboxBaseBackoff << min(notification.Attempts-1, 10)
+	if delay > outboxMaxBackoff {
+		delay = outboxMaxBackoff
+	}
+
+	// Honour rate limiting from the remote API for the whole channel
+	var retryAfter *RetryAfterError
+	if errors.As(deliveryErr, &retryAfter) {
+		delay = retryAfter.Delay
+		o.pausedUntil[notification.Channel] = time.Now().Add(delay)
+	}
+
+	notification.NextAttemptAt = time.Now().Add(delay)
+
+	exhausted := notification.Attempts >= o.maxAttempts
+	if exhausted && !notification.Critical {
+		notification.Status = models.NotificationFailed
+	}
+
+	o.mu.Unlock()
+
+	metrics.NotificationDeliveryErrors.WithLabelValues(string(notification.Channel)).Inc()
+	if exhausted && !notification.Critical {
+		metrics.NotificationsFailed.WithLabelValues(string(notification.Channel), string(notification.Kind)).Inc()
+	}
+
+	switch {
+	case exhausted && notification.Critical:
+		o.logger.Error("Critical notification still undelivered, will keep retrying",
+			zap.String("id", notification.ID),
+			zap.String("channel", string(notification.Channel)),
+			zap.String("kind", string(notification.Kind)),
+			zap.Int("attempts", notification.Attempts),
+			zap.Duration("next_attempt_in", delay),
+			zap.Error(deliveryErr))
+	case exhausted:
+		o.logger.Error("Notification delivery failed after all attempts",
+			zap.String("id", notification.ID),
+			zap.String("channel", string(notification.Channel)),
+			zap.String("kind", string(notification.Kind)),
+			zap.Int("attempts", notification.Attempts),
+			zap.Error(deliveryErr))
+	default:
+		o.logger.Warn("Notification delivery failed, will retry",
+			zap.String("id", notification.ID),
+			zap.String("channel", string(notification.Channel)),
+			zap.String("kind", string(notification.Kind)),
+			zap.Int("attempts", notification.Attempts),
+			zap.Duration("next_attempt_in", delay),
+			zap.Error(deliveryErr))
+	}
+
+	if err := o.persist(notification); err != nil {
+		o.logger.Error("Failed to persist notification state",
+			zap.String("id", notification.ID),
+			zap.Error(err))
+	}
+}
+
+// persist atomically writes a notification to its file in the outbox directory
+func (o *NotificationOutbox) persist(notification *models.Notification) error {
+	o.mu.Lock()
+	data, err := json.Marshal(notification)
+	o.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := o.path(notification.ID) + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, o.path(notification.ID))
+}
+
+// path returns the file path of a notification
+func (o *NotificationOutbox) path(id string) string {
+	return filepath.Join(o.dir, id+".json")
+}
+
+// Status returns a snapshot of pending and failed notifications
+func (o *NotificationOutbox) Status() OutboxStatus {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	status := OutboxStatus{Items: make([]OutboxItemStatus, 0, len(o.items))}
+	for _, notification := range o.items {
+		switch notification.Status {
+		case models.NotificationPending:
+			status.Pending++
+		case models.NotificationFailed:
+			status.Failed++
+		}
+
+		status.Items = append(status.Items, OutboxItemStatus{
+			ID:            notification.ID,
+			Channel:       notification.Channel,
+			Kind:          notification.Kind,
+			DeviceID:      notification.DeviceID,
+			Critical:      notification.Critical,
+			Status:        notification.Status,
+			Attempts:      notification.Attempts,
+			LastError:     notification.LastError,
+			CreatedAt:     notification.CreatedAt,
+			NextAttemptAt: notification.NextAttemptAt,
+		})
+	}
+
+	sort.Slice(status.Items, func(i, j int) bool {
+		return status.Items[i].CreatedAt.Before(status.Items[j].CreatedAt)
+	})
+
+	return status
+}
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"reflect"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Payload formats accepted on the device queues. JSON is the default; constrained devices can
+// send the same fields as CBOR or MessagePack, or use the Protobuf schema in proto/kaelo.proto.
+const (
+	PayloadFormatJSON     = "json"
+	PayloadFormatCBOR     = "cbor"
+	PayloadFormatMsgPack  = "msgpack"
+	PayloadFormatProtobuf = "protobuf"
+)
+
+// payloadContentTypes maps AMQP content types to payload formats
+var payloadContentTypes = map[string]string{
+	"application/json":                PayloadFormatJSON,
+	"application/cbor":                PayloadFormatCBOR,
+	"application/msgpack":             PayloadFormatMsgPack,
+	"application/x-msgpack":           PayloadFormatMsgPack,
+	"application/vnd.msgpack":         PayloadFormatMsgPack,
+	"application/protobuf":            PayloadFormatProtobuf,
+	"application/x-protobuf":          PayloadFormatProtobuf,
+	"application/vnd.google.protobuf": PayloadFormatProtobuf,
+}
+
+// payloadFormat selects the format of a message from its content type, or else from the last
+// segment of its MQTT topic / routing key (e.g. sensor_data_queue/cbor, which RabbitMQ's MQTT
+// plugin turns into the routing key sensor_data_queue.cbor). Anything else is JSON.
+func payloadFormat(contentType, topic string) string {
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err == nil {
+			if format, ok := payloadContentTypes[mediaType]; ok {
+				return format
+			}
+		}
+	}
+
+	if i := strings.LastIndexAny(topic, "./"); i >= 0 && isPayloadFormat(topic[i+1:]) {
+		return topic[i+1:]
+	}
+	return PayloadFormatJSON
+}
+
+// isPayloadFormat reports whether name is one of the payload formats
+func isPayloadFormat(name string) bool {
+	switch name {
+	case PayloadFormatJSON, PayloadFormatCBOR, PayloadFormatMsgPack, PayloadFormatProtobuf:
+		return true
+	}
+	return false
+}
+
+// payloadJSON converts a message body of the given format to JSON, so every format goes
+// through the same decoding and validation. The schema picks the Protobuf message type.
+func payloadJSON(format string, schema protoSchema, body []byte) ([]byte, error) {
+	var value interface{}
+
+	switch format {
+	case PayloadFormatJSON:
+		return body, nil
+	case PayloadFormatCBOR:
+		if err := cborDecMode.Unmarshal(body, &value); err != nil {
+			return nil, fmt.Errorf("failed to decode CBOR: %w", err)
+		}
+	case PayloadFormatMsgPack:
+		if err := msgpack.Unmarshal(body, &value); err != nil {
+			return nil, fmt.Errorf("failed to decode MessagePack: %w", err)
+		}
+	case PayloadFormatProtobuf:
+		message, err := decodeProto(schema, body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode Protobuf: %w", err)
+		}
+		value = message
+	default:
+		return nil, fmt.Errorf("unsupported payload format %q", format)
+	}
+
+	return json.Marshal(jsonValue("", value))
+}
+
+// cborDecMode decodes CBOR maps with string keys, as produced by JSON-like documents
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+}.DecMode()
+
+// jsonValue prepares a decoded CBOR or MessagePack value for JSON: map keys become strings and
+// numeric timestamps (unix seconds or milliseconds, which devices send to save space) become
+// RFC3339. Byte strings are encoded as base64 by encoding/json.
+func jsonValue(key string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = jsonValue(k, item)
+		}
+		return v
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			name := fmt.Sprint(k)
+			converted[name] = jsonValue(name, item)
+		}
+		return converted
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonValue("", item)
+		}
+		return v
+	}
+
+	if key != "timestamp" {
+		return value
+	}
+
+	var unix float64
+	switch v := reflect.ValueOf(value); {
+	case v.CanInt():
+		unix = float64(v.Int())
+	case v.CanUint():
+		unix = float64(v.Uint())
+	case v.CanFloat():
+		unix = v.Float()
+	default:
+		return value
+	}
+	if timestamp, err := decodeTimestamp(unix); err == nil {
+		return timestamp
+	}
+	return value
+}
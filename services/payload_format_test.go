@@ -0,0 +1,200 @@
+package services
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"kaelo/models"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestPayloadFormat(t *testing.T) {
+	tests := []struct {
+		contentType, topic, want string
+	}{
+		{"", "sensor_data_queue", PayloadFormatJSON},
+		{"application/json", "sensor_data_queue.cbor", PayloadFormatJSON},
+		{"application/cbor", "sensor_data_queue", PayloadFormatCBOR},
+		{"application/x-msgpack; charset=binary", "", PayloadFormatMsgPack},
+		{"application/x-protobuf", "", PayloadFormatProtobuf},
+		{"text/plain", "sensor_data_queue.msgpack", PayloadFormatMsgPack},
+		{"", "health_check_queue.protobuf", PayloadFormatProtobuf},
+		{"", "kaelo.site-a.ESP32-001.face.cbor", PayloadFormatCBOR},
+		{"", "kaelo.site-a.ESP32-001.telemetry", PayloadFormatJSON},
+		{"", "sensor_data_queue.xml", PayloadFormatJSON},
+	}
+	for _, tt := range tests {
+		if got := payloadFormat(tt.contentType, tt.topic); got != tt.want {
+			t.Errorf("payloadFormat(%q, %q) = %s, want %s", tt.contentType, tt.topic, got, tt.want)
+		}
+	}
+}
+
+// decodeFormattedReadings converts a payload to JSON and decodes its readings
+func decodeFormattedReadings(t *testing.T, format string, body []byte) []*models.SensorData {
+	t.Helper()
+
+	converted, err := payloadJSON(format, protoSensorData, body)
+	if err != nil {
+		t.Fatalf("payloadJSON(%s): %v", format, err)
+	}
+	readings, invalid, err := decodeSensorPayload(converted, deviceTopic{})
+	if err != nil || len(invalid) > 0 {
+		t.Fatalf("decodeSensorPayload(%s) = %v, %v", converted, invalid, err)
+	}
+	return readings
+}
+
+// wantTestPayloadReading is the reading sent by every format in the decoder tests
+var wantTestPayloadReading = &models.SensorData{
+	SchemaVersion:  2,
+	DeviceID:       "ESP32-001",
+	Seq:            42,
+	TemperatureDHT: 27.3,
+	Humidity:       60.5,
+	GasQuality:     "moderate",
+	FlameDetected:  true,
+	Acceleration:   models.AccelerationData{X: 0.25, Y: -0.5, Z: 9.81},
+	Gyroscope:      models.GyroscopeData{Z: 1.5},
+	Timestamp:      time.UnixMilli(1714532755250),
+}
+
+// testPayloadDocument is wantTestPayloadReading as CBOR and MessagePack devices send it, with a
+// unix millisecond timestamp
+func testPayloadDocument() map[string]interface{} {
+	return map[string]interface{}{
+		"schema_version":  2,
+		"device_id":       "ESP32-001",
+		"seq":             42,
+		"timestamp":       int64(1714532755250),
+		"temperature_dht": 27.3,
+		"humidity":        60.5,
+		"gas_quality":     "moderate",
+		"flame_detected":  true,
+		"acceleration":    map[string]interface{}{"x": 0.25, "y": -0.5, "z": 9.81},
+		"gyroscope":       map[string]interface{}{"x": 0, "y": 0, "z": 1.5},
+	}
+}
+
+func TestDecodeCBORPayload(t *testing.T) {
+	body, err := cbor.Marshal(testPayloadDocument())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readings := decodeFormattedReadings(t, PayloadFormatCBOR, body)
+	if len(readings) != 1 {
+		t.Fatalf("got %d readings, want 1", len(readings))
+	}
+	assertSameReading(t, readings[0], wantTestPayloadReading)
+}
+
+func TestDecodeMessagePackPayload(t *testing.T) {
+	// A batch envelope, as buffered by the firmware
+	sample := testPayloadDocument()
+	delete(sample, "device_id")
+	delete(sample, "schema_version")
+	second := testPayloadDocument()
+	second["seq"], second["timestamp"] = 43, int64(1714532756)
+
+	body, err := msgpack.Marshal(map[string]interface{}{
+		"device_id":      "ESP32-001",
+		"schema_version": 2,
+		"samples":        []interface{}{sample, second},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readings := decodeFormattedReadings(t, PayloadFormatMsgPack, body)
+	if len(readings) != 2 {
+		t.Fatalf("got %d readings, want 2", len(readings))
+	}
+	assertSameReading(t, readings[0], wantTestPayloadReading)
+
+	// Unix seconds are accepted as well
+	want := *wantTestPayloadReading
+	want.Seq, want.Timestamp = 43, time.Unix(1714532756, 0)
+	assertSameReading(t, readings[1], &want)
+}
+
+// appendProtoVector appends a kaelo.v1.Vector3 field
+func appendProtoVector(b []byte, number protowire.Number, x, y, z float32) []byte {
+	var vector []byte
+	for i, v := range []float32{x, y, z} {
+		vector = protowire.AppendTag(vector, protowire.Number(i+1), protowire.Fixed32Type)
+		vector = protowire.AppendFixed32(vector, math.Float32bits(v))
+	}
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+	return protowire.AppendBytes(b, vector)
+}
+
+func TestDecodeProtobufPayload(t *testing.T) {
+	var body []byte
+	body = protowire.AppendTag(body, 1, protowire.BytesType)
+	body = protowire.AppendString(body, "ESP32-001")
+	body = protowire.AppendTag(body, 2, protowire.VarintType)
+	body = protowire.AppendVarint(body, 1714532755250)
+	body = protowire.AppendTag(body, 4, protowire.VarintType)
+	body = protowire.AppendVarint(body, 42)
+	body = protowire.AppendTag(body, 5, protowire.Fixed32Type)
+	body = protowire.AppendFixed32(body, math.Float32bits(27.3))
+	body = protowire.AppendTag(body, 6, protowire.Fixed32Type)
+	body = protowire.AppendFixed32(body, math.Float32bits(60.5))
+	body = protowire.AppendTag(body, 7, protowire.VarintType)
+	body = protowire.AppendVarint(body, 2) // moderate
+	body = protowire.AppendTag(body, 8, protowire.VarintType)
+	body = protowire.AppendVarint(body, 1)
+	body = appendProtoVector(body, 9, 0.25, -0.5, 9.81)
+	body = appendProtoVector(body, 10, 0, 0, 1.5)
+	body = protowire.AppendTag(body, 12, protowire.VarintType)
+	body = protowire.AppendVarint(body, 2)
+	// A field added by a newer schema is skipped
+	body = protowire.AppendTag(body, 99, protowire.BytesType)
+	body = protowire.AppendString(body, "future")
+
+	readings := decodeFormattedReadings(t, PayloadFormatProtobuf, body)
+	if len(readings) != 1 {
+		t.Fatalf("got %d readings, want 1", len(readings))
+	}
+	assertSameReading(t, readings[0], wantTestPayloadReading)
+}
+
+func TestDecodeProtobufFaceImage(t *testing.T) {
+	image := []byte{0xff, 0xd8, 0xff, 0xe0, 0x00}
+
+	var body []byte
+	body = protowire.AppendTag(body, 1, protowire.BytesType)
+	body = protowire.AppendString(body, "unknown-7")
+	body = protowire.AppendTag(body, 3, protowire.BytesType)
+	body = protowire.AppendBytes(body, image)
+
+	converted, err := payloadJSON(PayloadFormatProtobuf, protoFaceRecognitionData, body)
+	if err != nil {
+		t.Fatalf("payloadJSON: %v", err)
+	}
+	var faceData models.FaceRecognitionData
+	if err := json.Unmarshal(converted, &faceData); err != nil {
+		t.Fatal(err)
+	}
+	if faceData.UID != "unknown-7" || faceData.Base64 != "/9j/4AA=" {
+		t.Errorf("decoded %+v, want uid unknown-7 and the image in base64", faceData)
+	}
+}
+
+func TestDecodeMalformedPayloads(t *testing.T) {
+	for format, body := range map[string][]byte{
+		PayloadFormatCBOR:     {0xbf, 0x61},
+		PayloadFormatMsgPack:  {0x82, 0xa1},
+		PayloadFormatProtobuf: {0x0a, 0x10, 'E'},
+	} {
+		if _, err := payloadJSON(format, protoSensorData, body); err == nil {
+			t.Errorf("payloadJSON(%s) accepted a truncated body", format)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoKind is how a Protobuf field is decoded
+type protoKind int
+
+const (
+	protoString protoKind = iota
+	protoBytes
+	protoBool
+	protoInt64
+	protoUint64
+	protoFloat
+	protoTimestampMillis
+	protoEnum
+	protoMessage
+)
+
+// protoField maps a field of proto/kaelo.proto to the JSON field of the same message
+type protoField struct {
+	name     string
+	kind     protoKind
+	repeated bool
+	enum     []string    // JSON values by enum number, for protoEnum
+	message  protoSchema // nested message, for protoMessage
+}
+
+// protoSchema describes a message of proto/kaelo.proto by field number. The messages are
+// decoded straight into their JSON form with protowire, so no generated code is needed.
+type protoSchema map[protowire.Number]protoField
+
+var protoVector3 = protoSchema{
+	1: {name: "x", kind: protoFloat},
+	2: {name: "y", kind: protoFloat},
+	3: {name: "z", kind: protoFloat},
+}
+
+// protoSensorData is kaelo.v1.SensorData; samples make it a batch envelope
+var protoSensorData = protoSchema{
+	1:  {name: "device_id", kind: protoString},
+	2:  {name: "timestamp", kind: protoTimestampMillis},
+	3:  {name: "message_id", kind: protoString},
+	4:  {name: "seq", kind: protoUint64},
+	5:  {name: "temperature_dht", kind: protoFloat},
+	6:  {name: "humidity", kind: protoFloat},
+	7:  {name: "gas_quality", kind: protoEnum, enum: []string{"", "good", "moderate", "poor"}},
+	8:  {name: "flame_detected", kind: protoBool},
+	9:  {name: "acceleration", kind: protoMessage, message: protoVector3},
+	10: {name: "gyroscope", kind: protoMessage, message: protoVector3},
+	11: {name: "temperature_mpu", kind: protoFloat},
+	12: {name: "schema_version", kind: protoUint64},
+	13: {name: "site", kind: protoString},
+}
+
+func init() {
+	// Samples are SensorData messages themselves
+	protoSensorData[15] = protoField{name: "samples", kind: protoMessage, repeated: true, message: protoSensorData}
+}
+
+// protoHealthCheckData is kaelo.v1.HealthCheckData
+var protoHealthCheckData = protoSchema{
+	1: {name: "device_id", kind: protoString},
+	2: {name: "timestamp", kind: protoTimestampMillis},
+	3: {name: "wifi_connected", kind: protoBool},
+	4: {name: "mqtt_connected", kind: protoBool},
+	5: {name: "uptime_ms", kind: protoInt64},
+	6: {name: "sensors", kind: protoMessage, message: protoSchema{
+		1: {name: "dht11", kind: protoBool},
+		2: {name: "mpu6050", kind: protoBool},
+		3: {name: "flame", kind: protoBool},
+		4: {name: "gas", kind: protoBool},
+	}},
+	7: {name: "site", kind: protoString},
+}
+
+// protoFaceRecognitionData is kaelo.v1.FaceRecognitionData. The raw image bytes end up
+// base64 encoded in the JSON "base64" field.
+var protoFaceRecognitionData = protoSchema{
+	1: {name: "uid", kind: protoString},
+	2: {name: "timestamp", kind: protoTimestampMillis},
+	3: {name: "base64", kind: protoBytes},
+	4: {name: "device_id", kind: protoString},
+	5: {name: "site", kind: protoString},
+}
+
+// decodeProto decodes a Protobuf message into a JSON-like map. Unknown fields are skipped
+// so older schemas keep working; fields absent on the wire are absent from the map.
+func decodeProto(schema protoSchema, body []byte) (map[string]interface{}, error) {
+	message := make(map[string]interface{})
+
+	for len(body) > 0 {
+		number, wireType, n := protowire.ConsumeTag(body)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		body = body[n:]
+
+		field, known := schema[number]
+		if !known {
+			n = protowire.ConsumeFieldValue(number, wireType, body)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			body = body[n:]
+			continue
+		}
+
+		value, n, err := decodeProtoValue(field, wireType, body)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", field.name, err)
+		}
+		body = body[n:]
+		if value == nil {
+			continue
+		}
+
+		if field.repeated {
+			items, _ := message[field.name].([]interface{})
+			message[field.name] = append(items, value)
+		} else {
+			message[field.name] = value
+		}
+	}
+
+	return message, nil
+}
+
+// decodeProtoValue decodes one field value and returns it with the number of bytes consumed
+func decodeProtoValue(field protoField, wireType protowire.Type, body []byte) (interface{}, int, error) {
+	expected := protowire.VarintType
+	switch field.kind {
+	case protoString, protoBytes, protoMessage:
+		expected = protowire.BytesType
+	case protoFloat:
+		expected = protowire.Fixed32Type
+	}
+	if wireType != expected {
+		return nil, 0, fmt.Errorf("unexpected wire type %d", wireType)
+	}
+
+	switch field.kind {
+	case protoString, protoBytes, protoMessage:
+		b, n := protowire.ConsumeBytes(body)
+		if n < 0 {
+			return nil, 0, protowire.ParseError(n)
+		}
+		switch field.kind {
+		case protoString:
+			return string(b), n, nil
+		case protoBytes:
+			return append([]byte(nil), b...), n, nil
+		}
+		message, err := decodeProto(field.message, b)
+		return message, n, err
+
+	case protoFloat:
+		v, n := protowire.ConsumeFixed32(body)
+		if n < 0 {
+			return nil, 0, protowire.ParseError(n)
+		}
+		// Keep the float's shortest decimal form so 27.3 isn't stored as 27.299999237060547
+		f, _ := strconv.ParseFloat(strconv.FormatFloat(float64(math.Float32frombits(v)), 'g', -1, 32), 64)
+		return f, n, nil
+	}
+
+	v, n := protowire.ConsumeVarint(body)
+	if n < 0 {
+		return nil, 0, protowire.ParseError(n)
+	}
+	switch field.kind {
+	case protoBool:
+		return v != 0, n, nil
+	case protoInt64:
+		return int64(v), n, nil
+	case protoTimestampMillis:
+		if v == 0 {
+			// Unset, like a missing JSON timestamp
+			return nil, n, nil
+		}
+		return time.UnixMilli(int64(v)), n, nil
+	case protoEnum:
+		// Values added by newer schemas read as unspecified
+		if v >= uint64(len(field.enum)) {
+			return field.enum[0], n, nil
+		}
+		return field.enum[v], n, nil
+	default:
+		return v, n, nil
+	}
+}
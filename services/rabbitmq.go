@@ -4,29 +4,69 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
 	"kaelo/config"
+	"kaelo/metrics"
 	"kaelo/models"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 	"go.uber.org/zap"
 )
 
+// faceRecognitionQueue is the queue (and routing key) for face recognition messages
+const faceRecognitionQueue = "face_recognition_queue"
+
+// Sensor data acknowledgement modes selectable via RABBITMQ_ACK_MODE (used by both transports)
+const (
+	// AckModeImmediate acks a message as soon as it is handed to the processing pipeline
+	AckModeImmediate = "immediate"
+	// AckModePersisted acks a message only after its reading has been written to storage
+	AckModePersisted = "persisted"
+)
+
+// amqpMessage converts a RabbitMQ delivery for the message processor
+func amqpMessage(msg amqp.Delivery) ingestMessage {
+	return ingestMessage{
+		contentType: msg.ContentType,
+		topic:       msg.RoutingKey,
+		messageID:   msg.MessageId,
+		body:        msg.Body,
+	}
+}
+
+// newAMQPDelivery wraps a RabbitMQ delivery so it settles exactly once
+func newAMQPDelivery(msg amqp.Delivery, queue string, logger *zap.Logger) *messageDelivery {
+	return newMessageDelivery(queue,
+		func() error { return msg.Ack(false) },
+		func(requeue bool) error { return msg.Nack(false, requeue) },
+		zap.Uint64("delivery_tag", msg.DeliveryTag),
+		logger)
+}
+
 // RabbitMQService handles RabbitMQ connection and message consumption
 type RabbitMQService struct {
 	config    *config.Config
+	processor *messageProcessor
 	conn      *amqp.Connection
 	channel   *amqp.Channel
 	logger    *zap.Logger
 	reconnect chan bool
 	isClosing bool
+	mu        sync.Mutex // guards conn, channel and isClosing, which reconnecting replaces
 }
 
 // NewRabbitMQService creates a new RabbitMQ service instance
-func NewRabbitMQService(cfg *config.Config, logger *zap.Logger) (*RabbitMQService, error) {
+func NewRabbitMQService(cfg *config.Config, dedup *MessageDeduplicator, logger *zap.Logger) (*RabbitMQService, error) {
+	if cfg.RabbitMQAckMode != AckModeImmediate && cfg.RabbitMQAckMode != AckModePersisted {
+		return nil, fmt.Errorf("invalid RABBITMQ_ACK_MODE %q (expected %s or %s)",
+			cfg.RabbitMQAckMode, AckModeImmediate, AckModePersisted)
+	}
+
 	service := &RabbitMQService{
 		config:    cfg,
+		processor: &messageProcessor{config: cfg, dedup: dedup, logger: logger},
 		logger:    logger,
 		reconnect: make(chan bool),
 		isClosing: false,
@@ -41,6 +81,7 @@ func NewRabbitMQService(cfg *config.Config, logger *zap.Logger) (*RabbitMQServic
 
 // connect establishes connection to RabbitMQ and declares exchange and queue
 func (r *RabbitMQService) connect() error {
+	var conn *amqp.Connection
 	var err error
 
 	r.logger.Info("Connecting to RabbitMQ", zap.String("url", r.config.RabbitMQURL))
@@ -48,7 +89,7 @@ func (r *RabbitMQService) connect() error {
 	// Connect to RabbitMQ with retry
 	maxRetries := 5
 	for attempt := 1; attempt <= maxRetries; attempt++ {
-		r.conn, err = amqp.Dial(r.config.RabbitMQURL)
+		conn, err = amqp.Dial(r.config.RabbitMQURL)
 		if err == nil {
 			break
 		}
@@ -70,23 +111,48 @@ func (r *RabbitMQService) connect() error {
 	r.logger.Info("Connected to RabbitMQ successfully")
 
 	// Create channel
-	r.channel, err = r.conn.Channel()
+	channel, err := conn.Channel()
 	if err != nil {
+		conn.Close()
 		return fmt.Errorf("failed to open channel: %w", err)
 	}
 
-	// Set QoS (prefetch count)
-	err = r.channel.Qos(
-		10,    // prefetch count - process 10 messages at a time
-		0,     // prefetch size
-		false, // global
+	if err := r.declareTopology(channel); err != nil {
+		conn.Close()
+		return err
+	}
+
+	r.mu.Lock()
+	r.conn, r.channel = conn, channel
+	r.mu.Unlock()
+
+	// Setup connection close notification
+	go r.handleReconnect(conn)
+
+	return nil
+}
+
+// declareTopology sets the prefetch and declares and binds the exchange and queues
+func (r *RabbitMQService) declareTopology(channel *amqp.Channel) error {
+	var err error
+
+	// Set QoS (prefetch count). In persisted ack mode messages stay unacked until their
+	// batch is written, so allow a full batch to be in flight.
+	prefetch := 10
+	if r.config.RabbitMQAckMode == AckModePersisted {
+		prefetch = max(prefetch, r.config.FirebaseBatchSize)
+	}
+	err = channel.Qos(
+		prefetch, // prefetch count
+		0,        // prefetch size
+		false,    // global
 	)
 	if err != nil {
 		return fmt.Errorf("failed to set QoS: %w", err)
 	}
 
 	// Declare exchange (direct exchange for now, can be changed to topic/fanout)
-	err = r.channel.ExchangeDeclare(
+	err = channel.ExchangeDeclare(
 		r.config.RabbitMQExchange, // name
 		"direct",                  // type - direct exchange
 		true,                      // durable
@@ -102,7 +168,7 @@ func (r *RabbitMQService) connect() error {
 	r.logger.Info("Exchange declared", zap.String("exchange", r.config.RabbitMQExchange))
 
 	// Declare queue
-	queue, err := r.channel.QueueDeclare(
+	queue, err := channel.QueueDeclare(
 		r.config.RabbitMQQueue, // name
 		true,                   // durable
 		false,                  // delete when unused
@@ -117,7 +183,7 @@ func (r *RabbitMQService) connect() error {
 	r.logger.Info("Queue declared", zap.String("queue", queue.Name))
 
 	// Bind queue to exchange with routing key
-	err = r.channel.QueueBind(
+	err = channel.QueueBind(
 		queue.Name,                // queue name
 		r.config.RabbitMQQueue,    // routing key (same as queue name for simplicity)
 		r.config.RabbitMQExchange, // exchange
@@ -133,31 +199,21 @@ func (r *RabbitMQService) connect() error {
 		zap.String("exchange", r.config.RabbitMQExchange),
 		zap.String("routing_key", r.config.RabbitMQQueue))
 
-	// Bind queue to amq.topic (for MQTT messages)
-	err = r.channel.QueueBind(
-		queue.Name,             // queue name
-		r.config.RabbitMQQueue, // routing key (MQTT topic)
-		"amq.topic",            // MQTT default exchange
-		false,                  // no-wait
-		nil,                    // arguments
-	)
-	if err != nil {
-		return fmt.Errorf("failed to bind queue to MQTT exchange: %w", err)
+	if err := r.bindMQTTTopics(channel, queue.Name); err != nil {
+		return err
+	}
+	if err := r.bindDeviceTopics(channel, queue.Name, deviceTopicTelemetry); err != nil {
+		return err
 	}
-
-	r.logger.Info("Queue bound to MQTT exchange",
-		zap.String("queue", queue.Name),
-		zap.String("exchange", "amq.topic"),
-		zap.String("routing_key", r.config.RabbitMQQueue))
 
 	// Declare face recognition queue
-	faceQueue, err := r.channel.QueueDeclare(
-		"face_recognition_queue", // name
-		true,                     // durable
-		false,                    // delete when unused
-		false,                    // exclusive
-		false,                    // no-wait
-		nil,                      // arguments
+	faceQueue, err := channel.QueueDeclare(
+		faceRecognitionQueue, // name
+		true,                 // durable
+		false,                // delete when unused
+		false,                // exclusive
+		false,                // no-wait
+		nil,                  // arguments
 	)
 	if err != nil {
 		return fmt.Errorf("failed to declare face recognition queue: %w", err)
@@ -166,9 +222,9 @@ func (r *RabbitMQService) connect() error {
 	r.logger.Info("Face recognition queue declared", zap.String("queue", faceQueue.Name))
 
 	// Bind face recognition queue to sensors exchange
-	err = r.channel.QueueBind(
+	err = channel.QueueBind(
 		faceQueue.Name,            // queue name
-		"face_recognition_queue",  // routing key
+		faceRecognitionQueue,      // routing key
 		r.config.RabbitMQExchange, // exchange
 		false,                     // no-wait
 		nil,                       // arguments
@@ -180,10 +236,17 @@ func (r *RabbitMQService) connect() error {
 	r.logger.Info("Face recognition queue bound to exchange",
 		zap.String("queue", faceQueue.Name),
 		zap.String("exchange", r.config.RabbitMQExchange),
-		zap.String("routing_key", "face_recognition_queue"))
+		zap.String("routing_key", faceRecognitionQueue))
+
+	if err := r.bindMQTTTopics(channel, faceQueue.Name); err != nil {
+		return err
+	}
+	if err := r.bindDeviceTopics(channel, faceQueue.Name, deviceTopicFace); err != nil {
+		return err
+	}
 
 	// Declare health check queue
-	healthCheckQueue, err := r.channel.QueueDeclare(
+	healthCheckQueue, err := channel.QueueDeclare(
 		r.config.HealthCheckQueue, // name
 		true,                      // durable
 		false,                     // delete when unused
@@ -198,7 +261,7 @@ func (r *RabbitMQService) connect() error {
 	r.logger.Info("Health check queue declared", zap.String("queue", healthCheckQueue.Name))
 
 	// Bind health check queue to sensors exchange
-	err = r.channel.QueueBind(
+	err = channel.QueueBind(
 		healthCheckQueue.Name,     // queue name
 		r.config.HealthCheckQueue, // routing key
 		r.config.RabbitMQExchange, // exchange
@@ -214,43 +277,110 @@ func (r *RabbitMQService) connect() error {
 		zap.String("exchange", r.config.RabbitMQExchange),
 		zap.String("routing_key", r.config.HealthCheckQueue))
 
-	// Setup connection close notification
-	go r.handleReconnect()
+	if err := r.bindMQTTTopics(channel, healthCheckQueue.Name); err != nil {
+		return err
+	}
+	if err := r.bindDeviceTopics(channel, healthCheckQueue.Name, deviceTopicHealth); err != nil {
+		return err
+	}
 
 	return nil
 }
 
-// handleReconnect handles automatic reconnection when connection is lost
-func (r *RabbitMQService) handleReconnect() {
-	for {
-		closeErr := <-r.conn.NotifyClose(make(chan *amqp.Error))
-		if r.isClosing {
-			r.logger.Info("RabbitMQ connection closed gracefully")
-			return
+// bindMQTTTopics binds a queue to the MQTT topic of the same name on amq.topic. Devices
+// publishing a binary format name it in a topic suffix (sensor_data_queue/cbor), so the queue
+// is bound to <queue>.* as well.
+func (r *RabbitMQService) bindMQTTTopics(channel *amqp.Channel, queue string) error {
+	keys := []string{queue, queue + ".*"}
+	for _, key := range keys {
+		err := channel.QueueBind(
+			queue,       // queue name
+			key,         // routing key (MQTT topic)
+			"amq.topic", // MQTT default exchange
+			false,       // no-wait
+			nil,         // arguments
+		)
+		if err != nil {
+			return fmt.Errorf("failed to bind %s to MQTT exchange: %w", queue, err)
 		}
+	}
 
-		r.logger.Error("RabbitMQ connection lost", zap.Error(closeErr))
+	r.logger.Info("Queue bound to MQTT exchange",
+		zap.String("queue", queue),
+		zap.String("exchange", "amq.topic"),
+		zap.Strings("routing_keys", keys))
+	return nil
+}
 
-		// Attempt to reconnect
-		for {
-			r.logger.Info("Attempting to reconnect to RabbitMQ...")
-			err := r.connect()
-			if err == nil {
-				r.logger.Info("Successfully reconnected to RabbitMQ")
-				r.reconnect <- true
-				break
-			}
+// bindDeviceTopics binds a queue to one kind of per-device MQTT topic
+// ({root}/{site}/{device_id}/{kind}) on amq.topic
+func (r *RabbitMQService) bindDeviceTopics(channel *amqp.Channel, queue, kind string) error {
+	if r.config.DeviceTopicRoot == "" {
+		return nil
+	}
 
-			r.logger.Error("Failed to reconnect", zap.Error(err))
-			time.Sleep(5 * time.Second)
+	keys := deviceTopicBindings(r.config.DeviceTopicRoot, kind)
+	for _, key := range keys {
+		err := channel.QueueBind(
+			queue,       // queue name
+			key,         // routing key (MQTT topic with wildcards)
+			"amq.topic", // MQTT default exchange
+			false,       // no-wait
+			nil,         // arguments
+		)
+		if err != nil {
+			return fmt.Errorf("failed to bind %s to device topics: %w", queue, err)
 		}
 	}
+
+	r.logger.Info("Queue bound to device topics",
+		zap.String("queue", queue),
+		zap.String("exchange", "amq.topic"),
+		zap.Strings("routing_keys", keys))
+	return nil
+}
+
+// handleReconnect handles automatic reconnection when connection is lost. A successful
+// reconnect starts a new handler for the new connection, so this one returns.
+func (r *RabbitMQService) handleReconnect(conn *amqp.Connection) {
+	closeErr := <-conn.NotifyClose(make(chan *amqp.Error))
+
+	r.mu.Lock()
+	closing := r.isClosing
+	r.mu.Unlock()
+	if closing {
+		r.logger.Info("RabbitMQ connection closed gracefully")
+		return
+	}
+
+	r.logger.Error("RabbitMQ connection lost", zap.Error(closeErr))
+
+	// Attempt to reconnect
+	for {
+		r.logger.Info("Attempting to reconnect to RabbitMQ...")
+		err := r.connect()
+		if err == nil {
+			r.logger.Info("Successfully reconnected to RabbitMQ")
+			r.reconnect <- true
+			return
+		}
+
+		r.logger.Error("Failed to reconnect", zap.Error(err))
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// currentChannel returns the channel of the current connection
+func (r *RabbitMQService) currentChannel() *amqp.Channel {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.channel
 }
 
 // ConsumeSensorData starts consuming sensor data messages from RabbitMQ queue
 func (r *RabbitMQService) ConsumeSensorData(ctx context.Context, sensorDataChan chan<- *models.SensorData) error {
 	for {
-		msgs, err := r.channel.Consume(
+		msgs, err := r.currentChannel().Consume(
 			r.config.RabbitMQQueue, // queue
 			"kaelo-service",        // consumer tag
 			false,                  // auto-ack (false = manual ack)
@@ -264,7 +394,8 @@ func (r *RabbitMQService) ConsumeSensorData(ctx context.Context, sensorDataChan
 		}
 
 		r.logger.Info("Started consuming messages from RabbitMQ",
-			zap.String("queue", r.config.RabbitMQQueue))
+			zap.String("queue", r.config.RabbitMQQueue),
+			zap.String("ack_mode", r.config.RabbitMQAckMode))
 
 	consumeLoop:
 		for {
@@ -284,60 +415,35 @@ func (r *RabbitMQService) ConsumeSensorData(ctx context.Context, sensorDataChan
 					break consumeLoop
 				}
 
-				// Process message
-				if err := r.processMessage(msg, sensorDataChan); err != nil {
-					r.logger.Error("Failed to process message",
-						zap.Error(err),
-						zap.String("message_id", msg.MessageId))
+				metrics.MessagesConsumed.WithLabelValues(r.config.RabbitMQQueue).Inc()
 
-					// Negative acknowledgment - requeue the message
-					msg.Nack(false, true)
-				} else {
-					// Acknowledge message
-					msg.Ack(false)
-				}
+				// The delivery settles once, so readings of a batch that were already handed
+				// to the pipeline can't ack it again after it was requeued below
+				delivery := newAMQPDelivery(msg, r.config.RabbitMQQueue, r.logger)
+				r.processor.handleSensorMessage(amqpMessage(msg), delivery, sensorDataChan)
 			}
 		}
 	}
 }
 
-// processMessage parses and forwards sensor data to the channel
-func (r *RabbitMQService) processMessage(msg amqp.Delivery, sensorDataChan chan<- *models.SensorData) error {
-	// Parse JSON message
-	var sensorData models.SensorData
-	if err := json.Unmarshal(msg.Body, &sensorData); err != nil {
-		return fmt.Errorf("failed to unmarshal message: %w", err)
-	}
-
-	// Validate sensor data
-	if sensorData.DeviceID == "" {
-		return fmt.Errorf("invalid sensor data: missing device_id")
-	}
+// Ping reports whether the RabbitMQ connection and channel are open
+func (r *RabbitMQService) Ping(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	// Set timestamp if not provided
-	if sensorData.Timestamp.IsZero() {
-		sensorData.Timestamp = time.Now()
+	if r.conn == nil || r.conn.IsClosed() {
+		return fmt.Errorf("rabbitmq connection is closed")
 	}
-
-	r.logger.Debug("Received sensor data from RabbitMQ",
-		zap.String("device_id", sensorData.DeviceID),
-		zap.Float64("temperature_dht", sensorData.TemperatureDHT),
-		zap.Float64("humidity", sensorData.Humidity),
-		zap.String("gas_quality", sensorData.GasQuality),
-		zap.Bool("flame_detected", sensorData.FlameDetected),
-		zap.Time("timestamp", sensorData.Timestamp))
-
-	// Send to processing channel (non-blocking with timeout)
-	select {
-	case sensorDataChan <- &sensorData:
-		return nil
-	case <-time.After(5 * time.Second):
-		return fmt.Errorf("timeout sending to processing channel")
+	if r.channel == nil || r.channel.IsClosed() {
+		return fmt.Errorf("rabbitmq channel is closed")
 	}
+	return nil
 }
 
 // Close gracefully closes RabbitMQ connection
 func (r *RabbitMQService) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.isClosing = true
 
 	r.logger.Info("Closing RabbitMQ connection")
@@ -366,7 +472,7 @@ func (r *RabbitMQService) Publish(sensorData *models.SensorData) error {
 		return fmt.Errorf("failed to marshal sensor data: %w", err)
 	}
 
-	err = r.channel.Publish(
+	err = r.currentChannel().Publish(
 		r.config.RabbitMQExchange, // exchange
 		r.config.RabbitMQQueue,    // routing key
 		false,                     // mandatory
@@ -391,10 +497,10 @@ func (r *RabbitMQService) Publish(sensorData *models.SensorData) error {
 
 // ConsumeFaceRecognitionData starts consuming face recognition messages from RabbitMQ
 func (r *RabbitMQService) ConsumeFaceRecognitionData(ctx context.Context, faceDataChan chan<- *models.FaceRecognitionData) error {
-	queueName := "face_recognition_queue"
+	queueName := faceRecognitionQueue
 
 	for {
-		msgs, err := r.channel.Consume(
+		msgs, err := r.currentChannel().Consume(
 			queueName,                   // queue
 			"face-recognition-consumer", // consumer tag
 			false,                       // auto-ack
@@ -428,61 +534,33 @@ func (r *RabbitMQService) ConsumeFaceRecognitionData(ctx context.Context, faceDa
 					break faceConsumeLoop
 				}
 
+				metrics.MessagesConsumed.WithLabelValues(queueName).Inc()
+
 				// Process message
-				if err := r.processFaceRecognitionMessage(msg, faceDataChan); err != nil {
+				if err := r.processor.processFaceRecognitionMessage(amqpMessage(msg), faceDataChan); err != nil {
 					r.logger.Error("Failed to process face recognition message",
 						zap.Error(err),
 						zap.String("message_id", msg.MessageId))
 
 					// Negative acknowledgment - requeue the message
 					msg.Nack(false, true)
+					metrics.MessagesNacked.WithLabelValues(queueName).Inc()
 				} else {
 					// Acknowledge message
 					msg.Ack(false)
+					metrics.MessagesAcked.WithLabelValues(queueName).Inc()
 				}
 			}
 		}
 	}
 }
 
-// processFaceRecognitionMessage parses and forwards face recognition data to the channel
-func (r *RabbitMQService) processFaceRecognitionMessage(msg amqp.Delivery, faceDataChan chan<- *models.FaceRecognitionData) error {
-	// Parse JSON message
-	var faceData models.FaceRecognitionData
-	if err := json.Unmarshal(msg.Body, &faceData); err != nil {
-		return fmt.Errorf("failed to unmarshal face recognition message: %w", err)
-	}
-
-	// Validate data
-	if faceData.UID == "" {
-		return fmt.Errorf("invalid face recognition data: missing uid")
-	}
-
-	// Set timestamp if not provided
-	if faceData.Timestamp.IsZero() {
-		faceData.Timestamp = time.Now()
-	}
-
-	r.logger.Debug("Received face recognition data from RabbitMQ",
-		zap.String("uid", faceData.UID),
-		zap.Time("timestamp", faceData.Timestamp),
-		zap.Bool("has_image", faceData.Base64 != ""))
-
-	// Send to processing channel (non-blocking with timeout)
-	select {
-	case faceDataChan <- &faceData:
-		return nil
-	case <-time.After(5 * time.Second):
-		return fmt.Errorf("timeout sending to face recognition processing channel")
-	}
-}
-
 // ConsumeHealthCheck starts consuming health check messages from RabbitMQ
 func (r *RabbitMQService) ConsumeHealthCheck(ctx context.Context, healthCheckChan chan<- *models.HealthCheckData) error {
 	queueName := r.config.HealthCheckQueue
 
 	for {
-		msgs, err := r.channel.Consume(
+		msgs, err := r.currentChannel().Consume(
 			queueName,               // queue
 			"health-check-consumer", // consumer tag
 			false,                   // auto-ack
@@ -516,53 +594,23 @@ func (r *RabbitMQService) ConsumeHealthCheck(ctx context.Context, healthCheckCha
 					break healthCheckConsumeLoop
 				}
 
+				metrics.MessagesConsumed.WithLabelValues(queueName).Inc()
+
 				// Process message
-				if err := r.processHealthCheckMessage(msg, healthCheckChan); err != nil {
+				if err := r.processor.processHealthCheckMessage(amqpMessage(msg), healthCheckChan); err != nil {
 					r.logger.Error("Failed to process health check message",
 						zap.Error(err),
 						zap.String("message_id", msg.MessageId))
 
 					// Negative acknowledgment - requeue the message
 					msg.Nack(false, true)
+					metrics.MessagesNacked.WithLabelValues(queueName).Inc()
 				} else {
 					// Acknowledge message
 					msg.Ack(false)
+					metrics.MessagesAcked.WithLabelValues(queueName).Inc()
 				}
 			}
 		}
 	}
 }
-
-// processHealthCheckMessage parses and forwards health check data to the channel
-func (r *RabbitMQService) processHealthCheckMessage(msg amqp.Delivery, healthCheckChan chan<- *models.HealthCheckData) error {
-	// Parse JSON message
-	var healthCheck models.HealthCheckData
-	if err := json.Unmarshal(msg.Body, &healthCheck); err != nil {
-		return fmt.Errorf("failed to unmarshal health check message: %w", err)
-	}
-
-	// Validate data
-	if healthCheck.DeviceID == "" {
-		return fmt.Errorf("invalid health check data: missing device_id")
-	}
-
-	// Set timestamp if not provided
-	if healthCheck.Timestamp.IsZero() {
-		healthCheck.Timestamp = time.Now()
-	}
-
-	r.logger.Debug("Received health check data from RabbitMQ",
-		zap.String("device_id", healthCheck.DeviceID),
-		zap.Time("timestamp", healthCheck.Timestamp),
-		zap.Bool("wifi_connected", healthCheck.WiFiConnected),
-		zap.Bool("mqtt_connected", healthCheck.MQTTConnected),
-		zap.Int64("uptime_ms", healthCheck.UptimeMs))
-
-	// Send to processing channel (non-blocking with timeout)
-	select {
-	case healthCheckChan <- &healthCheck:
-		return nil
-	case <-time.After(5 * time.Second):
-		return fmt.Errorf("timeout sending to health check processing channel")
-	}
-}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"kaelo/config"
+	"kaelo/metrics"
+	"kaelo/models"
+
+	"go.uber.org/zap"
+)
+
+// retentionStartDelay delays the first run so it doesn't compete with startup
+const retentionStartDelay = time.Minute
+
+// RetentionPolicy is the maximum age of records in a collection
+type RetentionPolicy struct {
+	Collection string `json:"collection"`
+	Days       int    `json:"days"`
+}
+
+// RetentionResult reports the outcome of pruning one collection
+type RetentionResult struct {
+	Collection string    `json:"collection"`
+	Cutoff     time.Time `json:"cutoff"`
+	Removed    int       `json:"removed"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// RetentionReport reports a retention run
+type RetentionReport struct {
+	DryRun     bool              `json:"dry_run"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+	Results    []RetentionResult `json:"results"`
+}
+
+// RetentionStatus summarizes the retention job
+type RetentionStatus struct {
+	Enabled   bool              `json:"enabled"`
+	DryRun    bool              `json:"dry_run"`
+	Policies  []RetentionPolicy `json:"policies"`
+	NextRunAt time.Time         `json:"next_run_at,omitzero"`
+	LastRun   *RetentionReport  `json:"last_run,omitempty"`
+}
+
+// RetentionService periodically deletes records older than their collection's retention policy
+type RetentionService struct {
+	store     SensorStore
+	policies  []RetentionPolicy
+	interval  time.Duration
+	chunkSize int
+	dryRun    bool
+	logger    *zap.Logger
+	nextRunAt time.Time
+	lastRun   *RetentionReport
+	mu        sync.Mutex
+}
+
+// NewRetentionService creates a retention job from the RETENTION_* settings.
+// Collections with a retention of 0 days are kept forever.
+func NewRetentionService(cfg *config.Config, store SensorStore, logger *zap.Logger) *RetentionService {
+	all := []RetentionPolicy{
+		{Collection: sensorDataPath, Days: cfg.RetentionSensorDataDays},
+		{Collection: rollupCollection(models.RollupMinute), Days: cfg.RetentionRollups1mDays},
+		{Collection: rollupCollection(models.RollupHour), Days: cfg.RetentionRollups1hDays},
+		{Collection: anomaliesPath, Days: cfg.RetentionAnomaliesDays},
+		{Collection: faceEventsPath, Days: cfg.RetentionFaceEventsDays},
+	}
+	if _, ok := store.(HealthEventStore); ok {
+		all = append(all, RetentionPolicy{Collection: healthEventsPath, Days: cfg.RetentionHealthDays})
+	}
+
+	var policies []RetentionPolicy
+	for _, policy := range all {
+		if policy.Days > 0 {
+			policies = append(policies, policy)
+		}
+	}
+
+	return &RetentionService{
+		store:     store,
+		policies:  policies,
+		interval:  time.Duration(cfg.RetentionInterval) * time.Hour,
+		chunkSize: max(cfg.RetentionChunkSize, 1),
+		dryRun:    cfg.RetentionDryRun,
+		logger:    logger,
+	}
+}
+
+// enabled reports whether the job runs at all
+func (s *RetentionService) enabled() bool {
+	return s.interval > 0 && len(s.policies) > 0
+}
+
+// Start runs the retention job on its interval until the context is cancelled
+func (s *RetentionService) Start(ctx context.Context) {
+	if !s.enabled() {
+		s.logger.Info("Retention job disabled")
+		return
+	}
+
+	s.logger.Info("Starting retention job",
+		zap.Duration("interval", s.interval),
+		zap.Bool("dry_run", s.dryRun),
+		zap.Any("policies", s.policies))
+	if s.dryRun {
+		s.logger.Warn("Retention dry run is enabled (RETENTION_DRY_RUN), old records will be counted but not deleted")
+	}
+
+	s.scheduleNext(retentionStartDelay)
+	timer := time.NewTimer(retentionStartDelay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.logger.Info("Retention job stopped")
+			return
+		case <-timer.C:
+			s.Run(ctx)
+			s.scheduleNext(s.interval)
+			timer.Reset(s.interval)
+		}
+	}
+}
+
+// scheduleNext records when the next run is due
+func (s *RetentionService) scheduleNext(delay time.Duration) {
+	s.mu.Lock()
+	s.nextRunAt = time.Now().Add(delay)
+	s.mu.Unlock()
+}
+
+// Run prunes every collection with a retention policy and reports what was removed
+func (s *RetentionService) Run(ctx context.Context) RetentionReport {
+	report := RetentionReport{DryRun: s.dryRun, StartedAt: time.Now()}
+
+	for _, policy := range s.policies {
+		if ctx.Err() != nil {
+			break
+		}
+
+		cutoff := report.StartedAt.AddDate(0, 0, -policy.Days)
+		removed, err := s.store.Prune(ctx, policy.Collection, cutoff, PruneOptions{
+			ChunkSize: s.chunkSize,
+			DryRun:    s.dryRun,
+		})
+
+		result := RetentionResult{Collection: policy.Collection, Cutoff: cutoff, Removed: removed}
+		if !s.dryRun {
+			metrics.RetentionRecordsRemoved.WithLabelValues(policy.Collection).Add(float64(removed))
+		}
+
+		if err != nil {
+			// Records deleted before the error are still reported
+			result.Error = err.Error()
+			metrics.RetentionErrors.WithLabelValues(policy.Collection).Inc()
+			s.logger.Error("Failed to prune old records",
+				zap.String("collection", policy.Collection),
+				zap.Time("cutoff", cutoff),
+				zap.Int("removed", removed),
+				zap.Error(err))
+		} else if s.dryRun {
+			s.logger.Info("Retention dry run, records would be removed",
+				zap.String("collection", policy.Collection),
+				zap.Time("cutoff", cutoff),
+				zap.Int("removed", removed))
+		} else {
+			s.logger.Info("Pruned old records",
+				zap.String("collection", policy.Collection),
+				zap.Time("cutoff", cutoff),
+				zap.Int("removed", removed))
+		}
+
+		report.Results = append(report.Results, result)
+	}
+
+	report.FinishedAt = time.Now()
+	metrics.RetentionLastRunTimestamp.Set(float64(report.FinishedAt.Unix()))
+
+	if s.dryRun {
+		wouldRemove := 0
+		for _, result := range report.Results {
+			wouldRemove += result.Removed
+		}
+		s.logger.Warn("Retention dry run finished, nothing was deleted; set RETENTION_DRY_RUN=false to delete",
+			zap.Int("would_remove", wouldRemove))
+	}
+
+	s.mu.Lock()
+	s.lastRun = &report
+	s.mu.Unlock()
+
+	return report
+}
+
+// Status returns the retention policies and the report of the last run
+func (s *RetentionService) Status() RetentionStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return RetentionStatus{
+		Enabled:   s.enabled(),
+		DryRun:    s.dryRun,
+		Policies:  s.policies,
+		NextRunAt: s.nextRunAt,
+		LastRun:   s.lastRun,
+	}
+}
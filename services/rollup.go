@@ -0,0 +1,255 @@
+package services
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"kaelo/config"
+	"kaelo/metrics"
+	"kaelo/models"
+
+	"go.uber.org/zap"
+)
+
+// rollupBucketKey identifies an in-memory rollup bucket
+type rollupBucketKey struct {
+	resolution models.RollupResolution
+	deviceID   string
+	start      int64 // bucket start in unix seconds
+}
+
+// RollupStatus summarizes the rollup service state
+type RollupStatus struct {
+	PendingBuckets int       `json:"pending_buckets"`
+	LastFlushAt    time.Time `json:"last_flush_at,omitzero"`
+	LastError      string    `json:"last_error,omitempty"`
+}
+
+// RollupService aggregates readings into per-minute and per-hour rollups per device.
+// A bucket is written once its end plus the grace period has passed. Readings arriving
+// later start a new partial bucket that the store merges into the written one.
+//
+// Each bucket remembers the readings it counted until the dedup window has passed after it
+// was due, so a redelivered reading isn't merged into the stored bucket a second time.
+type RollupService struct {
+	store         SensorStore
+	grace         time.Duration
+	flushInterval time.Duration
+	seenWindow    time.Duration
+	logger        *zap.Logger
+	pending       map[rollupBucketKey]*models.Rollup
+	seen          map[rollupBucketKey]map[string]struct{} // identities of the readings counted per bucket
+	lastFlushAt   time.Time
+	lastError     string
+	mu            sync.Mutex
+	flushMu       sync.Mutex // serializes flushes so a bucket isn't merged twice concurrently
+	shutdownChan  chan bool
+}
+
+// NewRollupService creates a new rollup service
+func NewRollupService(cfg *config.Config, store SensorStore, logger *zap.Logger) *RollupService {
+	return &RollupService{
+		store:         store,
+		grace:         time.Duration(cfg.RollupGrace) * time.Second,
+		flushInterval: time.Duration(cfg.RollupFlushInterval) * time.Second,
+		seenWindow:    time.Duration(cfg.DedupWindow) * time.Second,
+		logger:        logger,
+		pending:       make(map[rollupBucketKey]*models.Rollup),
+		seen:          make(map[rollupBucketKey]map[string]struct{}),
+		shutdownChan:  make(chan bool, 1),
+	}
+}
+
+// Start aggregates readings from the channel until the context is cancelled,
+// then writes all partial buckets
+func (s *RollupService) Start(ctx context.Context, sensorDataChan <-chan *models.SensorData) {
+	s.logger.Info("Starting rollup service",
+		zap.Duration("grace", s.grace),
+		zap.Duration("flush_interval", s.flushInterval))
+
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.logger.Info("Rollup service received shutdown signal, flushing partial buckets")
+			s.shutdown(ctx)
+			return
+
+		case sensorData, ok := <-sensorDataChan:
+			if !ok {
+				// The distributor closes the channel on shutdown
+				s.logger.Info("Rollup channel closed, flushing partial buckets")
+				s.shutdown(ctx)
+				return
+			}
+			s.Add(sensorData)
+
+		case <-ticker.C:
+			s.flush(ctx, false)
+		}
+	}
+}
+
+// shutdown writes all partial buckets and signals WaitForShutdown
+func (s *RollupService) shutdown(ctx context.Context) {
+	// ctx may already be cancelled, give the final flush a short deadline of its own
+	flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 3*time.Second)
+	s.flush(flushCtx, true)
+	cancel()
+
+	s.shutdownChan <- true
+}
+
+// Add includes a reading in its minute and hour buckets, unless a bucket already counted it
+func (s *RollupService) Add(data *models.SensorData) {
+	now := time.Now()
+	identity := messageIdentity(data)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, resolution := range models.RollupResolutions {
+		start := resolution.BucketStart(data.Timestamp)
+		key := rollupBucketKey{resolution: resolution, deviceID: data.DeviceID, start: start.Unix()}
+
+		seen := s.seen[key]
+		if seen == nil {
+			seen = make(map[string]struct{})
+			s.seen[key] = seen
+		}
+		if identity != "" {
+			if _, ok := seen[identity]; ok {
+				metrics.RollupDuplicateReadings.WithLabelValues(string(resolution)).Inc()
+				continue
+			}
+			seen[identity] = struct{}{}
+		}
+
+		rollup, ok := s.pending[key]
+		if !ok {
+			if s.due(start, resolution, now) {
+				// The bucket was already written, this partial bucket will be merged into it
+				metrics.RollupLateReadings.WithLabelValues(string(resolution)).Inc()
+			}
+			rollup = models.NewRollup(data.DeviceID, resolution, start)
+			s.pending[key] = rollup
+		}
+		rollup.Add(data)
+	}
+
+	metrics.RollupPendingBuckets.Set(float64(len(s.pending)))
+}
+
+// due reports whether a bucket is complete, i.e. its end plus the grace period has passed
+func (s *RollupService) due(start time.Time, resolution models.RollupResolution, now time.Time) bool {
+	return !now.Before(start.Add(resolution.Duration() + s.grace))
+}
+
+// forgettable reports whether the readings counted in a written bucket can be forgotten,
+// i.e. the dedup window has passed since the bucket was due
+func (s *RollupService) forgettable(key rollupBucketKey, now time.Time) bool {
+	return s.due(time.Unix(key.start, 0).Add(s.seenWindow), key.resolution, now)
+}
+
+// flush writes due buckets to the store, or all buckets when all is set.
+// Buckets that fail to write are kept and retried on the next flush.
+func (s *RollupService) flush(ctx context.Context, all bool) {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	now := time.Now()
+
+	s.mu.Lock()
+	var ready []*models.Rollup
+	for key, rollup := range s.pending {
+		if all || s.due(rollup.BucketStart, rollup.Resolution, now) {
+			ready = append(ready, rollup)
+			delete(s.pending, key)
+		}
+	}
+	for key := range s.seen {
+		if _, ok := s.pending[key]; !ok && s.forgettable(key, now) {
+			delete(s.seen, key)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(ready) == 0 {
+		return
+	}
+
+	// Oldest first so dashboards see complete history up to the newest written bucket
+	sort.Slice(ready, func(i, j int) bool { return ready[i].BucketStart.Before(ready[j].BucketStart) })
+
+	written := 0
+	var err error
+	for i, rollup := range ready {
+		if err = s.store.MergeRollup(ctx, rollup); err != nil {
+			metrics.RollupWriteFailures.Inc()
+			s.requeue(ready[i:])
+			break
+		}
+		metrics.RollupsWritten.WithLabelValues(string(rollup.Resolution)).Inc()
+		written++
+	}
+
+	s.mu.Lock()
+	s.lastFlushAt = now
+	s.lastError = ""
+	if err != nil {
+		s.lastError = err.Error()
+	}
+	metrics.RollupPendingBuckets.Set(float64(len(s.pending)))
+	s.mu.Unlock()
+
+	if err != nil {
+		s.logger.Error("Failed to write rollups, will retry",
+			zap.Int("written", written),
+			zap.Int("remaining", len(ready)-written),
+			zap.Error(err))
+		return
+	}
+
+	s.logger.Debug("Wrote rollups", zap.Int("buckets", written))
+}
+
+// requeue puts buckets that failed to write back into the pending set, merging them with
+// readings that arrived for the same bucket in the meantime
+func (s *RollupService) requeue(rollups []*models.Rollup) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rollup := range rollups {
+		key := rollupBucketKey{resolution: rollup.Resolution, deviceID: rollup.DeviceID, start: rollup.BucketStart.Unix()}
+		if pending, ok := s.pending[key]; ok {
+			rollup.Merge(pending)
+		}
+		s.pending[key] = rollup
+	}
+}
+
+// Status returns a summary of the rollup service state
+func (s *RollupService) Status() RollupStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return RollupStatus{
+		PendingBuckets: len(s.pending),
+		LastFlushAt:    s.lastFlushAt,
+		LastError:      s.lastError,
+	}
+}
+
+// WaitForShutdown waits for the rollup service to write partial buckets
+func (s *RollupService) WaitForShutdown(timeout time.Duration) bool {
+	select {
+	case <-s.shutdownChan:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"kaelo/config"
+	"kaelo/models"
+
+	"go.uber.org/zap"
+)
+
+// fakeRollupStore records the rollups merged into it
+type fakeRollupStore struct {
+	SensorStore
+
+	mu     sync.Mutex
+	merged []*models.Rollup
+}
+
+func (s *fakeRollupStore) MergeRollup(_ context.Context, rollup *models.Rollup) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.merged = append(s.merged, rollup)
+	return nil
+}
+
+// counted returns the readings merged into a resolution's buckets
+func (s *fakeRollupStore) counted(resolution models.RollupResolution) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, rollup := range s.merged {
+		if rollup.Resolution == resolution {
+			count += rollup.Count
+		}
+	}
+	return count
+}
+
+func newTestRollupService(store SensorStore) *RollupService {
+	return NewRollupService(&config.Config{RollupGrace: 60, RollupFlushInterval: 15, DedupWindow: 600}, store, zap.NewNop())
+}
+
+func TestRollupSkipsRedeliveredReadings(t *testing.T) {
+	store := &fakeRollupStore{}
+	s := newTestRollupService(store)
+
+	now := time.Now()
+	reading := func(seq uint64) *models.SensorData {
+		data := testReading("ESP32-001", seq, nil)
+		data.Timestamp = now
+		return data
+	}
+
+	s.Add(reading(7))
+	s.Add(reading(7))
+	s.flush(context.Background(), true)
+
+	// Redelivered after its bucket was written
+	s.Add(reading(7))
+	s.flush(context.Background(), true)
+
+	for _, resolution := range models.RollupResolutions {
+		if count := store.counted(resolution); count != 1 {
+			t.Errorf("%s buckets counted %d readings, want 1", resolution, count)
+		}
+	}
+
+	// A late reading that wasn't counted yet is still merged
+	s.Add(reading(8))
+	s.flush(context.Background(), true)
+	if count := store.counted(models.RollupMinute); count != 2 {
+		t.Errorf("1m buckets counted %d readings after a late reading, want 2", count)
+	}
+}
+
+func TestRollupForgetsReadingsAfterDedupWindow(t *testing.T) {
+	store := &fakeRollupStore{}
+	s := newTestRollupService(store)
+
+	// Buckets in 2024 were due long ago
+	s.Add(testReading("ESP32-001", 7, nil))
+	s.flush(context.Background(), false)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.seen) != 0 {
+		t.Errorf("kept counted readings of %d buckets older than the dedup window", len(s.seen))
+	}
+}
+
+func TestRollupBucketStartIsUTCAligned(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 10, 59, 30, 0, time.FixedZone("ICT", 7*3600))
+
+	start := models.RollupHour.BucketStart(ts)
+	if want := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC); !start.Equal(want) {
+		t.Errorf("hour bucket of %s starts at %s, want %s", ts, start, want)
+	}
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kaelo/models"
+)
+
+// decodeSensorPayload decodes a sensor message body. Besides a single reading object, firmware
+// that buffers readings may send an array of readings or an envelope that sends the device ID
+// (site and schema_version) once for a list of samples:
+//
+//	{"device_id": "ESP32-001", "samples": [{"timestamp": "...", "humidity": 60, ...}, ...]}
+//
+// Every reading is validated against its schema_version and upgraded to the current model
+// (see migrateSensorDocument). Batched samples are checked one by one: invalid samples are
+// returned as errors next to the valid readings. The error is set when the body itself can't
+// be used.
+//
+// Messages published on a device topic get their device_id and site from the topic, and are
+// rejected when the payload names another device or site.
+func decodeSensorPayload(body []byte, topic deviceTopic) (readings []*models.SensorData, invalid []error, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var payload interface{}
+	if err := decoder.Decode(&payload); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal message: %w", err)
+	}
+	received := time.Now()
+
+	switch doc := payload.(type) {
+	case []interface{}:
+		if len(doc) == 0 {
+			return nil, nil, errors.New("invalid batch: no samples")
+		}
+		readings, invalid = decodeSamples(nil, doc, topic, received)
+		return readings, invalid, nil
+
+	case map[string]interface{}:
+		if err := topic.claim(doc); err != nil {
+			return nil, nil, err
+		}
+
+		samples, isBatch := doc["samples"]
+		if !isBatch || samples == nil {
+			sensorData, err := migrateSensorDocument(doc, received)
+			if err != nil {
+				return nil, nil, err
+			}
+			return []*models.SensorData{sensorData}, nil, nil
+		}
+
+		list, ok := samples.([]interface{})
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid batch: samples: expected an array, got %s", describeJSON(samples))
+		}
+		if deviceID, _ := doc["device_id"].(string); deviceID == "" {
+			return nil, nil, errors.New("invalid batch: missing device_id")
+		}
+		if len(list) == 0 {
+			return nil, nil, errors.New("invalid batch: no samples")
+		}
+		readings, invalid = decodeSamples(doc, list, topic, received)
+		return readings, invalid, nil
+
+	default:
+		return nil, nil, fmt.Errorf("invalid sensor data: expected an object or an array, got %s", describeJSON(payload))
+	}
+}
+
+// decodeSamples decodes the samples of a batch. Samples inherit the envelope's device_id, site
+// and schema_version.
+func decodeSamples(envelope map[string]interface{}, samples []interface{}, topic deviceTopic, received time.Time) (readings []*models.SensorData, invalid []error) {
+	for i, sample := range samples {
+		doc, ok := sample.(map[string]interface{})
+		if !ok {
+			invalid = append(invalid, fmt.Errorf("sample %d: expected an object, got %s", i, describeJSON(sample)))
+			continue
+		}
+		if err := inheritEnvelope(envelope, doc); err != nil {
+			invalid = append(invalid, fmt.Errorf("sample %d: %w", i, err))
+			continue
+		}
+		if err := topic.claim(doc); err != nil {
+			invalid = append(invalid, fmt.Errorf("sample %d: %w", i, err))
+			continue
+		}
+
+		sensorData, err := migrateSensorDocument(doc, received)
+		if err != nil {
+			invalid = append(invalid, fmt.Errorf("sample %d: %w", i, err))
+			continue
+		}
+		readings = append(readings, sensorData)
+	}
+	return readings, invalid
+}
+
+// inheritEnvelope fills a sample's device_id, site and schema_version from its envelope. Buffered
+// samples were taken before the message was sent, so unlike single readings they must carry
+// their own timestamp.
+func inheritEnvelope(envelope, doc map[string]interface{}) error {
+	if envelope != nil {
+		deviceID := envelope["device_id"]
+		switch own, ok := doc["device_id"]; {
+		case !ok || own == nil:
+			doc["device_id"] = deviceID
+		case own != deviceID:
+			return fmt.Errorf("device_id %v does not match batch device_id %v", own, deviceID)
+		}
+
+		for _, name := range []string{"site", "schema_version"} {
+			if value, ok := envelope[name]; ok {
+				if _, own := doc[name]; !own {
+					doc[name] = value
+				}
+			}
+		}
+	}
+
+	if timestamp, ok := doc["timestamp"]; !ok || timestamp == nil {
+		return errors.New("missing timestamp")
+	}
+	return nil
+}
+
+// batchDeliveryAck shares one broker delivery between the readings of a batched message.
+// The delivery is acked once every reading has been acked and nacked as soon as one is nacked;
+// the underlying delivery settles only once, so later acks are ignored.
+type batchDeliveryAck struct {
+	delivery models.DeliveryAck
+	pending  atomic.Int32
+}
+
+// newBatchDeliveryAck returns one DeliveryAck per reading of a message
+func newBatchDeliveryAck(delivery models.DeliveryAck, readings int) []models.DeliveryAck {
+	batch := &batchDeliveryAck{delivery: delivery}
+	batch.pending.Store(int32(readings))
+
+	acks := make([]models.DeliveryAck, readings)
+	for i := range acks {
+		acks[i] = &batchReadingAck{batch: batch}
+	}
+	return acks
+}
+
+// batchReadingAck settles one reading of a batch, at most once
+type batchReadingAck struct {
+	batch *batchDeliveryAck
+	once  sync.Once
+}
+
+// Ack acknowledges the reading, and the delivery once it was the last one pending
+func (a *batchReadingAck) Ack() {
+	a.once.Do(func() {
+		if a.batch.pending.Add(-1) == 0 {
+			a.batch.delivery.Ack()
+		}
+	})
+}
+
+// Nack rejects the whole delivery
+func (a *batchReadingAck) Nack(requeue bool) {
+	a.once.Do(func() {
+		a.batch.delivery.Nack(requeue)
+	})
+}
@@ -0,0 +1,332 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"kaelo/metrics"
+	"kaelo/models"
+)
+
+// CurrentSensorSchemaVersion is the schema_version of the current SensorData payload.
+// Payloads without schema_version are version 1.
+const CurrentSensorSchemaVersion = 2
+
+// schemaKind is the JSON type a payload field must have
+type schemaKind int
+
+const (
+	schemaString schemaKind = iota
+	schemaNumber
+	schemaInteger // non-negative integer
+	schemaBool
+	schemaTimestamp
+	schemaObject
+	schemaRemoved // no longer accepted in this version
+)
+
+// schemaField describes one field of a payload version
+type schemaField struct {
+	name     string
+	kind     schemaKind
+	required bool
+	min, max float64       // allowed range of numbers, unbounded when both are zero
+	values   []string      // allowed values of strings, any when empty
+	fields   []schemaField // members of objects
+}
+
+// sensorSchema is one version of the SensorData payload. upgrade migrates a valid payload of
+// this version to the next one; it is nil for the current version.
+type sensorSchema struct {
+	fields  []schemaField
+	upgrade func(doc map[string]interface{}, received time.Time)
+}
+
+// Sensor ranges, wide enough for every sensor the firmware supports
+var (
+	temperatureField = schemaField{kind: schemaNumber, min: -40, max: 125}
+	humidityField    = schemaField{name: "humidity", kind: schemaNumber, min: 0, max: 100}
+	// MPU6050 at its widest ranges: ±16 g and ±2000 °/s
+	accelerationField = schemaField{name: "acceleration", kind: schemaObject, fields: vectorFields(-160, 160)}
+	gyroscopeField    = schemaField{name: "gyroscope", kind: schemaObject, fields: vectorFields(-35, 35)}
+)
+
+func vectorFields(min, max float64) []schemaField {
+	return []schemaField{
+		{name: "x", kind: schemaNumber, min: min, max: max},
+		{name: "y", kind: schemaNumber, min: min, max: max},
+		{name: "z", kind: schemaNumber, min: min, max: max},
+	}
+}
+
+func named(field schemaField, name string) schemaField {
+	field.name = name
+	return field
+}
+
+// sensorSchemas lists the SensorData payload versions by schema_version
+var sensorSchemas = map[int]sensorSchema{
+	// Version 1: original firmware. The timestamp is optional and the deprecated MPU
+	// temperature is still sent.
+	1: {
+		fields: []schemaField{
+			{name: "device_id", kind: schemaString, required: true},
+			{name: "site", kind: schemaString},
+			{name: "timestamp", kind: schemaTimestamp},
+			{name: "message_id", kind: schemaString},
+			{name: "seq", kind: schemaInteger},
+			named(temperatureField, "temperature_dht"),
+			named(temperatureField, "temperature_mpu"),
+			humidityField,
+			{name: "gas_quality", kind: schemaString, values: []string{"", "good", "moderate", "poor"}},
+			{name: "flame_detected", kind: schemaBool},
+			accelerationField,
+			gyroscopeField,
+		},
+		upgrade: func(doc map[string]interface{}, received time.Time) {
+			// temperature_mpu is kept: readings stay comparable with what the device sent
+			if _, ok := doc["timestamp"]; !ok {
+				doc["timestamp"] = received.Format(time.RFC3339Nano)
+			}
+		},
+	},
+	// Version 2: every reading carries its timestamp; temperature_mpu is gone
+	2: {
+		fields: []schemaField{
+			{name: "device_id", kind: schemaString, required: true},
+			{name: "site", kind: schemaString},
+			{name: "timestamp", kind: schemaTimestamp, required: true},
+			{name: "message_id", kind: schemaString},
+			{name: "seq", kind: schemaInteger},
+			named(temperatureField, "temperature_dht"),
+			{name: "temperature_mpu", kind: schemaRemoved},
+			humidityField,
+			{name: "gas_quality", kind: schemaString, values: []string{"good", "moderate", "poor"}},
+			{name: "flame_detected", kind: schemaBool},
+			accelerationField,
+			gyroscopeField,
+		},
+	},
+}
+
+// migrateSensorDocument validates a decoded SensorData payload against its schema_version and
+// upgrades it to the current version. The returned reading keeps the version the device sent.
+func migrateSensorDocument(doc map[string]interface{}, received time.Time) (*models.SensorData, error) {
+	version, err := documentSchemaVersion(doc)
+	if err != nil {
+		metrics.SchemaValidationFailures.WithLabelValues("unknown").Inc()
+		return nil, err
+	}
+	label := strconv.Itoa(version)
+
+	var outOfRange []string
+	if err := validateFields("", sensorSchemas[version].fields, doc, &outOfRange); err != nil {
+		metrics.SchemaValidationFailures.WithLabelValues(label).Inc()
+		return nil, fmt.Errorf("invalid schema_version %d payload: %w", version, err)
+	}
+	_, timestamped := doc["timestamp"]
+
+	// A value out of range is a faulty sensor, not a faulty reading: the field is cleared and
+	// the rest of the reading, flame and gas included, is kept
+	var invalidFields []string
+	for _, path := range outOfRange {
+		field, _, _ := strings.Cut(path, ".")
+		if !contains(invalidFields, field) {
+			invalidFields = append(invalidFields, field)
+			delete(doc, field)
+			metrics.SensorValuesOutOfRange.WithLabelValues(field).Inc()
+		}
+	}
+
+	for v := version; v < CurrentSensorSchemaVersion; v++ {
+		sensorSchemas[v].upgrade(doc, received)
+	}
+	delete(doc, "schema_version")
+
+	encoded, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var sensorData models.SensorData
+	if err := json.Unmarshal(encoded, &sensorData); err != nil {
+		return nil, err
+	}
+	sensorData.SchemaVersion = version
+	sensorData.TimestampAssigned = !timestamped
+	sensorData.InvalidFields = invalidFields
+
+	metrics.SchemaVersionReadings.WithLabelValues(label).Inc()
+	return &sensorData, nil
+}
+
+// documentSchemaVersion returns the schema_version of a payload, 1 when it has none
+func documentSchemaVersion(doc map[string]interface{}) (int, error) {
+	value, ok := doc["schema_version"]
+	if !ok || value == nil {
+		return 1, nil
+	}
+
+	version, err := schemaInt(value)
+	if err != nil {
+		return 0, fmt.Errorf("schema_version: %w", err)
+	}
+	if _, ok := sensorSchemas[int(version)]; !ok {
+		return 0, fmt.Errorf("schema_version: unsupported version %d (supported 1 to %d)", version, CurrentSensorSchemaVersion)
+	}
+	return int(version), nil
+}
+
+// validateFields checks the fields of an object and reports every problem found, each
+// prefixed with the field's path (e.g. "acceleration.x: ..."). Numbers out of their range
+// aren't problems, their paths are added to outOfRange instead.
+func validateFields(prefix string, fields []schemaField, doc map[string]interface{}, outOfRange *[]string) error {
+	var problems []string
+	for _, field := range fields {
+		path := prefix + field.name
+		value, ok := doc[field.name]
+		if ok && value == nil {
+			// null is treated like a missing field
+			delete(doc, field.name)
+			ok = false
+		}
+
+		switch {
+		case !ok && field.required:
+			problems = append(problems, path+": required")
+		case !ok:
+		case field.kind == schemaRemoved:
+			problems = append(problems, path+": no longer accepted in this schema_version")
+		default:
+			if err := validateValue(path, field, value, outOfRange); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validateValue checks a single present field
+func validateValue(path string, field schemaField, value interface{}, outOfRange *[]string) error {
+	switch field.kind {
+	case schemaString:
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected a string, got %s", path, describeJSON(value))
+		}
+		if field.required && s == "" {
+			return fmt.Errorf("%s: must not be empty", path)
+		}
+		if len(field.values) > 0 && !contains(field.values, s) {
+			return fmt.Errorf("%s: %q is not one of %s", path, s, strings.Join(nonEmpty(field.values), ", "))
+		}
+
+	case schemaNumber:
+		n, err := schemaFloat(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if (field.min != 0 || field.max != 0) && (n < field.min || n > field.max) {
+			*outOfRange = append(*outOfRange, path)
+		}
+
+	case schemaInteger:
+		if _, err := schemaInt(value); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+	case schemaBool:
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: expected true or false, got %s", path, describeJSON(value))
+		}
+
+	case schemaTimestamp:
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected an RFC3339 timestamp, got %s", path, describeJSON(value))
+		}
+		if _, err := time.Parse(time.RFC3339, s); err != nil {
+			return fmt.Errorf("%s: expected an RFC3339 timestamp, got %q", path, s)
+		}
+
+	case schemaObject:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an object, got %s", path, describeJSON(value))
+		}
+		return validateFields(path+".", field.fields, object, outOfRange)
+	}
+	return nil
+}
+
+// schemaFloat reads a JSON number
+func schemaFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return v.Float64()
+	case float64:
+		return v, nil
+	}
+	return 0, fmt.Errorf("expected a number, got %s", describeJSON(value))
+}
+
+// schemaInt reads a non-negative JSON integer
+func schemaInt(value interface{}) (uint64, error) {
+	var text string
+	switch v := value.(type) {
+	case json.Number:
+		text = v.String()
+	case float64:
+		text = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return 0, fmt.Errorf("expected an integer, got %s", describeJSON(value))
+	}
+
+	n, err := strconv.ParseUint(text, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("expected a non-negative integer, got %s", text)
+	}
+	return n, nil
+}
+
+// describeJSON names the JSON type of a value for error messages
+func describeJSON(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return fmt.Sprintf("string %q", v)
+	case json.Number, float64:
+		return fmt.Sprintf("number %v", v)
+	case bool:
+		return fmt.Sprintf("%t", v)
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func nonEmpty(values []string) []string {
+	var result []string
+	for _, v := range values {
+		if v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"kaelo/config"
+	"kaelo/models"
+
+	"go.uber.org/zap"
+)
+
+func TestOutOfRangeValuesAreCleared(t *testing.T) {
+	data := decodeTestReading(t, `{"schema_version": 2, "device_id": "ESP32-001", "timestamp": "2024-05-01T10:00:00+07:00",
+		"temperature_dht": 26.5, "humidity": 140, "gas_quality": "poor", "flame_detected": true,
+		"acceleration": {"x": 0, "y": 0, "z": 9.81}, "gyroscope": {"x": 0, "y": 300, "z": 0}}`)
+
+	if want := []string{"humidity", "gyroscope"}; !reflect.DeepEqual(data.InvalidFields, want) {
+		t.Fatalf("InvalidFields = %v, want %v", data.InvalidFields, want)
+	}
+	if data.Humidity != 0 || data.Gyroscope != (models.GyroscopeData{}) {
+		t.Errorf("out of range values kept: humidity %g, gyroscope %+v", data.Humidity, data.Gyroscope)
+	}
+	if data.TemperatureDHT != 26.5 || data.Acceleration.Z != 9.81 || !data.FlameDetected || data.GasQuality != "poor" {
+		t.Errorf("valid values lost: %+v", data)
+	}
+	if data.Has("humidity") || data.Has("gyroscope") || !data.Has("temperature_dht") {
+		t.Error("Has doesn't match InvalidFields")
+	}
+
+	// Flame and gas still alert; the cleared humidity doesn't raise a humidity_low
+	thresholds, err := NewThresholdManager(&config.Config{
+		ThresholdsPath: filepath.Join(t.TempDir(), "thresholds.json"),
+		TemperatureMin: 10, TemperatureMax: 35, HumidityMin: 30, HumidityMax: 80,
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	detector := NewAnomalyDetectionService(thresholds)
+	types := make(map[models.AnomalyType]bool)
+	for _, anomaly := range detector.DetectAnomalies(data) {
+		types[anomaly.Type] = true
+	}
+	if !types[models.FlameDetected] || !types[models.GasQualityPoor] {
+		t.Errorf("got anomalies %v, want flame and poor gas", types)
+	}
+	if types[models.HumidityTooLow] || types[models.GyroscopeAbnormal] {
+		t.Errorf("got anomalies %v for cleared values", types)
+	}
+}
+
+func TestInvalidPayloadIsRejected(t *testing.T) {
+	body := `{"schema_version": 2, "device_id": "ESP32-001", "humidity": "wet"}`
+	readings, invalid, err := decodeSensorPayload([]byte(body), deviceTopic{})
+	if err == nil && len(invalid) == 0 {
+		t.Fatalf("decodeSensorPayload(%s) = %v, want an error", body, readings)
+	}
+}
+
+func TestSchemaVersion1KeepsMPUTemperature(t *testing.T) {
+	data := decodeTestReading(t, `{"device_id": "ESP32-001", "temperature_dht": 25, "temperature_mpu": 26.5}`)
+	if data.TemperatureMPU != 26.5 || !data.Has("temperature_mpu") {
+		t.Errorf("temperature_mpu = %g, want 26.5", data.TemperatureMPU)
+	}
+
+	without := decodeTestReading(t, `{"device_id": "ESP32-001", "temperature_dht": 25}`)
+	if without.Has("temperature_mpu") {
+		t.Error("reading without temperature_mpu reports having one")
+	}
+}
@@ -0,0 +1,477 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"kaelo/config"
+	"kaelo/metrics"
+	"kaelo/models"
+
+	"go.uber.org/zap"
+)
+
+// spillSegment is a single spilled batch on disk. Segment files are named
+// "{spilled_at_unix_nano}-{sequence}-{reading_count}.jsonl" so they sort in spill order.
+type spillSegment struct {
+	name      string
+	spilledAt time.Time
+	readings  int
+	size      int64
+	rejected  int // replays the store rejected, see retryableStoreError
+}
+
+// spillQuarantineDir is the subdirectory of the spill directory holding segments the store
+// keeps rejecting
+const spillQuarantineDir = "quarantine"
+
+// spillMaxRejections is how often the store may reject a segment before it is quarantined, so
+// the segments behind it still drain
+const spillMaxRejections = 3
+
+// SpillStatus summarizes the spill backlog
+type SpillStatus struct {
+	Segments int       `json:"segments"`
+	Readings int       `json:"readings"`
+	Bytes    int64     `json:"bytes"`
+	MaxBytes int64     `json:"max_bytes"`
+	OldestAt time.Time `json:"oldest_at,omitzero"`
+}
+
+// SpillBuffer is an on-disk write-ahead log for batches the store failed to write.
+// Spilled batches are replayed to the store in order once it is reachable again.
+type SpillBuffer struct {
+	dir            string
+	maxBytes       int64
+	replayInterval time.Duration
+	store          SensorStore
+	logger         *zap.Logger
+	segments       []spillSegment // oldest first
+	totalBytes     int64
+	seq            int64
+	mu             sync.Mutex
+	replayMu       sync.Mutex // serializes replay so segments are written in order
+}
+
+// NewSpillBuffer creates the spill directory and loads segments left over from a previous run
+func NewSpillBuffer(cfg *config.Config, store SensorStore, logger *zap.Logger) (*SpillBuffer, error) {
+	if err := os.MkdirAll(cfg.SpillDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spill directory: %w", err)
+	}
+
+	s := &SpillBuffer{
+		dir:            cfg.SpillDir,
+		maxBytes:       int64(cfg.SpillMaxMB) * 1024 * 1024,
+		replayInterval: time.Duration(cfg.SpillReplayInterval) * time.Second,
+		store:          store,
+		logger:         logger,
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// load scans the spill directory for segments
+func (s *SpillBuffer) load() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read spill directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(name, ".tmp") {
+			// Incomplete segment from a crash during spill
+			os.Remove(filepath.Join(s.dir, name))
+			continue
+		}
+
+		segment, ok := parseSpillSegment(name)
+		if !ok {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		segment.size = info.Size()
+
+		s.segments = append(s.segments, segment)
+		s.totalBytes += segment.size
+	}
+
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].name < s.segments[j].name })
+	s.updateMetrics()
+
+	if len(s.segments) > 0 {
+		status := s.statusLocked()
+		s.logger.Warn("Found spilled batches from a previous run, they will be replayed",
+			zap.Int("segments", status.Segments),
+			zap.Int("readings", status.Readings),
+			zap.Time("oldest_at", status.OldestAt))
+	}
+
+	return nil
+}
+
+// parseSpillSegment parses a segment file name
+func parseSpillSegment(name string) (spillSegment, bool) {
+	base, ok := strings.CutSuffix(name, ".jsonl")
+	if !ok {
+		return spillSegment{}, false
+	}
+
+	parts := strings.Split(base, "-")
+	if len(parts) != 3 {
+		return spillSegment{}, false
+	}
+
+	spilledAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return spillSegment{}, false
+	}
+	readings, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return spillSegment{}, false
+	}
+
+	return spillSegment{name: name, spilledAt: time.Unix(0, spilledAt), readings: readings}, true
+}
+
+// Append writes a failed batch to disk. The oldest segments are evicted to stay within
+// the size cap or when the disk is full.
+func (s *SpillBuffer) Append(batch []*models.SensorData) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, data := range batch {
+		line, err := json.Marshal(data)
+		if err != nil {
+			return fmt.Errorf("failed to encode reading: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	size := int64(buf.Len())
+	if size > s.maxBytes {
+		s.dropped(len(batch))
+		return fmt.Errorf("batch of %d bytes exceeds spill size cap of %d bytes", size, s.maxBytes)
+	}
+	for s.totalBytes+size > s.maxBytes && len(s.segments) > 0 {
+		s.evictOldest("spill size cap reached")
+	}
+
+	s.seq++
+	spilledAt := time.Now()
+	segment := spillSegment{
+		name:      fmt.Sprintf("%020d-%06d-%d.jsonl", spilledAt.UnixNano(), s.seq%1000000, len(batch)),
+		spilledAt: spilledAt,
+		readings:  len(batch),
+		size:      size,
+	}
+
+	err := s.writeSegment(segment.name, buf.Bytes())
+	for err != nil && errors.Is(err, syscall.ENOSPC) && len(s.segments) > 0 {
+		// Disk full: make room by dropping the oldest data and try again
+		s.evictOldest("disk full")
+		err = s.writeSegment(segment.name, buf.Bytes())
+	}
+	if err != nil {
+		s.dropped(len(batch))
+		s.updateMetrics()
+		return fmt.Errorf("failed to write spill segment: %w", err)
+	}
+
+	s.segments = append(s.segments, segment)
+	s.totalBytes += size
+	metrics.SpillWrites.Inc()
+	s.updateMetrics()
+
+	return nil
+}
+
+// writeSegment atomically writes a segment file
+func (s *SpillBuffer) writeSegment(name string, data []byte) error {
+	path := filepath.Join(s.dir, name)
+	tmpPath := path + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// evictOldest deletes the oldest segment. Must be called with s.mu held.
+func (s *SpillBuffer) evictOldest(reason string) {
+	oldest := s.segments[0]
+	s.segments = s.segments[1:]
+	s.totalBytes -= oldest.size
+
+	if err := os.Remove(filepath.Join(s.dir, oldest.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.logger.Error("Failed to remove evicted spill segment", zap.String("segment", oldest.name), zap.Error(err))
+	}
+
+	s.dropped(oldest.readings)
+	s.logger.Error("Evicted oldest spilled batch, data lost",
+		zap.String("reason", reason),
+		zap.String("segment", oldest.name),
+		zap.Int("readings", oldest.readings),
+		zap.Time("spilled_at", oldest.spilledAt))
+}
+
+// dropped records readings lost from the spill buffer
+func (s *SpillBuffer) dropped(readings int) {
+	metrics.SpillDroppedReadings.Add(float64(readings))
+}
+
+// Start replays spilled batches to the store until the context is cancelled
+func (s *SpillBuffer) Start(ctx context.Context) {
+	s.logger.Info("Starting spill buffer replay",
+		zap.String("dir", s.dir),
+		zap.Int64("max_bytes", s.maxBytes),
+		zap.Duration("replay_interval", s.replayInterval))
+
+	ticker := time.NewTicker(s.replayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.logger.Info("Spill buffer replay stopped")
+			return
+		case <-ticker.C:
+			s.replay(ctx)
+			s.mu.Lock()
+			s.updateMetrics()
+			s.mu.Unlock()
+		}
+	}
+}
+
+// replay writes spilled segments to the store oldest first. It stops at the first failure,
+// unless the store rejected the segment often enough for it to be quarantined.
+func (s *SpillBuffer) replay(ctx context.Context) {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+
+	replayed := 0
+	for ctx.Err() == nil {
+		s.mu.Lock()
+		if len(s.segments) == 0 {
+			s.mu.Unlock()
+			break
+		}
+		segment := s.segments[0]
+		s.mu.Unlock()
+
+		batch, err := s.readSegment(segment.name)
+		if err != nil {
+			s.logger.Error("Failed to read spill segment, discarding it",
+				zap.String("segment", segment.name),
+				zap.Error(err))
+			s.remove(segment, false)
+			continue
+		}
+
+		writeCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err = s.store.WriteBatch(writeCtx, batch)
+		cancel()
+		if err != nil {
+			if !retryableStoreError(err) && s.rejected(segment) >= spillMaxRejections {
+				s.quarantine(segment, err)
+				continue
+			}
+			s.logger.Warn("Spill replay failed, will retry",
+				zap.String("segment", segment.name),
+				zap.Int("remaining_segments", s.Status().Segments),
+				zap.Error(err))
+			return
+		}
+
+		s.remove(segment, true)
+		replayed += len(batch)
+	}
+
+	if replayed > 0 {
+		s.logger.Info("Replayed spilled readings to store",
+			zap.Int("readings", replayed),
+			zap.Int("remaining_segments", s.Status().Segments))
+	}
+}
+
+// readSegment reads the readings in a segment, skipping malformed lines
+func (s *SpillBuffer) readSegment(name string) ([]*models.SensorData, error) {
+	file, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var batch []*models.SensorData
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var data models.SensorData
+		if err := json.Unmarshal(scanner.Bytes(), &data); err != nil {
+			s.logger.Warn("Skipping malformed spilled reading", zap.String("segment", name), zap.Error(err))
+			continue
+		}
+		batch = append(batch, &data)
+	}
+
+	return batch, scanner.Err()
+}
+
+// rejected counts a replay of the oldest segment the store rejected and returns the count so far
+func (s *SpillBuffer) rejected(segment spillSegment) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.segments) == 0 || s.segments[0].name != segment.name {
+		return 0
+	}
+	s.segments[0].rejected++
+	return s.segments[0].rejected
+}
+
+// quarantine moves a segment the store keeps rejecting out of the replay queue. It is kept in
+// the quarantine directory for inspection and can be moved back to be replayed again.
+func (s *SpillBuffer) quarantine(segment spillSegment, err error) {
+	dir := filepath.Join(s.dir, spillQuarantineDir)
+	moveErr := os.MkdirAll(dir, 0o755)
+	if moveErr == nil {
+		moveErr = os.Rename(filepath.Join(s.dir, segment.name), filepath.Join(dir, segment.name))
+	}
+	if moveErr != nil && !errors.Is(moveErr, os.ErrNotExist) {
+		s.logger.Error("Failed to quarantine spill segment, discarding it",
+			zap.String("segment", segment.name),
+			zap.Error(moveErr))
+		s.remove(segment, false)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.popLocked(segment) {
+		return
+	}
+	metrics.SpillQuarantinedReadings.Add(float64(segment.readings))
+	s.updateMetrics()
+
+	s.logger.Error("Store keeps rejecting spilled batch, moved it to quarantine",
+		zap.String("segment", segment.name),
+		zap.String("quarantine_dir", dir),
+		zap.Int("readings", segment.readings),
+		zap.Int("attempts", spillMaxRejections),
+		zap.Error(err))
+}
+
+// remove deletes a segment once it has been replayed or found unreadable
+func (s *SpillBuffer) remove(segment spillSegment, replayed bool) {
+	if err := os.Remove(filepath.Join(s.dir, segment.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.logger.Error("Failed to remove spill segment", zap.String("segment", segment.name), zap.Error(err))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.popLocked(segment) {
+		return
+	}
+
+	if replayed {
+		metrics.SpillReplayedReadings.Add(float64(segment.readings))
+	} else {
+		s.dropped(segment.readings)
+	}
+	s.updateMetrics()
+}
+
+// popLocked drops the oldest segment from the backlog once it was replayed, discarded or
+// quarantined. It reports false if the segment was evicted while it was being replayed. Must be
+// called with s.mu held.
+func (s *SpillBuffer) popLocked(segment spillSegment) bool {
+	if len(s.segments) == 0 || s.segments[0].name != segment.name {
+		return false
+	}
+	s.segments = s.segments[1:]
+	s.totalBytes -= segment.size
+	return true
+}
+
+// Status returns a summary of the spill backlog
+func (s *SpillBuffer) Status() SpillStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.statusLocked()
+}
+
+// statusLocked returns the backlog summary. Must be called with s.mu held.
+func (s *SpillBuffer) statusLocked() SpillStatus {
+	status := SpillStatus{
+		Segments: len(s.segments),
+		Bytes:    s.totalBytes,
+		MaxBytes: s.maxBytes,
+	}
+	for _, segment := range s.segments {
+		status.Readings += segment.readings
+	}
+	if len(s.segments) > 0 {
+		status.OldestAt = s.segments[0].spilledAt
+	}
+	return status
+}
+
+// updateMetrics publishes the backlog gauges. Must be called with s.mu held.
+func (s *SpillBuffer) updateMetrics() {
+	status := s.statusLocked()
+	metrics.SpillBacklogSegments.Set(float64(status.Segments))
+	metrics.SpillBacklogReadings.Set(float64(status.Readings))
+	metrics.SpillBacklogBytes.Set(float64(status.Bytes))
+
+	age := 0.0
+	if !status.OldestAt.IsZero() {
+		age = time.Since(status.OldestAt).Seconds()
+	}
+	metrics.SpillOldestAgeSeconds.Set(age)
+}
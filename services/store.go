@@ -0,0 +1,323 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"kaelo/config"
+	"kaelo/models"
+
+	"firebase.google.com/go/v4/errorutils"
+	"go.uber.org/zap"
+)
+
+// ErrNotFound is returned by stores when the requested record does not exist
+var ErrNotFound = errors.New("not found")
+
+// retryableStoreError reports whether a failed write may succeed when sent again because the
+// store was unreachable, overloaded, out of disk space or refusing the credentials. Other errors mean the store rejected
+// the data, e.g. a value Firebase or the JSON encoder refuses, and would fail the same way again.
+func retryableStoreError(err error) bool {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return true
+	case errors.As(err, &netErr):
+		return true
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ENOSPC):
+		return true
+	}
+	return errorutils.IsUnavailable(err) || errorutils.IsDeadlineExceeded(err) || errorutils.IsInternal(err) ||
+		errorutils.IsResourceExhausted(err) || errorutils.IsAborted(err) || errorutils.IsUnknown(err) ||
+		errorutils.IsUnauthenticated(err) || errorutils.IsPermissionDenied(err)
+}
+
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+)
+
+// SortOrder controls the order of query results by timestamp
+type SortOrder string
+
+const (
+	SortAscending  SortOrder = "asc"
+	SortDescending SortOrder = "desc"
+)
+
+// TimeRangeQuery filters and paginates records by device and timestamp
+type TimeRangeQuery struct {
+	DeviceID string    // Empty matches all devices
+	From     time.Time // Zero means unbounded
+	To       time.Time // Zero means unbounded
+	Limit    int
+	Cursor   string // Opaque cursor returned as NextCursor by the previous page
+	Order    SortOrder
+}
+
+// ParseRangeTime parses a -from/-to flag of the command line tools: an RFC3339 timestamp or
+// a date in the local timezone. A date used as the end of the range covers the whole day.
+func ParseRangeTime(value string, endOfDay bool) (time.Time, error) {
+	return parseRangeTimeIn(value, endOfDay, time.Local)
+}
+
+// parseRangeTimeIn is ParseRangeTime with dates in loc
+func parseRangeTimeIn(value string, endOfDay bool, loc *time.Location) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	day, err := time.ParseInLocation("2006-01-02", value, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected RFC3339 or YYYY-MM-DD, got %q", value)
+	}
+	if endOfDay {
+		return day.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	}
+	return day, nil
+}
+
+// AnomalyQuery filters anomalies in addition to the time range
+type AnomalyQuery struct {
+	TimeRangeQuery
+	Type     models.AnomalyType
+	Severity models.AnomalySeverity
+}
+
+// Page is a single page of query results
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// SensorStore persists and queries readings, anomalies and face events
+type SensorStore interface {
+	WriteBatch(ctx context.Context, batch []*models.SensorData) error
+	LatestReading(ctx context.Context, deviceID string) (*models.SensorData, error)
+	QueryReadings(ctx context.Context, query TimeRangeQuery) (Page[*models.SensorData], error)
+
+	WriteAnomalies(ctx context.Context, anomalies []*models.Anomaly) error
+	QueryAnomalies(ctx context.Context, query AnomalyQuery) (Page[*models.Anomaly], error)
+
+	WriteFaceEvent(ctx context.Context, event *models.FaceEvent) error
+	QueryFaceEvents(ctx context.Context, query TimeRangeQuery) (Page[*models.FaceEvent], error)
+
+	// MergeRollup adds a rollup to the stored bucket, creating it if it doesn't exist
+	MergeRollup(ctx context.Context, rollup *models.Rollup) error
+
+	// Prune deletes records of a collection that are older than the cutoff and returns how many
+	// were removed, or would be removed in a dry run
+	Prune(ctx context.Context, collection string, cutoff time.Time, opts PruneOptions) (int, error)
+
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// ReadingSink receives a copy of every batch the batch writer flushes, e.g. a time-series
+// database. Sinks are secondary: their failures are logged but don't affect acknowledgement
+// or the spill buffer, which only follow the sensor store.
+type ReadingSink interface {
+	Name() string
+	WriteBatch(ctx context.Context, batch []*models.SensorData) error
+}
+
+// HealthEventStore records device health checks. Implemented by the bolt store, and by the
+// mirrored store through its bolt copy.
+type HealthEventStore interface {
+	WriteHealthEvent(ctx context.Context, data *models.HealthCheckData) error
+	QueryHealthEvents(ctx context.Context, query TimeRangeQuery) (Page[*models.HealthCheckData], error)
+}
+
+// PruneOptions controls how old records are deleted
+type PruneOptions struct {
+	ChunkSize int  // Records deleted per request
+	DryRun    bool // Only count the records that would be deleted
+}
+
+// rollupCollection returns the collection holding rollups of a resolution
+func rollupCollection(resolution models.RollupResolution) string {
+	return rollupsPath + "/" + string(resolution)
+}
+
+// Storage backends selectable via STORAGE_BACKEND
+const (
+	StorageBackendFirebase = "firebase"
+	StorageBackendLocal    = "local"
+	StorageBackendBolt     = "bolt"
+)
+
+// NewSensorStore creates the storage backend selected in the configuration. With BOLT_MIRROR
+// set, a remote backend is wrapped so everything is also kept in the embedded store.
+func NewSensorStore(cfg *config.Config, logger *zap.Logger) (SensorStore, error) {
+	store, err := newPrimaryStore(cfg, logger)
+	if err != nil || !cfg.BoltMirror || cfg.StorageBackend == StorageBackendBolt {
+		return store, err
+	}
+
+	mirror, err := NewBoltStore(cfg, logger)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return NewMirroredStore(store, mirror, logger), nil
+}
+
+// DescribeStorage names where the configured store keeps data, for startup messages
+func DescribeStorage(cfg *config.Config) string {
+	var description string
+	switch cfg.StorageBackend {
+	case StorageBackendFirebase:
+		description = "Firebase Realtime Database"
+	case StorageBackendLocal:
+		description = "local files in " + cfg.LocalStoreDir
+	case StorageBackendBolt:
+		return "embedded database " + cfg.BoltPath
+	default:
+		return cfg.StorageBackend
+	}
+	if cfg.BoltMirror {
+		description += ", mirrored to " + cfg.BoltPath
+	}
+	return description
+}
+
+// newPrimaryStore creates the backend selected with STORAGE_BACKEND
+func newPrimaryStore(cfg *config.Config, logger *zap.Logger) (SensorStore, error) {
+	switch cfg.StorageBackend {
+	case StorageBackendFirebase:
+		if cfg.FirebaseDbUrl == "" || cfg.FirebaseServiceAccountJSON == "" {
+			return nil, fmt.Errorf("firebase configuration is required for the %s storage backend", StorageBackendFirebase)
+		}
+		store, err := NewFirebaseService(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case StorageBackendLocal:
+		store, err := NewLocalStore(cfg, logger)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case StorageBackendBolt:
+		store, err := NewBoltStore(cfg, logger)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q (expected %s, %s or %s)",
+			cfg.StorageBackend, StorageBackendFirebase, StorageBackendLocal, StorageBackendBolt)
+	}
+}
+
+// normalizedLimit returns the page size clamped to the allowed range
+func (q TimeRangeQuery) normalizedLimit() int {
+	if q.Limit <= 0 {
+		return defaultQueryLimit
+	}
+	if q.Limit > maxQueryLimit {
+		return maxQueryLimit
+	}
+	return q.Limit
+}
+
+// descending reports whether results are returned newest first
+func (q TimeRangeQuery) descending() bool {
+	return q.Order == SortDescending
+}
+
+// storedTimestampLayout is RFC3339Nano with a fixed number of fractional digits. Stored in
+// UTC, every timestamp has the same length and suffix, so string ordering matches time ordering
+// (time.RFC3339Nano trims trailing zeros, which would sort "…:00.5Z" before "…:00Z").
+const storedTimestampLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// storedTimestamp formats a timestamp the way it is stored and indexed: UTC, nanosecond precision.
+// Records written before timestamps were normalised carry a local offset (e.g. +07:00) and only
+// compare correctly against timestamps in the same offset.
+func storedTimestamp(t time.Time) string {
+	return t.UTC().Format(storedTimestampLayout)
+}
+
+// readingKey returns the storage key of a reading. Keys are deterministic so a redelivered
+// reading overwrites the stored copy instead of duplicating it. Like messageIdentity, a reading
+// with a sequence number and an assigned timestamp is keyed by the bucketed receive time, so a
+// resend within the bucket overwrites it but a counter restarted by a reboot doesn't overwrite
+// history. Without a sequence number the receive time stays in the key, so readings with equal
+// values taken at different times aren't merged.
+func readingKey(data *models.SensorData) string {
+	switch {
+	case data.MessageID != "":
+		return sanitizeKey(data.DeviceID + "-m-" + data.MessageID)
+	case data.Seq != 0 && data.TimestampAssigned:
+		return sanitizeKey(fmt.Sprintf("%d-%s-s-%d", seqEpoch(data).UnixNano(), data.DeviceID, data.Seq))
+	case data.Seq != 0:
+		return sanitizeKey(fmt.Sprintf("%d-%s-s-%d", data.Timestamp.UnixNano(), data.DeviceID, data.Seq))
+	}
+	return sanitizeKey(fmt.Sprintf("%d-%s-%s", data.Timestamp.UnixNano(), data.DeviceID, readingFingerprint(data)))
+}
+
+// sanitizeKey replaces characters that are not allowed in Firebase keys
+func sanitizeKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20 || r == 0x7f:
+			return '_'
+		case strings.ContainsRune(".$#[]/", r):
+			return '_'
+		}
+		return r
+	}, key)
+}
+
+// anomalyKey returns the storage key of an anomaly
+func anomalyKey(anomaly *models.Anomaly) string {
+	return fmt.Sprintf("%d-%s-%s", anomaly.Timestamp.UnixNano(), anomaly.DeviceID, anomaly.Type)
+}
+
+// faceEventKey returns the storage key of a face event
+func faceEventKey(event *models.FaceEvent) string {
+	return fmt.Sprintf("%d-%s", event.Timestamp.UnixNano(), event.UID)
+}
+
+// rollupKey returns the storage key of a rollup bucket within its resolution and device
+func rollupKey(rollup *models.Rollup) string {
+	return storedTimestamp(rollup.BucketStart)
+}
+
+// encodeCursor builds an opaque cursor from the sort value and key of the last returned record
+func encodeCursor(sortValue, key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(sortValue + "|" + key))
+}
+
+// decodeCursor parses a cursor produced by encodeCursor
+func decodeCursor(cursor string) (sortValue, key string, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	sortValue, key, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return "", "", fmt.Errorf("invalid cursor")
+	}
+
+	return sortValue, key, nil
+}
+
+// pastCursor reports whether a record sorts strictly after the cursor in the query order
+func pastCursor(sortValue, key, cursorValue, cursorKey string, descending bool) bool {
+	if descending {
+		return sortValue < cursorValue || (sortValue == cursorValue && key < cursorKey)
+	}
+	return sortValue > cursorValue || (sortValue == cursorValue && key > cursorKey)
+}
@@ -0,0 +1,79 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"kaelo/config"
+)
+
+func TestParseRangeTime(t *testing.T) {
+	ict := time.FixedZone("ICT", 7*3600)
+
+	tests := []struct {
+		value    string
+		endOfDay bool
+		want     time.Time
+	}{
+		{"", false, time.Time{}},
+		{"2024-05-01T10:00:00Z", false, time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+		{"2024-05-01T10:00:00+07:00", true, time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)},
+		{"2024-05-01", false, time.Date(2024, 4, 30, 17, 0, 0, 0, time.UTC)},
+		{"2024-05-01", true, time.Date(2024, 5, 1, 17, 0, 0, 0, time.UTC).Add(-time.Nanosecond)},
+	}
+	for _, tt := range tests {
+		got, err := parseRangeTimeIn(tt.value, tt.endOfDay, ict)
+		if err != nil {
+			t.Errorf("ParseRangeTime(%q, %v): %v", tt.value, tt.endOfDay, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("ParseRangeTime(%q, %v) = %s, want %s", tt.value, tt.endOfDay, got, tt.want)
+		}
+	}
+
+	if _, err := parseRangeTimeIn("01/05/2024", false, ict); err == nil {
+		t.Error("ParseRangeTime accepted a date in another format")
+	}
+}
+
+func TestPruneEndBoundary(t *testing.T) {
+	cutoff := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	end := storedTimestamp(pruneEnd(cutoff))
+
+	// Firebase compares stored timestamps as strings against the inclusive end
+	tests := []struct {
+		offset time.Duration
+		pruned bool
+	}{
+		{-time.Second, true},
+		{-500 * time.Millisecond, true},
+		{-time.Nanosecond, true},
+		{0, false},
+		{time.Nanosecond, false},
+	}
+	for _, tt := range tests {
+		stored := storedTimestamp(cutoff.Add(tt.offset))
+		if pruned := stored <= end; pruned != tt.pruned {
+			t.Errorf("record at cutoff%+v (%s) pruned = %v, want %v", tt.offset, stored, pruned, tt.pruned)
+		}
+	}
+}
+
+func TestDescribeStorage(t *testing.T) {
+	tests := []struct {
+		cfg  config.Config
+		want string
+	}{
+		{config.Config{StorageBackend: StorageBackendFirebase}, "Firebase Realtime Database"},
+		{config.Config{StorageBackend: StorageBackendFirebase, BoltMirror: true, BoltPath: "data/kaelo.db"},
+			"Firebase Realtime Database, mirrored to data/kaelo.db"},
+		{config.Config{StorageBackend: StorageBackendLocal, LocalStoreDir: "data/store"}, "local files in data/store"},
+		{config.Config{StorageBackend: StorageBackendBolt, BoltMirror: true, BoltPath: "data/kaelo.db"}, "embedded database data/kaelo.db"},
+	}
+	for _, tt := range tests {
+		if got := DescribeStorage(&tt.cfg); got != tt.want {
+			t.Errorf("DescribeStorage(%s) = %q, want %q", tt.cfg.StorageBackend, got, tt.want)
+		}
+	}
+}
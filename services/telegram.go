@@ -1,8 +1,11 @@
 package services
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"html"
 	"strconv"
 	"strings"
 	"time"
@@ -15,15 +18,14 @@ import (
 )
 
 type TelegramService struct {
-	bot                 *tgbotapi.BotAPI
-	chatID              int64
-	config              *config.Config
-	lastAlertTimes      map[string]time.Time // Track last alert time per device
-	lastFlameAlertTimes map[string]time.Time // Track last flame alert time per device
-	logger              *zap.Logger
+	bot    *tgbotapi.BotAPI
+	chatID int64
+	config *config.Config
+	outbox *NotificationOutbox
+	logger *zap.Logger
 }
 
-func NewTelegramService(cfg *config.Config) (*TelegramService, error) {
+func NewTelegramService(cfg *config.Config, outbox *NotificationOutbox) (*TelegramService, error) {
 	logger, _ := zap.NewProduction()
 	bot, err := tgbotapi.NewBotAPI(cfg.TelegramBotToken)
 	if err != nil {
@@ -38,12 +40,11 @@ func NewTelegramService(cfg *config.Config) (*TelegramService, error) {
 	logger.Info("Telegram bot authorized", zap.String("username", bot.Self.UserName))
 
 	ts := &TelegramService{
-		bot:                 bot,
-		chatID:              chatID,
-		config:              cfg,
-		lastAlertTimes:      make(map[string]time.Time),
-		lastFlameAlertTimes: make(map[string]time.Time),
-		logger:              logger,
+		bot:    bot,
+		chatID: chatID,
+		config: cfg,
+		outbox: outbox,
+		logger: logger,
 	}
 
 	// Test Telegram connection with retry
@@ -52,6 +53,8 @@ func NewTelegramService(cfg *config.Config) (*TelegramService, error) {
 		return nil, fmt.Errorf("telegram connection test failed: %v", err)
 	}
 
+	outbox.RegisterSender(models.NotificationChannelTelegram, ts)
+
 	return ts, nil
 }
 
@@ -83,83 +86,85 @@ func (ts *TelegramService) testConnection() error {
 	return fmt.Errorf("failed to connect to Telegram after %d attempts", maxRetries)
 }
 
-// SendAnomalyAlert sends a beautifully formatted anomaly alert to Telegram with throttling
+// Ping checks that the Telegram bot is still authorised
+func (ts *TelegramService) Ping(ctx context.Context) error {
+	if _, err := ts.bot.GetMe(); err != nil {
+		return fmt.Errorf("telegram bot not authorised: %w", err)
+	}
+	return nil
+}
+
+// SendAnomalyAlert queues a beautifully formatted anomaly alert for Telegram.
+// Anomalies are expected to be deduplicated by AlertDeduplicator beforehand.
 func (ts *TelegramService) SendAnomalyAlert(anomalies []*models.Anomaly, sensorData *models.SensorData) error {
 	if len(anomalies) == 0 {
 		return nil
 	}
 
-	// Check for flame detection - special case handling
-	hasFlameDetection := ts.hasFlameDetection(anomalies)
-
-	if hasFlameDetection {
-		// For flame detection: check flame-specific throttling
-		if ts.shouldThrottleFlameAlert(sensorData.DeviceID) {
-			ts.logger.Debug("Throttling flame alert", zap.String("device_id", sensorData.DeviceID))
-			return nil
-		}
-	} else {
-		// For non-flame anomalies: use regular throttling
-		if ts.shouldThrottleAlert(sensorData.DeviceID) {
-			ts.logger.Debug("Throttling alert", zap.String("device_id", sensorData.DeviceID))
-			return nil
-		}
-	}
-
-	message := ts.formatAnomalyMessage(anomalies, sensorData)
-
-	msg := tgbotapi.NewMessage(ts.chatID, message)
-	msg.ParseMode = "HTML"
-	msg.DisableWebPagePreview = true
-
-	_, err := ts.bot.Send(msg)
+	err := ts.enqueue(&models.Notification{
+		Kind:     models.NotificationAnomalyAlert,
+		DeviceID: sensorData.DeviceID,
+		Critical: hasCriticalAnomaly(anomalies),
+		Text:     ts.formatAnomalyMessage(anomalies, sensorData),
+	})
 	if err != nil {
-		return fmt.Errorf("error sending telegram message: %v", err)
-	}
-
-	// Update last alert time for this device
-	if hasFlameDetection {
-		ts.lastFlameAlertTimes[sensorData.DeviceID] = time.Now()
-	} else {
-		ts.lastAlertTimes[sensorData.DeviceID] = time.Now()
+		return fmt.Errorf("error queueing telegram message: %v", err)
 	}
 
-	ts.logger.Info("Sent anomaly alert",
+	ts.logger.Info("Queued anomaly alert",
 		zap.String("device_id", sensorData.DeviceID),
 		zap.Int("anomaly_count", len(anomalies)))
 	return nil
 }
 
-// shouldThrottleAlert checks if we should throttle alerts for a device (within 15 seconds)
-func (ts *TelegramService) shouldThrottleAlert(deviceID string) bool {
-	lastAlertTime, exists := ts.lastAlertTimes[deviceID]
-	if !exists {
-		return false // No previous alert, don't throttle
+// hasCriticalAnomaly checks if any of the anomalies is critical (e.g. flame detection)
+func hasCriticalAnomaly(anomalies []*models.Anomaly) bool {
+	for _, anomaly := range anomalies {
+		if anomaly.GetSeverity() == models.SeverityCritical {
+			return true
+		}
 	}
+	return false
+}
 
-	timeSinceLastAlert := time.Since(lastAlertTime)
-	return timeSinceLastAlert < 15*time.Second
+// enqueue writes a Telegram notification to the outbox for delivery
+func (ts *TelegramService) enqueue(notification *models.Notification) error {
+	notification.Channel = models.NotificationChannelTelegram
+	return ts.outbox.Enqueue(notification)
 }
 
-// shouldThrottleFlameAlert checks if we should throttle flame alerts for a device (within 15 seconds)
-func (ts *TelegramService) shouldThrottleFlameAlert(deviceID string) bool {
-	lastFlameAlertTime, exists := ts.lastFlameAlertTimes[deviceID]
-	if !exists {
-		return false // No previous flame alert, don't throttle
-	}
+// DeliverNotification sends an outbox notification to Telegram
+func (ts *TelegramService) DeliverNotification(ctx context.Context, notification *models.Notification) error {
+	var chattable tgbotapi.Chattable
 
-	timeSinceLastFlameAlert := time.Since(lastFlameAlertTime)
-	return timeSinceLastFlameAlert < 15*time.Second
-}
+	if len(notification.Photo) > 0 {
+		photoMsg := tgbotapi.NewPhoto(ts.chatID, tgbotapi.FileBytes{
+			Name:  notification.PhotoName,
+			Bytes: notification.Photo,
+		})
+		photoMsg.Caption = notification.Text
+		photoMsg.ParseMode = "HTML"
+		chattable = photoMsg
+	} else {
+		msg := tgbotapi.NewMessage(ts.chatID, notification.Text)
+		msg.ParseMode = "HTML"
+		msg.DisableWebPagePreview = true
+		chattable = msg
+	}
 
-// hasFlameDetection checks if any of the anomalies contains flame detection
-func (ts *TelegramService) hasFlameDetection(anomalies []*models.Anomaly) bool {
-	for _, anomaly := range anomalies {
-		if anomaly.Type == models.FlameDetected {
-			return true
+	if _, err := ts.bot.Send(chattable); err != nil {
+		// Honour Telegram rate limiting (HTTP 429 with retry_after)
+		var tgErr *tgbotapi.Error
+		if errors.As(err, &tgErr) && tgErr.RetryAfter > 0 {
+			return &RetryAfterError{
+				Delay: time.Duration(tgErr.RetryAfter) * time.Second,
+				Err:   err,
+			}
 		}
+		return fmt.Errorf("error sending telegram message: %v", err)
 	}
-	return false
+
+	return nil
 }
 
 // formatAnomalyMessage creates a mobile-friendly, beautifully formatted message
@@ -175,8 +180,8 @@ func (ts *TelegramService) formatAnomalyMessage(anomalies []*models.Anomaly, sen
 
 	// Current readings section
 	sb.WriteString("📊 <b>Current Readings:</b>\n")
-	sb.WriteString(fmt.Sprintf("🌡️ DHT Temperature: %.1f°C\n", sensorData.TemperatureDHT))
-	sb.WriteString(fmt.Sprintf("💧 Humidity: %.1f%%\n", sensorData.Humidity))
+	sb.WriteString(fmt.Sprintf("🌡️ DHT Temperature: %s\n", formatSensorValue(sensorData, "temperature_dht", "%.1f°C", sensorData.TemperatureDHT)))
+	sb.WriteString(fmt.Sprintf("💧 Humidity: %s\n", formatSensorValue(sensorData, "humidity", "%.1f%%", sensorData.Humidity)))
 	sb.WriteString(fmt.Sprintf("💨 Gas Quality: %s\n", sensorData.GasQuality))
 	sb.WriteString(fmt.Sprintf("🔥 Flame: %t\n\n", sensorData.FlameDetected))
 
@@ -193,6 +198,12 @@ func (ts *TelegramService) formatAnomalyMessage(anomalies []*models.Anomaly, sen
 
 		sb.WriteString(fmt.Sprintf("   └ %s\n", anomaly.Description))
 
+		if anomaly.SuppressedCount > 0 {
+			sb.WriteString(fmt.Sprintf("   └ 🔁 x%d in last %s\n",
+				anomaly.SuppressedCount,
+				formatRepeatWindow(time.Since(anomaly.LastNotifiedAt))))
+		}
+
 		if i < len(anomalies)-1 {
 			sb.WriteString("\n")
 		}
@@ -236,19 +247,18 @@ func (ts *TelegramService) getAnomalyTitle(anomaly *models.Anomaly) string {
 	}
 }
 
-// SendStatusMessage sends a general status message
+// SendStatusMessage queues a general status message
 func (ts *TelegramService) SendStatusMessage(message string) error {
-	msg := tgbotapi.NewMessage(ts.chatID, message)
-	msg.ParseMode = "HTML"
-
-	_, err := ts.bot.Send(msg)
-	return err
+	return ts.enqueue(&models.Notification{
+		Kind: models.NotificationStatusMessage,
+		Text: message,
+	})
 }
 
 // SendStartupMessage sends a message when the service starts
 func (ts *TelegramService) SendStartupMessage() error {
 	message := "🟢 <b>KAELO Monitoring Service Started</b>\n\n" +
-		"📡 Connected to Firebase Realtime Database\n" +
+		"📡 Storing data in " + html.EscapeString(DescribeStorage(ts.config)) + "\n" +
 		"🤖 Telegram notifications active\n" +
 		"👀 Monitoring sensor data for anomalies...\n\n" +
 		"✅ System is ready and operational!"
@@ -256,7 +266,7 @@ func (ts *TelegramService) SendStartupMessage() error {
 	return ts.SendStatusMessage(message)
 }
 
-// SendUnknownPersonAlert sends alert when unknown person is detected with photo
+// SendUnknownPersonAlert queues an alert when unknown person is detected with photo
 func (ts *TelegramService) SendUnknownPersonAlert(uid string, imageBase64 string, timestamp string) error {
 	// Format message
 	message := fmt.Sprintf(
@@ -269,7 +279,13 @@ func (ts *TelegramService) SendUnknownPersonAlert(uid string, imageBase64 string
 		timestamp,
 	)
 
-	// If photo is provided, send photo with caption
+	notification := &models.Notification{
+		Kind:     models.NotificationUnknownPerson,
+		Critical: true,
+		Text:     message,
+	}
+
+	// If photo is provided, attach it to the notification
 	if imageBase64 != "" {
 		// Clean base64 string (remove whitespace and newlines)
 		cleanBase64 := strings.ReplaceAll(imageBase64, " ", "")
@@ -286,9 +302,10 @@ func (ts *TelegramService) SendUnknownPersonAlert(uid string, imageBase64 string
 				zap.String("uid", uid))
 
 			// Send text-only message if image decode fails
-			msg := tgbotapi.NewMessage(ts.chatID, message+"\n\n❌ Failed to decode image")
-			msg.ParseMode = "HTML"
-			ts.bot.Send(msg)
+			notification.Text = message + "\n\n❌ Failed to decode image"
+			if queueErr := ts.enqueue(notification); queueErr != nil {
+				return fmt.Errorf("error queueing text message: %v", queueErr)
+			}
 
 			return fmt.Errorf("error decoding image: %v", err)
 		}
@@ -306,63 +323,32 @@ func (ts *TelegramService) SendUnknownPersonAlert(uid string, imageBase64 string
 				zap.String("uid", uid))
 
 			// Send text-only message if image is too large
-			msg := tgbotapi.NewMessage(ts.chatID, message+"\n\n❌ Image too large to send")
-			msg.ParseMode = "HTML"
-			ts.bot.Send(msg)
+			notification.Text = message + "\n\n❌ Image too large to send"
+			if queueErr := ts.enqueue(notification); queueErr != nil {
+				return fmt.Errorf("error queueing text message: %v", queueErr)
+			}
 
 			return fmt.Errorf("image size %d bytes exceeds Telegram limit of %d bytes", len(imageData), maxSize)
 		}
 
-		// Create photo message with caption
-		photoBytes := tgbotapi.FileBytes{
-			Name:  fmt.Sprintf("unknown_person_%s.jpg", uid),
-			Bytes: imageData,
-		}
-
-		photoMsg := tgbotapi.NewPhoto(ts.chatID, photoBytes)
-		photoMsg.Caption = message
-		photoMsg.ParseMode = "HTML"
-
-		_, err = ts.bot.Send(photoMsg)
-		if err != nil {
-			ts.logger.Error("Failed to send photo",
-				zap.Error(err),
-				zap.Int("image_size", len(imageData)),
-				zap.String("uid", uid))
-
-			// Fallback: send text-only message
-			msg := tgbotapi.NewMessage(ts.chatID, message+"\n\n❌ Failed to send photo")
-			msg.ParseMode = "HTML"
-			ts.bot.Send(msg)
-
-			return fmt.Errorf("error sending photo: %v", err)
-		}
-
-		ts.logger.Info("Unknown person alert with photo sent successfully",
-			zap.String("uid", uid),
-			zap.String("timestamp", timestamp),
-			zap.Int("image_size", len(imageData)))
-	} else {
-		// Send text-only message if no photo
-		msg := tgbotapi.NewMessage(ts.chatID, message)
-		msg.ParseMode = "HTML"
-		msg.DisableWebPagePreview = true
-
-		_, err := ts.bot.Send(msg)
-		if err != nil {
-			ts.logger.Error("Failed to send text message", zap.Error(err))
-			return fmt.Errorf("error sending text message: %v", err)
-		}
+		notification.PhotoName = fmt.Sprintf("unknown_person_%s.jpg", uid)
+		notification.Photo = imageData
+	}
 
-		ts.logger.Info("Unknown person alert (text only) sent",
-			zap.String("uid", uid),
-			zap.String("timestamp", timestamp))
+	if err := ts.enqueue(notification); err != nil {
+		ts.logger.Error("Failed to queue unknown person alert", zap.Error(err))
+		return fmt.Errorf("error queueing unknown person alert: %v", err)
 	}
 
+	ts.logger.Info("Unknown person alert queued",
+		zap.String("uid", uid),
+		zap.String("timestamp", timestamp),
+		zap.Bool("has_photo", len(notification.Photo) > 0))
+
 	return nil
 }
 
-// SendHealthCheckTimeoutAlert sends an alert when a device fails to send health check within timeout
+// SendHealthCheckTimeoutAlert queues an alert when a device fails to send health check within timeout
 func (ts *TelegramService) SendHealthCheckTimeoutAlert(deviceID string, lastSeen time.Time, timeSinceLastSeen time.Duration, lastHealthCheck *models.HealthCheckData) error {
 	var sb strings.Builder
 
@@ -396,23 +382,23 @@ func (ts *TelegramService) SendHealthCheckTimeoutAlert(deviceID string, lastSeen
 	// Status indicator
 	sb.WriteString("🔴 <b>Status:</b> DEVICE TIMEOUT")
 
-	msg := tgbotapi.NewMessage(ts.chatID, sb.String())
-	msg.ParseMode = "HTML"
-	msg.DisableWebPagePreview = true
-
-	_, err := ts.bot.Send(msg)
+	err := ts.enqueue(&models.Notification{
+		Kind:     models.NotificationHealthTimeout,
+		DeviceID: deviceID,
+		Text:     sb.String(),
+	})
 	if err != nil {
-		return fmt.Errorf("error sending health check timeout alert: %v", err)
+		return fmt.Errorf("error queueing health check timeout alert: %v", err)
 	}
 
-	ts.logger.Info("Sent health check timeout alert",
+	ts.logger.Info("Queued health check timeout alert",
 		zap.String("device_id", deviceID),
 		zap.Duration("time_since_last_seen", timeSinceLastSeen))
 
 	return nil
 }
 
-// SendHealthCheckRecoveryAlert sends an alert when a device recovers from timeout
+// SendHealthCheckRecoveryAlert queues an alert when a device recovers from timeout
 func (ts *TelegramService) SendHealthCheckRecoveryAlert(deviceID string, downDuration time.Duration) error {
 	var sb strings.Builder
 
@@ -427,16 +413,16 @@ func (ts *TelegramService) SendHealthCheckRecoveryAlert(deviceID string, downDur
 	// Status indicator
 	sb.WriteString("🟢 <b>Status:</b> DEVICE ONLINE")
 
-	msg := tgbotapi.NewMessage(ts.chatID, sb.String())
-	msg.ParseMode = "HTML"
-	msg.DisableWebPagePreview = true
-
-	_, err := ts.bot.Send(msg)
+	err := ts.enqueue(&models.Notification{
+		Kind:     models.NotificationHealthRecovery,
+		DeviceID: deviceID,
+		Text:     sb.String(),
+	})
 	if err != nil {
-		return fmt.Errorf("error sending health check recovery alert: %v", err)
+		return fmt.Errorf("error queueing health check recovery alert: %v", err)
 	}
 
-	ts.logger.Info("Sent health check recovery alert",
+	ts.logger.Info("Queued health check recovery alert",
 		zap.String("device_id", deviceID),
 		zap.Duration("down_duration", downDuration))
 
@@ -459,11 +445,28 @@ func formatSensorStatus(working bool) string {
 	return "❌ Failed"
 }
 
+// formatSensorValue formats a reading's value, or notes that it was cleared as out of range
+func formatSensorValue(data *models.SensorData, field, format string, value float64) string {
+	if !data.Has(field) {
+		return "⚠️ out of range"
+	}
+	return fmt.Sprintf(format, value)
+}
+
 func formatUptime(uptimeMs int64) string {
 	duration := time.Duration(uptimeMs) * time.Millisecond
 	return formatDuration(duration)
 }
 
+func formatRepeatWindow(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%.0f sec", d.Seconds())
+	} else if d < time.Hour {
+		return fmt.Sprintf("%d min", int(d.Round(time.Minute).Minutes()))
+	}
+	return fmt.Sprintf("%d hr %d min", int(d.Hours()), int(d.Minutes())%60)
+}
+
 func formatDuration(d time.Duration) string {
 	if d < time.Minute {
 		return fmt.Sprintf("%.0f seconds", d.Seconds())
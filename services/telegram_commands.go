@@ -0,0 +1,101 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"kaelo/models"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+)
+
+// StartCommands answers bot commands sent in the configured chat until the context is
+// cancelled. Messages from other chats are ignored.
+//
+// Supported commands:
+//
+//	/latest <device_id>  newest stored reading of a device
+func (ts *TelegramService) StartCommands(ctx context.Context, store SensorStore) {
+	ts.logger.Info("Starting Telegram command handler")
+
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 30
+	updates := ts.bot.GetUpdatesChan(u)
+
+	for {
+		select {
+		case <-ctx.Done():
+			ts.bot.StopReceivingUpdates()
+			ts.logger.Info("Telegram command handler stopped")
+			return
+		case update := <-updates:
+			message := update.Message
+			if message == nil || !message.IsCommand() || message.Chat.ID != ts.chatID {
+				continue
+			}
+
+			var reply string
+			switch message.Command() {
+			case "latest":
+				reply = ts.latestCommand(ctx, store, strings.TrimSpace(message.CommandArguments()))
+			default:
+				continue
+			}
+
+			msg := tgbotapi.NewMessage(ts.chatID, reply)
+			msg.ParseMode = "HTML"
+			msg.ReplyToMessageID = message.MessageID
+			if _, err := ts.bot.Send(msg); err != nil {
+				ts.logger.Warn("Failed to reply to Telegram command",
+					zap.String("command", message.Command()),
+					zap.Error(err))
+			}
+		}
+	}
+}
+
+// latestCommand formats the newest reading of a device
+func (ts *TelegramService) latestCommand(ctx context.Context, store SensorStore, deviceID string) string {
+	if deviceID == "" {
+		return "Usage: <code>/latest device_id</code>"
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	data, err := store.LatestReading(lookupCtx, deviceID)
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Sprintf("No readings for device <b>%s</b>", html.EscapeString(deviceID))
+	}
+	if err != nil {
+		ts.logger.Error("Failed to get latest reading for Telegram command",
+			zap.String("device_id", deviceID),
+			zap.Error(err))
+		return "⚠️ Failed to get the latest reading, please try again later"
+	}
+
+	return formatLatestReading(data)
+}
+
+// formatLatestReading formats a reading for a command reply
+func formatLatestReading(data *models.SensorData) string {
+	var sb strings.Builder
+
+	sb.WriteString(fmt.Sprintf("📱 <b>Device:</b> %s\n", html.EscapeString(data.DeviceID)))
+	sb.WriteString(fmt.Sprintf("🕐 <b>Time:</b> %s (%s ago)\n\n",
+		data.Timestamp.In(time.Local).Format("2006-01-02 15:04:05"),
+		formatDuration(time.Since(data.Timestamp))))
+
+	sb.WriteString("📊 <b>Latest Readings:</b>\n")
+	sb.WriteString(fmt.Sprintf("🌡️ DHT Temperature: %s\n", formatSensorValue(data, "temperature_dht", "%.1f°C", data.TemperatureDHT)))
+	sb.WriteString(fmt.Sprintf("💧 Humidity: %s\n", formatSensorValue(data, "humidity", "%.1f%%", data.Humidity)))
+	sb.WriteString(fmt.Sprintf("💨 Gas Quality: %s\n", html.EscapeString(data.GasQuality)))
+	sb.WriteString(fmt.Sprintf("🔥 Flame: %t", data.FlameDetected))
+
+	return sb.String()
+}
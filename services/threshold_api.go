@@ -0,0 +1,155 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"kaelo/models"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// maxAdminRequestBody limits the size of admin API request bodies
+	maxAdminRequestBody = 64 * 1024
+
+	defaultAuditLimit = 50
+)
+
+// ThresholdAPIHandler serves the authenticated threshold management API
+type ThresholdAPIHandler struct {
+	thresholds *ThresholdManager
+	auth       *AdminAuth
+	logger     *zap.Logger
+}
+
+// NewThresholdAPIHandler creates a new threshold management API handler
+func NewThresholdAPIHandler(thresholds *ThresholdManager, auth *AdminAuth, logger *zap.Logger) *ThresholdAPIHandler {
+	return &ThresholdAPIHandler{
+		thresholds: thresholds,
+		auth:       auth,
+		logger:     logger,
+	}
+}
+
+// Register registers the threshold routes on the HTTP server
+func (a *ThresholdAPIHandler) Register(server *HTTPServer) {
+	server.Handle("GET /api/v1/thresholds", a.auth.Require(a.handleGetThresholds))
+	server.Handle("PUT /api/v1/thresholds", a.auth.Require(a.handlePutGlobal))
+	server.Handle("GET /api/v1/thresholds/devices/{id}", a.auth.Require(a.handleGetDevice))
+	server.Handle("PUT /api/v1/thresholds/devices/{id}", a.auth.Require(a.handlePutDevice))
+	server.Handle("DELETE /api/v1/thresholds/devices/{id}", a.auth.Require(a.handleDeleteDevice))
+	server.Handle("GET /api/v1/thresholds/audit", a.auth.Require(a.handleAuditLog))
+}
+
+// handleGetThresholds returns the global thresholds and all device overrides
+func (a *ThresholdAPIHandler) handleGetThresholds(w http.ResponseWriter, r *http.Request, actor string) {
+	writeJSON(w, http.StatusOK, a.thresholds.Snapshot())
+}
+
+// handlePutGlobal replaces the global thresholds. All fields are required.
+func (a *ThresholdAPIHandler) handlePutGlobal(w http.ResponseWriter, r *http.Request, actor string) {
+	var thresholds models.Thresholds
+	if err := decodeAdminBody(w, r, &thresholds); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := a.thresholds.SetGlobal(a.change(r, actor), thresholds); err != nil {
+		a.writeChangeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a.thresholds.Snapshot())
+}
+
+// handleGetDevice returns the overrides and effective thresholds for a device
+func (a *ThresholdAPIHandler) handleGetDevice(w http.ResponseWriter, r *http.Request, actor string) {
+	writeJSON(w, http.StatusOK, a.thresholds.Device(r.PathValue("id")))
+}
+
+// handlePutDevice replaces the overrides for a device. Omitted fields inherit the global value.
+func (a *ThresholdAPIHandler) handlePutDevice(w http.ResponseWriter, r *http.Request, actor string) {
+	deviceID := r.PathValue("id")
+
+	var overrides models.ThresholdOverrides
+	if err := decodeAdminBody(w, r, &overrides); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := a.thresholds.SetDevice(a.change(r, actor), deviceID, overrides); err != nil {
+		a.writeChangeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a.thresholds.Device(deviceID))
+}
+
+// handleDeleteDevice removes the overrides for a device
+func (a *ThresholdAPIHandler) handleDeleteDevice(w http.ResponseWriter, r *http.Request, actor string) {
+	deviceID := r.PathValue("id")
+
+	err := a.thresholds.DeleteDevice(a.change(r, actor), deviceID)
+	if errors.Is(err, ErrNotFound) {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("no threshold overrides for device %s", deviceID))
+		return
+	}
+	if err != nil {
+		a.writeChangeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a.thresholds.Device(deviceID))
+}
+
+// handleAuditLog returns recent threshold changes, newest first
+func (a *ThresholdAPIHandler) handleAuditLog(w http.ResponseWriter, r *http.Request, actor string) {
+	limit := defaultAuditLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxQueryLimit {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q (expected 1-%d)", value, maxQueryLimit))
+			return
+		}
+		limit = parsed
+	}
+
+	entries, err := a.thresholds.AuditLog(limit)
+	if err != nil {
+		a.logger.Error("Failed to read threshold audit log", zap.Error(err))
+		writeAPIError(w, http.StatusInternalServerError, fmt.Errorf("failed to read audit log"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"items": entries})
+}
+
+// change describes the actor making a request
+func (a *ThresholdAPIHandler) change(r *http.Request, actor string) ThresholdChange {
+	return ThresholdChange{Actor: actor, RemoteAddr: r.RemoteAddr}
+}
+
+// writeChangeError writes a validation error as 400 and anything else as 500
+func (a *ThresholdAPIHandler) writeChangeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrInvalidThresholds) {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	a.logger.Error("Failed to change thresholds", zap.Error(err))
+	writeAPIError(w, http.StatusInternalServerError, fmt.Errorf("failed to change thresholds"))
+}
+
+// decodeAdminBody decodes a JSON request body, rejecting unknown fields
+func decodeAdminBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminRequestBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	return nil
+}
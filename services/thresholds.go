@@ -0,0 +1,316 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kaelo/config"
+	"kaelo/models"
+
+	"go.uber.org/zap"
+)
+
+// ErrInvalidThresholds is returned when a threshold change fails validation
+var ErrInvalidThresholds = errors.New("invalid thresholds")
+
+// ThresholdSet is an immutable snapshot of the global thresholds and per-device overrides
+type ThresholdSet struct {
+	Global  models.Thresholds                    `json:"global"`
+	Devices map[string]models.ThresholdOverrides `json:"devices"`
+}
+
+// DeviceThresholds describes the thresholds in effect for a single device
+type DeviceThresholds struct {
+	DeviceID  string                     `json:"device_id"`
+	Overrides *models.ThresholdOverrides `json:"overrides,omitempty"`
+	Effective models.Thresholds          `json:"effective"`
+}
+
+// ThresholdChange describes who is making a threshold change
+type ThresholdChange struct {
+	Actor      string
+	RemoteAddr string
+}
+
+// ThresholdManager holds the thresholds used for anomaly detection. Readers get a consistent
+// snapshot without locking; changes are validated, persisted and audited before being swapped in.
+type ThresholdManager struct {
+	current   atomic.Pointer[ThresholdSet]
+	path      string
+	auditPath string
+	logger    *zap.Logger
+	mu        sync.Mutex // serializes changes
+}
+
+// NewThresholdManager loads persisted thresholds, falling back to the configured defaults
+func NewThresholdManager(cfg *config.Config, logger *zap.Logger) (*ThresholdManager, error) {
+	m := &ThresholdManager{
+		path:      cfg.ThresholdsPath,
+		auditPath: cfg.ThresholdAuditPath,
+		logger:    logger,
+	}
+
+	set := &ThresholdSet{
+		Global:  DefaultThresholds(cfg),
+		Devices: make(map[string]models.ThresholdOverrides),
+	}
+
+	data, err := os.ReadFile(m.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		logger.Info("No persisted thresholds found, using configured defaults", zap.String("path", m.path))
+	case err != nil:
+		return nil, fmt.Errorf("failed to read thresholds: %w", err)
+	default:
+		if err := json.Unmarshal(data, set); err != nil {
+			return nil, fmt.Errorf("failed to parse thresholds %s: %w", m.path, err)
+		}
+		if set.Devices == nil {
+			set.Devices = make(map[string]models.ThresholdOverrides)
+		}
+		if err := set.validate(); err != nil {
+			return nil, fmt.Errorf("invalid persisted thresholds %s: %w", m.path, err)
+		}
+		logger.Info("Loaded persisted thresholds",
+			zap.String("path", m.path),
+			zap.Int("device_overrides", len(set.Devices)))
+	}
+
+	m.current.Store(set)
+	return m, nil
+}
+
+// DefaultThresholds returns the thresholds configured through environment variables
+func DefaultThresholds(cfg *config.Config) models.Thresholds {
+	return models.Thresholds{
+		TemperatureMin:  cfg.TemperatureMin,
+		TemperatureMax:  cfg.TemperatureMax,
+		HumidityMin:     cfg.HumidityMin,
+		HumidityMax:     cfg.HumidityMax,
+		GyroscopeMax:    5.0,
+		AccelerationMax: 15.0,
+	}
+}
+
+// validate checks the global thresholds and every device's effective thresholds
+func (s *ThresholdSet) validate() error {
+	if err := s.Global.Validate(); err != nil {
+		return fmt.Errorf("global: %w", err)
+	}
+	for deviceID, overrides := range s.Devices {
+		if err := overrides.Apply(s.Global).Validate(); err != nil {
+			return fmt.Errorf("device %s: %w", deviceID, err)
+		}
+	}
+	return nil
+}
+
+// clone returns a copy of the set that can be modified
+func (s *ThresholdSet) clone() *ThresholdSet {
+	devices := make(map[string]models.ThresholdOverrides, len(s.Devices))
+	for deviceID, overrides := range s.Devices {
+		devices[deviceID] = overrides
+	}
+	return &ThresholdSet{Global: s.Global, Devices: devices}
+}
+
+// Snapshot returns the current thresholds. The returned set must not be modified.
+func (m *ThresholdManager) Snapshot() *ThresholdSet {
+	return m.current.Load()
+}
+
+// For returns the thresholds in effect for a device
+func (m *ThresholdManager) For(deviceID string) models.Thresholds {
+	set := m.current.Load()
+	if overrides, ok := set.Devices[deviceID]; ok {
+		return overrides.Apply(set.Global)
+	}
+	return set.Global
+}
+
+// Device returns the overrides and effective thresholds for a device
+func (m *ThresholdManager) Device(deviceID string) DeviceThresholds {
+	set := m.current.Load()
+	result := DeviceThresholds{DeviceID: deviceID, Effective: set.Global}
+	if overrides, ok := set.Devices[deviceID]; ok {
+		result.Overrides = &overrides
+		result.Effective = overrides.Apply(set.Global)
+	}
+	return result
+}
+
+// SetGlobal replaces the global thresholds
+func (m *ThresholdManager) SetGlobal(change ThresholdChange, thresholds models.Thresholds) error {
+	return m.update(change, models.ThresholdAuditUpdateGlobal, "", func(set *ThresholdSet) (interface{}, interface{}, error) {
+		before := set.Global
+		set.Global = thresholds
+		return before, thresholds, nil
+	})
+}
+
+// SetDevice replaces the overrides for a device
+func (m *ThresholdManager) SetDevice(change ThresholdChange, deviceID string, overrides models.ThresholdOverrides) error {
+	if overrides.IsEmpty() {
+		return fmt.Errorf("%w: at least one threshold override is required", ErrInvalidThresholds)
+	}
+
+	return m.update(change, models.ThresholdAuditSetDevice, deviceID, func(set *ThresholdSet) (interface{}, interface{}, error) {
+		var before interface{}
+		if existing, ok := set.Devices[deviceID]; ok {
+			before = existing
+		}
+		set.Devices[deviceID] = overrides
+		return before, overrides, nil
+	})
+}
+
+// DeleteDevice removes the overrides for a device. Returns ErrNotFound if there are none.
+func (m *ThresholdManager) DeleteDevice(change ThresholdChange, deviceID string) error {
+	return m.update(change, models.ThresholdAuditDeleteDevice, deviceID, func(set *ThresholdSet) (interface{}, interface{}, error) {
+		before, ok := set.Devices[deviceID]
+		if !ok {
+			return nil, nil, ErrNotFound
+		}
+		delete(set.Devices, deviceID)
+		return before, nil, nil
+	})
+}
+
+// update applies a change to a copy of the current set, validates and persists it,
+// then swaps it in and records the change in the audit log
+func (m *ThresholdManager) update(change ThresholdChange, action models.ThresholdAuditAction, deviceID string,
+	apply func(set *ThresholdSet) (before, after interface{}, err error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	next := m.current.Load().clone()
+	before, after, err := apply(next)
+	if err != nil {
+		return err
+	}
+
+	if err := next.validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidThresholds, err)
+	}
+
+	if err := m.persist(next); err != nil {
+		m.logger.Error("Failed to persist thresholds", zap.String("path", m.path), zap.Error(err))
+		return fmt.Errorf("failed to persist thresholds: %w", err)
+	}
+
+	m.current.Store(next)
+
+	entry := models.ThresholdAuditEntry{
+		Timestamp:  time.Now(),
+		Actor:      change.Actor,
+		RemoteAddr: change.RemoteAddr,
+		Action:     action,
+		DeviceID:   deviceID,
+		Before:     before,
+		After:      after,
+	}
+
+	m.logger.Info("Thresholds changed",
+		zap.String("actor", change.Actor),
+		zap.String("action", string(action)),
+		zap.String("device_id", deviceID),
+		zap.Any("before", before),
+		zap.Any("after", after))
+
+	if err := m.appendAudit(entry); err != nil {
+		m.logger.Error("Failed to write threshold audit entry",
+			zap.String("path", m.auditPath),
+			zap.Error(err))
+	}
+
+	return nil
+}
+
+// persist atomically writes the threshold set to disk
+func (m *ThresholdManager) persist(set *ThresholdSet) error {
+	data, err := json.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(m.path), 0o755); err != nil {
+		return err
+	}
+
+	tmpPath := m.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, m.path)
+}
+
+// appendAudit appends an entry to the audit log
+func (m *ThresholdManager) appendAudit(entry models.ThresholdAuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(m.auditPath), 0o755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(m.auditPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// AuditLog returns the most recent audit entries, newest first
+func (m *ThresholdManager) AuditLog(limit int) ([]models.ThresholdAuditEntry, error) {
+	file, err := os.Open(m.auditPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return []models.ThresholdAuditEntry{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	var entries []models.ThresholdAuditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry models.ThresholdAuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			m.logger.Warn("Skipping malformed threshold audit entry", zap.Error(err))
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	// Entries are appended in order, so reverse for newest first
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	if entries == nil {
+		entries = []models.ThresholdAuditEntry{}
+	}
+
+	return entries, nil
+}